@@ -1,9 +1,13 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"os/user"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/perrychain/perry/pkg/p2pnet"
@@ -27,6 +31,11 @@ func main() {
 	defaultWalletPath := fmt.Sprintf("%s/.wallet.json", defaultHomeDir)
 
 	var walletPath = flag.String("wallet", defaultWalletPath, "Specify wallet path")
+	var workers = flag.Int("workers", 1, "Number of concurrent senders")
+	var interval = flag.Duration("interval", time.Millisecond, "Delay between packets for each sender")
+	var msgType = flag.Uint("type", 0, "Message type")
+	var plaintext = flag.Bool("plaintext", false, "Send unsealed messages")
+	var recipientKey = flag.String("recipient", "", "Recipient public key (base64), defaults to the sender wallet")
 
 	flag.Parse()
 
@@ -49,9 +58,7 @@ func main() {
 			//poh.GeneratePOH(100_000_000_000)
 		}()
 
-		for {
-
-		}
+		select {}
 
 	} else {
 
@@ -64,11 +71,65 @@ func main() {
 			senderwallet.GenerateWallet()
 		}
 
+		recipient := senderwallet.PublicKey
+
+		if *recipientKey != "" {
+			key, err := base64.StdEncoding.DecodeString(*recipientKey)
+
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				log.Fatal(fmt.Sprintf("Invalid recipient key: %s", *recipientKey))
+			}
+
+			recipient = key
+		}
+
+		defer p2p.Close()
+
+		// Spread the packets across workers, all sharing the same socket
+		var sent, failed int64
+		var wg sync.WaitGroup
+
+		start := time.Now()
+		jobs := make(chan int)
+
+		for w := 0; w < *workers; w++ {
+
+			wg.Add(1)
+
+			go func() {
+
+				defer wg.Done()
+
+				for i := range jobs {
+
+					if _, err := p2p.Send(&senderwallet, recipient, []byte(fmt.Sprintf("%s message %d", time.Now(), i)), uint8(*msgType), p2pnet.SendOptions{Plaintext: *plaintext}); err != nil {
+						atomic.AddInt64(&failed, 1)
+						log.Warn("Send => ", err)
+						continue
+					}
+
+					atomic.AddInt64(&sent, 1)
+
+					if *interval > 0 {
+						time.Sleep(*interval)
+					}
+
+				}
+
+			}()
+
+		}
+
 		for i := 0; i < *num; i++ {
-			p2p.Send(senderwallet, fmt.Sprintf("%d", i))
-			time.Sleep(1 * time.Millisecond)
+			jobs <- i
 		}
 
+		close(jobs)
+		wg.Wait()
+
+		elapsed := time.Since(start)
+		log.Info(fmt.Sprintf("Sent (%d) packets, (%d) failed in %s => %.0f p/sec", sent, failed, elapsed, float64(sent)/elapsed.Seconds()))
+
 	}
 
 }
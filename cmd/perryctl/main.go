@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/base64"
 	"flag"
 	"fmt"
@@ -29,10 +30,16 @@ func init() {
 
 func main() {
 
-	var cmd = flag.String("cmd", "verify", "verify blockchain DB")
+	var cmd = flag.String("cmd", "verify", "verify, repair, encrypt, snapshot, restore, export or import blockchain DB, sign message")
 	var dbpath = flag.String("dbpath", ".blockchain.db", "Path to blockchain DB")
+	var chainID = flag.String("chainid", blockdb.DefaultChainID, "Chain ID recorded in the blockchain DB manifest")
 	var msg = flag.String("msg", "Hello world", "Message to sign")
 	var format = flag.String("format", "base64", "Format hex or base64 (default)")
+	var snapshotPath = flag.String("snapshot", "blockchain-snapshot.tar.gz", "Path to snapshot archive")
+	var snapshotKey = flag.String("snapshotkey", "", "Public key (base64) the snapshot must be signed with, required to restore")
+	var exportPath = flag.String("file", "blockchain-export", "Path to export to, or archive to import from")
+	var exportFormat = flag.String("exportformat", blockdb.FormatArchive, "Export format jsonl, csv or archive (default)")
+	var keyFile = flag.String("keyfile", "", fmt.Sprintf("Key file to unlock an encrypted blockchain DB (default passphrase from $%s)", blockdb.PassphraseEnv))
 
 	usr, _ := user.Current()
 	defaultHomeDir := fmt.Sprintf("%s/.perry", usr.HomeDir)
@@ -42,8 +49,26 @@ func main() {
 
 	flag.Parse()
 
+	passphrase, err := blockdb.LoadPassphrase(*keyFile)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *cmd == "verify" {
-		verify(*dbpath)
+		verify(*dbpath, *chainID, passphrase)
+	} else if *cmd == "repair" {
+		repair(*dbpath, *chainID, passphrase)
+	} else if *cmd == "encrypt" {
+		encrypt(*dbpath, *chainID, passphrase)
+	} else if *cmd == "snapshot" {
+		snapshot(*dbpath, *chainID, *snapshotPath, *walletPath, passphrase)
+	} else if *cmd == "restore" {
+		restore(*dbpath, *chainID, *snapshotPath, *snapshotKey, passphrase)
+	} else if *cmd == "export" {
+		export(*dbpath, *chainID, *exportPath, *exportFormat, passphrase)
+	} else if *cmd == "import" {
+		importArchive(*dbpath, *chainID, *exportPath, passphrase)
 	} else if *cmd == "sign" {
 		sign(*dbpath, *msg, *walletPath, *format)
 	}
@@ -62,7 +87,7 @@ func sign(dbpath, msg, walletPath, format string) {
 	sdata, err := mywallet.Sign([]byte(msg))
 
 	if err != nil {
-		log.Warn("Error signing data %s", err)
+		log.Warn(fmt.Sprintf("Error signing data %s", err))
 	}
 
 	if format == "hex" {
@@ -87,58 +112,232 @@ func sign(dbpath, msg, walletPath, format string) {
 
 }
 
-func verify(dbpath string) {
+func repair(dbpath, chainID string, passphrase []byte) {
 
-	start := time.Now()
+	fmt.Println(fmt.Sprintf("Repairing blockchain DB => %s", dbpath))
 
-	fmt.Println(fmt.Sprintf("Verfiying blockchain DB => %s", dbpath))
+	db := newDB(dbpath, chainID, passphrase)
 
-	db := blockdb.New(dbpath)
-	db.Open()
-	db.Verify()
+	result, err := db.Repair()
 
-	fmt.Println("Number of entries: ", len(db.Blocks))
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Could not repair BlockDB: %s", err))
+	}
 
-	totalRows := 0
-	mywallet := wallet.New()
-	cpu_cores := runtime.NumCPU()
+	fmt.Println("Valid blocks: ", result.Valid)
 
-	//pool := pond.New(cpu_cores-1, cpu_cores*2, pond.Strategy(pond.Eager()))
+	if result.Quarantined > 0 {
+		fmt.Println("Reason: ", result.Reason)
+		fmt.Println("Quarantined blocks: ", result.Quarantined)
+		fmt.Println("Quarantine file: ", result.QuarantineFile)
+	}
 
-	// Distribute jobs on each core for the specified sequence
-	tasks := uint64(len(db.Blocks))
+}
 
-	//var error_abort bool
+func encrypt(dbpath, chainID string, passphrase []byte) {
 
-	for i := uint64(0); i < tasks; i++ {
+	if passphrase == nil {
+		log.Fatal(fmt.Sprintf("Specify -keyfile or $%s to encrypt the blockchain DB", blockdb.PassphraseEnv))
+	}
 
-		//pool.Submit(func() {
+	fmt.Println(fmt.Sprintf("Encrypting blockchain DB => %s", dbpath))
 
-		totalRows += len(db.Blocks[i].Value.Payload)
+	db := newDB(dbpath, chainID, nil)
 
-		for i2 := 0; i2 < len(db.Blocks[i].Value.Payload); i2++ {
+	if err := db.Encrypt(passphrase); err != nil {
+		log.Fatal(fmt.Sprintf("Could not encrypt BlockDB: %s", err))
+	}
 
-			packet := db.Blocks[i].Value.Payload[i2]
+	defer db.Close()
 
-			// TODO: Match header names with wallet/p2p implementation
-			fmt.Println(string(packet.Data))
-			verify := mywallet.VerifyRaw(packet.Sender[:], packet.Data[:], packet.Signature[:])
+	fmt.Println("Encrypted blocks: ", db.Len())
 
-			//log.Debug(fmt.Sprintf("\t(Block %d, Payload %d) Status %t : Verifying Sender => %s, Data => %s, Signature => %s\n", i, i2, verify, base64.StdEncoding.EncodeToString(packet.Sender[:]), base64.StdEncoding.EncodeToString(packet.Data[:]), base64.StdEncoding.EncodeToString(packet.Signature[:])))
+}
 
-			if !verify {
-				log.Warn(fmt.Sprintf("Transaction verification failed! SeqID => %d Payload => %d", db.Blocks[i].Value.Header.SeqID, i2))
-			}
+func snapshot(dbpath, chainID, snapshotPath, walletPath string, passphrase []byte) {
+
+	mywallet, err := wallet.Load(walletPath)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := newDB(dbpath, chainID, passphrase)
+
+	if err := db.Open(); err != nil {
+		log.Fatal(fmt.Sprintf("Could not open BlockDB: %s", err))
+	}
+
+	defer db.Close()
+
+	f, err := os.Create(snapshotPath)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	manifest, err := db.Snapshot(f, &mywallet)
+
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Could not create snapshot: %s", err))
+	}
+
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Snapshot saved: ", snapshotPath)
+	fmt.Println("Height: ", manifest.Height)
+	fmt.Println("Head: ", base64.StdEncoding.EncodeToString(manifest.Head[:]))
+
+}
+
+func export(dbpath, chainID, exportPath, format string, passphrase []byte) {
+
+	db := newDB(dbpath, chainID, passphrase)
+
+	if err := db.Open(); err != nil {
+		log.Fatal(fmt.Sprintf("Could not open BlockDB: %s", err))
+	}
+
+	defer db.Close()
+
+	f, err := os.Create(exportPath)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	result, err := db.Export(f, format)
+
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Could not export BlockDB: %s", err))
+	}
+
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(fmt.Sprintf("Exported (%s) => %s", format, exportPath))
+	fmt.Println("Blocks: ", result.Blocks)
+	fmt.Println("TX's: ", result.Txs)
+
+}
+
+func importArchive(dbpath, chainID, archivePath string, passphrase []byte) {
+
+	f, err := os.Open(archivePath)
+
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	defer f.Close()
+
+	db := newDB(dbpath, chainID, passphrase)
+
+	result, err := db.Import(f)
+
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Could not import archive: %s", err))
+	}
+
+	db.Close()
+
+	fmt.Println("Imported blockchain DB => ", dbpath)
+	fmt.Println("Blocks: ", result.Blocks)
+	fmt.Println("Head: ", base64.StdEncoding.EncodeToString(result.Head[:]))
+
+}
+
+func restore(dbpath, chainID, snapshotPath, snapshotKey string, passphrase []byte) {
+
+	// Snapshots are only trusted if signed by the expected node
+	publicKey, err := base64.StdEncoding.DecodeString(snapshotKey)
+
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		log.Fatal("Specify the base64 public key the snapshot is signed with (-snapshotkey)")
+	}
+
+	f, err := os.Open(snapshotPath)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer f.Close()
+
+	manifest, err := blockdb.RestoreSnapshot(f, dbpath, publicKey)
+
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Could not restore snapshot: %s", err))
+	}
+
+	// Snapshots are plaintext, encrypt the restored DB if a key is specified
+	if passphrase != nil {
+		db := newDB(dbpath, chainID, nil)
+
+		if err := db.Encrypt(passphrase); err != nil {
+			log.Fatal(fmt.Sprintf("Could not encrypt BlockDB: %s", err))
 		}
 
-		//})
+		db.Close()
 	}
 
-	fmt.Println("Number of unique transactions: ", totalRows)
+	fmt.Println("Restored blockchain DB => ", dbpath)
+	fmt.Println("Height: ", manifest.Height)
+	fmt.Println("Signed by: ", base64.StdEncoding.EncodeToString(manifest.PublicKey))
+
+}
+
+func verify(dbpath, chainID string, passphrase []byte) {
+
+	start := time.Now()
+
+	fmt.Println(fmt.Sprintf("Verfiying blockchain DB => %s", dbpath))
+
+	db := newDB(dbpath, chainID, passphrase)
+
+	if err := db.Open(); err != nil {
+		log.Fatal(fmt.Sprintf("Could not open BlockDB: %s", err))
+	}
+
+	cpu_cores := runtime.NumCPU()
+
+	err := db.VerifyParallel(cpu_cores, func(verified, total int) {
+		fmt.Printf("\rVerified blocks %d/%d", verified, total)
+	})
+
+	fmt.Println()
 
-	// Stop the pool and wait for all submitted tasks to complete
-	//pool.StopAndWait()
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Could not verify BlockDB: %s", err))
+	}
+
+	fmt.Println("Number of entries: ", db.Len())
+
+	totalRows := 0
+
+	// Stream each block from disk to verify the TX signatures, as synced blocks are verified
+	err = db.Iterate(0, db.Len(), func(i int, block *blockdb.BlockKV) error {
+
+		totalRows += len(block.Value.Payload)
+
+		for i2 := 0; i2 < len(block.Value.Payload); i2++ {
+			if err := blockdb.VerifyBlockTx(block, i2); err != nil {
+				log.Warn(fmt.Sprintf("Transaction verification failed! SeqID => %d Payload => %d", block.Value.Header.SeqID, i2))
+			}
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Could not read BlockDB: %s", err))
+	}
+
+	fmt.Println("Number of unique transactions: ", totalRows)
 
 	timer := time.Now()
 	elapsed := timer.Sub(start)
@@ -150,3 +349,14 @@ func verify(dbpath string) {
 	fmt.Println(fmt.Sprintf("BlockchainDB > VerifySignaturePerCore per sec: %d", VerifyHashRatePerCore))
 
 }
+
+// The blockchain DB for the chain ID, unlocked with the passphrase if encrypted
+func newDB(dbpath, chainID string, passphrase []byte) *blockdb.BlockDB {
+
+	db := blockdb.New(dbpath)
+	db.ChainID = chainID
+	db.Passphrase = passphrase
+
+	return &db
+
+}
@@ -1,12 +1,16 @@
 package cmd
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"fmt"
+	"os/user"
 
 	log "github.com/sirupsen/logrus"
 
 	"os"
 
+	"github.com/perrychain/perry/pkg/blockdb"
 	"github.com/perrychain/perry/pkg/http"
 	"github.com/perrychain/perry/pkg/p2pnet"
 	"github.com/spf13/cobra"
@@ -16,6 +20,21 @@ const rpcIP = "rpcip"
 const rpcPort = "rpcport"
 const p2pIP = "p2pip"
 const p2pPort = "p2pport"
+const maxBlockSize = "maxblocksize"
+const maxBlockTx = "maxblocktx"
+const snapshotPath = "snapshot"
+const snapshotKey = "snapshotkey"
+const chainID = "chainid"
+const archive = "archive"
+const retainAge = "retainage"
+const retainBlocks = "retainblocks"
+const retainSize = "retainsize"
+const dbKeyFile = "dbkeyfile"
+const peersFile = "peersfile"
+const bootstrapPeers = "bootstrap"
+const bansFile = "bansfile"
+const allowReorg = "allowreorg"
+const maxReorgDepth = "maxreorgdepth"
 
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
@@ -27,10 +46,43 @@ var serveCmd = &cobra.Command{
 		rpc_port, _ := cmd.Flags().GetUint16(rpcPort)
 		p2p_ip, _ := cmd.Flags().GetString(p2pIP)
 		p2p_port, _ := cmd.Flags().GetUint16(p2pPort)
+		max_block_size, _ := cmd.Flags().GetInt(maxBlockSize)
+		max_block_tx, _ := cmd.Flags().GetInt(maxBlockTx)
+		snapshot_path, _ := cmd.Flags().GetString(snapshotPath)
+		snapshot_key, _ := cmd.Flags().GetString(snapshotKey)
+		chain_id, _ := cmd.Flags().GetString(chainID)
+		archive_node, _ := cmd.Flags().GetBool(archive)
+		retain_age, _ := cmd.Flags().GetDuration(retainAge)
+		retain_blocks, _ := cmd.Flags().GetUint64(retainBlocks)
+		retain_size, _ := cmd.Flags().GetInt64(retainSize)
+		db_key_file, _ := cmd.Flags().GetString(dbKeyFile)
+		peers_file, _ := cmd.Flags().GetString(peersFile)
+		bootstrap_peers, _ := cmd.Flags().GetStringSlice(bootstrapPeers)
+		bans_file, _ := cmd.Flags().GetString(bansFile)
+		allow_reorg, _ := cmd.Flags().GetBool(allowReorg)
+		max_reorg_depth, _ := cmd.Flags().GetInt(maxReorgDepth)
 
 		walletPath, _ := cmd.Flags().GetString(walletLocation)
 		dbPath, _ := cmd.Flags().GetString(dbLocation)
 
+		// Unlock or create an encrypted blockchain DB
+		passphrase, err := blockdb.LoadPassphrase(db_key_file)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Snapshots are only trusted if signed by the expected node
+		var snapshot_public_key []byte
+
+		if snapshot_path != "" {
+			snapshot_public_key, err = base64.StdEncoding.DecodeString(snapshot_key)
+
+			if err != nil || len(snapshot_public_key) != ed25519.PublicKeySize {
+				log.Fatal(fmt.Sprintf("Specify the base64 public key the snapshot is signed with (--%s)", snapshotKey))
+			}
+		}
+
 		// Check wallet path
 		if _, err := os.Stat(walletPath); err != nil {
 			log.Fatal(fmt.Sprintf("Wallet %s could not be opened (%s)", walletPath, err))
@@ -42,10 +94,27 @@ var serveCmd = &cobra.Command{
 		p2p_node := p2pnet.Node{Port: p2p_port, Host: p2p_ip}
 
 		http := http.New(http.HTTP{
-			RPC_Node:   rpc_node,
-			P2P_Node:   p2p_node,
-			WalletPath: walletPath,
-			DBPath:     dbPath,
+			RPC_Node:     rpc_node,
+			P2P_Node:     p2p_node,
+			WalletPath:   walletPath,
+			DBPath:       dbPath,
+			MaxBlockSize: max_block_size,
+			MaxBlockTx:   max_block_tx,
+			SnapshotPath: snapshot_path,
+			SnapshotKey:  snapshot_public_key,
+			ChainID:      chain_id,
+			Retention: blockdb.RetentionPolicy{
+				Archive:    archive_node,
+				MaxAge:     retain_age,
+				KeepBlocks: retain_blocks,
+				MaxSize:    retain_size,
+			},
+			DBPassphrase:   passphrase,
+			PeersFile:      peers_file,
+			BootstrapPeers: bootstrap_peers,
+			BansFile:       bans_file,
+			AllowReorg:     allow_reorg,
+			MaxReorgDepth:  max_reorg_depth,
 		})
 
 		http.Serve()
@@ -62,6 +131,32 @@ func init() {
 	serveCmd.PersistentFlags().String(p2pIP, "127.0.0.1", "exposed IP for communication with P2P peers")
 	serveCmd.PersistentFlags().Uint16(p2pPort, 16842, "exposed HTTP port for communication with P2P peers")
 
+	serveCmd.PersistentFlags().Int(maxBlockSize, blockdb.DefaultMaxBlockSize, "maximum size of each block in bytes")
+	serveCmd.PersistentFlags().Int(maxBlockTx, blockdb.DefaultMaxBlockTx, "maximum number of transactions in each block")
+
+	serveCmd.PersistentFlags().String(snapshotPath, "", "bootstrap an empty blockchain DB from a snapshot file")
+	serveCmd.PersistentFlags().String(snapshotKey, "", "public key (base64) the snapshot must be signed with, required with --snapshot")
+	serveCmd.PersistentFlags().String(chainID, blockdb.DefaultChainID, "chain ID recorded in the blockchain DB manifest")
+
+	// Retention of TX data, archive nodes keep everything
+	serveCmd.PersistentFlags().Bool(archive, false, "archive node, keep all TX data and advertise to peers")
+	serveCmd.PersistentFlags().Duration(retainAge, 0, "prune TX data of blocks older than this age (0 keeps all)")
+	serveCmd.PersistentFlags().Uint64(retainBlocks, 0, "prune TX data of all but the latest number of blocks (0 keeps all)")
+	serveCmd.PersistentFlags().Int64(retainSize, 0, "prune TX data of the oldest blocks over this DB size in bytes (0 keeps all)")
+
+	// Encryption at rest, the passphrase is read from the key file or the environment
+	serveCmd.PersistentFlags().String(dbKeyFile, "", fmt.Sprintf("key file to encrypt the blockchain DB at rest (default passphrase from $%s)", blockdb.PassphraseEnv))
+
+	// Known peers are saved between runs
+	usr, _ := user.Current()
+	serveCmd.PersistentFlags().String(peersFile, fmt.Sprintf("%s/.perry/peers.json", usr.HomeDir), "file to save known peers and their health between runs")
+	serveCmd.PersistentFlags().StringSlice(bootstrapPeers, []string{p2pnet.DefaultBootstrapPeer}, "bootstrap RPC peers as host:port, comma separated")
+	serveCmd.PersistentFlags().String(bansFile, fmt.Sprintf("%s/.perry/bans.json", usr.HomeDir), "file to save banned peers and sender keys")
+
+	// Forks are only followed if every peer is trusted, the longer chain wins and any peer can claim one
+	serveCmd.PersistentFlags().Bool(allowReorg, false, "switch to the longer fork of a peer, only if every peer is trusted")
+	serveCmd.PersistentFlags().Int(maxReorgDepth, p2pnet.DefaultMaxReorgDepth, "most blocks rolled back to switch to a fork")
+
 	rootCmd.AddCommand(serveCmd)
 
 }
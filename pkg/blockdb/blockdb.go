@@ -4,23 +4,73 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/btree"
 )
 
 type Hash [32]byte
 
+var (
+	ErrChecksumMismatch = errors.New("checksum does not match")
+	ErrParentMismatch   = errors.New("parent hash does not match previous block")
+	ErrSeqIDMismatch    = errors.New("SeqID does not follow previous block")
+	ErrBlockTooLarge    = errors.New("block exceeds the maximum size in bytes")
+	ErrBlockTooManyTx   = errors.New("block exceeds the maximum number of transactions")
+	ErrTxTooLarge       = errors.New("TX does not fit in a block")
+	ErrIndexMismatch    = errors.New("block on disk does not match the index")
+	ErrLegacyBlock      = errors.New("block without a TX root follows a block with one")
+)
+
+// Default block limits, each block is stored as a single line on disk
+const DefaultMaxBlockSize = 2048 * 1024
+const DefaultMaxBlockTx = 4096
+
+// Default size in bytes of decoded blocks kept in memory
+const DefaultCacheSize = 64 * 1024 * 1024
+
+// Minimum blocks per worker, and how often progress is reported
+const verifyRangeMin = 256
+const verifyProgressStep = 1024
+
+// Block payloads are read from disk on demand, only the index is kept in memory
 type BlockDB struct {
-	File     *os.File
-	Filename string
-	Version  uint8
-	Blocks   []BlockKV
-	Mu       sync.RWMutex
+	File         *os.File
+	Filename     string
+	Version      uint8
+	ChainID      string
+	Index        []BlockIndex
+	Mu           sync.RWMutex
+	MaxBlockSize int
+	MaxBlockTx   int
+	CacheSize    int
+	Retention    RetentionPolicy
+	Passphrase   []byte
+	prunedHeight uint64
+	size         int64
+	indexFile    *os.File
+	cache        *blockCache
+	crypt        *dbCipher
+	byHash       map[Hash]int
+	byTime       *btree.BTree
+}
+
+// Location of each block on disk, with the header for queries without reading the payload
+type BlockIndex struct {
+	Key    Hash
+	Header BlockHeader
+	Offset int64
+	Length int
 }
 
 type BlockKV struct {
@@ -37,6 +87,7 @@ type BlockHeader struct {
 	Parent  Hash      `json:"parent"`
 	SeqID   uint64    `json:"seqid"`
 	SeqTime time.Time `json:"seqtime"`
+	TxRoot  *Hash     `json:"txroot,omitempty"`
 }
 
 type TxPayload struct {
@@ -46,25 +97,61 @@ type TxPayload struct {
 	Data      []byte `json:"data"`
 	Header    []byte `json:"header"`
 	Type      uint8  `json:"type"`
-	Reserved  uint8  `json:"reserved"`
+	Reserved  uint8  `json:"reserved"` // TX flags, see TxFlagSealed
 	Output    []byte `json:"output"`
 	Block     uint64
+	DataHash  []byte `json:"data_hash,omitempty"`
+	Pruned    bool   `json:"pruned,omitempty"`
+}
+
+// Data is sealed for the recipient and can only be read with the recipient wallet
+const TxFlagSealed uint8 = 1 << 0
+
+// Progress callback for VerifyParallel, number of blocks verified out of the total
+type VerifyProgress func(verified, total int)
+
+// Returned by Verify for the first invalid block in the chain
+type VerifyError struct {
+	Index int
+	SeqID uint64
+	Hash  Hash
+	Err   error
 }
 
-type SyncBlocks struct {
-	PublicKey []byte    `json:"public_key"`
-	Blocks    []BlockKV `json:"blocks"`
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("Block %d (SeqID %d, hash %s) failed verification: %s", e.Index, e.SeqID, base64.StdEncoding.EncodeToString(e.Hash[:]), e.Err)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// Decode only the hash and header of a block, the payload is skipped
+type blockHeaderKV struct {
+	Key   Hash `json:"hash"`
+	Value struct {
+		Header BlockHeader `json:"header"`
+	} `json:"block"`
 }
 
 func New(filename string) BlockDB {
 
-	return BlockDB{Version: 1, Filename: filename}
+	return BlockDB{Version: CurrentVersion, ChainID: DefaultChainID, Filename: filename, MaxBlockSize: DefaultMaxBlockSize, MaxBlockTx: DefaultMaxBlockTx, CacheSize: DefaultCacheSize, cache: newBlockCache()}
 
 }
 
-// Open the specified database file
+// Open the specified database file, loading the block index
 func (blockdb *BlockDB) Open() (err error) {
 
+	blockdb.Mu.Lock()
+	defer blockdb.Mu.Unlock()
+
+	return blockdb.open()
+
+}
+
+func (blockdb *BlockDB) open() (err error) {
+
 	// Return if no path specified
 	if blockdb.Filename == "" {
 		return
@@ -72,38 +159,134 @@ func (blockdb *BlockDB) Open() (err error) {
 
 	log.Debug("Opening => ", blockdb.Filename)
 
+	// Refuse incompatible formats, upgrade older formats before reading
+	if err = blockdb.checkSchema(); err != nil {
+		return err
+	}
+
 	// Open the specified file, create a new file if missing
-	f, err := os.OpenFile(blockdb.Filename, os.O_RDONLY|os.O_CREATE, 0755)
+	f, err := os.OpenFile(blockdb.Filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
 
 	if err != nil {
 		return err
 	}
 
+	stat, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	blockdb.File = f
+	blockdb.size = stat.Size()
+	blockdb.resetIndex()
+
+	if blockdb.cache == nil {
+		blockdb.cache = newBlockCache()
+	}
+
+	blockdb.cache.reset()
+
+	// Load the index saved on disk, then index any blocks appended since
+	if err = blockdb.loadIndex(); err != nil {
+		blockdb.close()
+		return err
+	}
+
+	if err = blockdb.scanIndex(); err != nil {
+		blockdb.close()
+		return err
+	}
+
+	log.Debug(fmt.Sprintf("Opened (%d) blocks", len(blockdb.Index)))
+
+	return
+
+}
+
+// Read any blocks after the last indexed block and append them to the index
+func (blockdb *BlockDB) scanIndex() (err error) {
+
+	var offset int64
+
+	if len(blockdb.Index) > 0 {
+		last := blockdb.Index[len(blockdb.Index)-1]
+		offset = last.Offset + int64(last.Length) + 1
+	}
+
+	if offset >= blockdb.size {
+		return
+	}
+
+	// Increase the buffer to read the larger blocks stored on disk, never below the default
+	// so blocks written before the limit was lowered can still be read
+	bufSize := DefaultMaxBlockSize
+
+	if blockdb.MaxBlockSize > bufSize {
+		bufSize = blockdb.MaxBlockSize
+	}
+
+	bufSize = blockdb.crypt.lineSize(bufSize)
+
 	var buf []byte
-	scanner := bufio.NewScanner(f)
-	// Increase the buffer to read the larger blocks stored on disk
-	// TODO: Limit each block size to 2MB max
-	scanner.Buffer(buf, 2048*1024)
+	scanner := bufio.NewScanner(io.NewSectionReader(blockdb.File, offset, blockdb.size-offset))
+	scanner.Buffer(buf, bufSize+1)
 
 	for scanner.Scan() {
 
-		if err := scanner.Err(); err != nil {
-			return err
+		line := scanner.Bytes()
+		lineOffset := offset
+		offset += int64(len(line)) + 1
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
 		}
 
-		var blockKv BlockKV
-		err = json.Unmarshal(scanner.Bytes(), &blockKv)
+		data, err := blockdb.crypt.openBlock(line)
 
 		if err != nil {
+			return fmt.Errorf("Block at offset %d: %w", lineOffset, err)
+		}
+
+		var header blockHeaderKV
+
+		if err = json.Unmarshal(data, &header); err != nil {
 			return err
 		}
 
-		blockdb.Blocks = append(blockdb.Blocks, blockKv)
+		if err = blockdb.appendIndex(BlockIndex{Key: header.Key, Header: header.Value.Header, Offset: lineOffset, Length: len(line)}); err != nil {
+			return err
+		}
 
 	}
 
-	if err := f.Close(); err != nil {
-		return err
+	return scanner.Err()
+
+}
+
+// Close the database file and index
+func (blockdb *BlockDB) Close() (err error) {
+
+	blockdb.Mu.Lock()
+	defer blockdb.Mu.Unlock()
+
+	return blockdb.close()
+
+}
+
+func (blockdb *BlockDB) close() (err error) {
+
+	if blockdb.indexFile != nil {
+		err = blockdb.indexFile.Close()
+		blockdb.indexFile = nil
+	}
+
+	if blockdb.File != nil {
+		if closeErr := blockdb.File.Close(); closeErr != nil {
+			err = closeErr
+		}
+		blockdb.File = nil
 	}
 
 	return
@@ -113,97 +296,439 @@ func (blockdb *BlockDB) Open() (err error) {
 // Append a new block to disk, new-line seperated
 func (blockdb *BlockDB) Append(block []byte) (err error) {
 
-	f, err := os.OpenFile(blockdb.Filename, os.O_RDWR|os.O_APPEND, 0755)
+	var header blockHeaderKV
+
+	if err = json.Unmarshal(block, &header); err != nil {
+		return err
+	}
+
+	blockdb.Mu.Lock()
+	defer blockdb.Mu.Unlock()
+
+	return blockdb.write(block, header.Key, header.Value.Header)
+
+}
+
+// Write an encoded block and add it to the index, lock must be held
+func (blockdb *BlockDB) write(block []byte, key Hash, header BlockHeader) (err error) {
+
+	if blockdb.File == nil {
+		if blockdb.Filename == "" {
+			return errors.New("Specify filename to append blocks")
+		}
+
+		if err = blockdb.open(); err != nil {
+			return err
+		}
+	}
+
+	offset := blockdb.size
+	line := blockdb.crypt.sealBlock(block)
+
+	n, err := blockdb.File.Write(append(line, '\n'))
+	blockdb.size += int64(n)
 
 	if err != nil {
 		return err
 	}
 
-	_, err = f.Write(append(block, '\n'))
+	return blockdb.appendIndex(BlockIndex{Key: key, Header: header, Offset: offset, Length: len(line)})
+
+}
+
+// Number of blocks in the database
+func (blockdb *BlockDB) Len() int {
+
+	blockdb.Mu.RLock()
+	defer blockdb.Mu.RUnlock()
+
+	return len(blockdb.Index)
+
+}
+
+// Return the block at index `i`, from the cache or read from disk.
+// The returned block is shared with the cache and must not be modified
+func (blockdb *BlockDB) Get(i int) (block *BlockKV, err error) {
+
+	// Held while reading, so the file is not closed or replaced by a rewrite of the DB
+	blockdb.Mu.RLock()
+	defer blockdb.Mu.RUnlock()
+
+	return blockdb.get(i)
+
+}
+
+// Return the block with the hash, if still in the chain
+func (blockdb *BlockDB) getByHash(key Hash) (block *BlockKV, err error) {
+
+	blockdb.Mu.RLock()
+	defer blockdb.Mu.RUnlock()
+
+	pos, ok := blockdb.byHash[key]
+
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+
+	return blockdb.get(pos)
+
+}
+
+// Read lock must be held
+func (blockdb *BlockDB) get(i int) (block *BlockKV, err error) {
+
+	if i < 0 || i >= len(blockdb.Index) {
+		return nil, fmt.Errorf("Block index %d out of range (%d blocks)", i, len(blockdb.Index))
+	}
+
+	entry := blockdb.Index[i]
+
+	if block, ok := blockdb.cache.get(entry.Key); ok {
+		return block, nil
+	}
+
+	if blockdb.File == nil {
+		return nil, errors.New("BlockDB is not open")
+	}
+
+	data := make([]byte, entry.Length)
+
+	if _, err = blockdb.File.ReadAt(data, entry.Offset); err != nil {
+		return nil, err
+	}
+
+	if data, err = blockdb.crypt.openBlock(data); err != nil {
+		return nil, &VerifyError{Index: i, SeqID: entry.Header.SeqID, Hash: entry.Key, Err: err}
+	}
+
+	block = &BlockKV{}
+
+	if err = json.Unmarshal(data, block); err != nil {
+		return nil, err
+	}
+
+	if block.Key != entry.Key {
+		return nil, &VerifyError{Index: i, SeqID: entry.Header.SeqID, Hash: entry.Key, Err: ErrIndexMismatch}
+	}
+
+	blockdb.cache.put(entry.Key, block, entry.Length, blockdb.CacheSize)
 
 	return
 
 }
 
-// Verfiy the blockchain DB on disk matches the specified signature
-// TODO: Use multiple go routines
-func (blockdb *BlockDB) Verify() (err error) {
+// Stream blocks from index `from` up to `to` (exclusive) without caching, the lock is not held during `fn`
+func (blockdb *BlockDB) Iterate(from, to int, fn func(i int, block *BlockKV) error) (err error) {
 
 	blockdb.Mu.RLock()
 
-	log.Debug(fmt.Sprintf("Verifying (%d) block signatures on disk ...", len(blockdb.Blocks)))
+	if to > len(blockdb.Index) {
+		to = len(blockdb.Index)
+	}
 
-	var currentHash Hash
+	if from < 0 {
+		from = 0
+	}
 
-	for i := 0; i < len(blockdb.Blocks); i++ {
+	if from >= to {
+		blockdb.Mu.RUnlock()
+		return
+	}
 
-		currentBlock := &blockdb.Blocks[i]
+	entries := append([]BlockIndex{}, blockdb.Index[from:to]...)
+	crypt := blockdb.crypt
+	file, err := blockdb.openReader()
+	blockdb.Mu.RUnlock()
 
-		h := sha256.New()
+	if err != nil {
+		return
+	}
 
-		payload, err := json.Marshal(currentBlock.Value.Payload)
+	defer file.Close()
 
-		if err != nil {
-			log.Fatal(err)
+	return readRange(file, crypt, from, entries, fn)
+
+}
+
+// Open a read handle for the blocks in the index, lock must be held. Prune, Encrypt and Reorg replace the DB
+// with a rename, so the handle keeps reading the file that matches the index captured with it
+func (blockdb *BlockDB) openReader() (*os.File, error) {
+
+	if blockdb.File == nil {
+		return nil, errors.New("BlockDB is not open")
+	}
+
+	return os.Open(blockdb.File.Name())
+
+}
+
+// Read the blocks for the index `entries` sequentially from `file`, `from` is the index of the first entry
+func readRange(file *os.File, crypt *dbCipher, from int, entries []BlockIndex, fn func(i int, block *BlockKV) error) (err error) {
+
+	if len(entries) == 0 {
+		return
+	}
+
+	start := entries[0].Offset
+	last := entries[len(entries)-1]
+
+	reader := bufio.NewReader(io.NewSectionReader(file, start, last.Offset+int64(last.Length)-start))
+	pos := start
+
+	for j, entry := range entries {
+
+		// Skip to the start of the block, in case of blank lines
+		if _, err = reader.Discard(int(entry.Offset - pos)); err != nil {
+			return err
 		}
 
-		if i > 0 {
-			currentHash = blockdb.Blocks[i-1].Key
+		data := make([]byte, entry.Length)
 
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return err
 		}
 
-		// Write the current hash
-		// Append the hash for the current block data state
-		h.Write(append(currentHash[:], payload...))
+		pos = entry.Offset + int64(entry.Length)
+
+		if data, err = crypt.openBlock(data); err != nil {
+			return &VerifyError{Index: from + j, SeqID: entry.Header.SeqID, Hash: entry.Key, Err: err}
+		}
 
-		checksum := h.Sum(nil)
+		block := &BlockKV{}
 
-		if !bytes.Equal(checksum, currentBlock.Key[:]) {
-			log.Warn("Checksum does not match ", i, " => ", checksum, currentBlock.Key)
+		if err = json.Unmarshal(data, block); err != nil {
+			return &VerifyError{Index: from + j, SeqID: entry.Header.SeqID, Hash: entry.Key, Err: err}
+		}
+
+		if err = fn(from+j, block); err != nil {
+			return err
 		}
 
 	}
 
-	blockdb.Mu.RUnlock()
+	return
+
+}
+
+// Verfiy the blockchain DB on disk, using all available CPU cores
+func (blockdb *BlockDB) Verify() (err error) {
+
+	return blockdb.VerifyParallel(runtime.NumCPU(), nil)
+
+}
+
+// Verify the hash, parent link and SeqID of each block, split into ranges across `cpu_cores` workers.
+// Returns a *VerifyError for the first (lowest) invalid block found
+func (blockdb *BlockDB) VerifyParallel(cpu_cores int, progress VerifyProgress) (err error) {
+
+	blockdb.Mu.RLock()
+	defer blockdb.Mu.RUnlock()
+
+	log.Debug(fmt.Sprintf("Verifying (%d) block signatures on disk ...", len(blockdb.Index)))
+
+	if verr := blockdb.verifyBlocks(cpu_cores, progress); verr != nil {
+		log.Warn(verr)
+		return verr
+	}
 
 	log.Debug(" done\n")
 	return
 
 }
 
+// Verify all blocks in parallel ranges read from disk, lock must be held
+func (blockdb *BlockDB) verifyBlocks(cpu_cores int, progress VerifyProgress) (firstErr *VerifyError) {
+
+	total := len(blockdb.Index)
+
+	if total == 0 {
+		return
+	}
+
+	if cpu_cores < 1 {
+		cpu_cores = 1
+	}
+
+	// Split the chain into ranges, at least verifyRangeMin blocks each
+	rangeSize := total / cpu_cores
+
+	if rangeSize < verifyRangeMin {
+		rangeSize = verifyRangeMin
+	}
+
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var verified int64
+
+	for start := 0; start < total; start += rangeSize {
+
+		end := start + rangeSize
+
+		if end > total {
+			end = total
+		}
+
+		wg.Add(1)
+
+		go func(start, end int) {
+
+			defer wg.Done()
+
+			err := readRange(blockdb.File, blockdb.crypt, start, blockdb.Index[start:end], func(i int, block *BlockKV) error {
+
+				// Abort if a lower block has already failed, it is reported first
+				errMu.Lock()
+				abort := firstErr != nil && firstErr.Index < i
+				errMu.Unlock()
+
+				if abort {
+					return errVerifyAbort
+				}
+
+				if verr := blockdb.verifyBlock(i, block); verr != nil {
+					return verr
+				}
+
+				done := atomic.AddInt64(&verified, 1)
+
+				if progress != nil && (done%verifyProgressStep == 0 || int(done) == total) {
+					progress(int(done), total)
+				}
+
+				return nil
+
+			})
+
+			if err == nil || err == errVerifyAbort {
+				return
+			}
+
+			verr, ok := err.(*VerifyError)
+
+			if !ok {
+				verr = &VerifyError{Index: start, SeqID: blockdb.Index[start].Header.SeqID, Hash: blockdb.Index[start].Key, Err: err}
+			}
+
+			errMu.Lock()
+			if firstErr == nil || verr.Index < firstErr.Index {
+				firstErr = verr
+			}
+			errMu.Unlock()
+
+		}(start, end)
+
+	}
+
+	wg.Wait()
+
+	return
+
+}
+
+// Confirm the block at index `i` matches the index, links to its parent and matches its checksum, lock must be held
+func (blockdb *BlockDB) verifyBlock(i int, block *BlockKV) *VerifyError {
+
+	if block.Key != blockdb.Index[i].Key || block.Value.Header.Parent != blockdb.Index[i].Header.Parent || block.Value.Header.SeqID != blockdb.Index[i].Header.SeqID {
+		return &VerifyError{Index: i, SeqID: block.Value.Header.SeqID, Hash: block.Key, Err: ErrIndexMismatch}
+	}
+
+	var parent BlockIndex
+
+	if i > 0 {
+		parent = blockdb.Index[i-1]
+	}
+
+	if err := checkBlock(block, parent.Key, parent.Header.SeqID); err != nil {
+		return &VerifyError{Index: i, SeqID: block.Value.Header.SeqID, Hash: block.Key, Err: err}
+	}
+
+	return nil
+
+}
+
+// Confirm a block follows the specified parent hash and SeqID, and the hash matches the payload.
+// Blocks with a TxRoot commit to the Merkle root of the TX's, older blocks to the encoded payload
+func checkBlock(block *BlockKV, parentHash Hash, parentSeqID uint64) (err error) {
+
+	if block.Value.Header.Parent != parentHash {
+		return ErrParentMismatch
+	}
+
+	if block.Value.Header.SeqID != parentSeqID+1 {
+		return ErrSeqIDMismatch
+	}
+
+	if block.Value.Header.TxRoot != nil {
+
+		root, err := TxRoot(block.Value.Payload)
+
+		if err != nil {
+			return err
+		}
+
+		if root != *block.Value.Header.TxRoot || BlockHash(block.Value.Header) != block.Key {
+			return ErrChecksumMismatch
+		}
+
+		return nil
+
+	}
+
+	payload, err := json.Marshal(block.Value.Payload)
+
+	if err != nil {
+		return err
+	}
+
+	// Append the hash for the current block data state
+	h := sha256.New()
+	h.Write(append(parentHash[:], payload...))
+
+	if !bytes.Equal(h.Sum(nil), block.Key[:]) {
+		return ErrChecksumMismatch
+	}
+
+	return
+
+}
+
 // JSON RPC methods
 
 // Return the latest message block in our stack
 func (blockdb *BlockDB) GetLatestBlock() (block *BlockKV) {
 
-	if len(blockdb.Blocks) == 0 {
+	blockdb.Mu.RLock()
+	len := len(blockdb.Index)
+	blockdb.Mu.RUnlock()
+
+	if len == 0 {
 		return &BlockKV{}
 	}
 
-	len := len(blockdb.Blocks) - 1
+	block, err := blockdb.Get(len - 1)
+
+	if err != nil {
+		log.Warn("GetLatestBlock => ", err)
 
-	return &blockdb.Blocks[len]
+		// Fallback to the indexed header
+		latest := blockdb.GetLatestIndex()
+		return &BlockKV{Key: latest.Key, Value: Block{Header: latest.Header}}
+	}
+
+	return
 
 }
 
-// Search for a specified block starting from a specified `from` sequence
-func (blockdb *BlockDB) Sync(from []byte) (id int) {
+// Return the index entry for the latest block, without reading the payload
+func (blockdb *BlockDB) GetLatestIndex() (entry BlockIndex) {
 
 	blockdb.Mu.RLock()
 	defer blockdb.Mu.RUnlock()
 
-	//fmt.Println("Searching for ", from)
-
-	for i := 0; i < len(blockdb.Blocks); i++ {
-		//fmt.Println("Searching ", i)
-
-		if bytes.Equal(blockdb.Blocks[i].Value.Header.Parent[:], from[:]) {
-			log.Debug("Sync => Found match: ", i)
-			return i
-		}
-
+	if len(blockdb.Index) == 0 {
+		return
 	}
 
-	return
+	return blockdb.Index[len(blockdb.Index)-1]
 
 }
@@ -0,0 +1,394 @@
+package blockdb_test
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/stretchr/testify/assert"
+)
+
+var db_path = "../../config/tests/blockchain-db-valid.json"
+var corrupt_db_path = "../../config/tests/blockchain-db.json"
+
+func TestVerify(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	err := db.Open()
+
+	assert.Nil(t, err)
+	assert.NotZero(t, db.Len())
+
+	err = db.Verify()
+	assert.Nil(t, err)
+
+	// Progress is reported for every block verified
+	var last int
+	err = db.VerifyParallel(4, func(verified, total int) {
+		last = verified
+		assert.Equal(t, db.Len(), total)
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, db.Len(), last)
+
+}
+
+func TestVerifyCorrupt(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, corrupt_db_path))
+	err := db.Open()
+
+	assert.Nil(t, err)
+
+	err = db.Verify()
+
+	var verr *blockdb.VerifyError
+	assert.True(t, errors.As(err, &verr))
+	assert.Equal(t, 0, verr.Index)
+	assert.True(t, errors.Is(err, blockdb.ErrChecksumMismatch))
+
+}
+
+func TestVerifyFirstInvalidBlock(t *testing.T) {
+
+	path := tempDB(t, db_path)
+
+	// Break the payload, parent link and SeqID of later blocks, the lowest is reported
+	tamper(t, path, 30, func(block *blockdb.BlockKV) { block.Value.Header.SeqID++ })
+	tamper(t, path, 20, func(block *blockdb.BlockKV) { block.Value.Header.Parent[0] ^= 0xff })
+	tamper(t, path, 10, func(block *blockdb.BlockKV) { block.Value.Payload[0].Data = []byte("tampered") })
+
+	db := blockdb.New(path)
+	err := db.Open()
+
+	assert.Nil(t, err)
+
+	for _, cpu_cores := range []int{1, 2, 8} {
+
+		err = db.VerifyParallel(cpu_cores, nil)
+
+		var verr *blockdb.VerifyError
+		assert.True(t, errors.As(err, &verr))
+		assert.Equal(t, 10, verr.Index)
+		assert.Equal(t, uint64(11), verr.SeqID)
+		assert.True(t, errors.Is(err, blockdb.ErrChecksumMismatch))
+
+	}
+
+	// Each failure type is reported with its own error
+	path = tempDB(t, db_path)
+	tamper(t, path, 20, func(block *blockdb.BlockKV) { block.Value.Header.Parent[0] ^= 0xff })
+
+	db = blockdb.New(path)
+	db.Open()
+	err = db.Verify()
+	assert.True(t, errors.Is(err, blockdb.ErrParentMismatch))
+
+	path = tempDB(t, db_path)
+	tamper(t, path, 30, func(block *blockdb.BlockKV) { block.Value.Header.SeqID++ })
+
+	db = blockdb.New(path)
+	db.Open()
+	err = db.Verify()
+	assert.True(t, errors.Is(err, blockdb.ErrSeqIDMismatch))
+
+}
+
+func TestLazyLoading(t *testing.T) {
+
+	path := tempDB(t, db_path)
+
+	db := blockdb.New(path)
+	err := db.Open()
+	assert.Nil(t, err)
+
+	total := db.Len()
+
+	// Blocks are read from disk on demand and match the index
+	for i := 0; i < total; i++ {
+		block, err := db.Get(i)
+		assert.Nil(t, err)
+		assert.Equal(t, db.Index[i].Key, block.Key)
+		assert.Equal(t, uint64(i+1), block.Value.Header.SeqID)
+	}
+
+	latest := db.GetLatestBlock()
+	assert.Equal(t, db.GetLatestIndex().Key, latest.Key)
+	assert.NotEmpty(t, latest.Value.Payload)
+
+	// The cache is bounded, blocks are still read once evicted
+	db.CacheSize = 4096
+
+	for i := 0; i < total; i++ {
+		_, err := db.Get(i)
+		assert.Nil(t, err)
+	}
+
+	var count int
+	err = db.Iterate(10, total+10, func(i int, block *blockdb.BlockKV) error {
+		assert.Equal(t, db.Index[i].Key, block.Key)
+		count++
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, total-10, count)
+
+	// Append a new block, the saved index is reused on open
+	next := *latest
+	next.Value.Header.Parent = latest.Key
+	next.Value.Header.SeqID++
+
+	payload, err := json.Marshal(next.Value.Payload)
+	assert.Nil(t, err)
+	next.Key = sha256.Sum256(append(latest.Key[:], payload...))
+
+	data, err := json.Marshal(next)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Append(data))
+	assert.Nil(t, db.Close())
+
+	_, err = os.Stat(db.IndexFilename())
+	assert.Nil(t, err)
+
+	db = blockdb.New(path)
+	assert.Nil(t, db.Open())
+	assert.Equal(t, total+1, db.Len())
+	assert.Equal(t, next.Key, db.GetLatestIndex().Key)
+	assert.Nil(t, db.Verify())
+
+	// A stale index is rebuilt from the DB file
+	db.Close()
+	assert.Nil(t, os.WriteFile(path, []byte(readFile(t, db_path)), 0644))
+
+	db = blockdb.New(path)
+	assert.Nil(t, db.Open())
+	assert.Equal(t, total, db.Len())
+	assert.Nil(t, db.Verify())
+
+}
+
+// Copy the test blockchain DB to a temporary file
+func tempDB(t *testing.T, src string) string {
+
+	data, err := os.ReadFile(src)
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "blockchain-db.json")
+	err = os.WriteFile(path, data, 0644)
+	assert.Nil(t, err)
+
+	return path
+
+}
+
+// Modify the block on line `i` of the DB file, without updating the hash
+func tamper(t *testing.T, path string, i int, fn func(block *blockdb.BlockKV)) {
+
+	lines := strings.Split(strings.TrimSpace(readFile(t, path)), "\n")
+
+	var block blockdb.BlockKV
+	assert.Nil(t, json.Unmarshal([]byte(lines[i]), &block))
+
+	fn(&block)
+
+	data, err := json.Marshal(block)
+	assert.Nil(t, err)
+
+	lines[i] = string(data)
+	assert.Nil(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+
+}
+
+func TestRepair(t *testing.T) {
+
+	path := tempDB(t, db_path)
+
+	db := blockdb.New(path)
+	err := db.Open()
+	assert.Nil(t, err)
+
+	total := db.Len()
+
+	// A valid DB is left untouched
+	result, err := db.Repair()
+	assert.Nil(t, err)
+	assert.Equal(t, total, result.Valid)
+	assert.Equal(t, 0, result.Quarantined)
+	assert.Empty(t, result.QuarantineFile)
+	db.Close()
+
+	// Break the parent link of block 30 and append an unparsable line
+	tamper(t, path, 30, func(block *blockdb.BlockKV) { block.Value.Header.Parent[0] ^= 0xff })
+
+	lines := strings.Split(strings.TrimSpace(readFile(t, path)), "\n")
+	lines = append(lines, "{\"hash\": [1, 2")
+	err = os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	assert.Nil(t, err)
+
+	db = blockdb.New(path)
+	assert.NotNil(t, db.Open())
+
+	result, err = db.Repair()
+	assert.Nil(t, err)
+	assert.Equal(t, 30, result.Valid)
+	assert.Equal(t, total-30+1, result.Quarantined)
+	assert.Contains(t, result.Reason, blockdb.ErrParentMismatch.Error())
+
+	// The quarantine file holds the original invalid tail
+	assert.Equal(t, strings.Join(lines[30:], "\n")+"\n", readFile(t, result.QuarantineFile))
+
+	// The repaired DB is reloaded and passes verification
+	assert.Equal(t, 30, db.Len())
+	assert.Nil(t, db.Verify())
+	db.Close()
+
+	db = blockdb.New(path)
+	assert.Nil(t, db.Open())
+	assert.Equal(t, 30, db.Len())
+	assert.Nil(t, db.Verify())
+
+}
+
+func TestRepairUnparsable(t *testing.T) {
+
+	path := tempDB(t, db_path)
+
+	lines := strings.Split(strings.TrimSpace(readFile(t, path)), "\n")
+	lines[10] = lines[10][:len(lines[10])/2]
+
+	// Blank lines before the broken block are skipped, the reason names the line in the file
+	lines = append(lines[:5], append([]string{"", ""}, lines[5:]...)...)
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	assert.Nil(t, err)
+
+	db := blockdb.New(path)
+
+	result, err := db.Repair()
+	assert.Nil(t, err)
+	assert.Equal(t, 10, result.Valid)
+	assert.Equal(t, len(lines)-12, result.Quarantined)
+	assert.Contains(t, result.Reason, "Line 13 ")
+	assert.Equal(t, 10, db.Len())
+	assert.Nil(t, db.Verify())
+
+}
+
+func readFile(t *testing.T, filename string) string {
+
+	data, err := os.ReadFile(filename)
+	assert.Nil(t, err)
+
+	return string(data)
+
+}
+
+func TestBlockFits(t *testing.T) {
+
+	db := blockdb.New("")
+
+	payload := make([]blockdb.TxPayload, 100)
+
+	for i := range payload {
+		payload[i] = blockdb.TxPayload{Data: []byte(strings.Repeat("x", 500)), Sender: make([]byte, 32), Signature: make([]byte, 64)}
+	}
+
+	assert.Equal(t, 100, db.BlockFits(payload))
+
+	// Limit by TX count
+	db.MaxBlockTx = 10
+	assert.Equal(t, 10, db.BlockFits(payload))
+
+	// Limit by size, the encoded block must be within the limit
+	db.MaxBlockTx = 0
+	db.MaxBlockSize = 16 * 1024
+
+	n := db.BlockFits(payload)
+	assert.True(t, n > 0 && n < 100)
+
+	block := blockdb.BlockKV{}
+	block.Value.Header.SeqID = 1
+	block.Value.Header.SeqTime = time.Now()
+	block.Value.Payload = payload[:n]
+
+	data, err := json.Marshal(block)
+	assert.Nil(t, err)
+	assert.Nil(t, db.CheckBlockSize(data, n))
+
+	block.Value.Payload = payload[:n+1]
+
+	data, err = json.Marshal(block)
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(db.CheckBlockSize(data, n+1), blockdb.ErrBlockTooLarge))
+
+	// A single TX over the limit never fits
+	db.MaxBlockSize = 256
+	assert.Equal(t, 0, db.BlockFits(payload))
+
+	db.MaxBlockTx = 1
+	assert.True(t, errors.Is(db.CheckBlockSize([]byte("{}"), 2), blockdb.ErrBlockTooManyTx))
+
+}
+
+func TestReadDuringRewrite(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	db.CacheSize = 0
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	total := db.Len()
+	done := make(chan error, 2)
+
+	// Repair closes and reopens the DB while blocks are read
+	go func() {
+
+		for i := 0; i < 20; i++ {
+			if _, err := db.Repair(); err != nil {
+				done <- err
+				return
+			}
+		}
+
+		done <- nil
+
+	}()
+
+	go func() {
+
+		for i := 0; i < 20; i++ {
+
+			read := 0
+
+			err := db.Iterate(0, total, func(i int, block *blockdb.BlockKV) error {
+				read++
+				_, err := db.Get(i)
+				return err
+			})
+
+			if err == nil && read != total {
+				err = errors.New("blocks missing from iterate")
+			}
+
+			if err != nil {
+				done <- err
+				return
+			}
+
+		}
+
+		done <- nil
+
+	}()
+
+	assert.Nil(t, <-done)
+	assert.Nil(t, <-done)
+
+}
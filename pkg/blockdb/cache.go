@@ -0,0 +1,85 @@
+package blockdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// LRU cache of decoded blocks, bounded by the encoded size of the blocks on disk
+type blockCache struct {
+	mu    sync.Mutex
+	size  int
+	items map[Hash]*list.Element
+	lru   *list.List
+}
+
+type cacheEntry struct {
+	key   Hash
+	block *BlockKV
+	size  int
+}
+
+func newBlockCache() *blockCache {
+
+	return &blockCache{items: make(map[Hash]*list.Element), lru: list.New()}
+
+}
+
+func (cache *blockCache) get(key Hash) (block *BlockKV, ok bool) {
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	elem, ok := cache.items[key]
+
+	if !ok {
+		return nil, false
+	}
+
+	cache.lru.MoveToFront(elem)
+
+	return elem.Value.(*cacheEntry).block, true
+
+}
+
+// Add a block to the cache, evicting the least recently used blocks over `limit` bytes
+func (cache *blockCache) put(key Hash, block *BlockKV, size int, limit int) {
+
+	if size > limit {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if elem, ok := cache.items[key]; ok {
+		cache.lru.MoveToFront(elem)
+		return
+	}
+
+	cache.items[key] = cache.lru.PushFront(&cacheEntry{key: key, block: block, size: size})
+	cache.size += size
+
+	for cache.size > limit {
+
+		elem := cache.lru.Back()
+		entry := elem.Value.(*cacheEntry)
+
+		cache.lru.Remove(elem)
+		delete(cache.items, entry.key)
+		cache.size -= entry.size
+
+	}
+
+}
+
+func (cache *blockCache) reset() {
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.items = make(map[Hash]*list.Element)
+	cache.lru.Init()
+	cache.size = 0
+
+}
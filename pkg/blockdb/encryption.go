@@ -0,0 +1,429 @@
+package blockdb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Environment variable holding the DB passphrase, if no key file is specified
+const PassphraseEnv = "PERRY_DB_PASSPHRASE"
+
+const EncryptionCipher = "xchacha20-poly1305"
+const EncryptionKDF = "argon2id"
+
+// Default argon2id parameters, the key is derived once when the DB is opened
+const kdfTime = 1
+const kdfMemory = 64 * 1024
+const kdfThreads = 4
+
+// Additional data for each type of sealed record, so records can't be swapped between files
+var (
+	blockAD = []byte("perry-block")
+	indexAD = []byte("perry-index")
+	checkAD = []byte("perry-check")
+)
+
+var (
+	ErrKeyRequired  = errors.New("blockchain DB is encrypted, a passphrase or key file is required")
+	ErrWrongKey     = errors.New("passphrase or key file does not unlock the blockchain DB")
+	ErrNotEncrypted = errors.New("blockchain DB is not encrypted")
+	ErrDecrypt      = errors.New("block could not be decrypted")
+)
+
+// Recorded in the manifest of encrypted DBs, the check value confirms the key before reading blocks
+type EncryptionParams struct {
+	Cipher  string `json:"cipher"`
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	Check   []byte `json:"check"`
+}
+
+// AEAD for the blocks and index on disk, a nil dbCipher reads and writes plaintext
+type dbCipher struct {
+	aead cipher.AEAD
+	salt []byte
+}
+
+// Load the DB passphrase from the key file, or the environment if no key file is specified.
+// Returns nil if neither is set, and the DB is opened unencrypted
+func LoadPassphrase(keyFile string) (passphrase []byte, err error) {
+
+	if keyFile == "" {
+		if env := os.Getenv(PassphraseEnv); env != "" {
+			return []byte(env), nil
+		}
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(keyFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not read key file %s (%s)", keyFile, err)
+	}
+
+	passphrase = bytes.TrimSpace(data)
+
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("Key file %s is empty", keyFile)
+	}
+
+	return
+
+}
+
+// Generate new parameters for the passphrase, with a random salt
+func newEncryptionParams(passphrase []byte) (params *EncryptionParams, crypt *dbCipher, err error) {
+
+	params = &EncryptionParams{Cipher: EncryptionCipher, KDF: EncryptionKDF, Salt: make([]byte, 16), Time: kdfTime, Memory: kdfMemory, Threads: kdfThreads}
+
+	if _, err = rand.Read(params.Salt); err != nil {
+		return
+	}
+
+	if crypt, err = newCipher(passphrase, params); err != nil {
+		return
+	}
+
+	params.Check = crypt.seal(nil, checkAD)
+
+	return
+
+}
+
+// Derive the key from the passphrase and confirm it unlocks the DB
+func unlock(passphrase []byte, params *EncryptionParams) (crypt *dbCipher, err error) {
+
+	if len(passphrase) == 0 {
+		return nil, ErrKeyRequired
+	}
+
+	if params.Cipher != EncryptionCipher || params.KDF != EncryptionKDF {
+		return nil, fmt.Errorf("%w: encryption %s with %s, expected %s with %s", ErrIncompatible, params.Cipher, params.KDF, EncryptionCipher, EncryptionKDF)
+	}
+
+	if crypt, err = newCipher(passphrase, params); err != nil {
+		return
+	}
+
+	if _, err = crypt.open(params.Check, checkAD); err != nil {
+		return nil, ErrWrongKey
+	}
+
+	return
+
+}
+
+func newCipher(passphrase []byte, params *EncryptionParams) (crypt *dbCipher, err error) {
+
+	key := argon2.IDKey(passphrase, params.Salt, params.Time, params.Memory, params.Threads, chacha20poly1305.KeySize)
+
+	aead, err := chacha20poly1305.NewX(key)
+
+	if err != nil {
+		return
+	}
+
+	return &dbCipher{aead: aead, salt: params.Salt}, nil
+
+}
+
+// Seal with a random nonce, prepended to the ciphertext
+func (crypt *dbCipher) seal(data, ad []byte) []byte {
+
+	nonce := make([]byte, crypt.aead.NonceSize(), crypt.aead.NonceSize()+len(data)+crypt.aead.Overhead())
+
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	return crypt.aead.Seal(nonce, nonce, data, ad)
+
+}
+
+func (crypt *dbCipher) open(data, ad []byte) ([]byte, error) {
+
+	if len(data) < crypt.aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+
+	plain, err := crypt.aead.Open(nil, data[:crypt.aead.NonceSize()], data[crypt.aead.NonceSize():], ad)
+
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plain, nil
+
+}
+
+// Encode a block as a line on disk, encrypted blocks are base64 encoded to keep one block per line
+func (crypt *dbCipher) sealBlock(block []byte) []byte {
+
+	if crypt == nil {
+		return block
+	}
+
+	sealed := crypt.seal(block, blockAD)
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(line, sealed)
+
+	return line
+
+}
+
+// Decode a block line read from disk
+func (crypt *dbCipher) openBlock(line []byte) ([]byte, error) {
+
+	if crypt == nil {
+		return line, nil
+	}
+
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+	n, err := base64.StdEncoding.Decode(sealed, line)
+
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return crypt.open(sealed[:n], blockAD)
+
+}
+
+// Maximum length on disk of a block of `size` bytes
+func (crypt *dbCipher) lineSize(size int) int {
+
+	if crypt == nil {
+		return size
+	}
+
+	return base64.StdEncoding.EncodedLen(crypt.aead.NonceSize() + size + crypt.aead.Overhead())
+
+}
+
+// Length of the block sealed in a line on disk, from the line length and its last two bytes, which hold
+// any base64 padding
+func (crypt *dbCipher) blockSize(length int, tail []byte) int {
+
+	if crypt == nil {
+		return length
+	}
+
+	size := base64.StdEncoding.DecodedLen(length) - bytes.Count(tail, []byte("="))
+
+	return size - crypt.aead.NonceSize() - crypt.aead.Overhead()
+
+}
+
+// Size of each index record on disk
+func (crypt *dbCipher) recordSize() int {
+
+	size := binary.Size(indexRecord{})
+
+	if crypt == nil {
+		return size
+	}
+
+	return crypt.aead.NonceSize() + size + crypt.aead.Overhead()
+
+}
+
+func (crypt *dbCipher) sealRecord(record indexRecord) []byte {
+
+	if crypt == nil {
+		return record.bytes()
+	}
+
+	return crypt.seal(record.bytes(), indexAD)
+
+}
+
+func (crypt *dbCipher) openRecord(data []byte) (record indexRecord, err error) {
+
+	if crypt != nil {
+		if data, err = crypt.open(data, indexAD); err != nil {
+			return
+		}
+	}
+
+	err = binary.Read(bytes.NewReader(data), binary.BigEndian, &record)
+
+	return
+
+}
+
+// Unlock the DB described by the manifest with the passphrase, reusing the key if already derived
+func (blockdb *BlockDB) unlock(manifest Manifest) (err error) {
+
+	if manifest.Encryption == nil {
+
+		if blockdb.Passphrase != nil {
+			return fmt.Errorf("%w, run perryctl -cmd encrypt to encrypt %s", ErrNotEncrypted, blockdb.Filename)
+		}
+
+		blockdb.crypt = nil
+		return
+
+	}
+
+	if blockdb.crypt == nil || !bytes.Equal(blockdb.crypt.salt, manifest.Encryption.Salt) {
+		if blockdb.crypt, err = unlock(blockdb.Passphrase, manifest.Encryption); err != nil {
+			return
+		}
+	}
+
+	return blockdb.completeEncrypt()
+
+}
+
+// Filename of the encrypted copy written by Encrypt
+func (blockdb *BlockDB) encryptFilename() string {
+
+	return fmt.Sprintf("%s.encrypt", blockdb.Filename)
+
+}
+
+// Replace the DB with the encrypted copy, if one is left by Encrypt. The copy is synced before the manifest
+// records the encryption, so it is complete once the manifest is encrypted. Lock must be held
+func (blockdb *BlockDB) completeEncrypt() (err error) {
+
+	if _, err = os.Stat(blockdb.encryptFilename()); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	if err = os.Rename(blockdb.encryptFilename(), blockdb.Filename); err != nil {
+		return
+	}
+
+	// The index is rebuilt for the encrypted blocks
+	if err = os.Remove(blockdb.IndexFilename()); err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	return nil
+
+}
+
+// Encrypt an existing plaintext DB with the passphrase, the DB is rewritten and reopened
+func (blockdb *BlockDB) Encrypt(passphrase []byte) (err error) {
+
+	if len(passphrase) == 0 {
+		return ErrKeyRequired
+	}
+
+	blockdb.Mu.Lock()
+	defer blockdb.Mu.Unlock()
+
+	if blockdb.File == nil {
+		if err = blockdb.open(); err != nil {
+			return
+		}
+	}
+
+	manifest, err := ReadManifest(blockdb.ManifestFilename())
+
+	if err != nil {
+		return
+	}
+
+	if manifest.Encryption != nil {
+		return fmt.Errorf("BlockDB %s is already encrypted", blockdb.Filename)
+	}
+
+	params, crypt, err := newEncryptionParams(passphrase)
+
+	if err != nil {
+		return
+	}
+
+	tmpFile := blockdb.encryptFilename()
+
+	out, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+
+	if err != nil {
+		return
+	}
+
+	defer os.Remove(tmpFile)
+
+	w := bufio.NewWriter(out)
+
+	for _, entry := range blockdb.Index {
+
+		data := make([]byte, entry.Length)
+
+		if _, err = blockdb.File.ReadAt(data, entry.Offset); err != nil {
+			break
+		}
+
+		if _, err = w.Write(append(crypt.sealBlock(data), '\n')); err != nil {
+			break
+		}
+
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return
+	}
+
+	// Record the encryption before the DB is replaced, so the key parameters are never lost. If interrupted
+	// after the manifest is written, the next open completes the replace from the encrypted copy
+	blockdb.close()
+
+	manifest.Encryption = params
+
+	if err = WriteManifest(blockdb.ManifestFilename(), manifest); err != nil {
+		blockdb.open()
+		return
+	}
+
+	if err = blockdb.completeEncrypt(); err != nil {
+
+		// Restore the manifest if the plaintext DB is still in place
+		if _, statErr := os.Stat(tmpFile); statErr == nil {
+			manifest.Encryption = nil
+
+			if WriteManifest(blockdb.ManifestFilename(), manifest) == nil {
+				blockdb.open()
+			}
+		}
+
+		return
+
+	}
+
+	blockdb.Passphrase = passphrase
+	blockdb.crypt = crypt
+
+	log.Info(fmt.Sprintf("Encrypted (%d) blocks in %s", len(blockdb.Index), blockdb.Filename))
+
+	return blockdb.open()
+
+}
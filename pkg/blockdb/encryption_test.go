@@ -0,0 +1,142 @@
+package blockdb_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+var passphrase = []byte("correct horse battery staple")
+
+func TestEncryptedDB(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "blockchain-db.json")
+
+	db := blockdb.New(path)
+	db.Passphrase = passphrase
+	assert.Nil(t, db.Open())
+
+	appendMerkleBlocks(t, &db, 5, time.Now())
+	head := db.GetLatestIndex()
+	db.Close()
+
+	// Neither the blocks nor the index are stored in plaintext
+	assert.False(t, strings.Contains(readFile(t, path), "message"))
+	assert.False(t, bytes.Contains([]byte(readFile(t, db.IndexFilename())), head.Key[:]))
+
+	manifest, err := blockdb.ReadManifest(db.ManifestFilename())
+	assert.Nil(t, err)
+	assert.NotNil(t, manifest.Encryption)
+
+	// The DB can only be opened with the passphrase
+	locked := blockdb.New(path)
+	assert.True(t, errors.Is(locked.Open(), blockdb.ErrKeyRequired))
+
+	locked.Passphrase = []byte("wrong")
+	assert.True(t, errors.Is(locked.Open(), blockdb.ErrWrongKey))
+
+	unlocked := blockdb.New(path)
+	unlocked.Passphrase = passphrase
+	assert.Nil(t, unlocked.Open())
+	defer unlocked.Close()
+
+	assert.Equal(t, 5, unlocked.Len())
+	assert.Equal(t, head.Key, unlocked.GetLatestIndex().Key)
+	assert.Nil(t, unlocked.Verify())
+
+	block, err := unlocked.Get(0)
+	assert.Nil(t, err)
+	assert.Equal(t, "message 0", string(block.Value.Payload[0].Data))
+
+	// Pruned blocks are written encrypted
+	_, err = unlocked.Prune(blockdb.RetentionPolicy{KeepBlocks: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, unlocked.Verify())
+	assert.False(t, strings.Contains(readFile(t, path), "message"))
+
+}
+
+func TestEncryptExisting(t *testing.T) {
+
+	path := tempDB(t, db_path)
+
+	db := blockdb.New(path)
+	assert.Nil(t, db.Open())
+	blocks := db.Len()
+	head := db.GetLatestIndex()
+
+	assert.Nil(t, db.Encrypt(passphrase))
+	assert.Equal(t, blocks, db.Len())
+	assert.Nil(t, db.Verify())
+	assert.False(t, strings.Contains(readFile(t, path), "payload"))
+
+	// Plaintext DBs are refused if a passphrase is set
+	plain := blockdb.New(tempDB(t, db_path))
+	plain.Passphrase = passphrase
+	assert.True(t, errors.Is(plain.Open(), blockdb.ErrNotEncrypted))
+
+	// Snapshots of encrypted DBs are exported in plaintext for peers
+	mywallet := wallet.New()
+	assert.Nil(t, mywallet.GenerateWallet())
+
+	// Decrypted blocks are not written to a temporary file
+	tmp := t.TempDir()
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	buf := new(bytes.Buffer)
+
+	_, err := db.Snapshot(buf, &mywallet)
+	assert.Nil(t, err)
+	db.Close()
+
+	files, err := os.ReadDir(tmp)
+	assert.Nil(t, err)
+	assert.Empty(t, files)
+
+	restorePath := filepath.Join(t.TempDir(), "blockchain-db.json")
+
+	manifest, err := blockdb.RestoreSnapshot(buf, restorePath, mywallet.PublicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, head.Key, manifest.Head)
+	assert.Equal(t, blocks, manifest.Blocks)
+
+}
+
+func TestEncryptInterrupted(t *testing.T) {
+
+	path := tempDB(t, db_path)
+
+	db := blockdb.New(path)
+	assert.Nil(t, db.Open())
+	blocks := db.Len()
+	assert.Nil(t, db.Encrypt(passphrase))
+	db.Close()
+
+	// Interrupted after the manifest was written, the encrypted copy is beside the plaintext DB
+	encrypted := readFile(t, path)
+	assert.Nil(t, os.WriteFile(path+".encrypt", []byte(encrypted), 0644))
+	assert.Nil(t, os.WriteFile(path, []byte(readFile(t, db_path)), 0644))
+	assert.Nil(t, os.Remove(db.IndexFilename()))
+
+	resumed := blockdb.New(path)
+	resumed.Passphrase = passphrase
+	assert.Nil(t, resumed.Open())
+	defer resumed.Close()
+
+	assert.Equal(t, blocks, resumed.Len())
+	assert.Nil(t, resumed.Verify())
+	assert.Equal(t, encrypted, readFile(t, path))
+
+	_, err := os.Stat(path + ".encrypt")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+}
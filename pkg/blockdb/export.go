@@ -0,0 +1,442 @@
+package blockdb
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Export formats, JSON lines and CSV have one TX per line. Archives hold whole blocks and can be imported
+const (
+	FormatJSONLines = "jsonl"
+	FormatCSV       = "csv"
+	FormatArchive   = "archive"
+)
+
+// Archive header and version, followed by length prefixed blocks and a trailer with the block count and head
+const archiveMagic = "PERRYARC"
+const archiveVersion = 1
+
+var ErrArchiveFormat = errors.New("invalid archive")
+
+// Blocks read from an archive before they are verified and appended
+const importBatch = 256
+
+var csvColumns = []string{"seqid", "seqtime", "block_hash", "tx", "type", "flags", "sender", "recipient", "signature", "header", "output", "data", "data_hash", "pruned"}
+
+// A TX with the context of the block it was included in
+type ExportTx struct {
+	BlockHash []byte    `json:"block_hash"`
+	SeqID     uint64    `json:"seqid"`
+	SeqTime   time.Time `json:"seqtime"`
+	Tx        int       `json:"tx"`
+	TxPayload
+}
+
+type ExportResult struct {
+	Blocks int  `json:"blocks"`
+	Txs    int  `json:"txs"`
+	Head   Hash `json:"head"`
+}
+
+// Stream the chain to `w` in the specified format, one block is read from disk at a time
+func (blockdb *BlockDB) Export(w io.Writer, format string) (result ExportResult, err error) {
+
+	switch format {
+	case FormatJSONLines:
+		return blockdb.exportJSONLines(w)
+	case FormatCSV:
+		return blockdb.exportCSV(w)
+	case FormatArchive:
+		return blockdb.exportArchive(w)
+	}
+
+	return result, fmt.Errorf("Unknown export format %s, expected %s, %s or %s", format, FormatJSONLines, FormatCSV, FormatArchive)
+
+}
+
+func (blockdb *BlockDB) exportJSONLines(w io.Writer) (result ExportResult, err error) {
+
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+
+	err = blockdb.Iterate(0, blockdb.Len(), func(i int, block *BlockKV) error {
+
+		result.add(block)
+
+		for tx := range block.Value.Payload {
+			if err := encoder.Encode(ExportTx{BlockHash: block.Key[:], SeqID: block.Value.Header.SeqID, SeqTime: block.Value.Header.SeqTime, Tx: tx, TxPayload: block.Value.Payload[tx]}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+		return
+	}
+
+	return result, bw.Flush()
+
+}
+
+// Byte fields are base64 encoded
+func (blockdb *BlockDB) exportCSV(w io.Writer) (result ExportResult, err error) {
+
+	cw := csv.NewWriter(w)
+
+	if err = cw.Write(csvColumns); err != nil {
+		return
+	}
+
+	encode := base64.StdEncoding.EncodeToString
+
+	err = blockdb.Iterate(0, blockdb.Len(), func(i int, block *BlockKV) error {
+
+		result.add(block)
+
+		for tx, payload := range block.Value.Payload {
+
+			record := []string{
+				strconv.FormatUint(block.Value.Header.SeqID, 10),
+				block.Value.Header.SeqTime.Format(time.RFC3339Nano),
+				encode(block.Key[:]),
+				strconv.Itoa(tx),
+				strconv.Itoa(int(payload.Type)),
+				strconv.Itoa(int(payload.Reserved)),
+				encode(payload.Sender),
+				encode(payload.Recipient),
+				encode(payload.Signature),
+				encode(payload.Header),
+				encode(payload.Output),
+				encode(payload.Data),
+				encode(payload.DataHash),
+				strconv.FormatBool(payload.Pruned),
+			}
+
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+		return
+	}
+
+	cw.Flush()
+
+	return result, cw.Error()
+
+}
+
+// Gzipped stream of blocks, each prefixed with the uvarint length of the encoded block
+func (blockdb *BlockDB) exportArchive(w io.Writer) (result ExportResult, err error) {
+
+	gz := gzip.NewWriter(w)
+	bw := bufio.NewWriter(gz)
+
+	if err = writeArchiveHeader(bw, blockdb.ChainID); err != nil {
+		return
+	}
+
+	err = blockdb.Iterate(0, blockdb.Len(), func(i int, block *BlockKV) error {
+
+		result.add(block)
+
+		data, err := json.Marshal(block)
+
+		if err != nil {
+			return err
+		}
+
+		return writeArchiveRecord(bw, data)
+
+	})
+
+	if err != nil {
+		return
+	}
+
+	// A zero length record ends the blocks, followed by the count and head to detect truncated archives
+	if err = writeArchiveRecord(bw, nil); err != nil {
+		return
+	}
+
+	if err = writeArchiveRecord(bw, []byte(strconv.Itoa(result.Blocks))); err != nil {
+		return
+	}
+
+	if _, err = bw.Write(result.Head[:]); err != nil {
+		return
+	}
+
+	if err = bw.Flush(); err != nil {
+		return
+	}
+
+	err = gz.Close()
+
+	log.Info(fmt.Sprintf("Export => (%d) blocks, (%d) TX's", result.Blocks, result.Txs))
+
+	return
+
+}
+
+// Replay an archive into the empty DB, each block is verified against its parent and its TX signatures
+// checked before it is appended. On failure the partially imported DB is removed
+func (blockdb *BlockDB) Import(r io.Reader) (result ExportResult, err error) {
+
+	if blockdb.File == nil {
+		if err = blockdb.Open(); err != nil {
+			return
+		}
+	}
+
+	if blockdb.Len() > 0 {
+		return result, fmt.Errorf("BlockDB %s is not empty, refusing to import", blockdb.Filename)
+	}
+
+	defer func() {
+		if err != nil {
+			blockdb.Close()
+			os.Remove(blockdb.Filename)
+			os.Remove(blockdb.IndexFilename())
+			os.Remove(blockdb.ManifestFilename())
+		}
+	}()
+
+	gz, err := gzip.NewReader(r)
+
+	if err != nil {
+		return result, fmt.Errorf("%w: %s", ErrArchiveFormat, err)
+	}
+
+	br := bufio.NewReader(gz)
+
+	// Accept blocks written before the limit was lowered, as when scanning the DB
+	maxRecord := DefaultMaxBlockSize
+
+	if blockdb.MaxBlockSize > maxRecord {
+		maxRecord = blockdb.MaxBlockSize
+	}
+
+	chainID, err := readArchiveHeader(br, maxRecord)
+
+	if err != nil {
+		return
+	}
+
+	if chainID != blockdb.ChainID {
+		return result, fmt.Errorf("%w: archive chain ID %s, expected %s", ErrIncompatible, chainID, blockdb.ChainID)
+	}
+
+	var parent *BlockKV
+	var blocks []BlockKV
+	var records [][]byte
+
+	for {
+
+		data, readErr := readArchiveRecord(br, maxRecord)
+
+		if readErr != nil {
+			return result, readErr
+		}
+
+		if len(data) > 0 {
+
+			var block BlockKV
+
+			if err = json.Unmarshal(data, &block); err != nil {
+				return result, &VerifyError{Index: result.Blocks + len(blocks), Err: err}
+			}
+
+			blocks = append(blocks, block)
+			records = append(records, data)
+
+		}
+
+		// Blocks are verified a batch at a time, as blocks synced from a peer are
+		if len(blocks) == importBatch || (len(data) == 0 && len(blocks) > 0) {
+
+			if err = blockdb.importBlocks(parent, blocks, records, result.Blocks); err != nil {
+				return
+			}
+
+			for i := range blocks {
+				result.add(&blocks[i])
+			}
+
+			parent = &blocks[len(blocks)-1]
+			blocks, records = nil, nil
+
+		}
+
+		if len(data) == 0 {
+			break
+		}
+
+	}
+
+	// Confirm the archive was not truncated
+	count, err := readArchiveRecord(br, maxRecord)
+
+	if err != nil {
+		return
+	}
+
+	var head Hash
+
+	if _, err = io.ReadFull(br, head[:]); err != nil {
+		return result, fmt.Errorf("%w: %s", ErrArchiveFormat, err)
+	}
+
+	if string(count) != strconv.Itoa(result.Blocks) || head != result.Head {
+		return result, fmt.Errorf("%w: imported (%d) blocks, archive has (%s)", ErrArchiveFormat, result.Blocks, count)
+	}
+
+	log.Info(fmt.Sprintf("Import => (%d) blocks, (%d) TX's", result.Blocks, result.Txs))
+
+	return
+
+}
+
+// Verify a batch of blocks following `parent`, the first block of the chain if nil, then append them.
+// `offset` is the index of the first block in the archive
+func (blockdb *BlockDB) importBlocks(parent *BlockKV, blocks []BlockKV, records [][]byte, offset int) error {
+
+	var parentHash Hash
+	var parentSeqID uint64
+
+	if parent != nil {
+		parentHash = parent.Key
+		parentSeqID = parent.Value.Header.SeqID
+	}
+
+	err := checkBlock(&blocks[0], parentHash, parentSeqID)
+
+	if err == nil {
+		err = checkLegacy(&blocks[0], parent)
+	}
+
+	if err != nil {
+		return &VerifyError{Index: offset, SeqID: blocks[0].Value.Header.SeqID, Hash: blocks[0].Key, Err: err}
+	}
+
+	if err = VerifyBlocks(blocks, runtime.NumCPU()); err != nil {
+
+		var verr *VerifyError
+
+		if errors.As(err, &verr) {
+			verr.Index += offset
+		}
+
+		return err
+
+	}
+
+	for _, data := range records {
+		if err = blockdb.Append(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func (result *ExportResult) add(block *BlockKV) {
+
+	result.Blocks++
+	result.Txs += len(block.Value.Payload)
+	result.Head = block.Key
+
+}
+
+func writeArchiveHeader(w io.Writer, chainID string) (err error) {
+
+	if _, err = io.WriteString(w, archiveMagic); err != nil {
+		return
+	}
+
+	if _, err = w.Write([]byte{archiveVersion}); err != nil {
+		return
+	}
+
+	return writeArchiveRecord(w, []byte(chainID))
+
+}
+
+func readArchiveHeader(r *bufio.Reader, maxRecord int) (chainID string, err error) {
+
+	header := make([]byte, len(archiveMagic)+1)
+
+	if _, err = io.ReadFull(r, header); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrArchiveFormat, err)
+	}
+
+	if string(header[:len(archiveMagic)]) != archiveMagic || header[len(archiveMagic)] != archiveVersion {
+		return "", fmt.Errorf("%w: unsupported archive version or format", ErrArchiveFormat)
+	}
+
+	data, err := readArchiveRecord(r, maxRecord)
+
+	return string(data), err
+
+}
+
+func writeArchiveRecord(w io.Writer, data []byte) (err error) {
+
+	length := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(length, uint64(len(data)))
+
+	if _, err = w.Write(length[:n]); err != nil {
+		return
+	}
+
+	_, err = w.Write(data)
+
+	return
+
+}
+
+// Records are bounded by the largest block, so a corrupt length can't exhaust memory
+func readArchiveRecord(r *bufio.Reader, maxRecord int) (data []byte, err error) {
+
+	length, err := binary.ReadUvarint(r)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrArchiveFormat, err)
+	}
+
+	if length > uint64(maxRecord) {
+		return nil, fmt.Errorf("%w: record of %d bytes exceeds %d", ErrArchiveFormat, length, maxRecord)
+	}
+
+	data = make([]byte, length)
+
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrArchiveFormat, err)
+	}
+
+	return
+
+}
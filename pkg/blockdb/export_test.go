@@ -0,0 +1,154 @@
+package blockdb_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportFormats(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	buf := new(bytes.Buffer)
+
+	result, err := db.Export(buf, blockdb.FormatJSONLines)
+	assert.Nil(t, err)
+	assert.Equal(t, db.Len(), result.Blocks)
+
+	// One TX per line, with the block context
+	scanner := bufio.NewScanner(buf)
+	lines := 0
+
+	for scanner.Scan() {
+
+		var tx blockdb.ExportTx
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &tx))
+		assert.Len(t, tx.BlockHash, 32)
+		lines++
+
+	}
+
+	assert.Equal(t, result.Txs, lines)
+
+	buf.Reset()
+
+	_, err = db.Export(buf, blockdb.FormatCSV)
+	assert.Nil(t, err)
+
+	records, err := csv.NewReader(buf).ReadAll()
+	assert.Nil(t, err)
+	assert.Equal(t, result.Txs+1, len(records))
+	assert.Equal(t, "seqid", records[0][0])
+
+	// TX flags are exported, so sealed and plaintext TX's can be told apart
+	assert.Equal(t, "flags", records[0][5])
+	assert.Equal(t, "0", records[1][5])
+
+	_, err = db.Export(buf, "xml")
+	assert.NotNil(t, err)
+
+}
+
+func TestExportImportArchive(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	buf := new(bytes.Buffer)
+
+	exported, err := db.Export(buf, blockdb.FormatArchive)
+	assert.Nil(t, err)
+
+	newdb := blockdb.New(filepath.Join(t.TempDir(), "blockchain-db.json"))
+
+	imported, err := newdb.Import(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, exported, imported)
+	assert.Equal(t, db.Len(), newdb.Len())
+	assert.Nil(t, newdb.Verify())
+
+	// Importing into a DB with blocks is refused
+	_, err = newdb.Import(bytes.NewReader(buf.Bytes()))
+	assert.NotNil(t, err)
+	newdb.Close()
+
+	// A truncated archive is rejected and the partial DB removed
+	truncated := archiveBlocks(t, buf.Bytes())
+	truncated = truncated[:len(truncated)/2]
+
+	path := filepath.Join(t.TempDir(), "blockchain-db.json")
+	partial := blockdb.New(path)
+
+	_, err = partial.Import(gzipBytes(t, truncated))
+	assert.True(t, errors.Is(err, blockdb.ErrArchiveFormat))
+	assert.NoFileExists(t, path)
+
+}
+
+func archiveBlocks(t *testing.T, archive []byte) []byte {
+
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	assert.Nil(t, err)
+
+	data, err := io.ReadAll(gz)
+	assert.Nil(t, err)
+
+	return data
+
+}
+
+func gzipBytes(t *testing.T, data []byte) io.Reader {
+
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+
+	_, err := gz.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, gz.Close())
+
+	return buf
+
+}
+
+// Imported blocks are verified as synced blocks are, TX's in blocks with a TX root must be signed
+func TestImportUnsigned(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	legacy := db.Len()
+	appendMerkleBlocks(t, &db, 2, time.Now())
+
+	buf := new(bytes.Buffer)
+
+	_, err := db.Export(buf, blockdb.FormatArchive)
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "blockchain-db.json")
+
+	imported := blockdb.New(path)
+
+	_, err = imported.Import(buf)
+	assert.ErrorIs(t, err, blockdb.ErrTxSignature)
+
+	var verr *blockdb.VerifyError
+	assert.True(t, errors.As(err, &verr))
+	assert.Equal(t, legacy, verr.Index)
+	assert.NoFileExists(t, path)
+
+}
@@ -0,0 +1,198 @@
+package blockdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errVerifyAbort = errors.New("verification aborted")
+
+// Fixed size index record, stored in the index file alongside the blockchain DB
+type indexRecord struct {
+	Key     Hash
+	Parent  Hash
+	SeqID   uint64
+	SeqTime int64
+	Offset  int64
+	Length  uint32
+}
+
+// Filename of the block index for the DB
+func (blockdb *BlockDB) IndexFilename() string {
+
+	return fmt.Sprintf("%s.idx", blockdb.Filename)
+
+}
+
+// Load the saved index, dropping any records that are stale or no longer match the DB file
+func (blockdb *BlockDB) loadIndex() (err error) {
+
+	f, err := os.OpenFile(blockdb.IndexFilename(), os.O_RDWR|os.O_CREATE, 0755)
+
+	if err != nil {
+		return err
+	}
+
+	blockdb.indexFile = f
+
+	reader := bufio.NewReader(f)
+	recordSize := blockdb.crypt.recordSize()
+
+	var end int64
+	var records int
+
+	for {
+
+		data := make([]byte, recordSize)
+
+		if _, err = io.ReadFull(reader, data); err != nil {
+			break
+		}
+
+		record, recordErr := blockdb.crypt.openRecord(data)
+
+		if recordErr != nil {
+			log.Warn("Block index ", blockdb.IndexFilename(), " could not be decrypted, rebuilding")
+			blockdb.resetIndex()
+			break
+		}
+
+		records++
+
+		entry := BlockIndex{
+			Key:    record.Key,
+			Header: BlockHeader{Parent: record.Parent, SeqID: record.SeqID, SeqTime: time.Unix(0, record.SeqTime)},
+			Offset: record.Offset,
+			Length: int(record.Length),
+		}
+
+		// Stop at the first record that is out of order or past the end of the DB file
+		if entry.Offset < end || entry.Offset+int64(entry.Length) > blockdb.size {
+			break
+		}
+
+		end = entry.Offset + int64(entry.Length) + 1
+		blockdb.addIndex(entry)
+
+	}
+
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	// Confirm the last indexed block matches the DB, otherwise rebuild the index from the start
+	if len(blockdb.Index) > 0 && !blockdb.indexMatches(blockdb.Index[len(blockdb.Index)-1]) {
+		log.Warn("Block index does not match ", blockdb.Filename, ", rebuilding")
+		blockdb.resetIndex()
+	}
+
+	// Only rewrite the index file if records were dropped, or a partial record was written
+	stat, err := f.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	if records == len(blockdb.Index) && stat.Size() == int64(records*recordSize) {
+		_, err = f.Seek(0, io.SeekEnd)
+		return err
+	}
+
+	return blockdb.saveIndex()
+
+}
+
+// Confirm the block at the indexed offset has the same hash
+func (blockdb *BlockDB) indexMatches(entry BlockIndex) bool {
+
+	data := make([]byte, entry.Length)
+
+	if _, err := blockdb.File.ReadAt(data, entry.Offset); err != nil {
+		return false
+	}
+
+	data, err := blockdb.crypt.openBlock(data)
+
+	if err != nil {
+		return false
+	}
+
+	var header blockHeaderKV
+
+	if err := json.Unmarshal(data, &header); err != nil {
+		return false
+	}
+
+	return header.Key == entry.Key && header.Value.Header.SeqID == entry.Header.SeqID
+
+}
+
+// Rewrite the index file with the loaded index
+func (blockdb *BlockDB) saveIndex() (err error) {
+
+	if err = blockdb.indexFile.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err = blockdb.indexFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+
+	for _, entry := range blockdb.Index {
+		buf.Write(blockdb.crypt.sealRecord(newIndexRecord(entry)))
+	}
+
+	_, err = blockdb.indexFile.Write(buf.Bytes())
+
+	return
+
+}
+
+// Append an entry to the index in memory and on disk, lock must be held
+func (blockdb *BlockDB) appendIndex(entry BlockIndex) (err error) {
+
+	blockdb.addIndex(entry)
+
+	if blockdb.indexFile == nil {
+		return
+	}
+
+	_, err = blockdb.indexFile.Write(blockdb.crypt.sealRecord(newIndexRecord(entry)))
+
+	return
+
+}
+
+func newIndexRecord(entry BlockIndex) indexRecord {
+
+	return indexRecord{
+		Key:     entry.Key,
+		Parent:  entry.Header.Parent,
+		SeqID:   entry.Header.SeqID,
+		SeqTime: entry.Header.SeqTime.UnixNano(),
+		Offset:  entry.Offset,
+		Length:  uint32(entry.Length),
+	}
+
+}
+
+// Encode the record as stored in a plaintext index
+func (record indexRecord) bytes() []byte {
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, record)
+
+	return buf.Bytes()
+
+}
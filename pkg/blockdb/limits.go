@@ -0,0 +1,94 @@
+package blockdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Confirm an encoded block is within the configured size and transaction limits
+func (blockdb *BlockDB) CheckBlockSize(block []byte, txCount int) (err error) {
+
+	if blockdb.MaxBlockSize > 0 && len(block) > blockdb.MaxBlockSize {
+		return fmt.Errorf("%w (%d > %d bytes)", ErrBlockTooLarge, len(block), blockdb.MaxBlockSize)
+	}
+
+	if blockdb.MaxBlockTx > 0 && txCount > blockdb.MaxBlockTx {
+		return fmt.Errorf("%w (%d > %d)", ErrBlockTooManyTx, txCount, blockdb.MaxBlockTx)
+	}
+
+	return
+
+}
+
+// Confirm a TX fits in a block on its own, larger TX's could never be written to the chain
+func (blockdb *BlockDB) CheckTxSize(tx TxPayload) (err error) {
+
+	if blockdb.BlockFits([]TxPayload{tx}) == 0 {
+		return fmt.Errorf("%w (max block size %d bytes)", ErrTxTooLarge, blockdb.MaxBlockSize)
+	}
+
+	return
+
+}
+
+// Return how many leading transactions from `payload` fit in a single block
+func (blockdb *BlockDB) BlockFits(payload []TxPayload) (n int) {
+
+	limit := len(payload)
+
+	if blockdb.MaxBlockTx > 0 && limit > blockdb.MaxBlockTx {
+		limit = blockdb.MaxBlockTx
+	}
+
+	if blockdb.MaxBlockSize <= 0 {
+		return limit
+	}
+
+	size := blockOverhead()
+
+	for n = 0; n < limit; n++ {
+
+		tx, err := json.Marshal(payload[n])
+
+		if err != nil {
+			return
+		}
+
+		// Each transaction after the first is comma seperated
+		size += len(tx)
+
+		if n > 0 {
+			size++
+		}
+
+		if size > blockdb.MaxBlockSize {
+			return
+		}
+
+	}
+
+	return
+
+}
+
+// Upper bound for the encoded size of a block with an empty payload
+func blockOverhead() int {
+
+	var maxHash Hash
+
+	for i := range maxHash {
+		maxHash[i] = math.MaxUint8
+	}
+
+	block := BlockKV{Key: maxHash}
+	block.Value.Header.Parent = maxHash
+	block.Value.Header.SeqID = math.MaxUint64
+	block.Value.Payload = []TxPayload{}
+
+	data, _ := json.Marshal(block)
+
+	// Allow for nanoseconds and a time zone offset in SeqTime
+	return len(data) + len(".000000000-00:00")
+
+}
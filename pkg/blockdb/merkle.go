@@ -0,0 +1,124 @@
+package blockdb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+)
+
+// Prefixes of the leaf and interior node hashes, so a leaf can't be taken for an interior node
+const (
+	merkleLeaf     = 0x00
+	merkleInterior = 0x01
+)
+
+// Leaf hash for a TX, the TX headers plus a hash of the data. Pruned TX's keep the data hash so
+// the leaf can be computed without the data
+func TxLeaf(tx TxPayload) (leaf Hash, err error) {
+
+	dataHash := tx.DataHash
+
+	if !tx.Pruned {
+		sum := sha256.Sum256(tx.Data)
+		dataHash = sum[:]
+	}
+
+	tx.Data = nil
+	tx.DataHash = nil
+	tx.Pruned = false
+
+	header, err := json.Marshal(tx)
+
+	if err != nil {
+		return
+	}
+
+	h := sha256.New()
+	h.Write([]byte{merkleLeaf})
+	h.Write(header)
+	h.Write(dataHash)
+
+	copy(leaf[:], h.Sum(nil))
+
+	return
+
+}
+
+// Merkle root of the TX leaves. An odd node is promoted to the next level unchanged, pairing it with
+// itself would give the TX's [a, b, c] and [a, b, c, c] the same root
+func TxRoot(payload []TxPayload) (root Hash, err error) {
+
+	if len(payload) == 0 {
+		return sha256.Sum256(nil), nil
+	}
+
+	level := make([]Hash, len(payload))
+
+	for i := range payload {
+		if level[i], err = TxLeaf(payload[i]); err != nil {
+			return
+		}
+	}
+
+	for len(level) > 1 {
+
+		next := make([]Hash, 0, (len(level)+1)/2)
+
+		for i := 0; i < len(level); i += 2 {
+
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				break
+			}
+
+			node := append([]byte{merkleInterior}, level[i][:]...)
+			next = append(next, sha256.Sum256(append(node, level[i+1][:]...)))
+
+		}
+
+		level = next
+
+	}
+
+	return level[0], nil
+
+}
+
+// Hash of a block with a TxRoot header, committing to the parent, SeqID, SeqTime and TX root
+func BlockHash(header BlockHeader) Hash {
+
+	var root Hash
+
+	if header.TxRoot != nil {
+		root = *header.TxRoot
+	}
+
+	seq := make([]byte, 16)
+	binary.BigEndian.PutUint64(seq[:8], header.SeqID)
+	binary.BigEndian.PutUint64(seq[8:], uint64(header.SeqTime.UnixNano()))
+
+	h := sha256.New()
+	h.Write(header.Parent[:])
+	h.Write(seq)
+	h.Write(root[:])
+
+	var hash Hash
+	copy(hash[:], h.Sum(nil))
+
+	return hash
+
+}
+
+// Drop the TX data, keeping the headers and a hash of the data for the Merkle commitment
+func PruneTx(tx *TxPayload) {
+
+	if tx.Pruned {
+		return
+	}
+
+	sum := sha256.Sum256(tx.Data)
+	tx.DataHash = sum[:]
+	tx.Data = nil
+	tx.Pruned = true
+
+}
@@ -0,0 +1,235 @@
+package blockdb
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/tidwall/btree"
+)
+
+// Page size of query results
+const DefaultQueryLimit = 100
+const MaxQueryLimit = 1000
+
+var ErrBlockNotFound = errors.New("block not found")
+
+// Options for block queries, results are returned in pages of `Limit` blocks
+type Query struct {
+	Payload bool   `json:"payload"`
+	Limit   int    `json:"limit"`
+	Cursor  uint64 `json:"cursor"`
+}
+
+// A page of query results, pass Next as the cursor to fetch the next page. Next is the SeqID of the first
+// block of the next page, so cursors stay valid as the DB is rewritten, and 0 on the last page
+type QueryResult struct {
+	Blocks []QueryBlock `json:"blocks"`
+	Next   uint64       `json:"next"`
+}
+
+// Header of a block, with the payload if requested
+type QueryBlock struct {
+	Key     Hash        `json:"hash"`
+	Header  BlockHeader `json:"header"`
+	Payload []TxPayload `json:"payload,omitempty"`
+}
+
+// Entry in the time index, ordered by SeqTime then position in the chain
+type timeKey struct {
+	seqTime int64
+	pos     int
+}
+
+func timeLess(a, b interface{}) bool {
+
+	ka, kb := a.(timeKey), b.(timeKey)
+
+	if ka.seqTime != kb.seqTime {
+		return ka.seqTime < kb.seqTime
+	}
+
+	return ka.pos < kb.pos
+
+}
+
+// Clear the index in memory, lock must be held
+func (blockdb *BlockDB) resetIndex() {
+
+	blockdb.Index = nil
+	blockdb.byHash = make(map[Hash]int)
+	blockdb.byTime = btree.New(timeLess)
+
+}
+
+// Add an entry to the index in memory, with the hash and time lookups. Lock must be held
+func (blockdb *BlockDB) addIndex(entry BlockIndex) {
+
+	if blockdb.byHash == nil {
+		blockdb.resetIndex()
+	}
+
+	pos := len(blockdb.Index)
+
+	blockdb.Index = append(blockdb.Index, entry)
+	blockdb.byHash[entry.Key] = pos
+	blockdb.byTime.Set(timeKey{seqTime: entry.Header.SeqTime.UnixNano(), pos: pos})
+
+}
+
+// Return the block with the specified hash
+func (blockdb *BlockDB) BlockByHash(key Hash, payload bool) (block QueryBlock, err error) {
+
+	blockdb.Mu.RLock()
+	pos, ok := blockdb.byHash[key]
+
+	var entry BlockIndex
+
+	if ok {
+		entry = blockdb.Index[pos]
+	}
+
+	blockdb.Mu.RUnlock()
+
+	if !ok {
+		return block, ErrBlockNotFound
+	}
+
+	blocks, err := blockdb.queryBlocks([]BlockIndex{entry}, payload)
+
+	if err != nil {
+		return
+	}
+
+	return blocks[0], nil
+
+}
+
+// Return the blocks with SeqID between `from` and `to` inclusive, in chain order
+func (blockdb *BlockDB) BlocksBySeqID(from, to uint64, query Query) (result QueryResult, err error) {
+
+	limit := query.limit()
+
+	if query.Cursor > from {
+		from = query.Cursor
+	}
+
+	blockdb.Mu.RLock()
+
+	// SeqIDs increase along the chain
+	start := sort.Search(len(blockdb.Index), func(i int) bool { return blockdb.Index[i].Header.SeqID >= from })
+
+	var entries []BlockIndex
+
+	for pos := start; pos < len(blockdb.Index) && blockdb.Index[pos].Header.SeqID <= to; pos++ {
+
+		if len(entries) == limit {
+			result.Next = blockdb.Index[pos].Header.SeqID
+			break
+		}
+
+		entries = append(entries, blockdb.Index[pos])
+
+	}
+
+	blockdb.Mu.RUnlock()
+
+	result.Blocks, err = blockdb.queryBlocks(entries, query.Payload)
+
+	return
+
+}
+
+// Return the blocks with SeqTime in the window [start, end), ordered by SeqTime
+func (blockdb *BlockDB) BlocksByTime(start, end time.Time, query Query) (result QueryResult, err error) {
+
+	limit := query.limit()
+
+	blockdb.Mu.RLock()
+
+	pivot := timeKey{seqTime: start.UnixNano()}
+
+	// Resume from the block with the cursor SeqID, wherever it is in the index now
+	if query.Cursor > 0 {
+
+		pos := sort.Search(len(blockdb.Index), func(i int) bool { return blockdb.Index[i].Header.SeqID >= query.Cursor })
+
+		if pos < len(blockdb.Index) {
+			pivot = timeKey{seqTime: blockdb.Index[pos].Header.SeqTime.UnixNano(), pos: pos}
+		}
+
+	}
+
+	var entries []BlockIndex
+
+	if blockdb.byTime != nil {
+
+		blockdb.byTime.Ascend(pivot, func(item interface{}) bool {
+
+			key := item.(timeKey)
+
+			if key.seqTime >= end.UnixNano() {
+				return false
+			}
+
+			if len(entries) == limit {
+				result.Next = blockdb.Index[key.pos].Header.SeqID
+				return false
+			}
+
+			entries = append(entries, blockdb.Index[key.pos])
+
+			return true
+
+		})
+
+	}
+
+	blockdb.Mu.RUnlock()
+
+	result.Blocks, err = blockdb.queryBlocks(entries, query.Payload)
+
+	return
+
+}
+
+// Headers are returned from the index entries captured by the query, payloads are read from disk through
+// the cache. Blocks are found again by hash, so the chain can be rewritten between the two
+func (blockdb *BlockDB) queryBlocks(entries []BlockIndex, payload bool) (blocks []QueryBlock, err error) {
+
+	blocks = make([]QueryBlock, 0, len(entries))
+
+	for _, entry := range entries {
+
+		if !payload {
+			blocks = append(blocks, QueryBlock{Key: entry.Key, Header: entry.Header})
+			continue
+		}
+
+		block, err := blockdb.getByHash(entry.Key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, QueryBlock{Key: block.Key, Header: block.Value.Header, Payload: block.Value.Payload})
+
+	}
+
+	return
+
+}
+
+func (query Query) limit() int {
+
+	if query.Limit <= 0 {
+		return DefaultQueryLimit
+	}
+
+	if query.Limit > MaxQueryLimit {
+		return MaxQueryLimit
+	}
+
+	return query.Limit
+
+}
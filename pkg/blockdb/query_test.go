@@ -0,0 +1,168 @@
+package blockdb_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlocksBySeqID(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	first := db.GetLatestIndex().Header.SeqID - uint64(db.Len()) + 1
+
+	// Page through the range, headers only
+	var seqIDs []uint64
+	query := blockdb.Query{Limit: 7}
+
+	for {
+
+		result, err := db.BlocksBySeqID(first+5, first+24, query)
+		assert.Nil(t, err)
+
+		for _, block := range result.Blocks {
+			assert.Nil(t, block.Payload)
+			seqIDs = append(seqIDs, block.Header.SeqID)
+		}
+
+		if result.Next == 0 {
+			break
+		}
+
+		query.Cursor = result.Next
+
+	}
+
+	assert.Len(t, seqIDs, 20)
+	assert.Equal(t, first+5, seqIDs[0])
+	assert.Equal(t, first+24, seqIDs[19])
+
+	// Payloads are read from disk
+	result, err := db.BlocksBySeqID(first, first, blockdb.Query{Payload: true})
+	assert.Nil(t, err)
+	assert.Len(t, result.Blocks, 1)
+	assert.NotEmpty(t, result.Blocks[0].Payload)
+	assert.Zero(t, result.Next)
+
+	result, err = db.BlocksBySeqID(math.MaxUint64-1, math.MaxUint64, blockdb.Query{})
+	assert.Nil(t, err)
+	assert.Empty(t, result.Blocks)
+
+}
+
+func TestBlocksByTime(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	legacy := db.Len()
+	window := time.Now().Add(-time.Hour)
+
+	appendMerkleBlocks(t, &db, 3, window.Add(-time.Minute))
+	appendMerkleBlocks(t, &db, 5, window.Add(time.Minute))
+	appendMerkleBlocks(t, &db, 2, window.Add(2*time.Hour))
+
+	var blocks []blockdb.QueryBlock
+	query := blockdb.Query{Limit: 2, Payload: true}
+
+	for {
+
+		result, err := db.BlocksByTime(window, window.Add(time.Hour), query)
+		assert.Nil(t, err)
+
+		blocks = append(blocks, result.Blocks...)
+
+		if result.Next == 0 {
+			break
+		}
+
+		query.Cursor = result.Next
+
+	}
+
+	assert.Len(t, blocks, 5)
+
+	for i, block := range blocks {
+		expected, err := db.Get(legacy + 3 + i)
+		assert.Nil(t, err)
+		assert.Equal(t, expected.Key, block.Key)
+		assert.NotEmpty(t, block.Payload)
+	}
+
+}
+
+func TestBlockByHash(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	expected, err := db.Get(10)
+	assert.Nil(t, err)
+
+	block, err := db.BlockByHash(expected.Key, true)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.Value.Header.SeqID, block.Header.SeqID)
+	assert.Equal(t, expected.Value.Payload, block.Payload)
+
+	_, err = db.BlockByHash(blockdb.Hash{}, false)
+	assert.True(t, errors.Is(err, blockdb.ErrBlockNotFound))
+
+}
+
+func TestQueryDuringRepair(t *testing.T) {
+
+	path := tempDB(t, db_path)
+
+	db := blockdb.New(path)
+	db.CacheSize = 0
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	first := db.GetLatestIndex().Header.SeqID - uint64(db.Len()) + 1
+
+	// Page to the middle of the chain before it is truncated
+	page, err := db.BlocksBySeqID(0, math.MaxUint64, blockdb.Query{Limit: 40})
+	assert.Nil(t, err)
+	assert.Equal(t, first+40, page.Next)
+
+	done := make(chan bool)
+
+	// Queries while the index shrinks fail or return fewer blocks, but never read past the index
+	go func() {
+
+		defer close(done)
+
+		for i := 0; i < 200; i++ {
+			db.BlocksBySeqID(0, math.MaxUint64, blockdb.Query{Limit: blockdb.MaxQueryLimit, Payload: i%2 == 0})
+			db.BlocksByTime(time.Unix(0, 0), time.Now(), blockdb.Query{Limit: blockdb.MaxQueryLimit, Payload: i%2 == 1})
+		}
+
+	}()
+
+	tamper(t, path, 30, func(block *blockdb.BlockKV) { block.Value.Header.Parent[0] ^= 0xff })
+
+	_, err = db.Repair()
+	assert.Nil(t, err)
+
+	<-done
+
+	// Cursors are SeqIDs, past the end of the truncated chain the page is empty
+	result, err := db.BlocksBySeqID(0, math.MaxUint64, blockdb.Query{Cursor: page.Next})
+	assert.Nil(t, err)
+	assert.Empty(t, result.Blocks)
+
+	result, err = db.BlocksBySeqID(0, math.MaxUint64, blockdb.Query{Cursor: first + 20})
+	assert.Nil(t, err)
+	assert.Len(t, result.Blocks, 10)
+	assert.Equal(t, first+20, result.Blocks[0].Header.SeqID)
+
+}
@@ -0,0 +1,297 @@
+package blockdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of latest blocks listed one by one in a locator, before the step doubles
+const locatorDense = 10
+
+var (
+	ErrAncestorNotFound = errors.New("common ancestor is not in the chain")
+	ErrForkChoice       = errors.New("branch is not heavier than the local chain")
+	ErrReorgDepth       = errors.New("reorganisation is deeper than allowed")
+)
+
+type ReorgResult struct {
+	Ancestor      Hash   `json:"ancestor"`
+	AncestorSeqID uint64 `json:"ancestor_seqid"`
+	OldHead       Hash   `json:"old_head"`
+	OldSeqID      uint64 `json:"old_seqid"`
+	NewHead       Hash   `json:"new_head"`
+	NewSeqID      uint64 `json:"new_seqid"`
+	Orphaned      int    `json:"orphaned"`
+	Applied       int    `json:"applied"`
+	OrphanFile    string `json:"orphan_file"`
+
+	// Blocks rolled back, so their TX's can be queued again
+	OrphanedBlocks []BlockKV `json:"-"`
+}
+
+// Fork choice rule, true if the chain ending at `head` is heavier than the chain ending at `local`.
+// Weight is only the chain length: blocks carry no PoH tick count or validator signatures, so the higher
+// SeqID is heavier, and ties go to the lower head hash so every node picks the same branch. The SeqID is
+// not proof of any work, any node can claim a longer chain, so it only decides between chains of trusted
+// nodes
+func Heavier(head, local BlockIndex) bool {
+
+	if head.Header.SeqID != local.Header.SeqID {
+		return head.Header.SeqID > local.Header.SeqID
+	}
+
+	return bytes.Compare(head.Key[:], local.Key[:]) < 0
+
+}
+
+// Hashes of blocks from the latest back to the first, dense at the head then doubling the step, so a
+// peer can find the latest block both chains share in a single request
+func (blockdb *BlockDB) Locator() (locator []Hash) {
+
+	blockdb.Mu.RLock()
+	defer blockdb.Mu.RUnlock()
+
+	step := 1
+
+	for pos := len(blockdb.Index) - 1; pos >= 0; pos -= step {
+
+		locator = append(locator, blockdb.Index[pos].Key)
+
+		if len(locator) >= locatorDense {
+			step *= 2
+		}
+
+		// Always end with the first block
+		if pos > 0 && pos-step < 0 {
+			locator = append(locator, blockdb.Index[0].Key)
+			break
+		}
+
+	}
+
+	return
+
+}
+
+// Return the first block of the locator in the chain, the latest block shared with the peer
+func (blockdb *BlockDB) FindAncestor(locator []Hash) (entry BlockIndex, ok bool) {
+
+	blockdb.Mu.RLock()
+	defer blockdb.Mu.RUnlock()
+
+	for _, key := range locator {
+		if pos, found := blockdb.byHash[key]; found {
+			return blockdb.Index[pos], true
+		}
+	}
+
+	return
+
+}
+
+// Roll back to the `ancestor` and apply the `branch` that follows it, if the branch is heavier than the
+// local chain and no more than `maxDepth` blocks are rolled back (0 for no limit). The zero hash rolls back
+// every block. The chain is rewritten to a new file that replaces the DB in one rename, and the orphaned
+// blocks are kept in a separate file
+func (blockdb *BlockDB) Reorg(ancestor Hash, branch []BlockKV, maxDepth int) (result ReorgResult, err error) {
+
+	if len(branch) == 0 {
+		return result, ErrForkChoice
+	}
+
+	blockdb.Mu.Lock()
+	defer blockdb.Mu.Unlock()
+
+	if blockdb.File == nil {
+		return result, errors.New("BlockDB is not open")
+	}
+
+	// Position of the first block rolled back
+	cut := 0
+
+	if ancestor != (Hash{}) {
+
+		pos, ok := blockdb.byHash[ancestor]
+
+		if !ok {
+			return result, ErrAncestorNotFound
+		}
+
+		cut = pos + 1
+		result.AncestorSeqID = blockdb.Index[pos].Header.SeqID
+
+	}
+
+	result.Ancestor = ancestor
+	result.Orphaned = len(blockdb.Index) - cut
+	result.Applied = len(branch)
+
+	if n := len(blockdb.Index); n > 0 {
+		result.OldHead = blockdb.Index[n-1].Key
+		result.OldSeqID = blockdb.Index[n-1].Header.SeqID
+	}
+
+	tip := branch[len(branch)-1]
+	result.NewHead = tip.Key
+	result.NewSeqID = tip.Value.Header.SeqID
+
+	if maxDepth > 0 && result.Orphaned > maxDepth {
+		return result, fmt.Errorf("%w (%d > %d blocks)", ErrReorgDepth, result.Orphaned, maxDepth)
+	}
+
+	if !Heavier(BlockIndex{Key: tip.Key, Header: tip.Value.Header}, BlockIndex{Key: result.OldHead, Header: BlockHeader{SeqID: result.OldSeqID}}) {
+		return result, ErrForkChoice
+	}
+
+	// Each block must follow the previous, starting from the ancestor
+	lines := make([][]byte, len(branch))
+	parentHash, parentSeqID := ancestor, result.AncestorSeqID
+
+	for i := range branch {
+
+		if err = checkBlock(&branch[i], parentHash, parentSeqID); err != nil {
+			return result, &VerifyError{Index: i, SeqID: branch[i].Value.Header.SeqID, Hash: branch[i].Key, Err: err}
+		}
+
+		if err = blockdb.checkBranchLegacy(branch, i, cut); err != nil {
+			return result, &VerifyError{Index: i, SeqID: branch[i].Value.Header.SeqID, Hash: branch[i].Key, Err: err}
+		}
+
+		data, err := json.Marshal(branch[i])
+
+		if err != nil {
+			return result, err
+		}
+
+		if err = blockdb.CheckBlockSize(data, len(branch[i].Value.Payload)); err != nil {
+			return result, err
+		}
+
+		lines[i] = blockdb.crypt.sealBlock(data)
+		parentHash, parentSeqID = branch[i].Key, branch[i].Value.Header.SeqID
+
+	}
+
+	offset := blockdb.size
+
+	if cut < len(blockdb.Index) {
+		offset = blockdb.Index[cut].Offset
+	}
+
+	// Keep the orphaned blocks, nothing is lost if the peer was wrong
+	if result.Orphaned > 0 {
+
+		err = readRange(blockdb.File, blockdb.crypt, cut, blockdb.Index[cut:], func(i int, block *BlockKV) error {
+			result.OrphanedBlocks = append(result.OrphanedBlocks, *block)
+			return nil
+		})
+
+		if err != nil {
+			return
+		}
+
+		result.OrphanFile = fmt.Sprintf("%s.orphaned-%d", blockdb.Filename, time.Now().UnixNano())
+
+		if err = copyTail(blockdb.File, offset, result.OrphanFile); err != nil {
+			return
+		}
+
+	}
+
+	if err = blockdb.rewrite(offset, lines); err != nil {
+		return
+	}
+
+	log.Info(fmt.Sprintf("Reorg => Rolled back (%d) blocks to SeqID %d, applied (%d) blocks to SeqID %d", result.Orphaned, result.AncestorSeqID, result.Applied, result.NewSeqID))
+
+	return
+
+}
+
+// Replace the DB with its first `offset` bytes followed by the sealed `lines`, and reload the index.
+// The new file is synced before the rename, so a crash leaves either the old or the new chain. Lock must be held
+func (blockdb *BlockDB) rewrite(offset int64, lines [][]byte) (err error) {
+
+	tmpFile := fmt.Sprintf("%s.reorg", blockdb.Filename)
+
+	out, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+
+	if err != nil {
+		return
+	}
+
+	defer os.Remove(tmpFile)
+
+	w := bufio.NewWriter(out)
+
+	_, err = io.Copy(w, io.NewSectionReader(blockdb.File, 0, offset))
+
+	for i := 0; err == nil && i < len(lines); i++ {
+		_, err = w.Write(append(lines[i], '\n'))
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return
+	}
+
+	// Replace the DB and rebuild the index for the new blocks
+	blockdb.close()
+
+	if err = os.Rename(tmpFile, blockdb.Filename); err != nil {
+		blockdb.open()
+		return
+	}
+
+	if err = os.Remove(blockdb.IndexFilename()); err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	return blockdb.open()
+
+}
+
+// Confirm a branch block without a TX root does not follow one with a TX root, the first block is
+// checked against the ancestor at `cut - 1`. Lock must be held
+func (blockdb *BlockDB) checkBranchLegacy(branch []BlockKV, i, cut int) error {
+
+	if branch[i].Value.Header.TxRoot != nil {
+		return nil
+	}
+
+	if i > 0 {
+		return checkLegacy(&branch[i], &branch[i-1])
+	}
+
+	if cut == 0 {
+		return nil
+	}
+
+	parent, err := blockdb.get(cut - 1)
+
+	if err != nil {
+		return err
+	}
+
+	return checkLegacy(&branch[i], parent)
+
+}
@@ -0,0 +1,154 @@
+package blockdb_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// Open a new DB with the signed blocks appended
+func chainDB(t *testing.T, blocks []blockdb.BlockKV) *blockdb.BlockDB {
+
+	db := blockdb.New(filepath.Join(t.TempDir(), "blockchain.db"))
+	assert.Nil(t, db.Open())
+	t.Cleanup(func() { db.Close() })
+
+	for i := range blocks {
+		assert.Nil(t, db.AppendBlock(&blocks[i]))
+	}
+
+	return &db
+
+}
+
+func TestLocatorAncestor(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	shared := signedBlocks(t, &signer, blockdb.BlockIndex{}, 100)
+	ancestor := blockdb.BlockIndex{Key: shared[99].Key, Header: shared[99].Value.Header}
+
+	local := chainDB(t, append(append([]blockdb.BlockKV{}, shared...), signedBlocks(t, &signer, ancestor, 30)...))
+	remote := chainDB(t, append(append([]blockdb.BlockKV{}, shared...), signedBlocks(t, &signer, ancestor, 5)...))
+
+	// Dense at the head, then doubling back to the first block
+	locator := local.Locator()
+	assert.Less(t, len(locator), 30)
+	assert.Equal(t, local.GetLatestIndex().Key, locator[0])
+	assert.Equal(t, shared[0].Key, locator[len(locator)-1])
+
+	// The latest shared block is within the step of the locator
+	found, ok := remote.FindAncestor(locator)
+	assert.True(t, ok)
+	assert.LessOrEqual(t, found.Header.SeqID, uint64(100))
+	assert.Greater(t, found.Header.SeqID, uint64(90))
+
+	_, ok = remote.FindAncestor([]blockdb.Hash{{1, 2, 3}})
+	assert.False(t, ok)
+
+	// Sync positions follow the hash, unknown hashes are not matched to the first block
+	pos, ok := remote.Sync(shared[99].Key[:])
+	assert.True(t, ok)
+	assert.Equal(t, 100, pos)
+
+	pos, ok = remote.Sync(make([]byte, 32))
+	assert.True(t, ok)
+	assert.Equal(t, 0, pos)
+
+	head := local.GetLatestIndex()
+	_, ok = remote.Sync(head.Key[:])
+	assert.False(t, ok)
+
+}
+
+func TestReorg(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	shared := signedBlocks(t, &signer, blockdb.BlockIndex{}, 10)
+	ancestor := blockdb.BlockIndex{Key: shared[9].Key, Header: shared[9].Value.Header}
+
+	db := chainDB(t, append(append([]blockdb.BlockKV{}, shared...), signedBlocks(t, &signer, ancestor, 3)...))
+	oldHead := db.GetLatestIndex()
+
+	// Lighter branches and deep reorgs are refused, the chain is unchanged
+	_, err := db.Reorg(ancestor.Key, signedBlocks(t, &signer, ancestor, 2), 0)
+	assert.True(t, errors.Is(err, blockdb.ErrForkChoice))
+
+	branch := signedBlocks(t, &signer, ancestor, 5)
+
+	_, err = db.Reorg(ancestor.Key, branch, 2)
+	assert.True(t, errors.Is(err, blockdb.ErrReorgDepth))
+
+	_, err = db.Reorg(blockdb.Hash{1, 2, 3}, branch, 0)
+	assert.True(t, errors.Is(err, blockdb.ErrAncestorNotFound))
+
+	// Branches must follow the ancestor
+	_, err = db.Reorg(shared[8].Key, branch, 0)
+
+	var verr *blockdb.VerifyError
+	assert.True(t, errors.As(err, &verr))
+	assert.True(t, errors.Is(err, blockdb.ErrParentMismatch))
+
+	assert.Equal(t, oldHead, db.GetLatestIndex())
+
+	// The heavier branch replaces the blocks after the ancestor
+	result, err := db.Reorg(ancestor.Key, branch, 0)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 3, result.Orphaned)
+	assert.Equal(t, 5, result.Applied)
+	assert.Equal(t, uint64(10), result.AncestorSeqID)
+	assert.Equal(t, oldHead.Key, result.OldHead)
+	assert.Equal(t, branch[4].Key, result.NewHead)
+
+	assert.Equal(t, 15, db.Len())
+	assert.Equal(t, branch[4].Key, db.GetLatestIndex().Key)
+	assert.Nil(t, db.Verify())
+
+	_, err = db.BlockByHash(oldHead.Key, false)
+	assert.True(t, errors.Is(err, blockdb.ErrBlockNotFound))
+
+	// Orphaned blocks are kept
+	orphaned, err := os.ReadFile(result.OrphanFile)
+	assert.Nil(t, err)
+	assert.NotEmpty(t, orphaned)
+
+	assert.Len(t, result.OrphanedBlocks, 3)
+	assert.Equal(t, oldHead.Key, result.OrphanedBlocks[2].Key)
+
+	// New blocks follow the new head, and the chain is the same once reopened
+	next := signedBlocks(t, &signer, db.GetLatestIndex(), 1)
+	assert.Nil(t, db.AppendBlock(&next[0]))
+
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.Open())
+	assert.Equal(t, 16, db.Len())
+	assert.Equal(t, next[0].Key, db.GetLatestIndex().Key)
+	assert.Nil(t, db.Verify())
+
+	// Equal length forks go to the lower head hash
+	a := signedBlocks(t, &signer, ancestor, 7)
+	b := signedBlocks(t, &signer, ancestor, 7)
+
+	if !blockdb.Heavier(blockdb.BlockIndex{Key: b[6].Key, Header: b[6].Value.Header}, blockdb.BlockIndex{Key: a[6].Key, Header: a[6].Value.Header}) {
+		a, b = b, a
+	}
+
+	_, err = db.Reorg(ancestor.Key, a, 0)
+	assert.Nil(t, err)
+
+	_, err = db.Reorg(ancestor.Key, b, 0)
+	assert.Nil(t, err)
+
+	_, err = db.Reorg(ancestor.Key, a, 0)
+	assert.True(t, errors.Is(err, blockdb.ErrForkChoice))
+
+}
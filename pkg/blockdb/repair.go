@@ -0,0 +1,160 @@
+package blockdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type RepairResult struct {
+	Valid          int    `json:"valid"`
+	Quarantined    int    `json:"quarantined"`
+	QuarantineFile string `json:"quarantine_file"`
+	Reason         string `json:"reason"`
+}
+
+// Truncate the blockchain DB to the last consistent block, the invalid tail is moved to a quarantine file.
+// Unlike Open, unparsable lines are accepted and treated as the first invalid block
+func (blockdb *BlockDB) Repair() (result RepairResult, err error) {
+
+	if blockdb.Filename == "" {
+		return result, errors.New("Specify filename to repair")
+	}
+
+	blockdb.Mu.Lock()
+	defer blockdb.Mu.Unlock()
+
+	blockdb.close()
+
+	// Unlock encrypted DBs before reading the blocks
+	if err = blockdb.checkSchema(); err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(blockdb.Filename, os.O_RDWR, 0755)
+
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	// Read every line raw, each block is checked against the previous valid block
+	reader := bufio.NewReader(f)
+
+	var offset, cut int64
+	var parent BlockKV
+	var invalid bool
+	var lineNumber int
+
+	for {
+
+		line, readErr := reader.ReadBytes('\n')
+
+		lineOffset := offset
+		offset += int64(len(line))
+
+		// Blank lines are skipped but still counted, so reasons name the line in the file
+		if len(line) > 0 {
+			lineNumber++
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+
+			if invalid {
+				result.Quarantined++
+
+			} else {
+
+				var block BlockKV
+
+				if data, err := blockdb.crypt.openBlock(bytes.TrimSpace(line)); err != nil {
+					result.Reason = fmt.Sprintf("Line %d could not be decrypted: %s", lineNumber, err)
+				} else if err := json.Unmarshal(data, &block); err != nil {
+					result.Reason = fmt.Sprintf("Line %d could not be parsed: %s", lineNumber, err)
+				} else if err := checkBlock(&block, parent.Key, parent.Value.Header.SeqID); err != nil {
+					result.Reason = (&VerifyError{Index: result.Valid, SeqID: block.Value.Header.SeqID, Hash: block.Key, Err: err}).Error()
+				}
+
+				if result.Reason != "" {
+					invalid = true
+					cut = lineOffset
+					result.Quarantined++
+				} else {
+					result.Valid++
+					parent = block
+				}
+
+			}
+
+		}
+
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return result, readErr
+		}
+
+	}
+
+	if result.Quarantined == 0 {
+		log.Info("Repair => No invalid blocks found in ", blockdb.Filename)
+		return result, blockdb.open()
+	}
+
+	log.Warn(fmt.Sprintf("Repair => Quarantining (%d) blocks after SeqID %d: %s", result.Quarantined, parent.Value.Header.SeqID, result.Reason))
+
+	// Copy the invalid tail to the quarantine file first, nothing is lost if the truncate fails
+	result.QuarantineFile = fmt.Sprintf("%s.quarantine-%d", blockdb.Filename, time.Now().Unix())
+
+	if err = copyTail(f, cut, result.QuarantineFile); err != nil {
+		return
+	}
+
+	if err = f.Truncate(cut); err != nil {
+		return
+	}
+
+	if err = f.Sync(); err != nil {
+		return
+	}
+
+	// Reload the index for the truncated DB
+	return result, blockdb.open()
+
+}
+
+// Copy from `offset` to the end of `f` into a new file and sync to disk
+func copyTail(f *os.File, offset int64, filename string) (err error) {
+
+	out, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		out.Close()
+		return
+	}
+
+	if _, err = io.Copy(out, f); err != nil {
+		out.Close()
+		return
+	}
+
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return
+	}
+
+	return out.Close()
+
+}
@@ -0,0 +1,299 @@
+package blockdb
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tidwall/btree"
+)
+
+// Data starts with a ReplayHeader, signed with the data
+const TxFlagReplay uint8 = 1 << 1
+
+// Size of the replay header, the timestamp in unix nanoseconds and a random nonce
+const ReplayHeaderSize = 8 + 8
+
+// Messages with a timestamp further than the window from the current time are rejected as stale
+const DefaultReplayWindow = 5 * time.Minute
+
+// Default number of (sender, nonce) pairs remembered within the window
+const DefaultMaxReplays = 1_000_000
+
+var (
+	ErrReplay      = errors.New("duplicate message, already seen")
+	ErrStale       = errors.New("message timestamp outside the replay window")
+	ErrReplayShort = errors.New("data is too short for the replay header")
+)
+
+// Timestamp and nonce under the sender signature, so a message can't be accepted twice
+type ReplayHeader struct {
+	Timestamp int64
+	Nonce     [8]byte
+}
+
+// Create a header for a message sent now
+func NewReplayHeader() (header ReplayHeader, err error) {
+
+	header.Timestamp = time.Now().UnixNano()
+	_, err = rand.Read(header.Nonce[:])
+
+	return
+
+}
+
+func ParseReplayHeader(data []byte) (header ReplayHeader, err error) {
+
+	if len(data) < ReplayHeaderSize {
+		return header, ErrReplayShort
+	}
+
+	header.Timestamp = int64(binary.BigEndian.Uint64(data[:8]))
+	copy(header.Nonce[:], data[8:ReplayHeaderSize])
+
+	return
+
+}
+
+func (header ReplayHeader) Bytes() []byte {
+
+	b := make([]byte, ReplayHeaderSize)
+	binary.BigEndian.PutUint64(b[:8], uint64(header.Timestamp))
+	copy(b[8:], header.Nonce[:])
+
+	return b
+
+}
+
+func (header ReplayHeader) Time() time.Time {
+
+	return time.Unix(0, header.Timestamp)
+
+}
+
+// Bounded set of (sender, nonce) pairs seen within the window. When full the oldest pairs are
+// forgotten, and messages no newer than the forgotten pairs are rejected as stale
+type ReplayGuard struct {
+	mu     sync.Mutex
+	window time.Duration
+	max    int
+	seen   map[string]int64 // key to the timestamp it is held under
+	byTime *btree.BTree
+	floor  int64
+}
+
+type replayEntry struct {
+	timestamp int64
+	key       string
+}
+
+// Create a guard for the window, holding at most `max` pairs. Zero values use the defaults
+func NewReplayGuard(window time.Duration, max int) *ReplayGuard {
+
+	if window <= 0 {
+		window = DefaultReplayWindow
+	}
+
+	if max <= 0 {
+		max = DefaultMaxReplays
+	}
+
+	return &ReplayGuard{
+		window: window,
+		max:    max,
+		seen:   make(map[string]int64),
+		byTime: btree.New(func(a, b interface{}) bool {
+			ea, eb := a.(replayEntry), b.(replayEntry)
+			if ea.timestamp != eb.timestamp {
+				return ea.timestamp < eb.timestamp
+			}
+			return ea.key < eb.key
+		}),
+	}
+
+}
+
+// Check the message from `sender` is within the window of `now` and not seen before, and record it
+func (guard *ReplayGuard) Check(sender []byte, header ReplayHeader, now time.Time) error {
+
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	guard.expire(now)
+
+	ts := header.Time()
+
+	if ts.Before(now.Add(-guard.window)) || ts.After(now.Add(guard.window)) || header.Timestamp <= guard.floor {
+		return fmt.Errorf("%w (%s)", ErrStale, ts.Format(time.RFC3339Nano))
+	}
+
+	return guard.record(string(sender)+string(header.Bytes()), header.Timestamp)
+
+}
+
+// Record the key as seen at the timestamp, lock must be held
+func (guard *ReplayGuard) record(key string, timestamp int64) error {
+
+	if _, ok := guard.seen[key]; ok {
+		return ErrReplay
+	}
+
+	guard.seen[key] = timestamp
+	guard.byTime.Set(replayEntry{timestamp: timestamp, key: key})
+
+	for len(guard.seen) > guard.max {
+		oldest := guard.byTime.PopMin().(replayEntry)
+		delete(guard.seen, oldest.key)
+		guard.floor = oldest.timestamp
+	}
+
+	return nil
+
+}
+
+// Check the TX data if it carries a replay header. Other TX's, such as those pushed over RPC, can't be
+// told apart from a copy, so the same TX is only accepted once within the window from when it is first
+// seen. A nil guard accepts every TX
+func (guard *ReplayGuard) CheckTx(tx TxPayload, now time.Time) error {
+
+	if guard == nil || tx.Pruned {
+		return nil
+	}
+
+	if tx.Reserved&TxFlagReplay == 0 {
+
+		guard.mu.Lock()
+		defer guard.mu.Unlock()
+
+		guard.expire(now)
+
+		return guard.record(txKey(tx), now.UnixNano())
+
+	}
+
+	header, err := ParseReplayHeader(tx.Data)
+
+	if err != nil {
+		return err
+	}
+
+	return guard.Check(tx.Sender, header, now)
+
+}
+
+// Forget the TX, so it is accepted again. TX's of blocks rolled back by a reorg are queued again
+func (guard *ReplayGuard) ForgetTx(tx TxPayload) {
+
+	if guard == nil {
+		return
+	}
+
+	key, ok := ReplayKey(tx)
+
+	if !ok {
+		return
+	}
+
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	if timestamp, ok := guard.seen[key]; ok {
+		guard.byTime.Delete(replayEntry{timestamp: timestamp, key: key})
+		delete(guard.seen, key)
+	}
+
+}
+
+// Confirm the TX was seen within the window, without recording it
+func (guard *ReplayGuard) Seen(tx TxPayload, now time.Time) bool {
+
+	if guard == nil {
+		return false
+	}
+
+	key, ok := ReplayKey(tx)
+
+	if !ok {
+		return false
+	}
+
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	guard.expire(now)
+
+	_, seen := guard.seen[key]
+
+	return seen
+
+}
+
+// Key a TX is held under, the sender and replay header, or the digest of a TX without a replay header.
+// False if the TX is pruned or its data is too short for the replay header
+func ReplayKey(tx TxPayload) (key string, ok bool) {
+
+	if tx.Pruned {
+		return "", false
+	}
+
+	if tx.Reserved&TxFlagReplay == 0 {
+		return txKey(tx), true
+	}
+
+	header, err := ParseReplayHeader(tx.Data)
+
+	if err != nil {
+		return "", false
+	}
+
+	return string(tx.Sender) + string(header.Bytes()), true
+
+}
+
+// Key of a TX without a replay header, the digest of the sender, recipient, type, flags and data
+func txKey(tx TxPayload) string {
+
+	h := sha256.New()
+
+	for _, field := range [][]byte{tx.Sender, tx.Recipient, {tx.Type, tx.Reserved}, tx.Data} {
+		binary.Write(h, binary.BigEndian, uint32(len(field)))
+		h.Write(field)
+	}
+
+	return "tx:" + string(h.Sum(nil))
+
+}
+
+// Drop pairs older than the window, they are rejected as stale, lock must be held
+func (guard *ReplayGuard) expire(now time.Time) {
+
+	cutoff := now.Add(-guard.window).UnixNano()
+
+	for guard.byTime.Len() > 0 {
+
+		oldest := guard.byTime.Min().(replayEntry)
+
+		if oldest.timestamp >= cutoff {
+			break
+		}
+
+		guard.byTime.PopMin()
+		delete(guard.seen, oldest.key)
+
+	}
+
+}
+
+// Number of pairs held
+func (guard *ReplayGuard) Len() int {
+
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	return len(guard.seen)
+
+}
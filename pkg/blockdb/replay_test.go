@@ -0,0 +1,65 @@
+package blockdb_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayGuard(t *testing.T) {
+
+	guard := blockdb.NewReplayGuard(time.Minute, 3)
+	now := time.Now()
+
+	header, err := blockdb.NewReplayHeader()
+	assert.Nil(t, err)
+
+	parsed, err := blockdb.ParseReplayHeader(header.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, header, parsed)
+
+	assert.Nil(t, guard.Check([]byte("alice"), header, now))
+	assert.True(t, errors.Is(guard.Check([]byte("alice"), header, now), blockdb.ErrReplay))
+
+	// The same nonce from another sender is a different message
+	assert.Nil(t, guard.Check([]byte("bob"), header, now))
+
+	// Outside the window in either direction
+	old := blockdb.ReplayHeader{Timestamp: now.Add(-2 * time.Minute).UnixNano()}
+	future := blockdb.ReplayHeader{Timestamp: now.Add(2 * time.Minute).UnixNano()}
+
+	assert.True(t, errors.Is(guard.Check([]byte("alice"), old, now), blockdb.ErrStale))
+	assert.True(t, errors.Is(guard.Check([]byte("alice"), future, now), blockdb.ErrStale))
+
+	// When full the oldest pairs are forgotten, and older messages are rejected as stale
+	for i := 1; i <= 3; i++ {
+		h := blockdb.ReplayHeader{Timestamp: now.Add(time.Duration(i) * time.Second).UnixNano()}
+		assert.Nil(t, guard.Check([]byte("carol"), h, now))
+	}
+
+	assert.Equal(t, 3, guard.Len())
+	assert.True(t, errors.Is(guard.Check([]byte("alice"), header, now), blockdb.ErrStale))
+
+	// Pairs expire with the window
+	later := now.Add(100 * time.Second)
+	assert.Nil(t, guard.Check([]byte("dave"), blockdb.ReplayHeader{Timestamp: later.UnixNano()}, later))
+	assert.Equal(t, 1, guard.Len())
+
+	// TX's without a replay header are accepted once within the window from when they are first seen
+	tx := blockdb.TxPayload{Sender: []byte("erin"), Data: []byte("x")}
+	assert.Nil(t, guard.CheckTx(tx, later))
+	assert.True(t, errors.Is(guard.CheckTx(tx, later), blockdb.ErrReplay))
+	assert.Nil(t, guard.CheckTx(blockdb.TxPayload{Sender: []byte("frank"), Data: []byte("x")}, later))
+	assert.Nil(t, guard.CheckTx(tx, later.Add(2*time.Minute)))
+
+	// Forgotten TX's are accepted again
+	guard.ForgetTx(tx)
+	assert.Nil(t, guard.CheckTx(tx, later.Add(2*time.Minute)))
+
+	tx.Reserved = blockdb.TxFlagReplay
+	assert.True(t, errors.Is(guard.CheckTx(tx, now), blockdb.ErrReplayShort))
+
+}
@@ -0,0 +1,272 @@
+package blockdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Per-node retention of TX data. Pruned blocks keep their headers and TX commitments so the chain
+// stays verifiable, a block is pruned if any limit applies. Archive nodes never prune
+type RetentionPolicy struct {
+	Archive    bool          `json:"archive"`
+	MaxAge     time.Duration `json:"max_age"`
+	KeepBlocks uint64        `json:"keep_blocks"`
+	MaxSize    int64         `json:"max_size"`
+}
+
+type PruneResult struct {
+	Pruned       int    `json:"pruned"`
+	Skipped      int    `json:"skipped"`
+	PrunedHeight uint64 `json:"pruned_height"`
+	Size         int64  `json:"size"`
+}
+
+// Confirm the policy prunes any data
+func (policy RetentionPolicy) Enabled() bool {
+
+	return !policy.Archive && (policy.MaxAge > 0 || policy.KeepBlocks > 0 || policy.MaxSize > 0)
+
+}
+
+// Highest SeqID with TX data pruned, blocks up to this height must be fetched from an archive node
+func (blockdb *BlockDB) PrunedHeight() uint64 {
+
+	blockdb.Mu.RLock()
+	defer blockdb.Mu.RUnlock()
+
+	return blockdb.prunedHeight
+
+}
+
+// Prune the TX data of blocks outside the retention policy. Blocks created before TX roots were
+// introduced commit to the full payload and are skipped
+func (blockdb *BlockDB) Prune(policy RetentionPolicy) (result PruneResult, err error) {
+
+	blockdb.Mu.Lock()
+	defer blockdb.Mu.Unlock()
+
+	result.PrunedHeight = blockdb.prunedHeight
+	result.Size = blockdb.size
+
+	if !policy.Enabled() || blockdb.File == nil {
+		return
+	}
+
+	cut := blockdb.pruneCut(policy)
+
+	// Skip blocks already pruned
+	start := 0
+
+	for start < cut && blockdb.Index[start].Header.SeqID <= blockdb.prunedHeight {
+		start++
+	}
+
+	// Nothing new crosses the cut
+	if start >= cut {
+		return
+	}
+
+	// Legacy blocks can't be pruned, the file is only rewritten if TX data is dropped
+	prunable := false
+
+	for i := start; i < cut && !prunable; i++ {
+		prunable = blockdb.Index[i].Header.TxRoot != nil
+	}
+
+	if !prunable {
+		return
+	}
+
+	log.Info(fmt.Sprintf("Prune => Pruning TX data for SeqID %d to %d", blockdb.Index[start].Header.SeqID, blockdb.Index[cut-1].Header.SeqID))
+
+	tmpFile := fmt.Sprintf("%s.prune", blockdb.Filename)
+
+	out, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+
+	if err != nil {
+		return
+	}
+
+	defer os.Remove(tmpFile)
+
+	w := bufio.NewWriter(out)
+
+	// Copy blocks outside the range raw, rewrite blocks in range without their TX data
+	err = readRange(blockdb.File, blockdb.crypt, 0, blockdb.Index, func(i int, block *BlockKV) error {
+
+		if i < start || i >= cut || block.Value.Header.TxRoot == nil {
+
+			if i >= start && i < cut {
+				result.Skipped++
+			}
+
+			data := make([]byte, blockdb.Index[i].Length)
+
+			if _, err := blockdb.File.ReadAt(data, blockdb.Index[i].Offset); err != nil {
+				return err
+			}
+
+			_, err := w.Write(append(data, '\n'))
+			return err
+
+		}
+
+		for tx := range block.Value.Payload {
+			PruneTx(&block.Value.Payload[tx])
+		}
+
+		data, err := json.Marshal(block)
+
+		if err != nil {
+			return err
+		}
+
+		result.Pruned++
+
+		_, err = w.Write(append(blockdb.crypt.sealBlock(data), '\n'))
+		return err
+
+	})
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = out.Sync()
+	}
+
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return
+	}
+
+	prunedHeight := blockdb.Index[cut-1].Header.SeqID
+
+	// Replace the DB and rebuild the index for the new offsets, the DB is reopened even if this fails
+	blockdb.close()
+
+	err = blockdb.replacePruned(tmpFile, prunedHeight)
+
+	if openErr := blockdb.open(); err == nil {
+		err = openErr
+	}
+
+	if err != nil {
+		return
+	}
+
+	result.PrunedHeight = blockdb.prunedHeight
+	result.Size = blockdb.size
+
+	log.Info(fmt.Sprintf("Prune => (%d) blocks pruned, (%d) skipped, %d bytes on disk", result.Pruned, result.Skipped, result.Size))
+
+	return
+
+}
+
+// Rename the pruned file over the closed DB and record the pruned height, lock must be held
+func (blockdb *BlockDB) replacePruned(tmpFile string, prunedHeight uint64) (err error) {
+
+	if err = os.Rename(tmpFile, blockdb.Filename); err != nil {
+		return
+	}
+
+	if err = os.Remove(blockdb.IndexFilename()); err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	manifest, err := ReadManifest(blockdb.ManifestFilename())
+
+	if err != nil {
+		return
+	}
+
+	manifest.PrunedHeight = prunedHeight
+
+	return WriteManifest(blockdb.ManifestFilename(), manifest)
+
+}
+
+// Number of leading blocks outside the retention policy, lock must be held
+func (blockdb *BlockDB) pruneCut(policy RetentionPolicy) (cut int) {
+
+	total := len(blockdb.Index)
+
+	if policy.KeepBlocks > 0 && uint64(total) > policy.KeepBlocks {
+		cut = total - int(policy.KeepBlocks)
+	}
+
+	if policy.MaxAge > 0 {
+
+		expired := time.Now().Add(-policy.MaxAge)
+		i := 0
+
+		for i < total && blockdb.Index[i].Header.SeqTime.Before(expired) {
+			i++
+		}
+
+		if i > cut {
+			cut = i
+		}
+
+	}
+
+	// Pruning only drops TX data, so counting whole blocks over-estimates the saving
+	if policy.MaxSize > 0 {
+
+		size := blockdb.size
+		i := 0
+
+		for i < total && size > policy.MaxSize {
+			size -= int64(blockdb.Index[i].Length)
+			i++
+		}
+
+		if i > cut {
+			cut = i
+		}
+
+	}
+
+	// Always keep the latest block
+	if cut >= total {
+		cut = total - 1
+	}
+
+	return
+
+}
+
+// Prune the DB with the configured retention policy at the specified interval
+func (blockdb *BlockDB) RetentionLoop(ctx context.Context, interval time.Duration) {
+
+	if !blockdb.Retention.Enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := blockdb.Prune(blockdb.Retention); err != nil {
+				log.Warn("Prune => ", err)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+
+}
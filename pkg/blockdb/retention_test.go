@@ -0,0 +1,224 @@
+package blockdb_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// Append `n` blocks committing to a TX root on top of the DB
+func appendMerkleBlocks(t *testing.T, db *blockdb.BlockDB, n int, seqTime time.Time) {
+
+	for i := 0; i < n; i++ {
+
+		latest := db.GetLatestIndex()
+
+		payload := []blockdb.TxPayload{
+			{Sender: []byte("sender"), Data: []byte(fmt.Sprintf("message %d", i)), Type: 1},
+			{Sender: []byte("sender"), Data: []byte(fmt.Sprintf("reply %d", i)), Type: 1},
+			{Sender: []byte("sender"), Data: []byte(fmt.Sprintf("ack %d", i)), Type: 1},
+		}
+
+		root, err := blockdb.TxRoot(payload)
+		assert.Nil(t, err)
+
+		header := blockdb.BlockHeader{Parent: latest.Key, SeqID: latest.Header.SeqID + 1, SeqTime: seqTime, TxRoot: &root}
+
+		block := blockdb.BlockKV{
+			Key: blockdb.BlockHash(header),
+			Value: blockdb.Block{
+				Header:  header,
+				Payload: payload,
+			},
+		}
+
+		data, err := json.Marshal(block)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Append(data))
+
+	}
+
+}
+
+func TestTxRootPruned(t *testing.T) {
+
+	payload := []blockdb.TxPayload{{Data: []byte("one")}, {Data: []byte("two")}, {Data: []byte("three")}}
+
+	root, err := blockdb.TxRoot(payload)
+	assert.Nil(t, err)
+
+	// Pruning any TX keeps the same root
+	blockdb.PruneTx(&payload[1])
+	assert.Nil(t, payload[1].Data)
+
+	pruned, err := blockdb.TxRoot(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, root, pruned)
+
+	// Changing the data does not
+	payload[0].Data = []byte("tampered")
+
+	tampered, err := blockdb.TxRoot(payload)
+	assert.Nil(t, err)
+	assert.NotEqual(t, root, tampered)
+
+}
+
+// A duplicated trailing TX commits to another root, odd nodes are not paired with themselves
+func TestTxRootDuplicate(t *testing.T) {
+
+	payload := []blockdb.TxPayload{{Data: []byte("one")}, {Data: []byte("two")}, {Data: []byte("three")}}
+
+	root, err := blockdb.TxRoot(payload)
+	assert.Nil(t, err)
+
+	duplicated, err := blockdb.TxRoot(append(payload, payload[2]))
+	assert.Nil(t, err)
+	assert.NotEqual(t, root, duplicated)
+
+	// A single TX is not its own leaf hash paired into a root
+	single, err := blockdb.TxRoot(payload[:1])
+	assert.Nil(t, err)
+
+	pair, err := blockdb.TxRoot([]blockdb.TxPayload{payload[0], payload[0]})
+	assert.Nil(t, err)
+	assert.NotEqual(t, single, pair)
+
+}
+
+// The block hash covers the whole header, a synced block can't be given another SeqTime
+func TestBlockHashHeader(t *testing.T) {
+
+	root, err := blockdb.TxRoot([]blockdb.TxPayload{{Data: []byte("one")}})
+	assert.Nil(t, err)
+
+	header := blockdb.BlockHeader{SeqID: 1, SeqTime: time.Now(), TxRoot: &root}
+	hash := blockdb.BlockHash(header)
+
+	rewritten := header
+	rewritten.SeqTime = header.SeqTime.Add(-time.Hour)
+	assert.NotEqual(t, hash, blockdb.BlockHash(rewritten))
+
+	rewritten = header
+	rewritten.SeqID++
+	assert.NotEqual(t, hash, blockdb.BlockHash(rewritten))
+
+	db := blockdb.New(filepath.Join(t.TempDir(), "blockchain-db.json"))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	block := blockdb.BlockKV{Key: hash, Value: blockdb.Block{Header: header, Payload: []blockdb.TxPayload{{Data: []byte("one")}}}}
+	block.Value.Header.SeqTime = header.SeqTime.Add(-time.Hour)
+
+	assert.ErrorIs(t, db.AppendBlock(&block), blockdb.ErrChecksumMismatch)
+
+}
+
+func TestPrune(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	assert.Nil(t, db.Open())
+
+	legacy := db.Len()
+	appendMerkleBlocks(t, &db, 10, time.Now())
+	assert.Nil(t, db.Verify())
+
+	head := db.GetLatestIndex()
+
+	// Archive nodes never prune
+	result, err := db.Prune(blockdb.RetentionPolicy{Archive: true, KeepBlocks: 2})
+	assert.Nil(t, err)
+	assert.Zero(t, result.Pruned)
+
+	result, err = db.Prune(blockdb.RetentionPolicy{KeepBlocks: 2})
+	assert.Nil(t, err)
+
+	// Legacy blocks commit to the full payload and are kept
+	assert.Equal(t, 8, result.Pruned)
+	assert.Equal(t, legacy, result.Skipped)
+	assert.Equal(t, head.Header.SeqID-2, result.PrunedHeight)
+	assert.Equal(t, result.PrunedHeight, db.PrunedHeight())
+
+	// The chain still verifies with the TX data dropped
+	assert.Equal(t, legacy+10, db.Len())
+	assert.Equal(t, head.Key, db.GetLatestIndex().Key)
+	assert.Nil(t, db.Verify())
+
+	block, err := db.Get(legacy)
+	assert.Nil(t, err)
+	assert.True(t, block.Value.Payload[0].Pruned)
+	assert.Nil(t, block.Value.Payload[0].Data)
+
+	block, err = db.Get(db.Len() - 1)
+	assert.Nil(t, err)
+	assert.False(t, block.Value.Payload[0].Pruned)
+	assert.NotNil(t, block.Value.Payload[0].Data)
+
+	// Already pruned blocks are not rewritten
+	result, err = db.Prune(blockdb.RetentionPolicy{KeepBlocks: 2})
+	assert.Nil(t, err)
+	assert.Zero(t, result.Pruned)
+
+	// The pruned height is persisted in the manifest
+	db.Close()
+
+	manifest, err := blockdb.ReadManifest(db.ManifestFilename())
+	assert.Nil(t, err)
+	assert.Equal(t, head.Header.SeqID-2, manifest.PrunedHeight)
+
+	reopened := blockdb.New(db.Filename)
+	assert.Nil(t, reopened.Open())
+	assert.Equal(t, head.Header.SeqID-2, reopened.PrunedHeight())
+	assert.Nil(t, reopened.Verify())
+
+}
+
+func TestPruneLegacy(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	before, err := os.Stat(db.Filename)
+	assert.Nil(t, err)
+
+	// Legacy blocks commit to the full payload, the file is not rewritten to prune nothing
+	result, err := db.Prune(blockdb.RetentionPolicy{KeepBlocks: 2})
+	assert.Nil(t, err)
+	assert.Zero(t, result.Pruned)
+
+	after, err := os.Stat(db.Filename)
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(before, after))
+
+	// The DB is still open
+	_, err = db.Get(0)
+	assert.Nil(t, err)
+
+}
+
+func TestPruneMaxAge(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	assert.Nil(t, db.Open())
+
+	legacy := db.Len()
+	appendMerkleBlocks(t, &db, 4, time.Now().Add(-48*time.Hour))
+	appendMerkleBlocks(t, &db, 4, time.Now())
+
+	result, err := db.Prune(blockdb.RetentionPolicy{MaxAge: 24 * time.Hour})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, result.Pruned)
+	assert.Nil(t, db.Verify())
+
+	block, err := db.Get(legacy + 4)
+	assert.Nil(t, err)
+	assert.False(t, block.Value.Payload[0].Pruned)
+
+}
@@ -0,0 +1,207 @@
+package blockdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Format versions of the blockchain DB on disk
+// 1 - JSON lines, one block per line (no manifest)
+// 2 - JSON lines with a binary block index and manifest
+// 3 - New blocks commit to a Merkle root of the TX's, allowing TX data to be pruned
+const LegacyVersion = 1
+const CurrentVersion = 3
+
+const DefaultChainID = "perry"
+const HashAlgorithm = "sha256"
+
+var ErrIncompatible = errors.New("incompatible blockchain DB")
+
+// Recorded alongside the DB, describes the format of the files on disk
+type Manifest struct {
+	Version       uint8     `json:"version"`
+	ChainID       string    `json:"chain_id"`
+	HashAlgorithm string    `json:"hash_algorithm"`
+	Created       time.Time `json:"created"`
+	Migrated      time.Time `json:"migrated"`
+	PrunedHeight  uint64    `json:"pruned_height"`
+
+	// Set if blocks and the index are encrypted at rest
+	Encryption *EncryptionParams `json:"encryption,omitempty"`
+}
+
+// Upgrades the DB files from one format version to the next
+type Migration struct {
+	From        uint8
+	To          uint8
+	Description string
+	Migrate     func(blockdb *BlockDB) error
+}
+
+var migrations = make(map[uint8]Migration)
+
+func init() {
+
+	RegisterMigration(Migration{
+		From:        1,
+		To:          2,
+		Description: "Build the binary block index for JSON lines",
+		Migrate: func(blockdb *BlockDB) error {
+			// Any index left by a newer build is discarded, the index is rebuilt on open
+			if err := os.Remove(blockdb.IndexFilename()); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return nil
+		},
+	})
+
+	RegisterMigration(Migration{
+		From:        2,
+		To:          3,
+		Description: "Commit new blocks to a Merkle TX root, existing blocks are unchanged",
+		Migrate: func(blockdb *BlockDB) error {
+			return nil
+		},
+	})
+
+}
+
+// Register a migration to upgrade the DB from `m.From`, run in order on open
+func RegisterMigration(m Migration) {
+
+	if m.To <= m.From {
+		panic(fmt.Sprintf("Migration from version %d must increase the version, not %d", m.From, m.To))
+	}
+
+	if existing, ok := migrations[m.From]; ok {
+		panic(fmt.Sprintf("Migration from version %d is already registered (%s)", m.From, existing.Description))
+	}
+
+	migrations[m.From] = m
+
+}
+
+// Filename of the manifest for the DB
+func (blockdb *BlockDB) ManifestFilename() string {
+
+	return fmt.Sprintf("%s.manifest", blockdb.Filename)
+
+}
+
+// Load the manifest, refuse incompatible DBs and run migrations for older formats.
+// DBs without a manifest are created at the current version, or treated as legacy JSON lines if not empty
+func (blockdb *BlockDB) checkSchema() (err error) {
+
+	manifest, err := ReadManifest(blockdb.ManifestFilename())
+	changed := false
+
+	if errors.Is(err, os.ErrNotExist) {
+
+		changed = true
+		manifest = Manifest{Version: CurrentVersion, ChainID: blockdb.ChainID, HashAlgorithm: HashAlgorithm, Created: time.Now()}
+
+		if stat, statErr := os.Stat(blockdb.Filename); statErr == nil && stat.Size() > 0 {
+			manifest.Version = LegacyVersion
+		} else if blockdb.Passphrase != nil {
+			// New DBs are encrypted from the first block if a passphrase is set
+			if manifest.Encryption, blockdb.crypt, err = newEncryptionParams(blockdb.Passphrase); err != nil {
+				return err
+			}
+		}
+
+	} else if err != nil {
+		return err
+	}
+
+	if manifest.HashAlgorithm != HashAlgorithm {
+		return fmt.Errorf("%w: hash algorithm %s, expected %s", ErrIncompatible, manifest.HashAlgorithm, HashAlgorithm)
+	}
+
+	if manifest.ChainID != blockdb.ChainID {
+		return fmt.Errorf("%w: chain ID %s, expected %s", ErrIncompatible, manifest.ChainID, blockdb.ChainID)
+	}
+
+	if manifest.Version > CurrentVersion {
+		return fmt.Errorf("%w: version %d is newer than supported version %d", ErrIncompatible, manifest.Version, CurrentVersion)
+	}
+
+	for manifest.Version < CurrentVersion {
+
+		m, ok := migrations[manifest.Version]
+
+		if !ok {
+			return fmt.Errorf("%w: no migration from version %d", ErrIncompatible, manifest.Version)
+		}
+
+		log.Info(fmt.Sprintf("Migrating %s from version %d to %d => %s", blockdb.Filename, m.From, m.To, m.Description))
+
+		if err = m.Migrate(blockdb); err != nil {
+			return fmt.Errorf("Migration from version %d failed: %w", m.From, err)
+		}
+
+		manifest.Version = m.To
+		manifest.Migrated = time.Now()
+		changed = false
+
+		// Record each step, a failed later migration resumes from here
+		if err = WriteManifest(blockdb.ManifestFilename(), manifest); err != nil {
+			return err
+		}
+
+	}
+
+	if err = blockdb.unlock(manifest); err != nil {
+		return err
+	}
+
+	blockdb.Version = manifest.Version
+	blockdb.prunedHeight = manifest.PrunedHeight
+
+	if changed {
+		return WriteManifest(blockdb.ManifestFilename(), manifest)
+	}
+
+	return
+
+}
+
+// Read a DB manifest from disk
+func ReadManifest(filename string) (manifest Manifest, err error) {
+
+	data, err := os.ReadFile(filename)
+
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("Could not parse manifest %s (%s)", filename, err)
+	}
+
+	return
+
+}
+
+// Write a DB manifest to disk, replacing the existing file
+func WriteManifest(filename string, manifest Manifest) (err error) {
+
+	data, err := json.MarshalIndent(manifest, "", " ")
+
+	if err != nil {
+		return
+	}
+
+	tmpFile := filename + ".tmp"
+
+	if err = os.WriteFile(tmpFile, data, 0644); err != nil {
+		return
+	}
+
+	return os.Rename(tmpFile, filename)
+
+}
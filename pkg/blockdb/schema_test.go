@@ -0,0 +1,91 @@
+package blockdb_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaMigrateLegacy(t *testing.T) {
+
+	// Today's JSON lines files have no manifest
+	path := tempDB(t, db_path)
+
+	db := blockdb.New(path)
+	assert.Nil(t, db.Open())
+	assert.Equal(t, uint8(blockdb.CurrentVersion), db.Version)
+	assert.NotZero(t, db.Len())
+	assert.Nil(t, db.Verify())
+	db.Close()
+
+	manifest, err := blockdb.ReadManifest(db.ManifestFilename())
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(blockdb.CurrentVersion), manifest.Version)
+	assert.Equal(t, blockdb.DefaultChainID, manifest.ChainID)
+	assert.Equal(t, blockdb.HashAlgorithm, manifest.HashAlgorithm)
+	assert.False(t, manifest.Migrated.IsZero())
+
+	// A new DB is created at the current version
+	db = blockdb.New(filepath.Join(t.TempDir(), "blockchain-db.json"))
+	assert.Nil(t, db.Open())
+	db.Close()
+
+	manifest, err = blockdb.ReadManifest(db.ManifestFilename())
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(blockdb.CurrentVersion), manifest.Version)
+	assert.True(t, manifest.Migrated.IsZero())
+
+}
+
+func TestSchemaIncompatible(t *testing.T) {
+
+	path := tempDB(t, db_path)
+
+	db := blockdb.New(path)
+	assert.Nil(t, db.Open())
+	db.Close()
+
+	// Another chain
+	other := blockdb.New(path)
+	other.ChainID = "perry-test"
+	assert.True(t, errors.Is(other.Open(), blockdb.ErrIncompatible))
+
+	manifest, err := blockdb.ReadManifest(db.ManifestFilename())
+	assert.Nil(t, err)
+
+	// Newer format
+	manifest.Version = blockdb.CurrentVersion + 1
+	assert.Nil(t, blockdb.WriteManifest(db.ManifestFilename(), manifest))
+	db = blockdb.New(path)
+	assert.True(t, errors.Is(db.Open(), blockdb.ErrIncompatible))
+
+	// Another hash algorithm
+	manifest.Version = blockdb.CurrentVersion
+	manifest.HashAlgorithm = "sha3-256"
+	assert.Nil(t, blockdb.WriteManifest(db.ManifestFilename(), manifest))
+	db = blockdb.New(path)
+	assert.True(t, errors.Is(db.Open(), blockdb.ErrIncompatible))
+
+	// Unparsable manifest
+	assert.Nil(t, os.WriteFile(db.ManifestFilename(), []byte("{"), 0644))
+	db = blockdb.New(path)
+	assert.NotNil(t, db.Open())
+
+}
+
+func TestRegisterMigration(t *testing.T) {
+
+	// A second migration from the same version would replace the first
+	assert.Panics(t, func() {
+		blockdb.RegisterMigration(blockdb.Migration{From: 1, To: 2, Migrate: func(*blockdb.BlockDB) error { return nil }})
+	})
+
+	assert.Panics(t, func() {
+		blockdb.RegisterMigration(blockdb.Migration{From: 3, To: 3})
+	})
+
+}
@@ -0,0 +1,420 @@
+package blockdb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/perrychain/perry/pkg/wallet"
+	log "github.com/sirupsen/logrus"
+)
+
+// Files stored in a snapshot archive, the manifest is written last
+const snapshotBlocksFile = "blocks.json"
+const snapshotIndexFile = "blocks.idx"
+const snapshotManifestFile = "manifest.json"
+
+var (
+	ErrSnapshotSignature = errors.New("snapshot manifest signature is invalid")
+	ErrSnapshotChecksum  = errors.New("snapshot file checksum does not match manifest")
+	ErrSnapshotHead      = errors.New("snapshot chain does not match manifest")
+	ErrSnapshotKey       = errors.New("snapshot public key required")
+)
+
+// Signed description of a snapshot, the signature covers the manifest with an empty signature
+type SnapshotManifest struct {
+	Version      uint8          `json:"version"`
+	ChainID      string         `json:"chain_id"`
+	Height       uint64         `json:"height"`
+	Blocks       int            `json:"blocks"`
+	PrunedHeight uint64         `json:"pruned_height"` // TX data of blocks up to this height is pruned
+	Head         Hash           `json:"head"`
+	Created      time.Time      `json:"created"`
+	Files        []SnapshotFile `json:"files"`
+	PublicKey    []byte         `json:"public_key"`
+	Signature    []byte         `json:"signature"`
+}
+
+type SnapshotFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum Hash   `json:"checksum"`
+}
+
+// Write a point-in-time snapshot of the chain and index as a gzipped tar to `w`, signed by `signer`
+func (blockdb *BlockDB) Snapshot(w io.Writer, signer *wallet.Wallet) (manifest SnapshotManifest, err error) {
+
+	// Capture the index at this point in time, blocks are only appended so the file range stays consistent
+	blockdb.Mu.RLock()
+	entries := append([]BlockIndex{}, blockdb.Index...)
+	prunedHeight := blockdb.prunedHeight
+	crypt := blockdb.crypt
+	file, err := blockdb.openReader()
+	blockdb.Mu.RUnlock()
+
+	if err != nil {
+		return manifest, fmt.Errorf("Open the BlockDB before creating a snapshot: %w", err)
+	}
+
+	defer file.Close()
+
+	var blocks io.Reader
+
+	// Snapshots are shared with peers, encrypted blocks are exported in plaintext. They are decrypted as
+	// they are written to the archive, never to disk
+	if crypt != nil {
+
+		sealed := entries
+
+		if entries, err = plainIndex(file, crypt, sealed); err != nil {
+			return
+		}
+
+		blocks = &blockReader{file: file, crypt: crypt, sealed: sealed, plain: entries}
+
+	}
+
+	manifest = SnapshotManifest{Version: blockdb.Version, ChainID: blockdb.ChainID, Blocks: len(entries), PrunedHeight: prunedHeight, Created: time.Now(), PublicKey: signer.PublicKey}
+
+	var end int64
+
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		manifest.Height = last.Header.SeqID
+		manifest.Head = last.Key
+		end = last.Offset + int64(last.Length) + 1
+	}
+
+	if blocks == nil {
+		blocks = io.NewSectionReader(file, 0, end)
+	}
+
+	index := new(bytes.Buffer)
+
+	for _, entry := range entries {
+		index.Write(newIndexRecord(entry).bytes())
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	files := []struct {
+		name   string
+		size   int64
+		reader io.Reader
+	}{
+		{snapshotBlocksFile, end, blocks},
+		{snapshotIndexFile, int64(index.Len()), index},
+	}
+
+	for _, f := range files {
+
+		if err = tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: f.size, ModTime: manifest.Created}); err != nil {
+			return
+		}
+
+		h := sha256.New()
+
+		if _, err = io.Copy(io.MultiWriter(tw, h), f.reader); err != nil {
+			return
+		}
+
+		snapshotFile := SnapshotFile{Name: f.name, Size: f.size}
+		copy(snapshotFile.Checksum[:], h.Sum(nil))
+
+		manifest.Files = append(manifest.Files, snapshotFile)
+
+	}
+
+	unsigned, err := json.Marshal(manifest)
+
+	if err != nil {
+		return
+	}
+
+	if manifest.Signature, err = signer.Sign(unsigned); err != nil {
+		return
+	}
+
+	data, err := json.MarshalIndent(manifest, "", " ")
+
+	if err != nil {
+		return
+	}
+
+	if err = tw.WriteHeader(&tar.Header{Name: snapshotManifestFile, Mode: 0644, Size: int64(len(data)), ModTime: manifest.Created}); err != nil {
+		return
+	}
+
+	if _, err = tw.Write(data); err != nil {
+		return
+	}
+
+	if err = tw.Close(); err != nil {
+		return
+	}
+
+	err = gz.Close()
+
+	log.Info(fmt.Sprintf("Snapshot => (%d) blocks, height %d", manifest.Blocks, manifest.Height))
+
+	return
+
+}
+
+// The index of the blocks decrypted, with the offsets they are written at in the snapshot. The length of
+// each block is taken from the line on disk, without decrypting it
+func plainIndex(file *os.File, crypt *dbCipher, entries []BlockIndex) (plain []BlockIndex, err error) {
+
+	var offset int64
+	tail := make([]byte, 2)
+
+	for _, entry := range entries {
+
+		if entry.Length < len(tail) {
+			return nil, ErrDecrypt
+		}
+
+		if _, err = file.ReadAt(tail, entry.Offset+int64(entry.Length-len(tail))); err != nil {
+			return nil, err
+		}
+
+		entry.Offset = offset
+		entry.Length = crypt.blockSize(entry.Length, tail)
+		offset += int64(entry.Length) + 1
+
+		plain = append(plain, entry)
+
+	}
+
+	return
+
+}
+
+// Reads the encrypted blocks decrypted, one per line, each must match the length of its plaintext entry
+type blockReader struct {
+	file   *os.File
+	crypt  *dbCipher
+	sealed []BlockIndex
+	plain  []BlockIndex
+	next   int
+	buf    []byte
+}
+
+func (r *blockReader) Read(p []byte) (n int, err error) {
+
+	for len(r.buf) == 0 {
+
+		if r.next >= len(r.sealed) {
+			return 0, io.EOF
+		}
+
+		entry := r.sealed[r.next]
+		data := make([]byte, entry.Length)
+
+		if _, err = r.file.ReadAt(data, entry.Offset); err != nil {
+			return
+		}
+
+		if data, err = r.crypt.openBlock(data); err != nil {
+			return
+		}
+
+		if len(data) != r.plain[r.next].Length {
+			return 0, ErrDecrypt
+		}
+
+		r.buf = append(data, '\n')
+		r.next++
+
+	}
+
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return
+
+}
+
+// Import a snapshot from `r` into a new BlockDB at `filename`, then verify the chain against the signed manifest.
+// The manifest must be signed by `publicKey`
+func RestoreSnapshot(r io.Reader, filename string, publicKey []byte) (manifest SnapshotManifest, err error) {
+
+	if len(publicKey) == 0 {
+		return manifest, ErrSnapshotKey
+	}
+
+	if stat, statErr := os.Stat(filename); statErr == nil && stat.Size() > 0 {
+		return manifest, fmt.Errorf("BlockDB %s already exists, refusing to overwrite", filename)
+	}
+
+	gz, err := gzip.NewReader(r)
+
+	if err != nil {
+		return
+	}
+
+	tr := tar.NewReader(gz)
+
+	targets := map[string]string{
+		snapshotBlocksFile: filename + ".restore",
+		snapshotIndexFile:  fmt.Sprintf("%s.idx", filename) + ".restore",
+	}
+
+	defer func() {
+		for _, target := range targets {
+			os.Remove(target)
+		}
+	}()
+
+	checksums := make(map[string]SnapshotFile)
+	var manifestData []byte
+
+	for {
+
+		header, readErr := tr.Next()
+
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return manifest, readErr
+		}
+
+		if header.Name == snapshotManifestFile {
+			if manifestData, err = io.ReadAll(tr); err != nil {
+				return
+			}
+			continue
+		}
+
+		target, ok := targets[header.Name]
+
+		if !ok {
+			return manifest, fmt.Errorf("Unexpected file in snapshot: %s", header.Name)
+		}
+
+		out, createErr := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+
+		if createErr != nil {
+			return manifest, createErr
+		}
+
+		h := sha256.New()
+		size, copyErr := io.Copy(io.MultiWriter(out, h), tr)
+
+		if closeErr := out.Close(); copyErr == nil {
+			copyErr = closeErr
+		}
+
+		if copyErr != nil {
+			return manifest, copyErr
+		}
+
+		snapshotFile := SnapshotFile{Name: header.Name, Size: size}
+		copy(snapshotFile.Checksum[:], h.Sum(nil))
+		checksums[header.Name] = snapshotFile
+
+	}
+
+	if manifestData == nil {
+		return manifest, errors.New("Snapshot manifest missing")
+	}
+
+	if err = json.Unmarshal(manifestData, &manifest); err != nil {
+		return
+	}
+
+	if err = manifest.verify(publicKey); err != nil {
+		return
+	}
+
+	for _, file := range manifest.Files {
+		if checksums[file.Name] != file {
+			return manifest, fmt.Errorf("%w (%s)", ErrSnapshotChecksum, file.Name)
+		}
+	}
+
+	if len(checksums) != len(manifest.Files) {
+		return manifest, fmt.Errorf("%w (unlisted files)", ErrSnapshotChecksum)
+	}
+
+	if manifest.PrunedHeight > manifest.Height {
+		return manifest, fmt.Errorf("%w (pruned height %d above height %d)", ErrSnapshotHead, manifest.PrunedHeight, manifest.Height)
+	}
+
+	if manifest.Version > CurrentVersion {
+		return manifest, fmt.Errorf("%w: snapshot version %d is newer than supported version %d", ErrIncompatible, manifest.Version, CurrentVersion)
+	}
+
+	// Record the snapshot format and chain, older formats are migrated when opened
+	db := New(filename)
+	db.ChainID = manifest.ChainID
+
+	if err = WriteManifest(db.ManifestFilename(), Manifest{Version: manifest.Version, ChainID: manifest.ChainID, HashAlgorithm: HashAlgorithm, PrunedHeight: manifest.PrunedHeight, Created: time.Now()}); err != nil {
+		return
+	}
+
+	if err = os.Rename(targets[snapshotIndexFile], fmt.Sprintf("%s.idx", filename)); err != nil {
+		return
+	}
+
+	if err = os.Rename(targets[snapshotBlocksFile], filename); err != nil {
+		return
+	}
+
+	// Verify the restored chain matches the manifest, remove it on failure
+	if err = db.Open(); err == nil {
+		err = db.Verify()
+	}
+
+	if err == nil && (db.Len() != manifest.Blocks || db.GetLatestIndex().Key != manifest.Head || db.GetLatestIndex().Header.SeqID != manifest.Height) {
+		err = ErrSnapshotHead
+	}
+
+	db.Close()
+
+	if err != nil {
+		os.Remove(filename)
+		os.Remove(db.IndexFilename())
+		os.Remove(db.ManifestFilename())
+		return
+	}
+
+	log.Info(fmt.Sprintf("Restored snapshot => (%d) blocks, height %d", manifest.Blocks, manifest.Height))
+
+	return
+
+}
+
+// Confirm the manifest is signed by its public key, the expected key
+func (manifest SnapshotManifest) verify(publicKey []byte) (err error) {
+
+	if len(manifest.PublicKey) != 32 || !bytes.Equal(publicKey, manifest.PublicKey) {
+		return ErrSnapshotSignature
+	}
+
+	unsigned := manifest
+	unsigned.Signature = nil
+
+	data, err := json.Marshal(unsigned)
+
+	if err != nil {
+		return
+	}
+
+	mywallet := wallet.New()
+
+	if !mywallet.VerifyRaw(manifest.PublicKey, data, manifest.Signature) {
+		return ErrSnapshotSignature
+	}
+
+	return
+
+}
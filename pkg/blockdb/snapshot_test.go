@@ -0,0 +1,122 @@
+package blockdb_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	mywallet := wallet.New()
+	assert.Nil(t, mywallet.GenerateWallet())
+
+	buf := new(bytes.Buffer)
+
+	manifest, err := db.Snapshot(buf, &mywallet)
+	assert.Nil(t, err)
+	assert.Equal(t, db.Len(), manifest.Blocks)
+	assert.Equal(t, db.GetLatestIndex().Key, manifest.Head)
+	assert.Equal(t, db.GetLatestIndex().Header.SeqID, manifest.Height)
+
+	// Restore to a new DB, signed by the expected key
+	path := filepath.Join(t.TempDir(), "blockchain-db.json")
+
+	restored, err := blockdb.RestoreSnapshot(bytes.NewReader(buf.Bytes()), path, mywallet.PublicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest.Head, restored.Head)
+
+	newdb := blockdb.New(path)
+	assert.Nil(t, newdb.Open())
+	assert.Equal(t, db.Len(), newdb.Len())
+	assert.Nil(t, newdb.Verify())
+	newdb.Close()
+
+	// An existing DB is never overwritten
+	_, err = blockdb.RestoreSnapshot(bytes.NewReader(buf.Bytes()), path, mywallet.PublicKey)
+	assert.NotNil(t, err)
+
+	// The key the snapshot is signed with is always required
+	_, err = blockdb.RestoreSnapshot(bytes.NewReader(buf.Bytes()), filepath.Join(t.TempDir(), "db.json"), nil)
+	assert.True(t, errors.Is(err, blockdb.ErrSnapshotKey))
+
+	// Signed by another key
+	other := wallet.New()
+	assert.Nil(t, other.GenerateWallet())
+
+	_, err = blockdb.RestoreSnapshot(bytes.NewReader(buf.Bytes()), filepath.Join(t.TempDir(), "db.json"), other.PublicKey)
+	assert.True(t, errors.Is(err, blockdb.ErrSnapshotSignature))
+
+}
+
+func TestSnapshotTampered(t *testing.T) {
+
+	mywallet := wallet.New()
+	assert.Nil(t, mywallet.GenerateWallet())
+
+	// Snapshot a chain with an invalid block, the checksums match but verification fails
+	path := tempDB(t, db_path)
+	tamper(t, path, 5, func(block *blockdb.BlockKV) { block.Value.Payload[0].Data = []byte("tampered") })
+
+	corrupt := blockdb.New(path)
+	assert.Nil(t, corrupt.Open())
+	defer corrupt.Close()
+
+	buf := new(bytes.Buffer)
+	_, err := corrupt.Snapshot(buf, &mywallet)
+	assert.Nil(t, err)
+
+	target := filepath.Join(t.TempDir(), "blockchain-db.json")
+
+	_, err = blockdb.RestoreSnapshot(bytes.NewReader(buf.Bytes()), target, mywallet.PublicKey)
+	assert.True(t, errors.Is(err, blockdb.ErrChecksumMismatch))
+	assert.NoFileExists(t, target)
+
+}
+
+// The pruned height is kept in the restored manifest, pruned blocks are fetched from archive nodes
+func TestSnapshotPruned(t *testing.T) {
+
+	db := blockdb.New(tempDB(t, db_path))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	appendMerkleBlocks(t, &db, 10, time.Now())
+
+	result, err := db.Prune(blockdb.RetentionPolicy{KeepBlocks: 2})
+	assert.Nil(t, err)
+	assert.NotZero(t, result.PrunedHeight)
+
+	mywallet := wallet.New()
+	assert.Nil(t, mywallet.GenerateWallet())
+
+	buf := new(bytes.Buffer)
+
+	manifest, err := db.Snapshot(buf, &mywallet)
+	assert.Nil(t, err)
+	assert.Equal(t, result.PrunedHeight, manifest.PrunedHeight)
+
+	path := filepath.Join(t.TempDir(), "blockchain-db.json")
+
+	restored, err := blockdb.RestoreSnapshot(buf, path, mywallet.PublicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, result.PrunedHeight, restored.PrunedHeight)
+
+	newdb := blockdb.New(path)
+	assert.Nil(t, newdb.Open())
+	defer newdb.Close()
+
+	assert.Equal(t, result.PrunedHeight, newdb.PrunedHeight())
+	assert.Nil(t, newdb.Verify())
+
+}
@@ -0,0 +1,89 @@
+package blockdb
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A page of blocks synced from a peer. Next is the hash of the last block, passed as `from` to fetch the
+// next page, and is empty on the last page. Height is the SeqID of the latest block of the peer
+type SyncBlocks struct {
+	PublicKey []byte    `json:"public_key"`
+	Blocks    []BlockKV `json:"blocks"`
+	Next      []byte    `json:"next,omitempty"`
+	Height    uint64    `json:"height"`
+}
+
+// Position of the block following `from`, the zero hash for the first block. Returns false if `from` is
+// not in the chain, the peer asking is on another branch and must find the common ancestor first
+func (blockdb *BlockDB) Sync(from []byte) (id int, ok bool) {
+
+	blockdb.Mu.RLock()
+	defer blockdb.Mu.RUnlock()
+
+	var key Hash
+
+	if len(from) != len(key) {
+		return 0, false
+	}
+
+	copy(key[:], from)
+
+	if key == (Hash{}) {
+		return 0, true
+	}
+
+	pos, ok := blockdb.byHash[key]
+
+	if !ok {
+		return 0, false
+	}
+
+	log.Debug("Sync => Found match: ", pos)
+
+	return pos + 1, true
+
+}
+
+// Position of the block with SeqID `height`, or the end of the chain if it is shorter
+func (blockdb *BlockDB) SyncHeight(height uint64) (id int) {
+
+	blockdb.Mu.RLock()
+	defer blockdb.Mu.RUnlock()
+
+	// SeqIDs increase along the chain
+	return sort.Search(len(blockdb.Index), func(i int) bool { return blockdb.Index[i].Header.SeqID >= height })
+
+}
+
+// Read up to `limit` blocks from position `id`, stopping before `maxBytes` of blocks on disk. The first
+// block is always read, so each page makes progress however large the block
+func (blockdb *BlockDB) SyncPage(id int, limit int, maxBytes int) (blocks []BlockKV, err error) {
+
+	blockdb.Mu.RLock()
+
+	end, size := id, 0
+
+	for end < len(blockdb.Index) && end-id < limit {
+
+		size += blockdb.Index[end].Length
+
+		if end > id && size > maxBytes {
+			break
+		}
+
+		end++
+
+	}
+
+	blockdb.Mu.RUnlock()
+
+	err = blockdb.Iterate(id, end, func(i int, block *BlockKV) error {
+		blocks = append(blocks, *block)
+		return nil
+	})
+
+	return
+
+}
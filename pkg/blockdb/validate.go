@@ -0,0 +1,248 @@
+package blockdb
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrTxSignature = errors.New("TX signature does not match the sender")
+
+// Version of the signed TX encoding, the packet version TX's with a replay header are sent with
+const TxSignatureVersion uint8 = 3
+
+// The bytes a TX with a replay header is signed over. The version, type, flags and recipient are
+// signed with the data, so none of them can be changed in transit
+func TxSigningBytes(version, txType, flags uint8, recipient, data []byte) []byte {
+
+	signed := make([]byte, 0, 3+len(recipient)+len(data))
+	signed = append(signed, version, txType, flags)
+	signed = append(signed, recipient...)
+
+	return append(signed, data...)
+
+}
+
+// Confirm the TX is signed by the sender. TX's with a replay header are signed with their type, flags
+// and recipient, older TX's over the data only. Pruned TX's can't be verified, only the commitment is kept
+func VerifyTx(tx TxPayload) error {
+
+	if tx.Pruned {
+		return nil
+	}
+
+	if len(tx.Sender) != ed25519.PublicKeySize {
+		return ErrTxSignature
+	}
+
+	signed := tx.Data
+
+	if tx.Reserved&TxFlagReplay != 0 {
+
+		if len(tx.Recipient) != ed25519.PublicKeySize {
+			return ErrTxSignature
+		}
+
+		signed = TxSigningBytes(TxSignatureVersion, tx.Type, tx.Reserved, tx.Recipient, tx.Data)
+
+	}
+
+	if !ed25519.Verify(tx.Sender, signed, tx.Signature) {
+		return ErrTxSignature
+	}
+
+	return nil
+
+}
+
+// Confirm the TX carries no signature or no sender to verify it with, as TX's of chains from before TX's
+// were signed. TX's with a replay header are always signed
+func unsigned(tx TxPayload) bool {
+
+	return (len(tx.Signature) == 0 || len(tx.Sender) == 0) && tx.Reserved&TxFlagReplay == 0
+
+}
+
+// Confirm TX `i` of the block is signed by the sender. Unsigned TX's are accepted in blocks without a
+// TX root, written before TX's were signed
+func VerifyBlockTx(block *BlockKV, i int) error {
+
+	tx := block.Value.Payload[i]
+
+	if block.Value.Header.TxRoot == nil && unsigned(tx) {
+		return nil
+	}
+
+	return VerifyTx(tx)
+
+}
+
+// Confirm a block without a TX root does not follow a block with one. Unsigned TX's are only accepted in
+// blocks without a TX root, which chains stopped writing once TX's were signed
+func checkLegacy(block *BlockKV, parent *BlockKV) error {
+
+	if block.Value.Header.TxRoot == nil && parent != nil && parent.Value.Header.TxRoot != nil {
+		return ErrLegacyBlock
+	}
+
+	return nil
+
+}
+
+// Verify blocks received from a peer before they are appended, across `cpu_cores` workers. Each block
+// must match its hash and link to the previous block, the first to the parent it names, and every TX
+// must be signed by the sender, except unsigned TX's in blocks without a TX root. Returns a *VerifyError
+// for the first (lowest) invalid block
+func VerifyBlocks(blocks []BlockKV, cpu_cores int) (err error) {
+
+	if cpu_cores < 1 {
+		cpu_cores = 1
+	}
+
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var firstErr *VerifyError
+	next := int64(-1)
+
+	for w := 0; w < cpu_cores; w++ {
+
+		wg.Add(1)
+
+		go func() {
+
+			defer wg.Done()
+
+			for {
+
+				i := int(atomic.AddInt64(&next, 1))
+
+				if i >= len(blocks) {
+					return
+				}
+
+				// Abort if a lower block has already failed, it is reported first
+				errMu.Lock()
+				abort := firstErr != nil && firstErr.Index < i
+				errMu.Unlock()
+
+				if abort {
+					return
+				}
+
+				verr := verifyReceived(blocks, i)
+
+				if verr == nil {
+					continue
+				}
+
+				errMu.Lock()
+				if firstErr == nil || verr.Index < firstErr.Index {
+					firstErr = verr
+				}
+				errMu.Unlock()
+
+			}
+
+		}()
+
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return
+
+}
+
+// Verify the block at index `i` of the blocks received
+func verifyReceived(blocks []BlockKV, i int) *VerifyError {
+
+	block := &blocks[i]
+
+	parentHash := block.Value.Header.Parent
+	parentSeqID := block.Value.Header.SeqID - 1
+
+	var parent *BlockKV
+
+	if i > 0 {
+		parent = &blocks[i-1]
+		parentHash = parent.Key
+		parentSeqID = parent.Value.Header.SeqID
+	}
+
+	err := checkBlock(block, parentHash, parentSeqID)
+
+	if err == nil && block.Value.Header.SeqID == 0 {
+		err = ErrSeqIDMismatch
+	}
+
+	// The first block is checked against the local head as it is appended
+	if err == nil {
+		err = checkLegacy(block, parent)
+	}
+
+	for j := 0; err == nil && j < len(block.Value.Payload); j++ {
+		if VerifyBlockTx(block, j) != nil {
+			err = fmt.Errorf("%w (TX %d)", ErrTxSignature, j)
+		}
+	}
+
+	if err != nil {
+		return &VerifyError{Index: i, SeqID: block.Value.Header.SeqID, Hash: block.Key, Err: err}
+	}
+
+	return nil
+
+}
+
+// Append a block received from a peer if it follows the latest block and is within the size limits.
+// The check and the write are made under the lock, so a block appended meanwhile can't be overwritten
+func (blockdb *BlockDB) AppendBlock(block *BlockKV) (err error) {
+
+	data, err := json.Marshal(block)
+
+	if err != nil {
+		return
+	}
+
+	if err = blockdb.CheckBlockSize(data, len(block.Value.Payload)); err != nil {
+		return
+	}
+
+	blockdb.Mu.Lock()
+	defer blockdb.Mu.Unlock()
+
+	var head BlockIndex
+
+	if n := len(blockdb.Index); n > 0 {
+		head = blockdb.Index[n-1]
+	}
+
+	if err = checkBlock(block, head.Key, head.Header.SeqID); err != nil {
+		return
+	}
+
+	// The head is only read for blocks without a TX root
+	if block.Value.Header.TxRoot == nil && len(blockdb.Index) > 0 {
+
+		parent, err := blockdb.get(len(blockdb.Index) - 1)
+
+		if err != nil {
+			return err
+		}
+
+		if err = checkLegacy(block, parent); err != nil {
+			return err
+		}
+
+	}
+
+	return blockdb.write(data, block.Key, block.Value.Header)
+
+}
@@ -0,0 +1,190 @@
+package blockdb_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// Build `n` blocks of signed TX's following the parent
+func signedBlocks(t *testing.T, signer *wallet.Wallet, parent blockdb.BlockIndex, n int) (blocks []blockdb.BlockKV) {
+
+	for i := 0; i < n; i++ {
+
+		var payload []blockdb.TxPayload
+
+		for j := 0; j < 3; j++ {
+
+			// Unique per call, so branches from the same parent differ
+			data := []byte(fmt.Sprintf("message %d.%d %d", i, j, time.Now().UnixNano()))
+			sig, err := signer.Sign(data)
+			assert.Nil(t, err)
+
+			payload = append(payload, blockdb.TxPayload{Sender: signer.PublicKey, Data: data, Signature: sig, Type: 1})
+
+		}
+
+		root, err := blockdb.TxRoot(payload)
+		assert.Nil(t, err)
+
+		header := blockdb.BlockHeader{Parent: parent.Key, SeqID: parent.Header.SeqID + 1, SeqTime: time.Now(), TxRoot: &root}
+
+		block := blockdb.BlockKV{
+			Key: blockdb.BlockHash(header),
+			Value: blockdb.Block{
+				Header:  header,
+				Payload: payload,
+			},
+		}
+
+		blocks = append(blocks, block)
+		parent = blockdb.BlockIndex{Key: block.Key, Header: block.Value.Header}
+
+	}
+
+	return
+
+}
+
+// Commit the block to its tampered TX's, so only the signature check fails
+func rehash(t *testing.T, block *blockdb.BlockKV) {
+
+	root, err := blockdb.TxRoot(block.Value.Payload)
+	assert.Nil(t, err)
+
+	block.Value.Header.TxRoot = &root
+	block.Key = blockdb.BlockHash(block.Value.Header)
+
+}
+
+func TestVerifyBlocks(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	blocks := signedBlocks(t, &signer, blockdb.BlockIndex{}, 40)
+
+	assert.Nil(t, blockdb.VerifyBlocks(blocks, 4))
+	assert.Nil(t, blockdb.VerifyBlocks(nil, 4))
+
+	// Pruned TX's keep their commitment, the signature can't be checked
+	pruned := append([]blockdb.BlockKV{}, blocks...)
+	pruned[5].Value.Payload = append([]blockdb.TxPayload{}, pruned[5].Value.Payload...)
+	blockdb.PruneTx(&pruned[5].Value.Payload[1])
+	assert.Nil(t, blockdb.VerifyBlocks(pruned, 4))
+
+	// The lowest invalid block is reported, for each failure type
+	tests := []struct {
+		index  int
+		err    error
+		tamper func(block *blockdb.BlockKV)
+	}{
+		{12, blockdb.ErrTxSignature, func(block *blockdb.BlockKV) { block.Value.Payload[2].Signature[0] ^= 0xff; rehash(t, block) }},
+		{20, blockdb.ErrChecksumMismatch, func(block *blockdb.BlockKV) { block.Key[0] ^= 0xff }},
+		{25, blockdb.ErrParentMismatch, func(block *blockdb.BlockKV) { block.Value.Header.Parent[0] ^= 0xff }},
+		{30, blockdb.ErrSeqIDMismatch, func(block *blockdb.BlockKV) { block.Value.Header.SeqID++ }},
+	}
+
+	for _, test := range tests {
+
+		tampered := signedBlocks(t, &signer, blockdb.BlockIndex{}, 40)
+		test.tamper(&tampered[test.index])
+
+		// A later block is broken too, the first is reported
+		tampered[35].Value.Payload[0].Data = []byte("tampered")
+
+		for _, cpu_cores := range []int{1, 3, 8} {
+
+			err := blockdb.VerifyBlocks(tampered, cpu_cores)
+
+			var verr *blockdb.VerifyError
+			assert.True(t, errors.As(err, &verr))
+			assert.Equal(t, test.index, verr.Index)
+			assert.True(t, errors.Is(err, test.err), err)
+
+		}
+
+	}
+
+	// TX's with a malformed sender key are rejected
+	tampered := signedBlocks(t, &signer, blockdb.BlockIndex{}, 1)
+	tampered[0].Value.Payload[0].Sender = []byte("sender")
+	rehash(t, &tampered[0])
+	assert.True(t, errors.Is(blockdb.VerifyBlocks(tampered, 1), blockdb.ErrTxSignature))
+
+}
+
+// TX's with a replay header are verified over the signed fields, as perryctl verifies the DB
+func TestVerifyBlockTx(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	data := []byte("message")
+	flags := blockdb.TxFlagReplay
+
+	signature, err := signer.Sign(blockdb.TxSigningBytes(blockdb.TxSignatureVersion, 1, flags, signer.PublicKey, data))
+	assert.Nil(t, err)
+
+	root := blockdb.Hash{}
+	block := blockdb.BlockKV{Value: blockdb.Block{
+		Header:  blockdb.BlockHeader{TxRoot: &root},
+		Payload: []blockdb.TxPayload{{Sender: signer.PublicKey, Recipient: signer.PublicKey, Data: data, Signature: signature, Type: 1, Reserved: flags}, {Sender: []byte("alice"), Data: data}, {Recipient: signer.PublicKey, Data: data, Signature: signature}},
+	}}
+
+	assert.Nil(t, blockdb.VerifyBlockTx(&block, 0))
+
+	// The signature covers the data alone for TX's without a replay header only
+	assert.False(t, signer.VerifyRaw(signer.PublicKey, data, signature))
+
+	// Unsigned TX's are only accepted in blocks without a TX root
+	assert.ErrorIs(t, blockdb.VerifyBlockTx(&block, 1), blockdb.ErrTxSignature)
+
+	// As are TX's with no sender to verify the signature with
+	assert.ErrorIs(t, blockdb.VerifyBlockTx(&block, 2), blockdb.ErrTxSignature)
+
+	block.Value.Header.TxRoot = nil
+	assert.Nil(t, blockdb.VerifyBlockTx(&block, 1))
+	assert.Nil(t, blockdb.VerifyBlockTx(&block, 2))
+
+}
+
+func TestAppendBlock(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	db := blockdb.New(filepath.Join(t.TempDir(), "blockchain.db"))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	blocks := signedBlocks(t, &signer, blockdb.BlockIndex{}, 3)
+
+	for i := range blocks {
+		assert.Nil(t, db.AppendBlock(&blocks[i]))
+	}
+
+	assert.Equal(t, 3, db.Len())
+	assert.Nil(t, db.Verify())
+
+	// Blocks must follow the latest block
+	assert.True(t, errors.Is(db.AppendBlock(&blocks[1]), blockdb.ErrParentMismatch))
+
+	fork := signedBlocks(t, &signer, db.GetLatestIndex(), 1)
+	fork[0].Value.Header.SeqID++
+	assert.True(t, errors.Is(db.AppendBlock(&fork[0]), blockdb.ErrSeqIDMismatch))
+
+	// Size limits apply to synced blocks
+	db.MaxBlockTx = 2
+	next := signedBlocks(t, &signer, db.GetLatestIndex(), 1)
+	assert.True(t, errors.Is(db.AppendBlock(&next[0]), blockdb.ErrBlockTooManyTx))
+
+	assert.Equal(t, 3, db.Len())
+
+}
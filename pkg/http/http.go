@@ -3,21 +3,46 @@ package http
 import (
 	"context"
 	"fmt"
+	"net"
+	"os"
+	"time"
 
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
+	"github.com/perrychain/perry/pkg/blockdb"
 	"github.com/perrychain/perry/pkg/p2pnet"
 	"github.com/perrychain/perry/pkg/poh_hash"
 	log "github.com/sirupsen/logrus"
 )
 
 type HTTP struct {
-	P2P_Node   p2pnet.Node
-	RPC_Node   p2pnet.Node
-	WalletPath string
-	DBPath     string
+	P2P_Node     p2pnet.Node
+	RPC_Node     p2pnet.Node
+	WalletPath   string
+	DBPath       string
+	MaxBlockSize int
+	MaxBlockTx   int
+	SnapshotPath string
+	SnapshotKey  []byte
+	ChainID      string
+	Retention    blockdb.RetentionPolicy
+	DBPassphrase []byte
+
+	// Peers are saved to PeersFile, bootstrap peers as host:port
+	PeersFile      string
+	BootstrapPeers []string
+
+	// Bans are saved to BansFile
+	BansFile string
+
+	// Switch to the longer fork of a trusted peer, rolling back at most MaxReorgDepth blocks (0 for the default)
+	AllowReorg    bool
+	MaxReorgDepth int
 }
 
+// Interval to prune the blockchain DB with the retention policy
+const retentionInterval = 10 * time.Minute
+
 func New(h HTTP) HTTP {
 
 	return h
@@ -29,11 +54,31 @@ func (http HTTP) Serve() {
 
 	router := gin.Default()
 
-	// Enable gzip compression by default
-	router.Use(gzip.Gzip(gzip.DefaultCompression))
+	// Enable gzip compression by default, snapshots are already compressed
+	router.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{"/p2p/snapshot"})))
+
+	// Bootstrap a new node from a snapshot, the remaining blocks are synced from peers
+	if http.SnapshotPath != "" {
+		http.restoreSnapshot()
+	}
 
 	poh := poh_hash.New(http.WalletPath, http.DBPath)
 
+	if http.MaxBlockSize > 0 {
+		poh.BlockDB.MaxBlockSize = http.MaxBlockSize
+	}
+
+	if http.MaxBlockTx > 0 {
+		poh.BlockDB.MaxBlockTx = http.MaxBlockTx
+	}
+
+	if http.ChainID != "" {
+		poh.BlockDB.ChainID = http.ChainID
+	}
+
+	poh.BlockDB.Retention = http.Retention
+	poh.BlockDB.Passphrase = http.DBPassphrase
+
 	p2p := p2pnet.New(p2pnet.P2P{
 		RPC_Node: p2pnet.Node{
 			Host: http.RPC_Node.Host,
@@ -44,21 +89,40 @@ func (http HTTP) Serve() {
 			Host: http.P2P_Node.Host,
 			Port: http.P2P_Node.Port,
 		},
+
+		PeersFile:      http.PeersFile,
+		BootstrapPeers: http.BootstrapPeers,
+		BansFile:       http.BansFile,
+		AllowReorg:     http.AllowReorg,
+		MaxReorgDepth:  http.MaxReorgDepth,
 	})
 
 	p2p.POH = &poh
 
+	// Sequencing receipts are issued as blocks are written
+	poh.OnBlock = p2p.BlockReceipts
+
 	// Launch the UDP packet receiver
 	go func() {
 		p2p.Listen(p2p.MsgHandler)
 	}()
 
+	// Launch the TCP stream listener for sync, snapshots and large messages
+	go func() {
+		p2p.ListenStreams()
+	}()
+
 	// Launch peer query
 	go func() {
 		p2p.QueryPeers(context.Background())
 
 	}()
 
+	// Launch TX data pruning for the retention policy
+	go func() {
+		poh.BlockDB.RetentionLoop(context.Background(), retentionInterval)
+	}()
+
 	// Launch the PoH go routine
 	go func() {
 		// TODO: Loop forever
@@ -72,23 +136,109 @@ func (http HTTP) Serve() {
 
 	router.GET("/verify", poh.Verify)
 
-	router.GET("/push", poh.Pushstate)
+	router.GET("/push", p2p.RateLimit(), poh.Pushstate)
 
 	router.GET("/state", poh.State)
 
 	router.GET("/", poh.Index)
 
+	// Block queries by SeqID range, SeqTime window or hash
+	router.GET("/blocks", poh.Blocks)
+
+	router.GET("/blocks/time", poh.BlocksByTime)
+
+	router.GET("/blocks/hash", poh.BlockByHash)
+
 	// p2p state
-	router.GET("/p2p/status", p2p.Status)
+	router.GET("/p2p/status", p2p.RateLimit(), p2p.Status)
 
 	// Sync state from specified point
-	router.GET("/p2p/sync", p2p.Sync)
+	router.GET("/p2p/sync", p2p.RateLimit(), p2p.Sync)
+
+	// Common ancestor with a peer's chain, from its block locator
+	router.GET("/p2p/ancestor", p2p.RateLimit(), p2p.Ancestor)
+
+	// Signed snapshot of the blockchain DB, only from the local host. Peers fetch snapshots over an
+	// authenticated stream session
+	router.GET("/p2p/snapshot", localOnly, p2p.Snapshot)
+
+	// Peer exchange, signed peer lists and the handshake to verify new peers
+	router.GET("/p2p/peers", p2p.RateLimit(), p2p.Peers)
+
+	router.GET("/p2p/handshake", p2p.RateLimit(), p2p.Handshake)
+
+	// Delivery receipts by message ID
+	router.GET("/p2p/receipt", p2p.RateLimit(), p2p.ReceiptStatus)
+
+	// How far a gossiped message has spread, by message ID
+	router.GET("/p2p/gossip", p2p.RateLimit(), p2p.GossipStatus)
 
-	// TODO: Add P2P support
-	//router.GET("/p2p/nodes", poh.state)
-	//router.GET("/p2p/status", poh.state)
+	// Admin endpoints, only from the local host
+	admin := router.Group("/admin", localOnly)
+
+	admin.GET("/bans", p2p.Bans)
+
+	admin.POST("/bans", p2p.AddBan)
+
+	admin.DELETE("/bans", p2p.RemoveBan)
 
 	log.Info("Launching service on ", fmt.Sprintf("%s:%d", http.RPC_Node.Host, http.RPC_Node.Port))
 	router.Run(fmt.Sprintf("%s:%d", http.RPC_Node.Host, http.RPC_Node.Port))
 
 }
+
+// Import the snapshot file if the blockchain DB is empty
+func (http HTTP) restoreSnapshot() {
+
+	if stat, err := os.Stat(http.DBPath); err == nil && stat.Size() > 0 {
+		log.Info("BlockDB exists, skipping snapshot ", http.SnapshotPath)
+		return
+	}
+
+	f, err := os.Open(http.SnapshotPath)
+
+	if err != nil {
+		log.Fatal(fmt.Sprintf("Could not open snapshot: %s", err))
+	}
+
+	defer f.Close()
+
+	// Any node can sign a snapshot, only the expected key is trusted
+	if len(http.SnapshotKey) == 0 {
+		log.Fatal("Could not restore snapshot: the public key the snapshot is signed with is required")
+	}
+
+	if _, err := blockdb.RestoreSnapshot(f, http.DBPath, http.SnapshotKey); err != nil {
+		log.Fatal(fmt.Sprintf("Could not restore snapshot: %s", err))
+	}
+
+	// Snapshots are plaintext, encrypt the restored DB before use
+	if http.DBPassphrase != nil {
+		db := blockdb.New(http.DBPath)
+
+		if http.ChainID != "" {
+			db.ChainID = http.ChainID
+		}
+
+		if err := db.Encrypt(http.DBPassphrase); err != nil {
+			log.Fatal(fmt.Sprintf("Could not encrypt BlockDB: %s", err))
+		}
+
+		db.Close()
+	}
+
+}
+
+// Reject requests not from the loopback interface
+func localOnly(c *gin.Context) {
+
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		c.AbortWithStatusJSON(403, gin.H{"status": "fail", "error": "admin endpoints are only available from the local host"})
+		return
+	}
+
+	c.Next()
+
+}
@@ -0,0 +1,877 @@
+package p2pnet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/wallet"
+	log "github.com/sirupsen/logrus"
+)
+
+// Methods served over stream sessions
+const (
+	StreamSync     = "sync"     // a SyncRequest, answered with a page of blocks
+	StreamSnapshot = "snapshot" // a snapshot of the chain, see blockdb.Snapshot
+	StreamMessage  = "message"  // a message too large for a packet, answered with a receipt
+	StreamStatus   = "status"   // the Status of the node
+	StreamPacket   = "packet"   // a packet gossiped between peers
+	StreamAncestor = "ancestor" // an ancestorRequest, answered with the Ancestor
+	StreamPeers    = "peers"    // the signed PeerList of the node
+)
+
+// Time to connect to a peer, peers that could not be reached are not dialed again until streamRetry
+const streamDialTimeout = 5 * time.Second
+const streamRetry = time.Minute
+
+// Largest request read from a sync or ancestor stream, a locator of maxLocator hashes fits
+const maxSyncRequest = 4096
+
+var (
+	ErrStreamsDisabled   = errors.New("streams are disabled")
+	ErrStreamUnavailable = errors.New("peer does not accept streams")
+	ErrPlaintextRefused  = errors.New("verified peer unreachable over a stream, plaintext refused")
+	ErrSnapshotRefused   = errors.New("snapshots are only served to verified peers")
+)
+
+// Stream sessions dialed to peers by address, and those accepted, so all are closed with the node
+type streamPool struct {
+	enabled  bool
+	mu       sync.Mutex
+	sessions map[string]*StreamSession
+	accepted map[*StreamSession]bool
+	failed   map[string]time.Time
+	dialing  map[string]bool
+	listener net.Listener
+	closed   bool
+}
+
+// The locator of a chain, as the HTTP ancestor request takes it
+type ancestorRequest struct {
+	Locator []string `json:"locator"`
+}
+
+// A message sent whole over a stream, with the gossip hops it has travelled
+type streamMessage struct {
+	Tx   blockdb.TxPayload `json:"tx"`
+	Hops uint8             `json:"hops"`
+}
+
+func newStreamPool(enabled bool) *streamPool {
+
+	return &streamPool{enabled: enabled, sessions: make(map[string]*StreamSession), accepted: make(map[*StreamSession]bool), failed: make(map[string]time.Time), dialing: make(map[string]bool)}
+
+}
+
+// Close the listener and every session
+func (pool *streamPool) close() (err error) {
+
+	pool.mu.Lock()
+
+	pool.closed = true
+
+	if pool.listener != nil {
+		err = pool.listener.Close()
+		pool.listener = nil
+	}
+
+	var sessions []*StreamSession
+
+	for _, session := range pool.sessions {
+		sessions = append(sessions, session)
+	}
+
+	for session := range pool.accepted {
+		sessions = append(sessions, session)
+	}
+
+	pool.mu.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+
+	return
+
+}
+
+// Accept stream sessions on the TCP port of the P2P node, beside the UDP transport
+func (p2p *P2P) ListenStreams() {
+
+	if !p2p.streams.enabled {
+		return
+	}
+
+	l, err := net.Listen("tcp", p2p.P2P_Node.address())
+
+	if err != nil {
+		log.Warn("Streams => ", err)
+		return
+	}
+
+	if err = p2p.ServeStreams(l); err != nil {
+		log.Warn("Streams => ", err)
+	}
+
+}
+
+// Accept stream sessions on the listener until the node is closed. Sessions authenticate with the node key
+func (p2p *P2P) ServeStreams(l net.Listener) error {
+
+	if p2p.POH == nil {
+		l.Close()
+		return ErrStreamsDisabled
+	}
+
+	p2p.streams.mu.Lock()
+
+	if p2p.streams.closed {
+		p2p.streams.mu.Unlock()
+		l.Close()
+		return ErrStreamClosed
+	}
+
+	p2p.streams.listener = l
+	p2p.streams.mu.Unlock()
+
+	for {
+
+		conn, err := l.Accept()
+
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		go p2p.serveSession(conn)
+
+	}
+
+}
+
+// Authenticate the peer and serve the streams it opens. Banned sources are dropped before the handshake
+func (p2p *P2P) serveSession(conn net.Conn) {
+
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	if p2p.reputation.Banned(SourceIP(ip)) || !p2p.reputation.AllowIP(ip) {
+		conn.Close()
+		return
+	}
+
+	session, err := NewStreamSession(conn, &p2p.POH.Wallet, nil, false, p2p.MaxStreams)
+
+	if err != nil {
+
+		log.Debug("Streams => ", err)
+
+		if errors.Is(err, ErrStreamAuth) {
+			p2p.reputation.Penalize(SourceIP(ip), PenaltySignature, "stream authentication failure")
+		}
+
+		return
+
+	}
+
+	if p2p.reputation.Banned(SourceKey(session.PublicKey)) {
+		session.Close()
+		return
+	}
+
+	pool := p2p.streams
+
+	pool.mu.Lock()
+
+	if pool.closed {
+		pool.mu.Unlock()
+		session.Close()
+		return
+	}
+
+	pool.accepted[session] = true
+	pool.mu.Unlock()
+
+	p2p.acceptStreams(session)
+
+	pool.mu.Lock()
+	delete(pool.accepted, session)
+	pool.mu.Unlock()
+
+}
+
+// Serve the streams the peer opens until the session ends, on sessions accepted or dialed
+func (p2p *P2P) acceptStreams(session *StreamSession) {
+
+	for {
+
+		stream, err := session.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go p2p.serveStream(session, stream)
+
+	}
+
+}
+
+func (p2p *P2P) serveStream(session *StreamSession, stream *Stream) {
+
+	ip, _, _ := net.SplitHostPort(session.RemoteAddr().String())
+
+	// Verified peers relay the traffic of many senders, which is limited by the key of each sender, so
+	// relayed packets and messages don't count against the peer IP
+	relayed := stream.Method == StreamPacket || stream.Method == StreamMessage
+
+	if !(relayed && p2p.verifiedPeer(session.PublicKey)) && !p2p.reputation.AllowIP(ip) {
+		stream.Reset("rate limited")
+		return
+	}
+
+	switch stream.Method {
+
+	case StreamSync:
+		p2p.serveSync(stream)
+
+	case StreamSnapshot:
+		p2p.serveSnapshot(session, stream)
+
+	case StreamMessage:
+		p2p.serveMessage(session, stream)
+
+	case StreamStatus:
+		p2p.serveStatus(stream)
+
+	case StreamPacket:
+		p2p.servePacket(session, stream)
+
+	case StreamAncestor:
+		p2p.serveAncestor(stream)
+
+	case StreamPeers:
+		p2p.servePeers(stream)
+
+	default:
+		stream.Reset("unknown method")
+
+	}
+
+}
+
+// Write the page of blocks requested, as the HTTP sync returns it
+func (p2p *P2P) serveSync(stream *Stream) {
+
+	var req SyncRequest
+
+	if err := json.NewDecoder(io.LimitReader(stream, maxSyncRequest)).Decode(&req); err != nil {
+		stream.Reset("invalid sync request")
+		return
+	}
+
+	page, err := p2p.SyncPage(req)
+
+	if err == nil {
+		err = json.NewEncoder(stream).Encode(page)
+	}
+
+	if err != nil {
+		stream.Reset(err.Error())
+		return
+	}
+
+	stream.Close()
+
+}
+
+// Write a snapshot of the chain, only to verified peers as each snapshot reads the whole chain
+func (p2p *P2P) serveSnapshot(session *StreamSession, stream *Stream) {
+
+	if !p2p.verifiedPeer(session.PublicKey) {
+		stream.Reset(ErrSnapshotRefused.Error())
+		return
+	}
+
+	if _, err := p2p.POH.BlockDB.Snapshot(stream, &p2p.POH.Wallet); err != nil {
+		log.Warn("Snapshot => ", err)
+		stream.Reset(err.Error())
+		return
+	}
+
+	stream.Close()
+
+}
+
+// Write the status of this node. Callers are known by the key of the session, not by an address they claim
+func (p2p *P2P) serveStatus(stream *Stream) {
+
+	if err := json.NewEncoder(stream).Encode(p2p.status()); err != nil {
+		stream.Reset(err.Error())
+		return
+	}
+
+	stream.Close()
+
+}
+
+// Write the ancestor for the locator requested, as the HTTP ancestor returns it
+func (p2p *P2P) serveAncestor(stream *Stream) {
+
+	var req ancestorRequest
+
+	if err := json.NewDecoder(io.LimitReader(stream, maxSyncRequest)).Decode(&req); err != nil {
+		stream.Reset("invalid ancestor request")
+		return
+	}
+
+	ancestor, err := p2p.ancestor(req.Locator)
+
+	if err == nil {
+		err = json.NewEncoder(stream).Encode(ancestor)
+	}
+
+	if err != nil {
+		stream.Reset(err.Error())
+		return
+	}
+
+	stream.Close()
+
+}
+
+// Write the signed list of peers, as the HTTP peers returns it
+func (p2p *P2P) servePeers(stream *Stream) {
+
+	list, err := p2p.peerList()
+
+	if err == nil {
+		err = json.NewEncoder(stream).Encode(list)
+	}
+
+	if err != nil {
+		stream.Reset(err.Error())
+		return
+	}
+
+	stream.Close()
+
+}
+
+// Handle a packet gossiped by a peer as if received over UDP, from the address of the session
+func (p2p *P2P) servePacket(session *StreamSession, stream *Stream) {
+
+	b, err := io.ReadAll(io.LimitReader(stream, maxDatagramSize+1))
+
+	// Packets from the sender arrive over UDP, peers only forward them
+	if err != nil || len(b) > maxDatagramSize || len(b) < 4 || b[3] == 0 {
+		stream.Reset("invalid packet")
+		return
+	}
+
+	stream.Close()
+
+	var src *net.UDPAddr
+
+	if addr, ok := session.RemoteAddr().(*net.TCPAddr); ok {
+		src = &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}
+	}
+
+	p2p.handlePacket(src, len(b), b, !p2p.verifiedPeer(session.PublicKey))
+
+}
+
+// Queue a message sent whole, checked as its fragments would be, and forward it to peers over streams.
+// The receipt is returned to the sender, not to the peers forwarding the message
+func (p2p *P2P) serveMessage(session *StreamSession, stream *Stream) {
+
+	var msg streamMessage
+
+	// Allow for the JSON encoding of the TX data
+	limit := int64(2 * (maxMessageData + 1024))
+
+	if err := json.NewDecoder(io.LimitReader(stream, limit)).Decode(&msg); err != nil {
+		stream.Reset("invalid message")
+		p2p.reputation.Penalize(SourceKey(session.PublicKey), PenaltyMalformed, "invalid stream message")
+		return
+	}
+
+	tx := msg.Tx
+
+	// The JSON limit allows for more, messages are held to the size they could be sent over UDP
+	if len(tx.Data) > maxMessageData {
+		stream.Reset(ErrMessageTooLarge.Error())
+		p2p.reputation.Penalize(SourceKey(session.PublicKey), PenaltyMalformed, "stream message too large")
+		return
+	}
+
+	// Messages always carry a replay header, the flags are signed with the data
+	validFlags := tx.Reserved&blockdb.TxFlagReplay != 0 && tx.Reserved&^(blockdb.TxFlagSealed|blockdb.TxFlagReplay) == 0
+
+	if !validFlags || len(tx.Data) < blockdb.ReplayHeaderSize || tx.Pruned || blockdb.VerifyTx(tx) != nil {
+		stream.Reset("signature failure")
+		p2p.reputation.Penalize(SourceKey(session.PublicKey), PenaltySignature, "stream message signature failure")
+		return
+	}
+
+	if p2p.reputation.Banned(SourceKey(tx.Sender)) || !p2p.reputation.AllowSender(tx.Sender) {
+		stream.Reset("rate limited")
+		return
+	}
+
+	if tx.Type == MsgTypeReceipt {
+		stream.Reset("receipts are not sent over streams")
+		return
+	}
+
+	id := MsgID(sha256.Sum256(append(append([]byte{}, tx.Data...), tx.Signature...)))
+	source := session.RemoteAddr().String()
+
+	if err := p2p.replay.CheckTx(tx, time.Now()); err != nil {
+
+		// Gossiped messages reach a node through several peers
+		if errors.Is(err, blockdb.ErrReplay) {
+			p2p.gossiped.received(id, msg.Hops, source, true)
+			stream.Close()
+			return
+		}
+
+		stream.Reset(err.Error())
+		return
+
+	}
+
+	// Rejected before it is forwarded, peers would reject it too
+	if err := p2p.POH.QueueTx(tx); err != nil {
+		stream.Reset(err.Error())
+		return
+	}
+
+	p2p.gossiped.received(id, msg.Hops, source, false)
+	go p2p.gossipMessage(id, msg)
+
+	if msg.Hops == 0 {
+
+		if receipt, ok := p2p.acknowledge(id, tx, nil); ok {
+			json.NewEncoder(stream).Encode(receipt)
+		}
+
+	}
+
+	stream.Close()
+
+}
+
+// Forward a message received whole to a fanout of verified peers over streams, unless it has travelled
+// the most hops. Peers that do not accept streams receive it once sequenced
+func (p2p *P2P) gossipMessage(id MsgID, msg streamMessage) {
+
+	if int(msg.Hops) >= p2p.GossipMaxHops {
+		return
+	}
+
+	msg.Hops++
+
+	var sent []string
+
+	for _, peer := range p2p.gossipPeers(id) {
+
+		if _, err := p2p.sendMessage(peer, msg); err != nil {
+			log.Debug(fmt.Sprintf("Gossip => %s: %s", peer, err))
+			continue
+		}
+
+		sent = append(sent, peer)
+
+	}
+
+	p2p.gossiped.forwarded(id, sent)
+
+}
+
+// Send a message whole to the node at the P2P address, returning the receipt if the node sent one
+func (p2p *P2P) sendMessage(addr string, msg streamMessage) (receipt *Receipt, err error) {
+
+	session, err := p2p.session(addr, p2p.verifiedKey(addr))
+
+	if err != nil {
+		return
+	}
+
+	stream, err := session.Open(StreamMessage)
+
+	if err != nil {
+		return
+	}
+
+	if err = json.NewEncoder(stream).Encode(msg); err != nil {
+		stream.Reset(err.Error())
+		return
+	}
+
+	stream.Close()
+
+	data, err := io.ReadAll(io.LimitReader(stream, maxSyncRequest))
+
+	if err != nil || len(data) == 0 {
+		return
+	}
+
+	receipt = &Receipt{}
+
+	if err = json.Unmarshal(data, receipt); err != nil {
+		return nil, err
+	}
+
+	// Receipts are signed by the node the session authenticated
+	if !bytes.Equal(receipt.Node, session.PublicKey) {
+		return nil, ErrReceiptSignature
+	}
+
+	return
+
+}
+
+// Send a message too large for a packet whole over a stream, the receipt is recorded for the sender.
+// Receipts are accepted from `node`, or the node the session authenticated if unknown
+func (p2p *P2P) sendStream(senderwallet *wallet.Wallet, recipient []byte, data []byte, msgType uint8, opts SendOptions, peer string, node []byte) (id MsgID, err error) {
+
+	tx, id, err := NewMessage(senderwallet, recipient, data, msgType, opts.Plaintext)
+
+	if err != nil {
+		return
+	}
+
+	receipt, err := p2p.sendMessage(peer, streamMessage{Tx: tx})
+
+	if err != nil {
+		return
+	}
+
+	// The receipt is signed by the node the session authenticated
+	if node == nil && receipt != nil {
+		node = receipt.Node
+	}
+
+	p2p.receipts.addSent(id, senderwallet.PublicKey, node)
+
+	if receipt == nil {
+		return
+	}
+
+	if recordErr := p2p.recordReceipt(*receipt); recordErr != nil {
+		log.Warn("Ignoring receipt, ", recordErr)
+	}
+
+	return
+
+}
+
+// Fetch a snapshot of the chain of the verified peer at the P2P address, written to `w`. Restore it with
+// blockdb.RestoreSnapshot, which checks the manifest
+func (p2p *P2P) FetchSnapshot(addr string, w io.Writer) (err error) {
+
+	expected := p2p.verifiedKey(addr)
+
+	if expected == nil {
+		return fmt.Errorf("%w, %s is not a verified peer", ErrStreamUnavailable, addr)
+	}
+
+	session, err := p2p.session(addr, expected)
+
+	if err != nil {
+		return
+	}
+
+	stream, err := session.Open(StreamSnapshot)
+
+	if err != nil {
+		return
+	}
+
+	stream.Close()
+
+	if _, err = io.Copy(w, stream); err != nil {
+		stream.Reset(err.Error())
+	}
+
+	return
+
+}
+
+// Query the status of the peer over a stream
+func (p2p *P2P) fetchStreamStatus(session *StreamSession) (io.ReadCloser, error) {
+
+	stream, err := session.Open(StreamStatus)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stream.Close()
+
+	return io.NopCloser(stream), nil
+
+}
+
+func (p2p *P2P) fetchStreamAncestor(session *StreamSession, locator []string) (io.ReadCloser, error) {
+
+	stream, err := session.Open(StreamAncestor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.NewEncoder(stream).Encode(ancestorRequest{Locator: locator}); err != nil {
+		stream.Reset(err.Error())
+		return nil, err
+	}
+
+	stream.Close()
+
+	return io.NopCloser(stream), nil
+
+}
+
+func (p2p *P2P) fetchStreamPeers(session *StreamSession) (io.ReadCloser, error) {
+
+	stream, err := session.Open(StreamPeers)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stream.Close()
+
+	return io.NopCloser(stream), nil
+
+}
+
+// Forward a packet to the peer over the session, the stream carries the one packet
+func (p2p *P2P) sendPacket(session *StreamSession, b []byte) (err error) {
+
+	stream, err := session.Open(StreamPacket)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = stream.Write(b); err != nil {
+		stream.Reset(err.Error())
+		return
+	}
+
+	return stream.Close()
+
+}
+
+// Fetch a page of blocks over a stream, invalid pages are penalised against the RPC peer
+func (p2p *P2P) fetchStreamPage(hostname string, session *StreamSession, req SyncRequest) (page blockdb.SyncBlocks, err error) {
+
+	stream, err := session.Open(StreamSync)
+
+	if err != nil {
+		return
+	}
+
+	if err = json.NewEncoder(stream).Encode(req); err != nil {
+		stream.Reset(err.Error())
+		return
+	}
+
+	stream.Close()
+
+	if page, err = p2p.decodePage(hostname, stream); err != nil {
+		stream.Reset("invalid sync data")
+	}
+
+	return
+
+}
+
+// The stream session to the verified peer serving RPC at `hostname`, nil for other peers. Verified peers are
+// only queried over a stream, an error is returned if there is none rather than falling back to HTTP
+func (p2p *P2P) rpcSession(hostname string) (session *StreamSession, err error) {
+
+	if !p2p.streams.enabled || p2p.POH == nil {
+		return nil, nil
+	}
+
+	for _, peer := range p2p.peers.Verified() {
+
+		if peer.RPC_Node.address() != hostname {
+			continue
+		}
+
+		if session, err = p2p.session(streamAddr(peer), peer.PublicKey); err != nil {
+			return nil, fmt.Errorf("%w, %s: %s", ErrPlaintextRefused, hostname, err)
+		}
+
+		return session, nil
+
+	}
+
+	return nil, nil
+
+}
+
+// The session to the node at the P2P address, dialed if there is none. If `expected` is set the node must hold it
+func (p2p *P2P) session(addr string, expected []byte) (session *StreamSession, err error) {
+
+	pool := p2p.streams
+
+	if !pool.enabled || p2p.POH == nil {
+		return nil, ErrStreamsDisabled
+	}
+
+	pool.mu.Lock()
+
+	if existing, ok := pool.sessions[addr]; ok && existing.Err() == nil {
+
+		pool.mu.Unlock()
+
+		if expected != nil && !bytes.Equal(existing.PublicKey, expected) {
+			return nil, fmt.Errorf("%w, expected another key", ErrStreamAuth)
+		}
+
+		return existing, nil
+
+	}
+
+	if failed, ok := pool.failed[addr]; ok && time.Since(failed) < streamRetry {
+		pool.mu.Unlock()
+		return nil, ErrStreamUnavailable
+	}
+
+	pool.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", addr, streamDialTimeout)
+
+	if err == nil {
+		session, err = NewStreamSession(conn, &p2p.POH.Wallet, expected, true, p2p.MaxStreams)
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if err != nil {
+
+		now := time.Now()
+
+		for failedAddr, failed := range pool.failed {
+			if now.Sub(failed) >= streamRetry {
+				delete(pool.failed, failedAddr)
+			}
+		}
+
+		pool.failed[addr] = now
+
+		return nil, fmt.Errorf("%w: %s", ErrStreamUnavailable, err)
+
+	}
+
+	if pool.closed {
+		session.Close()
+		return nil, ErrStreamClosed
+	}
+
+	// Another send dialed the node meanwhile
+	if existing, ok := pool.sessions[addr]; ok && existing.Err() == nil {
+		session.Close()
+		return existing, nil
+	}
+
+	delete(pool.failed, addr)
+	pool.sessions[addr] = session
+
+	go p2p.acceptStreams(session)
+
+	return
+
+}
+
+// The open session to the node at the P2P address, nil if there is none yet. A session is dialed in the
+// background for the next call, unless one is being dialed or the node could not be reached lately
+func (p2p *P2P) openSession(addr string) *StreamSession {
+
+	pool := p2p.streams
+
+	if !pool.enabled || p2p.POH == nil {
+		return nil
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if session, ok := pool.sessions[addr]; ok && session.Err() == nil {
+		return session
+	}
+
+	if failed, ok := pool.failed[addr]; pool.closed || pool.dialing[addr] || ok && time.Since(failed) < streamRetry {
+		return nil
+	}
+
+	pool.dialing[addr] = true
+
+	go func() {
+
+		if _, err := p2p.session(addr, p2p.verifiedKey(addr)); err != nil {
+			log.Debug(fmt.Sprintf("Streams => %s: %s", addr, err))
+		}
+
+		pool.mu.Lock()
+		delete(pool.dialing, addr)
+		pool.mu.Unlock()
+
+	}()
+
+	return nil
+
+}
+
+// Node key of the verified peer at the P2P address, nil if unknown
+func (p2p *P2P) verifiedKey(addr string) []byte {
+
+	for _, peer := range p2p.peers.Verified() {
+		if peer.P2P_Node.address() == addr {
+			return peer.PublicKey
+		}
+	}
+
+	return nil
+
+}
+
+// Whether the key is held by a verified peer
+func (p2p *P2P) verifiedPeer(publicKey []byte) bool {
+
+	for _, peer := range p2p.peers.Verified() {
+		if bytes.Equal(peer.PublicKey, publicKey) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// Address of the stream listener of a peer, the P2P port on the RPC host if the P2P host is unspecified
+func streamAddr(peer PeerInfo) string {
+
+	host := peer.P2P_Node.Host
+
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = peer.RPC_Node.Host
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(peer.P2P_Node.Port)))
+
+}
@@ -0,0 +1,302 @@
+package p2pnet_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// Count the HTTP requests for the status, sync, ancestor and peers endpoints
+func peerRequests(count *int32) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		switch c.Request.URL.Path {
+		case "/p2p/status", "/p2p/sync", "/p2p/ancestor", "/p2p/peers":
+			atomic.AddInt32(count, 1)
+		}
+
+	}
+
+}
+
+func TestStreamSync(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	var requests int32
+	b, addrB := newNode(t, nodeOptions{streams: true, middleware: []gin.HandlerFunc{peerRequests(&requests)}})
+	a, _ := newNode(t, nodeOptions{streams: true})
+
+	appendSigned(t, &b.POH.BlockDB, &signer, 25)
+
+	// B is verified with a handshake over HTTP
+	a.Discover(addrB)
+	atomic.StoreInt32(&requests, 0)
+
+	// Verified peers query the status, ancestor, sync and peers over a stream, not the HTTP endpoints
+	a.SyncPeer(addrB)
+	a.Discover(addrB)
+
+	assert.Equal(t, 25, a.POH.BlockDB.Len())
+	assert.Equal(t, b.POH.BlockDB.GetLatestIndex().Key, a.POH.BlockDB.GetLatestIndex().Key)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+	assert.Len(t, a.KnownPeers(), 1)
+
+	// Peers not verified sync over HTTP
+	c, _ := newNode(t, nodeOptions{streams: true})
+	c.SyncPeer(addrB)
+
+	assert.Equal(t, 25, c.POH.BlockDB.Len())
+	assert.Greater(t, atomic.LoadInt32(&requests), int32(0))
+
+}
+
+// Verified peers not reachable over a stream are not queried over plaintext HTTP instead
+func TestStreamSyncNoFallback(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	// B gives a P2P port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	var requests int32
+	b, addrB := newNode(t, nodeOptions{config: p2pnet.P2P{P2P_Node: p2pnet.Node{Host: "127.0.0.1", Port: port}}, middleware: []gin.HandlerFunc{peerRequests(&requests)}})
+	a, _ := newNode(t, nodeOptions{streams: true})
+
+	appendSigned(t, &b.POH.BlockDB, &signer, 5)
+
+	a.Discover(addrB)
+	atomic.StoreInt32(&requests, 0)
+
+	a.SyncPeer(addrB)
+	a.Discover(addrB)
+
+	assert.Equal(t, 0, a.POH.BlockDB.Len())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+
+}
+
+func TestStreamSnapshot(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	b, addrB := newNode(t, nodeOptions{streams: true})
+	a, addrA := newNode(t, nodeOptions{streams: true})
+
+	appendSigned(t, &b.POH.BlockDB, &signer, 10)
+
+	addr := fmt.Sprintf("%s:%d", b.P2P_Node.Host, b.P2P_Node.Port)
+
+	// Only verified peers are fetched from
+	var snapshot bytes.Buffer
+	assert.True(t, errors.Is(a.FetchSnapshot(addr, &snapshot), p2pnet.ErrStreamUnavailable))
+
+	a.Discover(addrB)
+
+	// Nor served to nodes other than verified peers
+	err := a.FetchSnapshot(addr, &snapshot)
+	assert.NotNil(t, err)
+	assert.Contains(t, fmt.Sprint(err), p2pnet.ErrSnapshotRefused.Error())
+
+	b.Discover(addrA)
+
+	snapshot.Reset()
+	assert.Nil(t, a.FetchSnapshot(addr, &snapshot))
+
+	manifest, err := blockdb.RestoreSnapshot(&snapshot, filepath.Join(t.TempDir(), "restored.db"), b.POH.Wallet.PublicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, manifest.Blocks)
+
+}
+
+func TestStreamMessage(t *testing.T) {
+
+	b, addrB := newNode(t, nodeOptions{streams: true})
+	a, _ := newNode(t, nodeOptions{streams: true})
+
+	a.Discover(addrB)
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	opts := p2pnet.SendOptions{Peer: fmt.Sprintf("%s:%d", b.P2P_Node.Host, b.P2P_Node.Port)}
+
+	// Neither node listens for UDP, the message is only received whole over a stream
+	id, err := a.Send(&sender, sender.PublicKey, make([]byte, 4000), 1, opts)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, queued(b))
+
+	receipt, ok := a.Receipt(id)
+	assert.True(t, ok)
+	assert.Equal(t, p2pnet.ReceiptReceived, receipt.Status)
+	assert.Equal(t, []byte(b.POH.Wallet.PublicKey), receipt.Node)
+	assert.Nil(t, receipt.Verify())
+
+	b.POH.Mu.Lock()
+	tx := b.POH.QueueSync.State[0]
+	b.POH.Mu.Unlock()
+
+	assert.Nil(t, blockdb.VerifyTx(tx))
+	assert.Equal(t, blockdb.TxFlagSealed|blockdb.TxFlagReplay, tx.Reserved)
+
+	stats, ok := b.Gossip(id)
+	assert.True(t, ok)
+	assert.Equal(t, uint8(0), stats.Hops)
+
+	// The largest message is accepted sealed
+	_, err = a.Send(&sender, sender.PublicKey, make([]byte, p2pnet.MaxMessageSize), 1, opts)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, queued(b))
+
+}
+
+// Messages sent whole are held to the size they could be sent over UDP, even if signed
+func TestStreamMessageTooLarge(t *testing.T) {
+
+	b, _ := newNode(t, nodeOptions{streams: true})
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(b.P2P_Node.Host, strconv.Itoa(int(b.P2P_Node.Port))))
+	assert.Nil(t, err)
+
+	session, err := p2pnet.NewStreamSession(conn, newWallet(t), b.POH.Wallet.PublicKey, true, p2pnet.DefaultMaxStreams)
+	assert.Nil(t, err)
+	defer session.Close()
+
+	sender := newWallet(t)
+
+	replay, err := blockdb.NewReplayHeader()
+	assert.Nil(t, err)
+
+	data := append(replay.Bytes(), make([]byte, 2+p2pnet.MaxMessageSize+wallet.BoxOverhead+1)...)
+
+	signature, err := sender.Sign(blockdb.TxSigningBytes(p2pnet.PacketVersion, 1, blockdb.TxFlagReplay, sender.PublicKey, data))
+	assert.Nil(t, err)
+
+	tx := blockdb.TxPayload{Data: data, Sender: sender.PublicKey, Recipient: sender.PublicKey, Signature: signature, Type: 1, Reserved: blockdb.TxFlagReplay}
+	assert.Nil(t, blockdb.VerifyTx(tx))
+
+	stream, err := session.Open(p2pnet.StreamMessage)
+	assert.Nil(t, err)
+
+	assert.Nil(t, json.NewEncoder(stream).Encode(gin.H{"tx": tx, "hops": 0}))
+
+	_, err = io.ReadAll(stream)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 0, queued(b))
+
+}
+
+func TestGossipSession(t *testing.T) {
+
+	a, addrA := newNode(t, nodeOptions{udp: true, streams: true})
+	b, addrB := newNode(t, nodeOptions{udp: true, streams: true})
+
+	a.Discover(addrB)
+	b.Discover(addrA)
+
+	client := p2pnet.New(p2pnet.P2P{})
+	defer client.Close()
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	opts := p2pnet.SendOptions{Peer: fmt.Sprintf("%s:%d", a.P2P_Node.Host, a.P2P_Node.Port)}
+
+	// The first packet is forwarded over UDP, while a session to B is dialed
+	_, err := client.Send(&sender, sender.PublicKey, []byte("message 0"), 1, opts)
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool { return queued(b) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// B no longer receives UDP, packets reach it over the encrypted session
+	assert.Nil(t, b.Transport.Close())
+
+	sent := 0
+
+	assert.Eventually(t, func() bool {
+
+		sent++
+		_, err := client.Send(&sender, sender.PublicKey, []byte(fmt.Sprintf("message %d", sent)), 1, opts)
+
+		return err == nil && queued(b) > 1
+
+	}, 5*time.Second, 50*time.Millisecond)
+
+}
+
+// Packets relayed by a verified peer are limited by the key of each sender, not the IP of the peer
+func TestGossipSessionRelayLimit(t *testing.T) {
+
+	a, addrA := newNode(t, nodeOptions{udp: true, streams: true})
+	b, addrB := newNode(t, nodeOptions{config: p2pnet.P2P{RateLimits: p2pnet.RateLimits{PeerRate: 0.001, PeerBurst: 2}}, udp: true, streams: true})
+
+	a.Discover(addrB)
+	b.Discover(addrA)
+
+	// B only receives packets relayed over the session from A
+	assert.Nil(t, b.Transport.Close())
+
+	client := p2pnet.New(p2pnet.P2P{})
+	defer client.Close()
+
+	opts := p2pnet.SendOptions{Peer: fmt.Sprintf("%s:%d", a.P2P_Node.Host, a.P2P_Node.Port)}
+
+	send := func(i int) {
+
+		sender := wallet.New()
+		assert.Nil(t, sender.GenerateWallet())
+
+		_, err := client.Send(&sender, sender.PublicKey, []byte(fmt.Sprintf("message %d", i)), 1, opts)
+		assert.Nil(t, err)
+
+	}
+
+	// Packets are forwarded over UDP until the session to B is dialed
+	sent := 0
+
+	assert.Eventually(t, func() bool {
+
+		send(sent)
+		sent++
+
+		return queued(b) > 0
+
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Well past the burst of the peer IP, each from a new sender
+	const messages = 10
+
+	base := queued(b)
+
+	for i := 0; i < messages; i++ {
+		send(sent + i)
+	}
+
+	assert.Eventually(t, func() bool { return queued(b) >= base+messages }, 5*time.Second, 10*time.Millisecond)
+
+}
@@ -0,0 +1,276 @@
+package p2pnet
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/perrychain/perry/pkg/blockdb"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default most blocks rolled back to switch to a heavier fork, deeper forks are logged and refused
+const DefaultMaxReorgDepth = 100
+
+var ErrReorgDisabled = errors.New("blocks carry no verifiable weight, reorgs are disabled")
+
+// Most hashes accepted in a locator, enough for chains of 2^50 blocks
+const maxLocator = 64
+
+var ErrSyncData = errors.New("invalid sync data")
+
+// Latest block shared by two chains, the zero hash if the chains share no blocks
+type Ancestor struct {
+	Hash  []byte `json:"hash"`
+	SeqID uint64 `json:"seqid"`
+}
+
+// Sync the heavier chain of the peer, appending to the local head or switching to the fork it is on if
+// reorgs are allowed
+func (p2p *P2P) syncChain(hostname string, local, remote blockdb.BlockIndex) {
+
+	ancestor, err := p2p.findAncestor(hostname)
+
+	if err != nil {
+		log.Warn(fmt.Sprintf("Fork => Finding common ancestor with %s: %s", hostname, err))
+		return
+	}
+
+	// The remote chain extends ours
+	if ancestor.Key == local.Key {
+		p2p.stateSync(hostname, remote.Header.SeqID)
+		return
+	}
+
+	if !p2p.AllowReorg {
+		log.Warn(fmt.Sprintf("Fork => Chains diverge after SeqID %d, keeping the local chain: %s", ancestor.Header.SeqID, ErrReorgDisabled))
+		return
+	}
+
+	p2p.reorg(hostname, ancestor, local, remote)
+
+}
+
+// Ask the peer for the latest block both chains share, from the locator of the local chain
+func (p2p *P2P) findAncestor(hostname string) (ancestor blockdb.BlockIndex, err error) {
+
+	var locator []string
+
+	for _, key := range p2p.POH.BlockDB.Locator() {
+		locator = append(locator, base64.StdEncoding.EncodeToString(key[:]))
+	}
+
+	body, err := p2p.ancestorBody(hostname, locator)
+
+	if err != nil {
+		return
+	}
+
+	defer body.Close()
+
+	var remote Ancestor
+
+	if err = json.NewDecoder(body).Decode(&remote); err != nil {
+		p2p.reputation.Penalize(sourceHost(hostname), PenaltyMalformed, "invalid ancestor")
+		return ancestor, fmt.Errorf("%w: %s", ErrSyncData, err)
+	}
+
+	if len(remote.Hash) == 0 {
+		return ancestor, nil
+	}
+
+	// The ancestor must be one of the blocks we sent
+	var key blockdb.Hash
+	ok := len(remote.Hash) == len(key)
+
+	if ok {
+		copy(key[:], remote.Hash)
+		ancestor, ok = p2p.POH.BlockDB.FindAncestor([]blockdb.Hash{key})
+	}
+
+	if !ok {
+		p2p.reputation.Penalize(sourceHost(hostname), PenaltyMalformed, "invalid ancestor")
+		return ancestor, fmt.Errorf("%w: ancestor is not in the local chain", ErrSyncData)
+	}
+
+	return
+
+}
+
+// The ancestor of the peer for the locator, over an encrypted stream if it is a verified peer and over HTTP otherwise
+func (p2p *P2P) ancestorBody(hostname string, locator []string) (io.ReadCloser, error) {
+
+	session, err := p2p.rpcSession(hostname)
+
+	if err != nil {
+		return nil, err
+	} else if session != nil {
+		return p2p.fetchStreamAncestor(session, locator)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/p2p/ancestor?locator=%s", hostname, url.QueryEscape(strings.Join(locator, ","))))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("ancestor request failed, %s", resp.Status)
+	}
+
+	return resp.Body, nil
+
+}
+
+// Switch to the heavier fork of the peer, rolling back to the common ancestor and applying its branch
+func (p2p *P2P) reorg(hostname string, ancestor, local, remote blockdb.BlockIndex) {
+
+	depth := local.Header.SeqID - ancestor.Header.SeqID
+
+	log.Warn(fmt.Sprintf("Fork => Chains diverge after SeqID %d, local head SeqID %d (%s), %s head SeqID %d (%s)", ancestor.Header.SeqID, local.Header.SeqID, hashString(local.Key), hostname, remote.Header.SeqID, hashString(remote.Key)))
+
+	if depth > uint64(p2p.MaxReorgDepth) {
+		log.Warn(fmt.Sprintf("Fork => Refusing to roll back (%d) blocks, more than %d", depth, p2p.MaxReorgDepth))
+		return
+	}
+
+	blocks, err := p2p.fetchBranch(hostname, ancestor, local)
+
+	if err != nil {
+		log.Warn(fmt.Sprintf("Fork => Fetching branch from %s: %s", hostname, err))
+		return
+	}
+
+	result, err := p2p.POH.BlockDB.Reorg(ancestor.Key, blocks, p2p.MaxReorgDepth)
+
+	var verr *blockdb.VerifyError
+
+	switch {
+
+	case err == nil:
+
+	// A block was appended locally meanwhile, or the valid part of the branch is lighter
+	case errors.Is(err, blockdb.ErrForkChoice), errors.Is(err, blockdb.ErrReorgDepth), errors.Is(err, blockdb.ErrAncestorNotFound):
+		log.Info(fmt.Sprintf("Fork => Keeping the local chain: %s", err))
+		return
+
+	// The branch must follow the ancestor and be within the block limits
+	case errors.As(err, &verr), errors.Is(err, blockdb.ErrBlockTooLarge), errors.Is(err, blockdb.ErrBlockTooManyTx):
+		log.Warn(fmt.Sprintf("Fork => Invalid branch from %s: %s", hostname, err))
+		p2p.reputation.Penalize(sourceHost(hostname), PenaltySyncData, "invalid fork branch")
+		return
+
+	default:
+		log.Warn(fmt.Sprintf("Fork => Reorg failed: %s", err))
+		return
+
+	}
+
+	// TX's only in the orphaned blocks are sequenced again
+	requeued := p2p.POH.RequeueOrphaned(result.OrphanedBlocks, blocks)
+
+	log.Warn(fmt.Sprintf("Fork => Reorganised to %s head SeqID %d (%s), (%d) blocks orphaned from SeqID %d (%s), saved to %s, (%d) TX's queued again", hostname, result.NewSeqID, hashString(result.NewHead), result.Orphaned, result.OldSeqID, hashString(result.OldHead), result.OrphanFile, requeued))
+
+	// The rest of the branch follows the new head
+	if result.NewSeqID < remote.Header.SeqID {
+		p2p.stateSync(hostname, remote.Header.SeqID)
+	}
+
+}
+
+// Fetch the valid part of the branch of the peer following the ancestor, page by page until it is heavier
+// than the local chain. Branches are bounded by the reorg depth, the rest is synced after the reorg
+func (p2p *P2P) fetchBranch(hostname string, ancestor, local blockdb.BlockIndex) (branch []blockdb.BlockKV, err error) {
+
+	from := ancestor.Key
+
+	for len(branch) <= p2p.MaxReorgDepth {
+
+		page, err := p2p.fetchPage(hostname, SyncRequest{From: from[:]})
+
+		if err != nil {
+			return nil, err
+		}
+
+		valid := p2p.verifySynced(hostname, page.Blocks)
+		branch = append(branch, page.Blocks[:valid]...)
+
+		if valid == 0 || valid < len(page.Blocks) || len(page.Next) == 0 {
+			break
+		}
+
+		tip := branch[len(branch)-1]
+
+		if blockdb.Heavier(blockdb.BlockIndex{Key: tip.Key, Header: tip.Value.Header}, local) {
+			break
+		}
+
+		from = tip.Key
+
+	}
+
+	return
+
+}
+
+func hashString(key blockdb.Hash) string {
+
+	return base64.StdEncoding.EncodeToString(key[:])
+
+}
+
+// JSON RPC method, return the latest block in the chain from the locator of a peer
+func (p2p *P2P) Ancestor(c *gin.Context) {
+
+	ancestor, err := p2p.ancestor(strings.Split(c.Query("locator"), ","))
+
+	if err != nil {
+		c.JSON(400, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, ancestor)
+
+}
+
+// The latest block in the chain from the base64 encoded locator of a peer
+func (p2p *P2P) ancestor(encoded []string) (ancestor Ancestor, err error) {
+
+	var locator []blockdb.Hash
+
+	for _, hash := range encoded {
+
+		if hash == "" {
+			continue
+		}
+
+		b, err := base64.StdEncoding.DecodeString(hash)
+
+		if err != nil || len(b) != len(blockdb.Hash{}) {
+			return ancestor, errors.New("locator hashes must be 32 bytes, base64 encoded")
+		}
+
+		var key blockdb.Hash
+		copy(key[:], b)
+		locator = append(locator, key)
+
+	}
+
+	if len(locator) > maxLocator {
+		return ancestor, fmt.Errorf("locator is limited to %d hashes", maxLocator)
+	}
+
+	if entry, ok := p2p.POH.BlockDB.FindAncestor(locator); ok {
+		ancestor = Ancestor{Hash: entry.Key[:], SeqID: entry.Header.SeqID}
+	}
+
+	return
+
+}
@@ -0,0 +1,212 @@
+package p2pnet_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// Append `n` blocks of signed TX's to the DB
+func appendSigned(t *testing.T, db *blockdb.BlockDB, signer *wallet.Wallet, n int) (blocks []blockdb.BlockKV) {
+
+	for i := 0; i < n; i++ {
+
+		block := signedBlock(t, signer, db.GetLatestIndex())
+		assert.Nil(t, db.AppendBlock(&block))
+		blocks = append(blocks, block)
+
+	}
+
+	return
+
+}
+
+// A block with a signed TX following the head
+func signedBlock(t *testing.T, signer *wallet.Wallet, head blockdb.BlockIndex) blockdb.BlockKV {
+
+	data := []byte(fmt.Sprintf("message %d", time.Now().UnixNano()))
+	sig, err := signer.Sign(data)
+	assert.Nil(t, err)
+
+	payload := []blockdb.TxPayload{{Sender: signer.PublicKey, Data: data, Signature: sig, Type: 1}}
+
+	root, err := blockdb.TxRoot(payload)
+	assert.Nil(t, err)
+
+	header := blockdb.BlockHeader{Parent: head.Key, SeqID: head.Header.SeqID + 1, SeqTime: time.Now(), TxRoot: &root}
+
+	return blockdb.BlockKV{
+		Key: blockdb.BlockHash(header),
+		Value: blockdb.Block{
+			Header:  header,
+			Payload: payload,
+		},
+	}
+
+}
+
+func TestSyncFork(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	a, addrA := newNode(t, nodeOptions{config: p2pnet.P2P{AllowReorg: true}})
+	b, addrB := newNode(t, nodeOptions{config: p2pnet.P2P{AllowReorg: true}})
+
+	// Both nodes share the first blocks, then diverge with B on the heavier fork
+	for _, block := range appendSigned(t, &a.POH.BlockDB, &signer, 5) {
+		assert.Nil(t, b.POH.BlockDB.AppendBlock(&block))
+	}
+
+	appendSigned(t, &a.POH.BlockDB, &signer, 2)
+	appendSigned(t, &b.POH.BlockDB, &signer, 4)
+
+	a.SyncPeer(addrB)
+
+	assert.Equal(t, 9, a.POH.BlockDB.Len())
+	assert.Equal(t, b.POH.BlockDB.GetLatestIndex().Key, a.POH.BlockDB.GetLatestIndex().Key)
+	assert.Nil(t, a.POH.BlockDB.Verify())
+
+	// The lighter chain is kept
+	b.SyncPeer(addrA)
+	assert.Equal(t, 9, b.POH.BlockDB.Len())
+
+	// Blocks on the same chain are appended to the head
+	appendSigned(t, &a.POH.BlockDB, &signer, 1)
+	b.SyncPeer(addrA)
+	assert.Equal(t, 10, b.POH.BlockDB.Len())
+
+	appendSigned(t, &b.POH.BlockDB, &signer, 3)
+	a.SyncPeer(addrB)
+	assert.Equal(t, 13, a.POH.BlockDB.Len())
+	assert.Equal(t, b.POH.BlockDB.GetLatestIndex().Key, a.POH.BlockDB.GetLatestIndex().Key)
+
+}
+
+func TestSyncForkDepth(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	a, _ := newNode(t, nodeOptions{config: p2pnet.P2P{AllowReorg: true, MaxReorgDepth: 2}})
+	b, addrB := newNode(t, nodeOptions{})
+
+	for _, block := range appendSigned(t, &a.POH.BlockDB, &signer, 5) {
+		assert.Nil(t, b.POH.BlockDB.AppendBlock(&block))
+	}
+
+	// Deep forks are refused
+	appendSigned(t, &a.POH.BlockDB, &signer, 3)
+	appendSigned(t, &b.POH.BlockDB, &signer, 6)
+
+	head := a.POH.BlockDB.GetLatestIndex()
+
+	a.SyncPeer(addrB)
+	assert.Equal(t, head.Key, a.POH.BlockDB.GetLatestIndex().Key)
+	assert.Equal(t, 8, a.POH.BlockDB.Len())
+
+}
+
+func TestSyncForkDisabled(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	a, _ := newNode(t, nodeOptions{})
+	b, addrB := newNode(t, nodeOptions{})
+
+	for _, block := range appendSigned(t, &a.POH.BlockDB, &signer, 5) {
+		assert.Nil(t, b.POH.BlockDB.AppendBlock(&block))
+	}
+
+	// A longer fork is no proof of weight, the local chain is kept
+	appendSigned(t, &a.POH.BlockDB, &signer, 1)
+	appendSigned(t, &b.POH.BlockDB, &signer, 4)
+
+	head := a.POH.BlockDB.GetLatestIndex()
+
+	a.SyncPeer(addrB)
+	assert.Equal(t, head.Key, a.POH.BlockDB.GetLatestIndex().Key)
+	assert.Equal(t, 6, a.POH.BlockDB.Len())
+
+}
+
+func TestSyncForkRequeue(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	a, _ := newNode(t, nodeOptions{config: p2pnet.P2P{AllowReorg: true}})
+	b, addrB := newNode(t, nodeOptions{})
+
+	for _, block := range appendSigned(t, &a.POH.BlockDB, &signer, 3) {
+		assert.Nil(t, b.POH.BlockDB.AppendBlock(&block))
+	}
+
+	orphaned := appendSigned(t, &a.POH.BlockDB, &signer, 2)
+
+	// The fork of B includes the TX of the first orphaned block
+	shared := orphaned[0].Value.Payload
+	root, err := blockdb.TxRoot(shared)
+	assert.Nil(t, err)
+
+	head := b.POH.BlockDB.GetLatestIndex()
+	header := blockdb.BlockHeader{Parent: head.Key, SeqID: head.Header.SeqID + 1, SeqTime: time.Now(), TxRoot: &root}
+
+	block := blockdb.BlockKV{
+		Key: blockdb.BlockHash(header),
+		Value: blockdb.Block{
+			Header:  header,
+			Payload: shared,
+		},
+	}
+
+	assert.Nil(t, b.POH.BlockDB.AppendBlock(&block))
+	appendSigned(t, &b.POH.BlockDB, &signer, 3)
+
+	a.SyncPeer(addrB)
+	assert.Equal(t, b.POH.BlockDB.GetLatestIndex().Key, a.POH.BlockDB.GetLatestIndex().Key)
+
+	// Only the TX not in the new chain is queued again
+	a.POH.Mu.Lock()
+	defer a.POH.Mu.Unlock()
+
+	assert.Len(t, a.POH.QueueSync.State, 1)
+	assert.Equal(t, orphaned[1].Value.Payload[0].Data, a.POH.QueueSync.State[0].Data)
+
+}
+
+func TestSyncInvalidBlock(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	a, _ := newNode(t, nodeOptions{})
+	b, addrB := newNode(t, nodeOptions{})
+
+	blocks := appendSigned(t, &b.POH.BlockDB, &signer, 3)
+
+	// A block with a forged TX, committed to by its hash
+	forged := signedBlock(t, &signer, b.POH.BlockDB.GetLatestIndex())
+	forged.Value.Payload[0].Data = []byte("forged")
+
+	root, err := blockdb.TxRoot(forged.Value.Payload)
+	assert.Nil(t, err)
+
+	forged.Value.Header.TxRoot = &root
+	forged.Key = blockdb.BlockHash(forged.Value.Header)
+
+	assert.Nil(t, b.POH.BlockDB.AppendBlock(&forged))
+	appendSigned(t, &b.POH.BlockDB, &signer, 2)
+
+	// Sync stops before the first invalid block
+	a.SyncPeer(addrB)
+	assert.Equal(t, 3, a.POH.BlockDB.Len())
+	assert.Equal(t, blocks[2].Key, a.POH.BlockDB.GetLatestIndex().Key)
+
+}
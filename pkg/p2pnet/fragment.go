@@ -0,0 +1,346 @@
+package p2pnet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/wallet"
+	log "github.com/sirupsen/logrus"
+)
+
+// Packet flag for a fragment of a larger message, cleared once the message is reassembled
+const PacketFlagFragment uint8 = 1 << 7
+
+// Packet version, each payload starts with a blockdb.ReplayHeader and the signature covers the version,
+// type, flags and recipient with the payload. Other versions are dropped
+const PacketVersion = blockdb.TxSignatureVersion
+
+// Each fragment payload has the message ID, fragment number, total fragments and fragment length after the replay header
+const fragmentHeaderSize = 32 + 2 + 2 + 2
+
+// Message bytes carried in each fragment
+const FragmentSize = len(Packet{}.Payload) - blockdb.ReplayHeaderSize - fragmentHeaderSize
+
+// Largest message that can be sent, sealed or plaintext
+const MaxMessageSize = 32 * 1024
+
+// Largest TX data of a message, with the replay header, the length prefix and the sealed box overhead
+const maxMessageData = blockdb.ReplayHeaderSize + 2 + MaxMessageSize + wallet.BoxOverhead
+
+// Default reassembly limits, incomplete messages are dropped after the timeout
+const DefaultFragmentTimeout = 30 * time.Second
+const DefaultMaxPartialMessages = 1024
+const DefaultMaxReassemblyBytes = 16 * 1024 * 1024
+
+var ErrFragment = errors.New("invalid fragment")
+var ErrReassemblyFull = errors.New("reassembly buffer full")
+
+// The fragment header within a packet payload
+type fragmentHeader struct {
+	MsgID  MsgID
+	Index  uint16
+	Total  uint16
+	Length uint16
+}
+
+// Incomplete messages, bounded by count and bytes held
+type reassembler struct {
+	mu          sync.Mutex
+	partials    map[string]*partialMessage
+	size        int
+	timeout     time.Duration
+	maxMessages int
+	maxBytes    int
+}
+
+type partialMessage struct {
+	sender    [32]byte
+	recipient [32]byte
+	msgType   uint8
+	flags     uint8
+	fragments [][]byte
+	received  int
+	size      int
+	started   time.Time
+}
+
+func newReassembler(timeout time.Duration, maxMessages, maxBytes int) *reassembler {
+
+	return &reassembler{partials: make(map[string]*partialMessage), timeout: timeout, maxMessages: maxMessages, maxBytes: maxBytes}
+
+}
+
+// Build the signed packets for a message, split into fragments if it does not fit a single packet.
+// The message and each fragment start with a replay header, so a captured packet can't be accepted twice.
+// Fragmented messages end with the sender signature of the whole message, so the stored TX can be verified
+func NewPackets(senderwallet *wallet.Wallet, recipient []byte, data []byte, msgType uint8, plaintext bool) (packets []Packet, id MsgID, err error) {
+
+	body, flags, err := messageBody(recipient, data, plaintext)
+
+	if err != nil {
+		return
+	}
+
+	template := Packet{Version: [1]byte{PacketVersion}, Type: [1]byte{msgType}, Flags: [1]byte{flags}}
+
+	copy(template.RecipientPublicKey[:], recipient)
+	copy(template.SenderPublicKey[:], senderwallet.PublicKey)
+
+	if len(body) <= len(template.Payload) {
+
+		packet := template
+		copy(packet.Payload[:], body)
+
+		if err = signPacket(senderwallet, &packet); err != nil {
+			return
+		}
+
+		return []Packet{packet}, packet.ID(), nil
+
+	}
+
+	signature, err := senderwallet.Sign(blockdb.TxSigningBytes(PacketVersion, msgType, flags, recipient, body))
+
+	if err != nil {
+		return
+	}
+
+	message := append(append([]byte{}, body...), signature...)
+	id = sha256.Sum256(message)
+	total := (len(message) + FragmentSize - 1) / FragmentSize
+
+	for i := 0; i < total; i++ {
+
+		end := (i + 1) * FragmentSize
+
+		if end > len(message) {
+			end = len(message)
+		}
+
+		chunk := message[i*FragmentSize : end]
+
+		packet := template
+		packet.Flags[0] |= PacketFlagFragment
+
+		var replay blockdb.ReplayHeader
+
+		if replay, err = blockdb.NewReplayHeader(); err != nil {
+			return
+		}
+
+		buf := bytes.NewBuffer(replay.Bytes())
+		binary.Write(buf, binary.BigEndian, fragmentHeader{MsgID: id, Index: uint16(i), Total: uint16(total), Length: uint16(len(chunk))})
+		buf.Write(chunk)
+		copy(packet.Payload[:], buf.Bytes())
+
+		if err = signPacket(senderwallet, &packet); err != nil {
+			return
+		}
+
+		packets = append(packets, packet)
+
+	}
+
+	return
+
+}
+
+// A message as a signed TX, as the receiving node stores it, for sending whole over a stream. The ID
+// is the one fragments of the same message would carry
+func NewMessage(senderwallet *wallet.Wallet, recipient []byte, data []byte, msgType uint8, plaintext bool) (tx blockdb.TxPayload, id MsgID, err error) {
+
+	body, flags, err := messageBody(recipient, data, plaintext)
+
+	if err != nil {
+		return
+	}
+
+	signature, err := senderwallet.Sign(blockdb.TxSigningBytes(PacketVersion, msgType, flags, recipient, body))
+
+	if err != nil {
+		return
+	}
+
+	tx = blockdb.TxPayload{Data: body, Sender: senderwallet.PublicKey, Recipient: recipient, Signature: signature, Type: msgType, Reserved: flags}
+
+	return tx, sha256.Sum256(append(append([]byte{}, body...), signature...)), nil
+
+}
+
+// The message data after a new replay header, sealed for the recipient unless plaintext. Both are prefixed
+// with their length, single packet messages are zero padded
+func messageBody(recipient []byte, data []byte, plaintext bool) (body []byte, flags uint8, err error) {
+
+	if len(recipient) != len(Packet{}.RecipientPublicKey) {
+		return nil, 0, ErrInvalidRecipient
+	}
+
+	if len(data) > MaxMessageSize {
+		return nil, 0, fmt.Errorf("%w (%d > %d bytes)", ErrMessageTooLarge, len(data), MaxMessageSize)
+	}
+
+	body = framed(data)
+	flags = blockdb.TxFlagReplay
+
+	if !plaintext {
+
+		if body, err = sealMessage(recipient, data); err != nil {
+			return
+		}
+
+		flags |= blockdb.TxFlagSealed
+
+	}
+
+	replay, err := blockdb.NewReplayHeader()
+
+	if err != nil {
+		return
+	}
+
+	return append(replay.Bytes(), body...), flags, nil
+
+}
+
+// The bytes a packet is signed over, every field but the gossip hops. A single packet is stored as a TX
+// signed with the packet signature, so this matches blockdb.TxSigningBytes
+func (packet Packet) SignedData() []byte {
+
+	return blockdb.TxSigningBytes(packet.Version[0], packet.Type[0], packet.Flags[0], packet.RecipientPublicKey[:], packet.Payload[:])
+
+}
+
+func signPacket(senderwallet *wallet.Wallet, packet *Packet) (err error) {
+
+	signature, err := senderwallet.Sign(packet.SignedData())
+
+	if err != nil {
+		return
+	}
+
+	copy(packet.SenderSignature[:], signature)
+
+	return
+
+}
+
+// Add a verified fragment, returning the TX once every fragment of the message has been received
+func (r *reassembler) add(packet Packet) (tx *blockdb.TxPayload, err error) {
+
+	var header fragmentHeader
+
+	if err = binary.Read(bytes.NewReader(packet.Payload[blockdb.ReplayHeaderSize:]), binary.BigEndian, &header); err != nil {
+		return
+	}
+
+	maxFragments := (maxMessageData+64)/FragmentSize + 1
+
+	if header.Total < 2 || int(header.Total) > maxFragments || header.Index >= header.Total || int(header.Length) > FragmentSize {
+		return nil, fmt.Errorf("%w (%d of %d, %d bytes)", ErrFragment, header.Index, header.Total, header.Length)
+	}
+
+	chunk := make([]byte, header.Length)
+	copy(chunk, packet.Payload[blockdb.ReplayHeaderSize+fragmentHeaderSize:])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(time.Now())
+
+	key := string(packet.SenderPublicKey[:]) + string(header.MsgID[:])
+	partial, ok := r.partials[key]
+
+	if !ok {
+
+		if len(r.partials) >= r.maxMessages {
+			return nil, fmt.Errorf("%w, (%d) incomplete messages held", ErrReassemblyFull, len(r.partials))
+		}
+
+		partial = &partialMessage{
+			sender:    packet.SenderPublicKey,
+			recipient: packet.RecipientPublicKey,
+			msgType:   packet.Type[0],
+			flags:     packet.Flags[0] &^ PacketFlagFragment,
+			fragments: make([][]byte, header.Total),
+			started:   time.Now(),
+		}
+
+		r.partials[key] = partial
+
+	}
+
+	if len(partial.fragments) != int(header.Total) || partial.recipient != packet.RecipientPublicKey || partial.msgType != packet.Type[0] || partial.flags != packet.Flags[0]&^PacketFlagFragment {
+		return nil, fmt.Errorf("%w, does not match earlier fragments", ErrFragment)
+	}
+
+	// Duplicates are ignored
+	if partial.fragments[header.Index] != nil {
+		return
+	}
+
+	if r.size+len(chunk) > r.maxBytes {
+		return nil, fmt.Errorf("%w (%d bytes)", ErrReassemblyFull, r.size)
+	}
+
+	partial.fragments[header.Index] = chunk
+	partial.received++
+	partial.size += len(chunk)
+	r.size += len(chunk)
+
+	if partial.received < len(partial.fragments) {
+		return
+	}
+
+	r.remove(key)
+
+	message := bytes.Join(partial.fragments, nil)
+
+	if sha256.Sum256(message) != header.MsgID || len(message) <= 64 {
+		return nil, fmt.Errorf("%w, message does not match ID", ErrFragment)
+	}
+
+	body, signature := message[:len(message)-64], message[len(message)-64:]
+
+	mywallet := wallet.New()
+
+	if !mywallet.VerifyRaw(partial.sender[:], blockdb.TxSigningBytes(PacketVersion, partial.msgType, partial.flags, partial.recipient[:], body), signature) {
+		return nil, fmt.Errorf("%w, message signature failure", ErrFragment)
+	}
+
+	return &blockdb.TxPayload{
+		Data:      body,
+		Sender:    partial.sender[:],
+		Recipient: partial.recipient[:],
+		Signature: signature,
+		Type:      partial.msgType,
+		Reserved:  partial.flags,
+	}, nil
+
+}
+
+// Drop messages not completed within the timeout, lock must be held
+func (r *reassembler) expire(now time.Time) {
+
+	for key, partial := range r.partials {
+		if now.Sub(partial.started) > r.timeout {
+			log.Debug(fmt.Sprintf("Reassembly => Dropping incomplete message, (%d) of (%d) fragments", partial.received, len(partial.fragments)))
+			r.remove(key)
+		}
+	}
+
+}
+
+func (r *reassembler) remove(key string) {
+
+	if partial, ok := r.partials[key]; ok {
+		r.size -= partial.size
+		delete(r.partials, key)
+	}
+
+}
@@ -0,0 +1,172 @@
+package p2pnet_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/poh_hash"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// Encode packets as received by MsgHandler
+func encodePackets(t *testing.T, packets []p2pnet.Packet) (datagrams [][]byte) {
+
+	for _, packet := range packets {
+		buf := new(bytes.Buffer)
+		assert.Nil(t, binary.Write(buf, binary.BigEndian, packet))
+		datagrams = append(datagrams, buf.Bytes())
+	}
+
+	return
+
+}
+
+func TestFragmentReassembly(t *testing.T) {
+
+	p2p := p2pnet.New(p2pnet.P2P{})
+	p2p.POH = &poh_hash.POH{}
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	recipient := wallet.New()
+	assert.Nil(t, recipient.GenerateWallet())
+
+	data := make([]byte, 5000)
+	rand.Read(data)
+
+	packets, _, err := p2pnet.NewPackets(&sender, recipient.PublicKey, data, 3, false)
+	assert.Nil(t, err)
+	assert.Greater(t, len(packets), 1)
+
+	datagrams := encodePackets(t, packets)
+
+	// Deliver out of order, with a duplicate, only the whole message is queued
+	rand.Shuffle(len(datagrams), func(i, j int) { datagrams[i], datagrams[j] = datagrams[j], datagrams[i] })
+	datagrams = append(datagrams[:1], datagrams...)
+
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	for i, datagram := range datagrams {
+
+		assert.Len(t, p2p.POH.QueueSync.State, 0, "fragment %d", i)
+		p2p.MsgHandler(src, len(datagram), datagram)
+
+	}
+
+	assert.Len(t, p2p.POH.QueueSync.State, 1)
+
+	tx := p2p.POH.QueueSync.State[0]
+	assert.Equal(t, uint8(3), tx.Type)
+
+	// The stored TX is signed by the sender
+	assert.Nil(t, blockdb.VerifyTx(tx))
+
+	opened, err := p2pnet.OpenPayload(&recipient, tx)
+	assert.Nil(t, err)
+	assert.Equal(t, data, opened)
+
+}
+
+func TestFragmentTimeout(t *testing.T) {
+
+	p2p := p2pnet.New(p2pnet.P2P{FragmentTimeout: 50 * time.Millisecond, MaxPartialMessages: 1})
+	p2p.POH = &poh_hash.POH{}
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	packets, _, err := p2pnet.NewPackets(&sender, sender.PublicKey, make([]byte, 2000), 0, true)
+	assert.Nil(t, err)
+
+	other, _, err := p2pnet.NewPackets(&sender, sender.PublicKey, bytes.Repeat([]byte{1}, 2000), 0, true)
+	assert.Nil(t, err)
+
+	datagrams := encodePackets(t, packets)
+	otherDatagrams := encodePackets(t, other)
+
+	p2p.MsgHandler(src, len(datagrams[0]), datagrams[0])
+
+	// Only one incomplete message is held
+	for _, datagram := range otherDatagrams {
+		p2p.MsgHandler(src, len(datagram), datagram)
+	}
+
+	assert.Len(t, p2p.POH.QueueSync.State, 0)
+
+	// Fragments arriving after the timeout can't complete the message
+	time.Sleep(100 * time.Millisecond)
+
+	for _, datagram := range datagrams[1:] {
+		p2p.MsgHandler(src, len(datagram), datagram)
+	}
+
+	assert.Len(t, p2p.POH.QueueSync.State, 0)
+
+}
+
+func TestPacketFieldsSigned(t *testing.T) {
+
+	p2p := p2pnet.New(p2pnet.P2P{})
+	p2p.POH = &poh_hash.POH{}
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	// The type, flags and recipient can't be changed without the sender key
+	packets, _, err := p2pnet.NewPackets(&sender, sender.PublicKey, []byte("hello"), 3, true)
+	assert.Nil(t, err)
+	assert.Len(t, packets, 1)
+
+	retyped := packets[0]
+	retyped.Type[0] = 4
+
+	resealed := packets[0]
+	resealed.Flags[0] |= blockdb.TxFlagSealed
+
+	redirected := packets[0]
+	redirected.RecipientPublicKey[0] ^= 0xff
+
+	for _, datagram := range encodePackets(t, []p2pnet.Packet{retyped, resealed, redirected}) {
+		p2p.MsgHandler(src, len(datagram), datagram)
+	}
+
+	assert.Len(t, p2p.POH.QueueSync.State, 0)
+
+	// Fragments of one message must agree on the flags, even when each is signed by the sender
+	fragments, _, err := p2pnet.NewPackets(&sender, sender.PublicKey, make([]byte, 2000), 3, true)
+	assert.Nil(t, err)
+	assert.Greater(t, len(fragments), 1)
+
+	fragments[1].Flags[0] |= blockdb.TxFlagSealed
+
+	signature, err := sender.Sign(fragments[1].SignedData())
+	assert.Nil(t, err)
+	copy(fragments[1].SenderSignature[:], signature)
+
+	for _, datagram := range encodePackets(t, fragments) {
+		p2p.MsgHandler(src, len(datagram), datagram)
+	}
+
+	assert.Len(t, p2p.POH.QueueSync.State, 0)
+
+	// Unchanged packets are queued, with the TX signature covering the same fields
+	for _, datagram := range encodePackets(t, packets) {
+		p2p.MsgHandler(src, len(datagram), datagram)
+	}
+
+	assert.Len(t, p2p.POH.QueueSync.State, 1)
+	assert.Nil(t, blockdb.VerifyTx(p2p.POH.QueueSync.State[0]))
+
+}
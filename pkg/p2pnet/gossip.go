@@ -0,0 +1,249 @@
+package p2pnet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/perrychain/perry/pkg/blockdb"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default number of peers each message is forwarded to, and the most hops from the sender it travels
+const DefaultGossipFanout = 4
+const DefaultGossipMaxHops = 6
+
+// Default number of messages tracked, the oldest are dropped first
+const DefaultMaxGossip = 100_000
+
+// How far a message has spread, as seen by this node
+type GossipStats struct {
+	MsgID      MsgID     `json:"msg_id"`
+	FirstSeen  time.Time `json:"first_seen"`
+	Hops       uint8     `json:"hops"`       // fewest hops from the sender a new packet was received at
+	Packets    int       `json:"packets"`    // packets received, including duplicates
+	Duplicates int       `json:"duplicates"` // packets dropped as already seen
+	Sources    int       `json:"sources"`    // distinct addresses the message was received from
+	Forwarded  int       `json:"forwarded"`  // packets forwarded to peers
+	Peers      int       `json:"peers"`      // distinct peers the message was forwarded to
+}
+
+// Gossip stats by message ID
+type gossipStore struct {
+	mu      sync.Mutex
+	entries map[MsgID]*gossipEntry
+	order   []MsgID
+	max     int
+}
+
+type gossipEntry struct {
+	stats   GossipStats
+	sources map[string]bool
+	peers   map[string]bool
+}
+
+func newGossipStore(max int) *gossipStore {
+
+	return &gossipStore{entries: make(map[MsgID]*gossipEntry), max: max}
+
+}
+
+// The entry for the message, added if new and dropping the oldest if full. Lock must be held
+func (store *gossipStore) entry(id MsgID, hops uint8) *gossipEntry {
+
+	if entry, ok := store.entries[id]; ok {
+		return entry
+	}
+
+	for len(store.order) >= store.max {
+		delete(store.entries, store.order[0])
+		store.order = store.order[1:]
+	}
+
+	entry := &gossipEntry{stats: GossipStats{MsgID: id, FirstSeen: time.Now(), Hops: hops}, sources: make(map[string]bool), peers: make(map[string]bool)}
+
+	store.entries[id] = entry
+	store.order = append(store.order, id)
+
+	return entry
+
+}
+
+// Record a packet of the message received from `source`
+func (store *gossipStore) received(id MsgID, hops uint8, source string, duplicate bool) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry := store.entry(id, hops)
+
+	entry.stats.Packets++
+
+	// The hops are not signed, a copy with the hops reset is dropped and does not count
+	if duplicate {
+		entry.stats.Duplicates++
+	} else if hops < entry.stats.Hops {
+		entry.stats.Hops = hops
+	}
+
+	if source != "" && !entry.sources[source] {
+		entry.sources[source] = true
+		entry.stats.Sources++
+	}
+
+}
+
+// Record a packet of the message forwarded to the peers
+func (store *gossipStore) forwarded(id MsgID, peers []string) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, ok := store.entries[id]
+
+	if !ok {
+		return
+	}
+
+	entry.stats.Forwarded += len(peers)
+
+	for _, peer := range peers {
+		if !entry.peers[peer] {
+			entry.peers[peer] = true
+			entry.stats.Peers++
+		}
+	}
+
+}
+
+func (store *gossipStore) get(id MsgID) (stats GossipStats, ok bool) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, ok := store.entries[id]
+
+	if ok {
+		stats = entry.stats
+	}
+
+	return
+
+}
+
+// The ID of the message a packet belongs to, the same ID the sender and receipts use
+func gossipID(packet Packet) MsgID {
+
+	var header fragmentHeader
+
+	if packet.Flags[0]&PacketFlagFragment != 0 && binary.Read(bytes.NewReader(packet.Payload[blockdb.ReplayHeaderSize:]), binary.BigEndian, &header) == nil {
+		return header.MsgID
+	}
+
+	return packet.ID()
+
+}
+
+// Forward a verified packet to a fanout of verified peers, unless it has travelled the most hops. Peers
+// receiving a packet again drop it by its replay header, so each node forwards a packet once, even if a
+// peer resets the hops, which are not signed. Packets go over the encrypted session to a peer once there
+// is one, over UDP until then
+func (p2p *P2P) gossip(id MsgID, packet Packet) {
+
+	if int(packet.Hops[0]) >= p2p.GossipMaxHops {
+		return
+	}
+
+	packet.Hops[0]++
+
+	buf := new(bytes.Buffer)
+
+	if err := binary.Write(buf, binary.BigEndian, packet); err != nil {
+		log.Warn("Gossip => ", err)
+		return
+	}
+
+	var sent []string
+
+	for _, peer := range p2p.gossipPeers(id) {
+
+		var err error
+
+		if session := p2p.openSession(peer); session != nil {
+			err = p2p.sendPacket(session, buf.Bytes())
+		} else {
+			err = p2p.Transport.Send(peer, buf.Bytes(), DefaultSendTimeout)
+		}
+
+		if err != nil {
+			log.Debug(fmt.Sprintf("Gossip => %s: %s", peer, err))
+			continue
+		}
+
+		sent = append(sent, peer)
+
+	}
+
+	p2p.gossiped.forwarded(id, sent)
+
+}
+
+// Up to GossipFanout verified peers to forward the message to. Peers are ranked by the hash of the
+// message ID and their address, so every fragment of a message is forwarded to the same peers
+func (p2p *P2P) gossipPeers(id MsgID) (peers []string) {
+
+	myNode := p2p.P2P_Node.address()
+
+	for address := range p2p.p2pPeers() {
+		if address != myNode {
+			peers = append(peers, address)
+		}
+	}
+
+	rank := func(address string) []byte {
+		hash := sha256.Sum256(append(id[:], address...))
+		return hash[:]
+	}
+
+	sort.Slice(peers, func(i, j int) bool { return bytes.Compare(rank(peers[i]), rank(peers[j])) < 0 })
+
+	if len(peers) > p2p.GossipFanout {
+		peers = peers[:p2p.GossipFanout]
+	}
+
+	return
+
+}
+
+// Return how far a message received by this node has spread
+func (p2p *P2P) Gossip(id MsgID) (GossipStats, bool) {
+
+	return p2p.gossiped.get(id)
+
+}
+
+// JSON RPC method, return the gossip stats for the message ID
+func (p2p *P2P) GossipStatus(c *gin.Context) {
+
+	var id MsgID
+
+	if err := id.UnmarshalText([]byte(c.Query("id"))); err != nil {
+		c.JSON(400, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
+
+	stats, ok := p2p.Gossip(id)
+
+	if !ok {
+		c.JSON(404, gin.H{"status": "fail", "error": "message not seen"})
+		return
+	}
+
+	c.JSON(200, stats)
+
+}
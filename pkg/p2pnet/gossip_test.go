@@ -0,0 +1,165 @@
+package p2pnet_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// Number of TXs queued to the PoH
+func queued(p2p *p2pnet.P2P) int {
+
+	p2p.POH.Mu.Lock()
+	defer p2p.POH.Mu.Unlock()
+
+	return len(p2p.POH.QueueSync.State)
+
+}
+
+func TestGossip(t *testing.T) {
+
+	a, addrA := newNode(t, nodeOptions{udp: true})
+	b, addrB := newNode(t, nodeOptions{udp: true})
+	c, addrC := newNode(t, nodeOptions{udp: true})
+
+	// A line of peers, A and C only reach each other through B
+	a.Discover(addrB)
+	c.Discover(addrB)
+	b.Discover(addrA)
+	b.Discover(addrC)
+
+	client := p2pnet.New(p2pnet.P2P{})
+	defer client.Close()
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	opts := p2pnet.SendOptions{Peer: fmt.Sprintf("%s:%d", a.P2P_Node.Host, a.P2P_Node.Port), Node: a.POH.Wallet.PublicKey}
+
+	single, err := client.Send(&sender, sender.PublicKey, []byte("Hello world"), 1, opts)
+	assert.Nil(t, err)
+
+	fragmented, err := client.Send(&sender, sender.PublicKey, make([]byte, 2000), 1, opts)
+	assert.Nil(t, err)
+
+	// Each node queues each message once
+	for _, node := range []*p2pnet.P2P{a, b, c} {
+		node := node
+		assert.Eventually(t, func() bool { return queued(node) == 2 }, 2*time.Second, 10*time.Millisecond)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	for _, node := range []*p2pnet.P2P{a, b, c} {
+		assert.Equal(t, 2, queued(node))
+	}
+
+	for _, id := range []p2pnet.MsgID{single, fragmented} {
+
+		stats, ok := a.Gossip(id)
+		assert.True(t, ok)
+		assert.Equal(t, uint8(0), stats.Hops)
+		assert.Equal(t, 1, stats.Peers)
+
+		stats, ok = b.Gossip(id)
+		assert.True(t, ok)
+		assert.Equal(t, uint8(1), stats.Hops)
+		assert.Equal(t, 2, stats.Peers)
+
+		stats, ok = c.Gossip(id)
+		assert.True(t, ok)
+		assert.Equal(t, uint8(2), stats.Hops)
+
+		// B sends the message back to A, dropped as a duplicate
+		stats, _ = a.Gossip(id)
+		assert.Equal(t, 2, stats.Sources)
+		assert.Greater(t, stats.Duplicates, 0)
+
+	}
+
+	// Only the node the sender reached acknowledges the message, the client is not a peer and fetches it
+	receipt, err := client.FetchReceipt(addrA, single)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(a.POH.Wallet.PublicKey), receipt.Node)
+
+	_, err = client.FetchReceipt(addrC, single)
+	assert.NotNil(t, err)
+
+	_, ok := c.Receipt(single)
+	assert.False(t, ok)
+
+}
+
+func TestGossipMaxHops(t *testing.T) {
+
+	a, _ := newNode(t, nodeOptions{udp: true})
+	b, addrB := newNode(t, nodeOptions{udp: true})
+
+	a.Discover(addrB)
+	a.GossipMaxHops = 1
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	// Packets that have travelled the most hops are queued, not forwarded
+	packets, id, err := p2pnet.NewPackets(&sender, sender.PublicKey, []byte("Hello world"), 1, true)
+	assert.Nil(t, err)
+
+	packets[0].Hops[0] = 1
+	datagram := encodePackets(t, packets)[0]
+	a.MsgHandler(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, len(datagram), datagram)
+
+	assert.Equal(t, 1, queued(a))
+
+	stats, ok := a.Gossip(id)
+	assert.True(t, ok)
+	assert.Equal(t, 0, stats.Forwarded)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, queued(b))
+
+}
+
+// The hops are not signed, a packet sent again with the hops reset is dropped as a replay
+func TestGossipHopsReset(t *testing.T) {
+
+	a, _ := newNode(t, nodeOptions{udp: true})
+	b, addrB := newNode(t, nodeOptions{udp: true})
+
+	a.Discover(addrB)
+	a.GossipMaxHops = 1
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	packets, id, err := p2pnet.NewPackets(&sender, sender.PublicKey, []byte("Hello world"), 1, true)
+	assert.Nil(t, err)
+
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	packets[0].Hops[0] = 1
+	datagram := encodePackets(t, packets)[0]
+	a.MsgHandler(src, len(datagram), datagram)
+
+	packets[0].Hops[0] = 0
+	datagram = encodePackets(t, packets)[0]
+	a.MsgHandler(src, len(datagram), datagram)
+
+	assert.Equal(t, 1, queued(a))
+
+	stats, ok := a.Gossip(id)
+	assert.True(t, ok)
+	assert.Equal(t, 2, stats.Packets)
+	assert.Equal(t, 1, stats.Duplicates)
+	assert.Equal(t, uint8(1), stats.Hops)
+	assert.Equal(t, 0, stats.Forwarded)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, queued(b))
+
+}
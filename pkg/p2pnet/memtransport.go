@@ -0,0 +1,278 @@
+package p2pnet
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Conditions of the links between nodes on a MemNetwork
+type MemConditions struct {
+	Latency   time.Duration // delay of each datagram
+	Jitter    time.Duration // random extra delay, up to Jitter
+	Loss      float64       // chance a datagram is dropped
+	Duplicate float64       // chance a datagram is delivered twice
+	Reorder   float64       // chance a datagram is held back behind those sent after it
+}
+
+// Nodes connected in one process. Datagrams are queued with a simulated delay and delivered in order of
+// arrival by Flush, on the calling goroutine, so a run with the same seed and sends delivers the same way
+type MemNetwork struct {
+	mu         sync.Mutex
+	conditions MemConditions
+	rand       *rand.Rand
+	nodes      map[string]*MemTransport
+	queue      memQueue
+	now        time.Duration
+	seq        uint64
+}
+
+// A transport for one node on a MemNetwork
+type MemTransport struct {
+	network   *MemNetwork
+	addr      *net.UDPAddr
+	handler   func(*net.UDPAddr, int, []byte)
+	listening chan struct{}
+	closed    chan struct{}
+}
+
+type memDatagram struct {
+	at  time.Duration
+	seq uint64
+	src *net.UDPAddr
+	dst string
+	b   []byte
+}
+
+// Datagrams in flight, by arrival time then the order sent
+type memQueue []memDatagram
+
+func NewMemNetwork(seed int64, conditions MemConditions) *MemNetwork {
+
+	return &MemNetwork{conditions: conditions, rand: rand.New(rand.NewSource(seed)), nodes: make(map[string]*MemTransport)}
+
+}
+
+// Add a node at the IP address and port `addr`
+func (network *MemNetwork) Transport(addr string) (*MemTransport, error) {
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	if _, ok := network.nodes[udpAddr.String()]; ok {
+		return nil, fmt.Errorf("address %s in use", udpAddr)
+	}
+
+	t := &MemTransport{network: network, addr: udpAddr, listening: make(chan struct{}), closed: make(chan struct{})}
+	network.nodes[udpAddr.String()] = t
+
+	return t, nil
+
+}
+
+// Deliver the datagrams in flight, and those sent by the handlers, until none are left for a listening
+// node. Returns the number delivered
+func (network *MemNetwork) Flush() (delivered int) {
+
+	for {
+
+		network.mu.Lock()
+
+		var held []memDatagram
+		var next memDatagram
+		var handler func(*net.UDPAddr, int, []byte)
+
+		for network.queue.Len() > 0 {
+
+			d := heap.Pop(&network.queue).(memDatagram)
+			node, ok := network.nodes[d.dst]
+
+			// Nodes not listening yet receive their datagrams once they are
+			if ok && node.handler == nil {
+				held = append(held, d)
+				continue
+			}
+
+			// Datagrams to unknown addresses are lost, as with UDP
+			if !ok {
+				continue
+			}
+
+			next, handler = d, node.handler
+
+			break
+
+		}
+
+		for _, d := range held {
+			heap.Push(&network.queue, d)
+		}
+
+		if handler != nil && next.at > network.now {
+			network.now = next.at
+		}
+
+		network.mu.Unlock()
+
+		if handler == nil {
+			return
+		}
+
+		handler(next.src, len(next.b), next.b)
+		delivered++
+
+	}
+
+}
+
+// Simulated time elapsed, the arrival time of the last datagram delivered
+func (network *MemNetwork) Elapsed() time.Duration {
+
+	network.mu.Lock()
+	defer network.mu.Unlock()
+
+	return network.now
+
+}
+
+// Queue the datagram with the delay, loss, duplication and reordering of the conditions. Lock must be held
+func (network *MemNetwork) send(src *net.UDPAddr, dst string, b []byte) {
+
+	conditions := network.conditions
+
+	if network.rand.Float64() < conditions.Loss {
+		return
+	}
+
+	copies := 1
+
+	if network.rand.Float64() < conditions.Duplicate {
+		copies = 2
+	}
+
+	for i := 0; i < copies; i++ {
+
+		at := network.now + conditions.Latency
+
+		if conditions.Jitter > 0 {
+			at += time.Duration(network.rand.Int63n(int64(conditions.Jitter) + 1))
+		}
+
+		// Held back past any datagram sent later
+		if network.rand.Float64() < conditions.Reorder {
+			at += conditions.Latency + conditions.Jitter + 1
+		}
+
+		network.seq++
+		heap.Push(&network.queue, memDatagram{at: at, seq: network.seq, src: src, dst: dst, b: append([]byte{}, b...)})
+
+	}
+
+}
+
+func (t *MemTransport) Send(addr string, b []byte, timeout time.Duration) error {
+
+	dst, err := net.ResolveUDPAddr("udp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if t.network.nodes[t.addr.String()] != t {
+		return net.ErrClosed
+	}
+
+	t.network.send(t.addr, dst.String(), b)
+
+	return nil
+
+}
+
+// Pass the datagrams delivered by Flush to the handler, blocks until closed
+func (t *MemTransport) Receive(h func(*net.UDPAddr, int, []byte)) error {
+
+	t.network.mu.Lock()
+
+	if t.handler != nil {
+		t.network.mu.Unlock()
+		return fmt.Errorf("%s is already receiving", t.addr)
+	}
+
+	t.handler = h
+	close(t.listening)
+
+	t.network.mu.Unlock()
+
+	<-t.closed
+
+	return nil
+
+}
+
+// Closed once the node is receiving, datagrams are delivered to it from then on
+func (t *MemTransport) Listening() <-chan struct{} {
+
+	return t.listening
+
+}
+
+func (t *MemTransport) LocalAddr() net.Addr {
+
+	return t.addr
+
+}
+
+// Remove the node from the network, datagrams to it are lost
+func (t *MemTransport) Close() error {
+
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if t.network.nodes[t.addr.String()] != t {
+		return nil
+	}
+
+	delete(t.network.nodes, t.addr.String())
+	close(t.closed)
+
+	return nil
+
+}
+
+func (q memQueue) Len() int { return len(q) }
+
+func (q memQueue) Less(i, j int) bool {
+
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+
+	return q[i].seq < q[j].seq
+
+}
+
+func (q memQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *memQueue) Push(x interface{}) { *q = append(*q, x.(memDatagram)) }
+
+func (q *memQueue) Pop() interface{} {
+
+	old := *q
+	d := old[len(old)-1]
+	*q = old[:len(old)-1]
+
+	return d
+
+}
@@ -0,0 +1,110 @@
+package p2pnet_test
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/poh_hash"
+	"github.com/stretchr/testify/assert"
+)
+
+// Listeners and handlers of a test node
+type nodeOptions struct {
+	config     p2pnet.P2P         // Passed to p2pnet.New, a P2P port given is kept
+	udp        bool               // Listen for packets on a UDP port
+	streams    bool               // Accept stream sessions on the P2P port
+	network    *p2pnet.MemNetwork // Listen for packets on the network instead, at the P2P port given
+	middleware []gin.HandlerFunc  // Run before the RPC handlers
+}
+
+// Start a node with its own BlockDB serving the RPC endpoints behind the middleware, returning its RPC
+// address. Peers are dialed on the host of the RPC server, so nodes are told apart by their P2P port
+func newNode(t *testing.T, opts nodeOptions) (*p2pnet.P2P, string) {
+
+	config := opts.config
+
+	if config.BootstrapPeers == nil {
+		config.BootstrapPeers = []string{}
+	}
+
+	var packets *net.UDPConn
+	var streams net.Listener
+	var err error
+
+	if opts.udp {
+
+		packets, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		assert.Nil(t, err)
+
+		config.P2P_Node = p2pnet.Node{Host: "127.0.0.1", Port: uint16(packets.LocalAddr().(*net.UDPAddr).Port)}
+
+	}
+
+	if opts.streams {
+
+		streams, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", config.P2P_Node.Port))
+		assert.Nil(t, err)
+
+		config.P2P_Node = p2pnet.Node{Host: "127.0.0.1", Port: uint16(streams.Addr().(*net.TCPAddr).Port)}
+
+	}
+
+	var transport *p2pnet.MemTransport
+
+	if opts.network != nil {
+
+		transport, err = opts.network.Transport(fmt.Sprintf("127.0.0.1:%d", config.P2P_Node.Port))
+		assert.Nil(t, err)
+
+		config.P2P_Node.Host = "127.0.0.1"
+		config.Transport = transport
+
+	}
+
+	node := p2pnet.New(config)
+	node.POH = &poh_hash.POH{BlockDB: blockdb.New(filepath.Join(t.TempDir(), "blockchain.db"))}
+	assert.Nil(t, node.POH.Wallet.GenerateWallet())
+	assert.Nil(t, node.POH.BlockDB.Open())
+
+	t.Cleanup(func() {
+		node.Close()
+		node.POH.BlockDB.Close()
+	})
+
+	if packets != nil {
+		go node.Serve(packets, node.MsgHandler)
+		t.Cleanup(func() { packets.Close() })
+	}
+
+	if streams != nil {
+		go node.ServeStreams(streams)
+	}
+
+	if transport != nil {
+		go node.Listen(node.MsgHandler)
+		<-transport.Listening()
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(opts.middleware...)
+	router.GET("/p2p/status", node.Status)
+	router.GET("/p2p/sync", node.Sync)
+	router.GET("/p2p/ancestor", node.Ancestor)
+	router.GET("/p2p/peers", node.Peers)
+	router.GET("/p2p/handshake", node.Handshake)
+	router.GET("/p2p/receipt", node.ReceiptStatus)
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	return node, strings.TrimPrefix(server.URL, "http://")
+
+}
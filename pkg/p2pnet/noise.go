@@ -0,0 +1,402 @@
+package p2pnet
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/perrychain/perry/pkg/wallet"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The XX pattern, both nodes send their static keys encrypted:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// Static keys are the X25519 keys of the node wallets. Each node sends its ed25519 key and signs the
+// handshake hash with it, as both signs of an ed25519 key share one X25519 key
+var noiseProtocol = []byte("Noise_XX_25519_ChaChaPoly_SHA256")
+var noisePrologue = []byte("perry-stream/1")
+
+// Handshake messages have fixed sizes, the ephemeral key, encrypted static key and signature
+const (
+	noiseKeySize       = curve25519.PointSize
+	noiseStaticSize    = ed25519.PublicKeySize + chacha20poly1305.Overhead
+	noiseSignatureSize = ed25519.SignatureSize + chacha20poly1305.Overhead
+)
+
+// Largest encrypted record, the length is sent as a big endian uint16
+const maxNoiseRecord = 65535
+
+var ErrNoiseNonce = errors.New("session nonces exhausted")
+
+// Encrypts one direction of a session, the nonce counts the records sent
+type noiseCipher struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+// Handshake state, the chaining key and hash of the messages so far
+type noiseState struct {
+	ck     []byte
+	h      []byte
+	cipher *noiseCipher
+}
+
+func newNoiseCipher(key []byte) (*noiseCipher, error) {
+
+	aead, err := chacha20poly1305.New(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &noiseCipher{aead: aead}, nil
+
+}
+
+func (c *noiseCipher) nonceBytes() []byte {
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+
+	return nonce
+
+}
+
+func (c *noiseCipher) seal(plaintext, ad []byte) ([]byte, error) {
+
+	if c.nonce == ^uint64(0) {
+		return nil, ErrNoiseNonce
+	}
+
+	ciphertext := c.aead.Seal(nil, c.nonceBytes(), plaintext, ad)
+	c.nonce++
+
+	return ciphertext, nil
+
+}
+
+func (c *noiseCipher) open(ciphertext, ad []byte) ([]byte, error) {
+
+	if c.nonce == ^uint64(0) {
+		return nil, ErrNoiseNonce
+	}
+
+	plaintext, err := c.aead.Open(nil, c.nonceBytes(), ciphertext, ad)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.nonce++
+
+	return plaintext, nil
+
+}
+
+func newNoiseState() *noiseState {
+
+	// The protocol name is 32 bytes, used as the hash without padding
+	state := &noiseState{h: append([]byte{}, noiseProtocol...)}
+	state.ck = append([]byte{}, state.h...)
+	state.mixHash(noisePrologue)
+
+	return state
+
+}
+
+func (state *noiseState) mixHash(data []byte) {
+
+	h := sha256.New()
+	h.Write(state.h)
+	h.Write(data)
+	state.h = h.Sum(nil)
+
+}
+
+// Mix a DH result into the chaining key, and key the cipher for the rest of the handshake
+func (state *noiseState) mixKey(ikm []byte) (err error) {
+
+	ck, key, err := noiseHKDF(state.ck, ikm)
+
+	if err != nil {
+		return
+	}
+
+	state.ck = ck
+	state.cipher, err = newNoiseCipher(key)
+
+	return
+
+}
+
+func (state *noiseState) encryptAndHash(plaintext []byte) (ciphertext []byte, err error) {
+
+	ciphertext = plaintext
+
+	if state.cipher != nil {
+		if ciphertext, err = state.cipher.seal(plaintext, state.h); err != nil {
+			return
+		}
+	}
+
+	state.mixHash(ciphertext)
+
+	return
+
+}
+
+func (state *noiseState) decryptAndHash(ciphertext []byte) (plaintext []byte, err error) {
+
+	plaintext = ciphertext
+
+	if state.cipher != nil {
+		if plaintext, err = state.cipher.open(ciphertext, state.h); err != nil {
+			return nil, ErrStreamAuth
+		}
+	}
+
+	state.mixHash(ciphertext)
+
+	return
+
+}
+
+// The ciphers for the initiator to send and receive
+func (state *noiseState) split() (send, recv *noiseCipher, err error) {
+
+	k1, k2, err := noiseHKDF(state.ck, nil)
+
+	if err != nil {
+		return
+	}
+
+	if send, err = newNoiseCipher(k1); err != nil {
+		return
+	}
+
+	recv, err = newNoiseCipher(k2)
+
+	return
+
+}
+
+// Two 32 byte outputs of HKDF-SHA256, with the chaining key as the salt
+func noiseHKDF(ck, ikm []byte) (out1, out2 []byte, err error) {
+
+	r := hkdf.New(sha256.New, ikm, ck, nil)
+
+	out1 = make([]byte, 32)
+	out2 = make([]byte, 32)
+
+	if _, err = io.ReadFull(r, out1); err == nil {
+		_, err = io.ReadFull(r, out2)
+	}
+
+	return
+
+}
+
+// Sign the handshake hash with the wallet, proving the ed25519 key the static key belongs to
+func (state *noiseState) writeIdentity(w io.Writer, signer *wallet.Wallet, static, remote []byte) (err error) {
+
+	s, err := state.encryptAndHash(signer.PublicKey)
+
+	if err != nil {
+		return
+	}
+
+	// es for the responder, se for the initiator
+	if err = state.mixDH(static, remote); err != nil {
+		return
+	}
+
+	signature, err := signer.Sign(noiseDigest(state.h))
+
+	if err != nil {
+		return
+	}
+
+	payload, err := state.encryptAndHash(signature)
+
+	if err != nil {
+		return
+	}
+
+	_, err = w.Write(append(s, payload...))
+
+	return
+
+}
+
+// Read the ed25519 key of the peer and check the signature of the handshake hash. `ephemeral` is the
+// private key mixed with the static key of the peer
+func (state *noiseState) readIdentity(r io.Reader, ephemeral []byte) (peer ed25519.PublicKey, err error) {
+
+	msg := make([]byte, noiseStaticSize+noiseSignatureSize)
+
+	if _, err = io.ReadFull(r, msg); err != nil {
+		return
+	}
+
+	key, err := state.decryptAndHash(msg[:noiseStaticSize])
+
+	if err != nil {
+		return
+	}
+
+	remote, err := wallet.X25519PublicKey(key)
+
+	if err != nil {
+		return nil, ErrStreamAuth
+	}
+
+	if err = state.mixDH(ephemeral, remote); err != nil {
+		return
+	}
+
+	digest := noiseDigest(state.h)
+
+	signature, err := state.decryptAndHash(msg[noiseStaticSize:])
+
+	if err != nil {
+		return
+	}
+
+	if !ed25519.Verify(key, digest, signature) {
+		return nil, ErrStreamAuth
+	}
+
+	return ed25519.PublicKey(key), nil
+
+}
+
+func (state *noiseState) mixDH(private, public []byte) error {
+
+	shared, err := curve25519.X25519(private, public)
+
+	if err != nil {
+		// Low order points are rejected
+		return ErrStreamAuth
+	}
+
+	return state.mixKey(shared)
+
+}
+
+// The signed content of a handshake, domain separated from other signatures by the wallet
+func noiseDigest(h []byte) []byte {
+
+	digest := sha256.Sum256(append(append([]byte{}, noisePrologue...), h...))
+
+	return digest[:]
+
+}
+
+// Run the XX handshake over the connection, returning the verified ed25519 key of the peer and the
+// ciphers for the session. The dialing side initiates
+func noiseHandshake(conn io.ReadWriter, signer *wallet.Wallet, initiator bool) (peer ed25519.PublicKey, send, recv *noiseCipher, err error) {
+
+	static, err := signer.X25519PrivateKey()
+
+	if err != nil {
+		return
+	}
+
+	ephemeral := make([]byte, curve25519.ScalarSize)
+
+	if _, err = rand.Read(ephemeral); err != nil {
+		return
+	}
+
+	ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+
+	if err != nil {
+		return
+	}
+
+	state := newNoiseState()
+	remoteEphemeral := make([]byte, noiseKeySize)
+
+	if initiator {
+
+		// -> e
+		state.mixHash(ephemeralPublic)
+		state.mixHash(nil)
+
+		if _, err = conn.Write(ephemeralPublic); err != nil {
+			return
+		}
+
+		// <- e, ee, s, es
+		if _, err = io.ReadFull(conn, remoteEphemeral); err != nil {
+			return
+		}
+
+		state.mixHash(remoteEphemeral)
+
+		if err = state.mixDH(ephemeral, remoteEphemeral); err != nil {
+			return
+		}
+
+		if peer, err = state.readIdentity(conn, ephemeral); err != nil {
+			return
+		}
+
+		// -> s, se
+		if err = state.writeIdentity(conn, signer, static, remoteEphemeral); err != nil {
+			return
+		}
+
+		send, recv, err = state.split()
+
+		return
+
+	}
+
+	// -> e
+	if _, err = io.ReadFull(conn, remoteEphemeral); err != nil {
+		return
+	}
+
+	state.mixHash(remoteEphemeral)
+	state.mixHash(nil)
+
+	// <- e, ee, s, es
+	state.mixHash(ephemeralPublic)
+
+	if err = state.mixDH(ephemeral, remoteEphemeral); err != nil {
+		return
+	}
+
+	// Written at once, so the message arrives whole
+	msg := bytes.NewBuffer(append([]byte{}, ephemeralPublic...))
+
+	if err = state.writeIdentity(msg, signer, static, remoteEphemeral); err != nil {
+		return
+	}
+
+	if _, err = conn.Write(msg.Bytes()); err != nil {
+		return
+	}
+
+	// -> s, se
+	if peer, err = state.readIdentity(conn, ephemeral); err != nil {
+		return
+	}
+
+	recv, send, err = state.split()
+
+	return
+
+}
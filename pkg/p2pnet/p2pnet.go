@@ -3,13 +3,13 @@ package p2pnet
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -22,20 +22,72 @@ import (
 // "Safe" UDP packet size up to 508 bytes
 type Packet struct {
 	Version            [1]byte
-	Reserved           [3]byte
+	Type               [1]byte
+	Flags              [1]byte  // TX flags, see blockdb.TxFlagSealed
+	Hops               [1]byte  // gossip hops from the sender, not signed, copies are dropped by the replay header
 	SenderPublicKey    [32]byte // TODO: Consider Base36 (with ICAP) or Base56 encoding w/ unique identifier
 	RecipientPublicKey [32]byte
 	Payload            [376]byte
 	SenderSignature    [64]byte
 }
 
+// Socket receive buffer, large enough to hold the fragments of several whole messages
+const socketReadBuffer = 4 * 1024 * 1024
+
 type P2P struct {
-	P2P_Node        Node            `json:"p2p_node"`
-	P2P_Peers       map[string]Node `json:"p2p_peers"`
-	RPC_Node        Node            `json:"rpc_node"`
-	RPC_Peers       map[string]Node `json:"rpc_peers"`
-	POH             *poh_hash.POH
-	maxDatagramSize int
+	P2P_Node Node `json:"p2p_node"`
+	RPC_Node Node `json:"rpc_node"`
+	POH      *poh_hash.POH
+
+	// Peers are saved to PeersFile between runs, bootstrap peers as host:port
+	PeersFile      string   `json:"-"`
+	BootstrapPeers []string `json:"-"`
+
+	// Limits for reassembling fragmented messages
+	FragmentTimeout    time.Duration `json:"-"`
+	MaxPartialMessages int           `json:"-"`
+	MaxReassemblyBytes int           `json:"-"`
+
+	// Size of the RPC and verified peer tables
+	MaxPeers int `json:"-"`
+
+	// Bans are saved to BansFile, zero rate limits use the defaults
+	BansFile   string     `json:"-"`
+	RateLimits RateLimits `json:"-"`
+
+	// Packets outside the replay window are stale, MaxReplays bounds the (sender, nonce) pairs held
+	ReplayWindow time.Duration `json:"-"`
+	MaxReplays   int           `json:"-"`
+
+	// Switch to the heavier (longer) fork of a peer, rolling back at most MaxReorgDepth blocks. Off unless
+	// every peer is trusted, blocks carry no verifiable weight so any peer could claim a longer fork
+	AllowReorg    bool `json:"-"`
+	MaxReorgDepth int  `json:"-"`
+
+	// Blocks and bytes requested per sync page, and the most peers synced from at once when far behind
+	SyncPageBlocks int `json:"-"`
+	SyncPageBytes  int `json:"-"`
+	SyncPeers      int `json:"-"`
+
+	// Peers each verified message is forwarded to, and the most hops it travels from the sender
+	GossipFanout  int `json:"-"`
+	GossipMaxHops int `json:"-"`
+
+	// Sends and receives datagrams, UDP unless set
+	Transport Transport `json:"-"`
+
+	// Traffic between verified peers goes over encrypted TCP streams on the P2P port, beside the UDP
+	// transport. Streams are off with other transports. MaxStreams bounds the streams a peer has open
+	DisableStreams bool `json:"-"`
+	MaxStreams     int  `json:"-"`
+
+	reassembly *reassembler
+	peers      *PeerManager
+	reputation *Reputation
+	replay     *blockdb.ReplayGuard
+	receipts   *receiptStore
+	gossiped   *gossipStore
+	streams    *streamPool
 }
 
 // JSON RPC
@@ -44,6 +96,10 @@ type Status struct {
 	Hash   []byte `json:"hash"`
 	SeqID  uint64 `json:"seqid"`
 
+	// Archive nodes keep all TX data, other nodes may have pruned blocks up to PrunedHeight
+	Archive      bool   `json:"archive"`
+	PrunedHeight uint64 `json:"pruned_height"`
+
 	P2P_Node  Node            `json:"p2p_node"`
 	P2P_Peers map[string]Node `json:"p2p_peers"`
 	RPC_Node  Node            `json:"rpc_node"`
@@ -57,6 +113,14 @@ type Node struct {
 	LastSeen  time.Time `json:"lastseen"`
 	Version   uint8     `json:"version"`
 	Bootstrap bool      `json:"bootstrap"`
+
+	Archive      bool   `json:"archive"`
+	PrunedHeight uint64 `json:"pruned_height"`
+
+	// Health of RPC peers, consecutive failures, latency and SeqID of the last status query
+	Failures   int           `json:"failures"`
+	Latency    time.Duration `json:"latency"`
+	SyncHeight uint64        `json:"sync_height"`
 }
 
 func New(p P2P) *P2P {
@@ -66,113 +130,169 @@ func New(p P2P) *P2P {
 		p.P2P_Node.Version = 1
 	}
 
-	if p.maxDatagramSize == 0 {
-		p.maxDatagramSize = 8192
+	if p.Transport == nil {
+		p.Transport = NewUDPTransport(p.MsgHandler)
 	}
 
-	p.RPC_Peers = make(map[string]Node)
+	if p.FragmentTimeout == 0 {
+		p.FragmentTimeout = DefaultFragmentTimeout
+	}
 
-	// Set our bootstrap node
-	p.RPC_Peers["127.0.0.1:24816"] = Node{Host: "127.0.0.1", Port: 24816, Bootstrap: true}
+	if p.MaxPartialMessages == 0 {
+		p.MaxPartialMessages = DefaultMaxPartialMessages
+	}
 
-	return &p
-}
+	if p.MaxReassemblyBytes == 0 {
+		p.MaxReassemblyBytes = DefaultMaxReassemblyBytes
+	}
 
-// Listen on the specified UDP port for P2P blockchain traffic
-func (p2p *P2P) Listen(h func(*net.UDPAddr, int, []byte)) {
+	p.reassembly = newReassembler(p.FragmentTimeout, p.MaxPartialMessages, p.MaxReassemblyBytes)
 
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p2p.P2P_Node.Host, p2p.P2P_Node.Port))
+	if p.MaxPeers == 0 {
+		p.MaxPeers = DefaultMaxPeers
+	}
 
-	log.Debug("P2P.Listen => ", addr)
+	p.peers = NewPeerManager(p.PeersFile, p.MaxPeers)
 
-	if err != nil {
-		log.Fatal(err)
+	if err := p.peers.Load(); err != nil {
+		log.Warn("Peers => ", err)
 	}
 
-	var l *net.UDPConn
-
-	if p2p.P2P_Node.Host == "224.0.0.1" {
-		l, err = net.ListenMulticastUDP("udp", nil, addr)
+	if p.BootstrapPeers == nil {
+		p.BootstrapPeers = []string{DefaultBootstrapPeer}
+	}
 
-	} else {
-		l, err = net.ListenUDP("udp", addr)
+	if err := p.peers.AddBootstrap(p.BootstrapPeers); err != nil {
+		log.Warn("Peers => ", err)
+	}
 
+	if p.MaxReorgDepth <= 0 {
+		p.MaxReorgDepth = DefaultMaxReorgDepth
 	}
 
-	if err != nil {
-		log.Fatal(err)
+	if p.SyncPageBlocks == 0 {
+		p.SyncPageBlocks = DefaultSyncPageBlocks
 	}
 
-	l.SetReadBuffer(8192) //this.maxDatagramSize)
+	if p.SyncPageBytes == 0 {
+		p.SyncPageBytes = DefaultSyncPageBytes
+	}
 
-	for {
-		b := make([]byte, p2p.maxDatagramSize)
-		n, src, err := l.ReadFromUDP(b)
-		if err != nil {
-			log.Warn("ReadFromUDP failed:", err)
-		}
-		h(src, n, b)
+	if p.SyncPeers == 0 {
+		p.SyncPeers = DefaultSyncPeers
 	}
 
-}
+	p.replay = blockdb.NewReplayGuard(p.ReplayWindow, p.MaxReplays)
+	p.receipts = newReceiptStore(DefaultMaxReceipts)
+
+	if p.GossipFanout == 0 {
+		p.GossipFanout = DefaultGossipFanout
+	}
 
-// Send a packet on the P2P network via UDP
-func (p2p *P2P) Send(senderwallet wallet.Wallet, data string) {
+	if p.GossipMaxHops == 0 {
+		p.GossipMaxHops = DefaultGossipMaxHops
+	}
 
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p2p.P2P_Node.Host, p2p.P2P_Node.Port))
+	p.gossiped = newGossipStore(DefaultMaxGossip)
 
-	if err != nil {
-		log.Fatal(err)
+	if p.MaxStreams == 0 {
+		p.MaxStreams = DefaultMaxStreams
 	}
 
-	c, err := net.DialUDP("udp", nil, addr)
+	_, udp := p.Transport.(*UDPTransport)
+	p.streams = newStreamPool(udp && !p.DisableStreams)
 
-	if err != nil {
-		log.Fatal(err)
+	p.reputation = NewReputation(p.BansFile, p.RateLimits)
+
+	if err := p.reputation.Load(); err != nil {
+		log.Warn("Bans => ", err)
 	}
 
-	// TODO: Pass the recipient public key in the function
-	rcptwallet := wallet.New()
-	rcptwallet.GenerateWallet()
+	return &p
+}
 
-	packet := Packet{}
+// Listen for P2P blockchain traffic, on the specified UDP port unless another transport is set
+func (p2p *P2P) Listen(h func(*net.UDPAddr, int, []byte)) {
 
-	packet.Version = [1]byte{1}
-	packet.Reserved = [3]byte{0, 0, 0}
+	if udp, ok := p2p.Transport.(*UDPTransport); ok && udp.LocalAddr() == nil {
 
-	copy(packet.RecipientPublicKey[:], rcptwallet.PublicKey)
-	copy(packet.SenderPublicKey[:], senderwallet.PublicKey)
+		addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p2p.P2P_Node.Host, p2p.P2P_Node.Port))
 
-	// Create the payload (test data)
-	// TODO: Copy just the msg and encrypt using the recipient public key
-	copy(packet.Payload[:], []byte(fmt.Sprintf("%s WOW A super important message here for you to consider %s", time.Now(), data)))
+		log.Debug("P2P.Listen => ", addr)
 
-	signature, err := senderwallet.Sign(packet.Payload[:])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var l *net.UDPConn
+
+		if p2p.P2P_Node.Host == "224.0.0.1" {
+			l, err = net.ListenMulticastUDP("udp", nil, addr)
+
+		} else {
+			l, err = net.ListenUDP("udp", addr)
+
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		udp.Bind(l)
 
-	if err != nil {
-		log.Warn(fmt.Sprintf("Failed to sign msg transaction: %s", err))
-		return
 	}
 
-	copy(packet.SenderSignature[:], signature)
+	if err := p2p.Transport.Receive(h); err != nil {
+		log.Fatal(err)
+	}
 
-	buf := new(bytes.Buffer)
+}
 
-	if err := binary.Write(buf, binary.BigEndian, packet); err != nil {
-		fmt.Println(err)
-		return
+// Read packets from the UDP socket, replies such as receipts are sent from the same socket
+func (p2p *P2P) Serve(l *net.UDPConn, h func(*net.UDPAddr, int, []byte)) {
+
+	udp, ok := p2p.Transport.(*UDPTransport)
+
+	if !ok {
+		log.Fatal("Serve => ", ErrNotUDP)
 	}
 
-	c.Write(buf.Bytes())
+	udp.Bind(l)
 
-	defer c.Close()
+	if err := udp.Receive(h); err != nil {
+		log.Warn("Serve => ", err)
+	}
 
 }
 
 // Process a UDP packet into the queue
 func (p2p *P2P) MsgHandler(src *net.UDPAddr, n int, b []byte) {
+
+	p2p.handlePacket(src, n, b, true)
+
+}
+
+// Process a packet into the queue, the source IP is rate limited if `limitIP`
+func (p2p *P2P) handlePacket(src *net.UDPAddr, n int, b []byte, limitIP bool) {
 	log.Debug(n, "bytes read from", src)
 
+	var ip string
+
+	if src != nil {
+		ip = src.IP.String()
+	}
+
+	// Banned and flooding sources are dropped before any work is done
+	if ip != "" && p2p.reputation.Banned(SourceIP(ip)) {
+		log.Debug("Ignoring packet, banned source ", ip)
+		return
+	}
+
+	if ip != "" && limitIP && !p2p.reputation.AllowUDP(ip) {
+		log.Debug("Ignoring packet, rate limited ", ip)
+		return
+	}
+
 	packet := Packet{}
 
 	r := bytes.NewReader(b)
@@ -182,6 +302,22 @@ func (p2p *P2P) MsgHandler(src *net.UDPAddr, n int, b []byte) {
 		return
 	}
 
+	if p2p.reputation.Banned(SourceKey(packet.SenderPublicKey[:])) {
+		log.Debug("Ignoring packet, banned sender")
+		return
+	}
+
+	if packet.Version[0] != PacketVersion {
+		log.Warn(fmt.Sprintf("Ignoring packet, version (%d) expected (%d)", packet.Version[0], PacketVersion))
+		return
+	}
+
+	// Every payload starts with a replay header, the flag is signed so it can't be cleared in transit
+	if packet.Flags[0]&blockdb.TxFlagReplay == 0 {
+		log.Warn("Ignoring packet, no replay header")
+		return
+	}
+
 	// Only accept blocks that are valid
 	if len(packet.SenderPublicKey) == 0 {
 		log.Warn("Ignoring packet, no sender:")
@@ -200,39 +336,130 @@ func (p2p *P2P) MsgHandler(src *net.UDPAddr, n int, b []byte) {
 
 	// Confirm if validated
 	mywallet := wallet.New()
-	verify := mywallet.VerifyRaw(packet.SenderPublicKey[:], packet.Payload[:], packet.SenderSignature[:])
+	verify := mywallet.VerifyRaw(packet.SenderPublicKey[:], packet.SignedData(), packet.SenderSignature[:])
+
+	// Unauthenticated datagrams are dropped without a penalty, the source IP can be spoofed and anyone can
+	// claim a sender key. Only misbehaviour under a valid signature counts against the sender
+	if !verify {
+		log.Warn("Ignoring packet, signature failure")
+		return
+	}
+
+	// Sender keys are limited once the signature proves the sender
+	if !p2p.reputation.AllowSender(packet.SenderPublicKey[:]) {
+		log.Debug("Ignoring packet, rate limited sender")
+		return
+	}
+
+	// Drop captured packets sent again, and packets outside the replay window
+	replay, _ := blockdb.ParseReplayHeader(packet.Payload[:])
+
+	id := gossipID(packet)
+	gossiped := packet.Type[0] != MsgTypeReceipt
+
+	var source string
+
+	if src != nil {
+		source = src.String()
+	}
+
+	if err := p2p.replay.Check(packet.SenderPublicKey[:], replay, time.Now()); err != nil {
+
+		// Gossiped messages reach a node through several peers
+		if errors.Is(err, blockdb.ErrReplay) && gossiped {
+			p2p.gossiped.received(id, packet.Hops[0], source, true)
+			log.Debug("Ignoring packet, ", err)
+			return
+		}
+
+		log.Warn("Ignoring packet, ", err)
+		return
+	}
 
-	// If signed and verified, push to the stack
-	if verify {
-		queuedata := blockdb.TxPayload{
+	var tx *blockdb.TxPayload
+
+	if packet.Flags[0]&PacketFlagFragment != 0 {
+
+		// Only whole messages are queued, once every fragment is received
+		var err error
+
+		if tx, err = p2p.reassembly.add(packet); err != nil {
+			log.Warn("Ignoring fragment, ", err)
+
+			// The fragment is signed, a full buffer is not the fault of the sender
+			if !errors.Is(err, ErrReassemblyFull) {
+				p2p.reputation.Penalize(SourceKey(packet.SenderPublicKey[:]), PenaltyMalformed, "invalid fragment")
+			}
+
+			return
+		}
+
+	} else {
+		// If signed and verified, push to the stack
+		tx = &blockdb.TxPayload{
 			Data:      packet.Payload[:],
 			Sender:    packet.SenderPublicKey[:],
 			Recipient: packet.RecipientPublicKey[:],
 			Signature: packet.SenderSignature[:],
+			Type:      packet.Type[0],
+			Reserved:  packet.Flags[0],
 		}
-		p2p.POH.Mu.Lock()
-		p2p.POH.QueueSync.State = append(p2p.POH.QueueSync.State, queuedata)
-		p2p.POH.Mu.Unlock()
 
-	} else {
-		log.Warn("Ignoring packet, signature failure")
+	}
+
+	// Verified messages are forwarded to peers, fragments as each is received
+	if gossiped {
+		p2p.gossiped.received(id, packet.Hops[0], source, false)
+		p2p.gossip(id, packet)
+	}
+
+	if tx == nil {
+		return
+	}
+
+	// Receipts for messages this node sent are recorded, not sequenced
+	if tx.Type == MsgTypeReceipt {
+		p2p.receiveReceipt(*tx)
+		return
+	}
+
+	if p2p.POH == nil {
+		return
+	}
+
+	if err := p2p.POH.QueueTx(*tx); err != nil {
+		log.Warn("Ignoring message, ", err)
 		return
 	}
 
+	// Receipts go to the sender, not to the peers forwarding the message
+	if packet.Hops[0] == 0 {
+		p2p.acknowledge(txMsgID(packet, *tx), *tx, src)
+	}
+
 }
 
 // Query peers at a specified interval, check block state and new peers
 func (p2p *P2P) QueryPeers(ctx context.Context) {
 
 	ticker := time.NewTicker(3 * time.Second)
+	saveTicker := time.NewTicker(peersSaveInterval)
 
 	for {
 		select {
 		case <-ticker.C:
 			p2p.doSync()
 
+		case <-saveTicker.C:
+			if err := p2p.peers.Save(); err != nil {
+				log.Warn("Peers => ", err)
+			}
+
 		case <-ctx.Done():
 			ticker.Stop()
+			saveTicker.Stop()
+			p2p.peers.Save()
+			return
 		}
 	}
 
@@ -243,14 +470,18 @@ func (p2p *P2P) doSync() {
 
 	myNode := fmt.Sprintf("%s:%d", p2p.RPC_Node.Host, p2p.RPC_Node.Port)
 
-	for host := range p2p.RPC_Peers {
+	for _, host := range p2p.peers.Hosts() {
 
 		if myNode == host {
 			log.Info("Host, skipping my node => ", host)
 
+		} else if p2p.reputation.Banned(sourceHost(host)) {
+			log.Info("Host, skipping banned node => ", host)
+
 		} else {
 			log.Info("Host, Query blocks etc => ", host)
-			p2p.querySync(host)
+			p2p.SyncPeer(host)
+			p2p.Discover(host)
 
 		}
 
@@ -258,25 +489,27 @@ func (p2p *P2P) doSync() {
 
 }
 
+// Query the latest block of the peer now, syncing from it if its chain is heavier
+func (p2p *P2P) SyncPeer(hostname string) {
+
+	p2p.querySync(hostname)
+
+}
+
 // Query the status of the remote RPC peer, check if block higher then local for sync
 func (p2p *P2P) querySync(hostname string) {
 
 	start := time.Now()
 
-	// Get our latest block
-	latestBlock := p2p.POH.BlockDB.GetLatestBlock()
-
-	// Query our external host
-	resp, err := http.Get(fmt.Sprintf("http://%s/p2p/status?rpc_host=%s&rpc_port=%d", hostname, p2p.RPC_Node.Host, p2p.RPC_Node.Port))
+	body, err := p2p.statusBody(hostname)
 
 	if err != nil {
 		log.Warn("Error connecting for status => ", err)
+		p2p.peers.RecordFailure(hostname)
 		return
 	}
 
-	defer resp.Body.Close()
-
-	log.Info("Response status:", resp.Status)
+	defer body.Close()
 
 	timer := time.Now()
 	elapsed := timer.Sub(start)
@@ -285,187 +518,134 @@ func (p2p *P2P) querySync(hostname string) {
 
 	remoteStatus := Status{}
 
-	json.NewDecoder(resp.Body).Decode(&remoteStatus)
+	if err = json.NewDecoder(body).Decode(&remoteStatus); err != nil {
+		log.Warn("Invalid status => ", err)
+		p2p.peers.RecordFailure(hostname)
+		p2p.reputation.Penalize(sourceHost(hostname), PenaltyMalformed, "invalid status")
+		return
+	}
+
+	p2p.peers.RecordSuccess(hostname, elapsed, remoteStatus.SeqID)
+
+	// Record the peer retention, to find archive nodes for pruned history
+	p2p.peers.SetRetention(hostname, remoteStatus.Archive, remoteStatus.PrunedHeight)
 
 	timer = time.Now()
 	elapsed = timer.Sub(start)
 
-	if bytes.Compare(latestBlock.Key[:], remoteStatus.Hash) == 0 && (latestBlock.Value.Header.SeqID == remoteStatus.SeqID) {
+	// Get our latest block, the remote head is compared by the fork choice rule
+	local := p2p.POH.BlockDB.GetLatestIndex()
+
+	var remote blockdb.BlockIndex
+	copy(remote.Key[:], remoteStatus.Hash)
+	remote.Header.SeqID = remoteStatus.SeqID
 
+	if local.Key == remote.Key && local.Header.SeqID == remote.Header.SeqID {
 		log.Info("GetLatestBlock matches from local to remote, skipping sync.")
-	} else if remoteStatus.SeqID > latestBlock.Value.Header.SeqID {
-		log.Info(fmt.Sprintf("Remote has larger SeqID (%d) vs local (%d) - Syncing\n", remoteStatus.SeqID, latestBlock.Value.Header.SeqID))
-		p2p.stateSync(hostname, latestBlock.Key)
 
-	} else if latestBlock.Value.Header.SeqID > remoteStatus.SeqID {
-		log.Info(fmt.Sprintf("Local has larger SeqID (%d) vs remote (%d) - Skipping\n", latestBlock.Value.Header.SeqID, remoteStatus.SeqID))
+	} else if blockdb.Heavier(remote, local) {
+		log.Info(fmt.Sprintf("Remote chain is heavier SeqID (%d) vs local (%d) - Syncing\n", remote.Header.SeqID, local.Header.SeqID))
+		p2p.syncChain(hostname, local, remote)
 
 	} else {
-		log.Info(fmt.Sprintf("querySync => Unknown state. Local (%d) Remote (%d)", latestBlock.Value.Header.SeqID, remoteStatus.SeqID))
+		log.Info(fmt.Sprintf("Local chain is heavier SeqID (%d) vs remote (%d) - Skipping\n", local.Header.SeqID, remote.Header.SeqID))
 
 	}
 
 }
 
-func (p2p *P2P) stateSync(hostname string, hash blockdb.Hash) {
+// The status of the RPC peer, over an encrypted stream if it is a verified peer and over HTTP otherwise
+func (p2p *P2P) statusBody(hostname string) (io.ReadCloser, error) {
 
-	start := time.Now()
-
-	hashB64 := base64.StdEncoding.EncodeToString(hash[:])
-
-	// TODO: Pass correct JSON RPC, not GET
-	resp, err := http.Get(fmt.Sprintf("http://%s/p2p/sync?from=%s", hostname, url.QueryEscape(hashB64)))
+	session, err := p2p.rpcSession(hostname)
 
 	if err != nil {
-		log.Warn("Error connecting for status => ", err)
-		return
+		return nil, err
+	} else if session != nil {
+		return p2p.fetchStreamStatus(session)
 	}
 
-	defer resp.Body.Close()
-
-	log.Debug("Response status:", resp.StatusCode)
-
-	syncBlocks := blockdb.SyncBlocks{}
-
-	json.NewDecoder(resp.Body).Decode(&syncBlocks)
-
-	timer := time.Now()
-	elapsed := timer.Sub(start)
-
-	log.Info(fmt.Sprintf("Prepare stateSync %s\n", elapsed))
-
-	blockLen := len(syncBlocks.Blocks)
-
-	for i := 0; i < len(syncBlocks.Blocks); i++ {
-
-		start = time.Now()
-
-		// TODO: Push to final signature state, vs each block
-
-		/*
-			for i2 := 0; i2 < len(syncBlocks.Blocks[i].Value.Payload); i2++ {
-
-
-				i3 := i2
-				i4 := i
-
-				go func() {
-
-					if len(syncBlocks.Blocks[i4].Value.Payload[i3].Sender) == 0 {
-						fmt.Println("Empty block at => ", i3)
-						//continue
-					}
-
-					// Confirm if validated
-					mywallet := wallet.New()
-					verify := mywallet.VerifyRaw(syncBlocks.Blocks[i4].Value.Payload[i3].Sender, syncBlocks.Blocks[i4].Value.Payload[i3].Data, syncBlocks.Blocks[i4].Value.Payload[i3].Signature)
+	// Query our external host
+	resp, err := http.Get(fmt.Sprintf("http://%s/p2p/status", hostname))
 
-					// If signed and verified, push to the stack
-					if !verify {
-						fmt.Printf("Signature failed -- Skipping block (%d) payload ID (%d)", i, i2)
-						//return
-					}
+	if err != nil {
+		return nil, err
+	}
 
-				}()
+	log.Info("Response status:", resp.Status)
 
+	return resp.Body, nil
 
-			}
-		*/
+}
 
-		// Prepare the JSON to write to disk
-		payload, err := json.Marshal(syncBlocks.Blocks[i])
+// Return the RPC peers reporting as archive nodes, with the full TX history
+func (p2p *P2P) ArchivePeers() (peers []string) {
 
-		if err != nil {
-			log.Fatal(err)
+	for host, node := range p2p.peers.RPCPeers() {
+		if node.Archive {
+			peers = append(peers, host)
 		}
+	}
 
-		// Append the new block to disk
-		err = p2p.POH.BlockDB.Append(p2p.POH.CreateBlock(payload, true))
-
-		if err != nil {
-			log.Fatal(err)
-		}
+	return
 
-		timer = time.Now()
-		elapsed = timer.Sub(start)
+}
 
-		txRate := uint32(float64(blockLen) * (1 / elapsed.Seconds()))
+// The P2P addresses of the verified peers, keyed by address
+func (p2p *P2P) p2pPeers() map[string]Node {
 
-		log.Info(fmt.Sprintf("Sync Blocks done in %s, %d per sec\n", elapsed, txRate))
+	peers := make(map[string]Node)
 
+	for _, peer := range p2p.peers.Verified() {
+		node := peer.P2P_Node
+		node.LastSeen = peer.LastSeen
+		peers[node.address()] = node
 	}
 
+	return peers
+
 }
 
 // JSON RPC methods
 
-// Return the latest status (latestblock)
+// Return the latest status (latestblock). Callers are not added to the peers, peers are only learned
+// through Discover, which verifies the node key
 func (p2p *P2P) Status(c *gin.Context) {
 
-	// Query our end-point
-	// TODO: Validate rpc_host and source ip
-	rpc_host, _ := c.GetQuery("rpc_host")
-	rpc_port, _ := c.GetQuery("rpc_port")
-
-	if rpc_host != "" && rpc_port != "" {
-
-		// TODO: Confirm correct end-point
-		rpc_addr := fmt.Sprintf("%s:%s", rpc_host, rpc_port)
-
-		log.Debug("Adding RPC Addr => ", rpc_addr)
-
-		if p2p.RPC_Peers[rpc_addr].Host == "" {
-			// New host, append to our stack
-			p2p.RPC_Peers[rpc_addr] = Node{Host: rpc_host}
-
-		}
+	c.JSON(200, p2p.status())
+}
 
-	}
+// The latest block and peers of this node, returned to peers querying the status over HTTP or a stream
+func (p2p *P2P) status() Status {
 
 	// Return the latest block in the stack
 	latestBlock := p2p.POH.BlockDB.GetLatestBlock()
 
-	status := Status{
+	return Status{
 		Parent: latestBlock.Value.Header.Parent[:],
 		SeqID:  latestBlock.Value.Header.SeqID,
 		Hash:   latestBlock.Key[:],
 
+		Archive:      p2p.POH.BlockDB.Retention.Archive,
+		PrunedHeight: p2p.POH.BlockDB.PrunedHeight(),
+
 		P2P_Node:  p2p.P2P_Node,
-		P2P_Peers: p2p.P2P_Peers,
+		P2P_Peers: p2p.p2pPeers(),
 
 		RPC_Node:  p2p.RPC_Node,
-		RPC_Peers: p2p.RPC_Peers,
+		RPC_Peers: p2p.peers.RPCPeers(),
 	}
 
-	c.JSON(200, status)
 }
 
-// Sync the state from a specified block
-func (p2p *P2P) Sync(c *gin.Context) {
-
-	from, _ := c.GetQuery("from")
-
-	fromBytes, _ := base64.StdEncoding.DecodeString(from)
-
-	log.Debug("fromBytes => ", fromBytes)
+// Stream a signed snapshot of the blockchain DB, for new nodes to bootstrap from
+func (p2p *P2P) Snapshot(c *gin.Context) {
 
-	blockID := p2p.POH.BlockDB.Sync(fromBytes)
-
-	// TODO: Replace with struct and pointer, vs manually walking array
-	c.Data(200, "application/json; charset=utf-8", []byte(fmt.Sprintf("{\"public_key\": \"%s\", \"blocks\": [", base64.StdEncoding.EncodeToString(p2p.POH.Wallet.PublicKey))))
-
-	if len(p2p.POH.BlockDB.Blocks) > 0 {
-
-		// Print the first block
-		c.JSON(200, &p2p.POH.BlockDB.Blocks[blockID])
-
-		for i := blockID + 1; i < len(p2p.POH.BlockDB.Blocks); i++ {
-			c.Data(200, "application/json; charset=utf-8", []byte(","))
-			c.JSON(200, &p2p.POH.BlockDB.Blocks[i])
-		}
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", "attachment; filename=blockchain-snapshot.tar.gz")
 
+	if _, err := p2p.POH.BlockDB.Snapshot(c.Writer, &p2p.POH.Wallet); err != nil {
+		log.Warn("Snapshot => ", err)
 	}
 
-	c.Data(200, "application/json; charset=utf-8", []byte("]}"))
-
 }
@@ -0,0 +1,400 @@
+package p2pnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Bootstrap peer used if none are configured
+const DefaultBootstrapPeer = "127.0.0.1:24816"
+
+// Interval to save the peers while running
+const peersSaveInterval = time.Minute
+
+// RPC peers are dropped after this many consecutive failures, bootstrap peers are kept
+const MaxPeerFailures = 10
+
+// Peers known to the node, RPC peers by address and verified peers by public key.
+// Safe for concurrent use by the RPC handlers and the sync loop
+type PeerManager struct {
+	mu       sync.RWMutex
+	rpc      map[string]Node
+	verified map[string]PeerInfo
+	max      int
+	file     string
+	dirty    bool
+}
+
+// Peers file on disk
+type peersFile struct {
+	RPC_Peers map[string]Node `json:"rpc_peers"`
+	Peers     []PeerInfo      `json:"peers"`
+}
+
+// Create a peer manager persisted to `file`, each table holds at most `max` peers. An empty file is not persisted
+func NewPeerManager(file string, max int) *PeerManager {
+
+	if max <= 0 {
+		max = DefaultMaxPeers
+	}
+
+	return &PeerManager{rpc: make(map[string]Node), verified: make(map[string]PeerInfo), max: max, file: file}
+
+}
+
+// Load the peers saved from a previous run, a missing file is not an error
+func (pm *PeerManager) Load() (err error) {
+
+	if pm.file == "" {
+		return
+	}
+
+	data, err := os.ReadFile(pm.file)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	var saved peersFile
+
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("Peers file %s is invalid (%s)", pm.file, err)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for host, node := range saved.RPC_Peers {
+		// Bootstrap peers are configured on each run
+		node.Bootstrap = false
+		pm.addRPC(host, node)
+	}
+
+	for _, peer := range saved.Peers {
+		pm.addVerified(peer)
+	}
+
+	log.Info(fmt.Sprintf("Loaded (%d) RPC peers, (%d) verified peers from %s", len(pm.rpc), len(pm.verified), pm.file))
+
+	return
+
+}
+
+// Save the peers if changed since the last save, the file is replaced atomically
+func (pm *PeerManager) Save() (err error) {
+
+	if pm.file == "" {
+		return
+	}
+
+	pm.mu.Lock()
+
+	if !pm.dirty {
+		pm.mu.Unlock()
+		return
+	}
+
+	saved := peersFile{RPC_Peers: make(map[string]Node, len(pm.rpc))}
+
+	for host, node := range pm.rpc {
+		saved.RPC_Peers[host] = node
+	}
+
+	for _, peer := range pm.verified {
+		saved.Peers = append(saved.Peers, peer)
+	}
+
+	pm.dirty = false
+	pm.mu.Unlock()
+
+	data, err := json.MarshalIndent(saved, "", "  ")
+
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(pm.file), 0700); err != nil {
+		return
+	}
+
+	tmpFile := fmt.Sprintf("%s.tmp", pm.file)
+
+	if err = os.WriteFile(tmpFile, data, 0600); err != nil {
+		return
+	}
+
+	return os.Rename(tmpFile, pm.file)
+
+}
+
+// Add the bootstrap peers, each as host:port
+func (pm *PeerManager) AddBootstrap(hosts []string) (err error) {
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, hostname := range hosts {
+
+		var node Node
+
+		if node, err = parseNode(hostname); err != nil {
+			return fmt.Errorf("Invalid bootstrap peer %s (%s)", hostname, err)
+		}
+
+		if existing, ok := pm.rpc[hostname]; ok {
+			node = existing
+		}
+
+		node.Bootstrap = true
+		pm.rpc[hostname] = node
+		pm.dirty = true
+
+	}
+
+	return
+
+}
+
+// Add an RPC peer if not already known
+func (pm *PeerManager) AddRPC(hostname string) (err error) {
+
+	node, err := parseNode(hostname)
+
+	if err != nil {
+		return
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if _, ok := pm.rpc[hostname]; !ok {
+		pm.addRPC(hostname, node)
+	}
+
+	return
+
+}
+
+// Add an RPC peer, evicting the peer with the most failures if full, lock must be held
+func (pm *PeerManager) addRPC(hostname string, node Node) {
+
+	if _, ok := pm.rpc[hostname]; !ok && len(pm.rpc) >= pm.max {
+
+		var worst string
+
+		for host, n := range pm.rpc {
+			if !n.Bootstrap && (worst == "" || n.Failures > pm.rpc[worst].Failures || (n.Failures == pm.rpc[worst].Failures && n.LastSeen.Before(pm.rpc[worst].LastSeen))) {
+				worst = host
+			}
+		}
+
+		if worst == "" {
+			return
+		}
+
+		log.Debug("Peers => Evicting RPC peer ", worst)
+		delete(pm.rpc, worst)
+
+	}
+
+	pm.rpc[hostname] = node
+	pm.dirty = true
+
+}
+
+// Record a successful query of the peer, with the round trip latency and the height reported
+func (pm *PeerManager) RecordSuccess(hostname string, latency time.Duration, height uint64) {
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	node, ok := pm.rpc[hostname]
+
+	if !ok {
+		return
+	}
+
+	node.Failures = 0
+	node.Latency = latency
+	node.SyncHeight = height
+	node.LastSeen = time.Now()
+
+	pm.rpc[hostname] = node
+	pm.dirty = true
+
+}
+
+// Record a failed query of the peer, dropping it after MaxPeerFailures consecutive failures
+func (pm *PeerManager) RecordFailure(hostname string) {
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	node, ok := pm.rpc[hostname]
+
+	if !ok {
+		return
+	}
+
+	node.Failures++
+	pm.dirty = true
+
+	if node.Failures >= MaxPeerFailures && !node.Bootstrap {
+		log.Info(fmt.Sprintf("Peers => Dropping %s after (%d) failures", hostname, node.Failures))
+		delete(pm.rpc, hostname)
+		return
+	}
+
+	pm.rpc[hostname] = node
+
+}
+
+// Record the retention reported by the peer
+func (pm *PeerManager) SetRetention(hostname string, archive bool, prunedHeight uint64) {
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if node, ok := pm.rpc[hostname]; ok {
+		node.Archive = archive
+		node.PrunedHeight = prunedHeight
+		pm.rpc[hostname] = node
+		pm.dirty = true
+	}
+
+}
+
+// Return a copy of the RPC peers, keyed by address
+func (pm *PeerManager) RPCPeers() map[string]Node {
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	peers := make(map[string]Node, len(pm.rpc))
+
+	for host, node := range pm.rpc {
+		peers[host] = node
+	}
+
+	return peers
+
+}
+
+// The addresses of the RPC peers and the verified peers, to query for blocks and peers
+func (pm *PeerManager) Hosts() (hosts []string) {
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	seen := make(map[string]bool)
+
+	for host := range pm.rpc {
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+
+	for _, peer := range pm.verified {
+		if host := peer.RPC_Node.address(); !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+
+	sort.Strings(hosts)
+
+	return
+
+}
+
+// Add or refresh a verified peer, evicting the least recently seen peer if full
+func (pm *PeerManager) AddVerified(peer PeerInfo) {
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.addVerified(peer)
+
+}
+
+func (pm *PeerManager) addVerified(peer PeerInfo) {
+
+	key := string(peer.PublicKey)
+
+	if _, ok := pm.verified[key]; !ok && len(pm.verified) >= pm.max {
+
+		var oldest string
+
+		for k, p := range pm.verified {
+			if oldest == "" || p.LastSeen.Before(pm.verified[oldest].LastSeen) {
+				oldest = k
+			}
+		}
+
+		log.Debug("Peers => Evicting ", pm.verified[oldest].RPC_Node.address())
+		delete(pm.verified, oldest)
+
+	}
+
+	pm.verified[key] = peer
+	pm.dirty = true
+
+}
+
+// Check if the public key belongs to a verified peer
+func (pm *PeerManager) IsVerified(publicKey []byte) bool {
+
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	_, ok := pm.verified[string(publicKey)]
+
+	return ok
+
+}
+
+// Return the verified peers, most recently seen first
+func (pm *PeerManager) Verified() (peers []PeerInfo) {
+
+	pm.mu.RLock()
+
+	for _, peer := range pm.verified {
+		peers = append(peers, peer)
+	}
+
+	pm.mu.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].LastSeen.After(peers[j].LastSeen) })
+
+	return
+
+}
+
+func parseNode(hostname string) (node Node, err error) {
+
+	host, portStr, err := net.SplitHostPort(hostname)
+
+	if err != nil {
+		return
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+
+	if err != nil {
+		return
+	}
+
+	return Node{Host: host, Port: uint16(port)}, nil
+
+}
@@ -0,0 +1,76 @@
+package p2pnet_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerManagerPersistence(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "peers.json")
+
+	pm := p2pnet.NewPeerManager(file, 0)
+	assert.Nil(t, pm.AddBootstrap([]string{"127.0.0.1:24816"}))
+	assert.Nil(t, pm.AddRPC("10.0.0.2:24816"))
+	assert.NotNil(t, pm.AddRPC("10.0.0.3"))
+
+	pm.RecordSuccess("10.0.0.2:24816", 25*time.Millisecond, 42)
+	pm.AddVerified(p2pnet.PeerInfo{PublicKey: make([]byte, 32), RPC_Node: p2pnet.Node{Host: "10.0.0.4", Port: 24816}, LastSeen: time.Now()})
+
+	assert.Nil(t, pm.Save())
+
+	// Reload, bootstrap peers come from the configuration of each run
+	loaded := p2pnet.NewPeerManager(file, 0)
+	assert.Nil(t, loaded.Load())
+
+	peers := loaded.RPCPeers()
+	assert.Equal(t, 2, len(peers))
+	assert.False(t, peers["127.0.0.1:24816"].Bootstrap)
+	assert.Equal(t, uint64(42), peers["10.0.0.2:24816"].SyncHeight)
+	assert.Equal(t, 25*time.Millisecond, peers["10.0.0.2:24816"].Latency)
+
+	assert.Equal(t, []string{"10.0.0.2:24816", "10.0.0.4:24816", "127.0.0.1:24816"}, loaded.Hosts())
+
+	// Missing and invalid files
+	assert.Nil(t, p2pnet.NewPeerManager(filepath.Join(t.TempDir(), "missing.json"), 0).Load())
+
+	assert.Nil(t, os.WriteFile(file, []byte("{"), 0600))
+	assert.NotNil(t, p2pnet.NewPeerManager(file, 0).Load())
+
+}
+
+func TestPeerManagerHealth(t *testing.T) {
+
+	pm := p2pnet.NewPeerManager("", 2)
+	assert.Nil(t, pm.AddBootstrap([]string{"127.0.0.1:24816"}))
+	assert.Nil(t, pm.AddRPC("10.0.0.2:24816"))
+
+	for i := 0; i < p2pnet.MaxPeerFailures; i++ {
+		pm.RecordFailure("10.0.0.2:24816")
+		pm.RecordFailure("127.0.0.1:24816")
+	}
+
+	// Failing peers are dropped, bootstrap peers are kept
+	peers := pm.RPCPeers()
+	assert.Equal(t, 1, len(peers))
+	assert.Equal(t, p2pnet.MaxPeerFailures, peers["127.0.0.1:24816"].Failures)
+
+	pm.RecordSuccess("127.0.0.1:24816", time.Millisecond, 1)
+	assert.Equal(t, 0, pm.RPCPeers()["127.0.0.1:24816"].Failures)
+
+	// When full, the peer with the most failures is evicted, never a bootstrap peer
+	assert.Nil(t, pm.AddRPC("10.0.0.3:24816"))
+	pm.RecordFailure("10.0.0.3:24816")
+	assert.Nil(t, pm.AddRPC("10.0.0.4:24816"))
+
+	peers = pm.RPCPeers()
+	assert.Equal(t, 2, len(peers))
+	assert.Contains(t, peers, "127.0.0.1:24816")
+	assert.Contains(t, peers, "10.0.0.4:24816")
+
+}
@@ -0,0 +1,358 @@
+package p2pnet
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/perrychain/perry/pkg/wallet"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default size of the peer tables, the least recently seen peer is evicted when full
+const DefaultMaxPeers = 128
+
+// Peers announced by other nodes are verified with a handshake, a few per round
+const maxHandshakesPerRound = 8
+
+// Peers not seen within this age are not shared with other nodes
+const peerShareAge = 24 * time.Hour
+
+const handshakeTimeout = 5 * time.Second
+
+var handshakeDomain = []byte("perry-handshake")
+
+var (
+	ErrPeerSignature = errors.New("peer signature is invalid")
+	ErrHandshake     = errors.New("peer handshake failed")
+)
+
+// A node identified by its wallet public key, with the addresses it can be reached on
+type PeerInfo struct {
+	PublicKey []byte    `json:"public_key"`
+	RPC_Node  Node      `json:"rpc_node"`
+	P2P_Node  Node      `json:"p2p_node"`
+	Version   uint8     `json:"version"`
+	LastSeen  time.Time `json:"lastseen"`
+}
+
+// Peer list shared between nodes, the signature covers the list with an empty signature
+type PeerList struct {
+	PublicKey []byte     `json:"public_key"`
+	Created   time.Time  `json:"created"`
+	Peers     []PeerInfo `json:"peers"`
+	Signature []byte     `json:"signature"`
+}
+
+// Response to a handshake, the node signs the challenge with its own details
+type Handshake struct {
+	Peer      PeerInfo `json:"peer"`
+	Challenge []byte   `json:"challenge"`
+	Signature []byte   `json:"signature"`
+}
+
+// Return the signed list of peers seen recently, for other nodes to discover
+func (p2p *P2P) Peers(c *gin.Context) {
+
+	list, err := p2p.peerList()
+
+	if err != nil {
+		c.JSON(500, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, list)
+
+}
+
+// The verified peers seen recently, signed by this node
+func (p2p *P2P) peerList() (list PeerList, err error) {
+
+	list = PeerList{PublicKey: p2p.POH.Wallet.PublicKey, Created: time.Now()}
+
+	for _, peer := range p2p.peers.Verified() {
+		if time.Since(peer.LastSeen) < peerShareAge {
+			list.Peers = append(list.Peers, peer)
+		}
+	}
+
+	err = list.sign(&p2p.POH.Wallet)
+
+	return
+
+}
+
+// Prove this node holds its wallet key, by signing the challenge with the node details
+func (p2p *P2P) Handshake(c *gin.Context) {
+
+	challenge, err := base64.StdEncoding.DecodeString(c.Query("challenge"))
+
+	if err != nil || len(challenge) != 32 {
+		c.JSON(400, gin.H{"status": "fail", "error": "challenge must be 32 bytes, base64 encoded"})
+		return
+	}
+
+	handshake := Handshake{Peer: p2p.self(), Challenge: challenge}
+
+	if handshake.Signature, err = p2p.POH.Wallet.Sign(handshake.digest()); err != nil {
+		c.JSON(500, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, handshake)
+
+}
+
+// Details of this node, as announced to peers
+func (p2p *P2P) self() PeerInfo {
+
+	return PeerInfo{PublicKey: p2p.POH.Wallet.PublicKey, RPC_Node: p2p.RPC_Node, P2P_Node: p2p.P2P_Node, Version: p2p.P2P_Node.Version, LastSeen: time.Now()}
+
+}
+
+// Return the verified peers, most recently seen first
+func (p2p *P2P) KnownPeers() []PeerInfo {
+
+	return p2p.peers.Verified()
+
+}
+
+// Fetch the peer list of a node and verify new peers, returns the number of peers added. Verified peers
+// are queried over an encrypted stream, new peers are handshaked over HTTP, which only carries signed details
+func (p2p *P2P) Discover(hostname string) (added int) {
+
+	session, err := p2p.rpcSession(hostname)
+
+	if err != nil {
+		log.Debug("Discover => ", err)
+		return
+	}
+
+	var body io.ReadCloser
+
+	if session != nil {
+		body, err = p2p.fetchStreamPeers(session)
+	} else {
+		body, err = peersBody(hostname)
+	}
+
+	if err != nil {
+		log.Debug("Discover => ", err)
+		return
+	}
+
+	defer body.Close()
+
+	var list PeerList
+
+	if err = json.NewDecoder(body).Decode(&list); err != nil {
+		log.Debug("Discover => ", err)
+		return
+	}
+
+	if err = list.verify(); err != nil {
+		log.Warn(fmt.Sprintf("Discover => Ignoring peer list from %s: %s", hostname, err))
+		p2p.reputation.Penalize(sourceHost(hostname), PenaltySignature, "invalid peer list")
+		return
+	}
+
+	// The announcing node is known by the key it signed with, a verified peer by the key of the session
+	if session == nil {
+		p2p.verifyPeer(hostname, list.PublicKey)
+	} else if bytes.Equal(list.PublicKey, session.PublicKey) {
+		p2p.seenPeer(session.PublicKey)
+	} else {
+		log.Warn(fmt.Sprintf("Discover => Ignoring peer list from %s: %s", hostname, ErrPeerSignature))
+		return
+	}
+
+	for _, candidate := range list.Peers {
+
+		if added >= maxHandshakesPerRound {
+			break
+		}
+
+		if bytes.Equal(candidate.PublicKey, p2p.POH.Wallet.PublicKey) || p2p.peers.IsVerified(candidate.PublicKey) {
+			continue
+		}
+
+		if p2p.verifyPeer(candidate.RPC_Node.address(), candidate.PublicKey) {
+			added++
+		}
+
+	}
+
+	return
+
+}
+
+// The peer list of a node that is not a verified peer
+func peersBody(hostname string) (io.ReadCloser, error) {
+
+	client := http.Client{Timeout: handshakeTimeout}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s/p2p/peers", hostname))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+
+}
+
+// Refresh when the verified peer was last seen, its key proven by a stream session
+func (p2p *P2P) seenPeer(publicKey []byte) {
+
+	for _, peer := range p2p.peers.Verified() {
+		if bytes.Equal(peer.PublicKey, publicKey) {
+			peer.LastSeen = time.Now()
+			p2p.peers.AddVerified(peer)
+			return
+		}
+	}
+
+}
+
+// Handshake with the node at `hostname`, adding it to the peer table if it holds the expected key
+func (p2p *P2P) verifyPeer(hostname string, publicKey []byte) bool {
+
+	peer, err := handshake(hostname, publicKey)
+
+	if err != nil {
+		log.Debug(fmt.Sprintf("Handshake => %s: %s", hostname, err))
+		return false
+	}
+
+	p2p.peers.AddVerified(peer)
+
+	// Verified peers are queried for blocks, with their health tracked
+	p2p.peers.AddRPC(peer.RPC_Node.address())
+
+	log.Debug("Handshake => Verified peer ", hostname)
+
+	return true
+
+}
+
+// Challenge the node at `hostname` to sign with `publicKey`. The address dialed replaces the address
+// the node reports, which may be a listening address such as 0.0.0.0, and the P2P host is bound to the
+// host dialed, so a node can't direct the packets of its peers to another host
+func handshake(hostname string, publicKey []byte) (peer PeerInfo, err error) {
+
+	node, err := parseNode(hostname)
+
+	if err != nil {
+		return
+	}
+
+	challenge := make([]byte, 32)
+
+	if _, err = rand.Read(challenge); err != nil {
+		return
+	}
+
+	client := http.Client{Timeout: handshakeTimeout}
+
+	resp, err := client.Get(fmt.Sprintf("http://%s/p2p/handshake?challenge=%s", hostname, url.QueryEscape(base64.StdEncoding.EncodeToString(challenge))))
+
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	var response Handshake
+
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return
+	}
+
+	if !bytes.Equal(response.Challenge, challenge) || !bytes.Equal(response.Peer.PublicKey, publicKey) || len(publicKey) != ed25519.PublicKeySize {
+		return peer, ErrHandshake
+	}
+
+	if !ed25519.Verify(publicKey, response.digest(), response.Signature) {
+		return peer, ErrHandshake
+	}
+
+	peer = response.Peer
+	peer.RPC_Node.Host = node.Host
+	peer.RPC_Node.Port = node.Port
+	peer.P2P_Node.Host = node.Host
+	peer.LastSeen = time.Now()
+
+	return
+
+}
+
+// The signed content of a handshake, domain separated from other signatures by the wallet
+func (handshake Handshake) digest() []byte {
+
+	peer, _ := json.Marshal(handshake.Peer)
+
+	h := sha256.New()
+	h.Write(handshakeDomain)
+	h.Write(handshake.Challenge)
+	h.Write(peer)
+
+	return h.Sum(nil)
+
+}
+
+func (list *PeerList) sign(signer *wallet.Wallet) (err error) {
+
+	list.Signature = nil
+
+	data, err := json.Marshal(list)
+
+	if err != nil {
+		return
+	}
+
+	list.Signature, err = signer.Sign(data)
+
+	return
+
+}
+
+func (list PeerList) verify() (err error) {
+
+	if len(list.PublicKey) != ed25519.PublicKeySize {
+		return ErrPeerSignature
+	}
+
+	unsigned := list
+	unsigned.Signature = nil
+
+	data, err := json.Marshal(unsigned)
+
+	if err != nil {
+		return
+	}
+
+	if !ed25519.Verify(list.PublicKey, data, list.Signature) {
+		return ErrPeerSignature
+	}
+
+	return
+
+}
+
+func (node Node) address() string {
+
+	return net.JoinHostPort(node.Host, strconv.Itoa(int(node.Port)))
+
+}
@@ -0,0 +1,100 @@
+package p2pnet_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerExchange(t *testing.T) {
+
+	a, _ := newNode(t, nodeOptions{})
+	b, addrB := newNode(t, nodeOptions{})
+	c, addrC := newNode(t, nodeOptions{})
+
+	// B learns of C directly, A then learns of C through B
+	assert.Equal(t, 0, b.Discover(addrC))
+	assert.Equal(t, 1, a.Discover(addrB))
+
+	peers := a.KnownPeers()
+	assert.Equal(t, 2, len(peers))
+
+	keys := map[string]string{}
+
+	for _, peer := range peers {
+		keys[string(peer.PublicKey)] = peer.RPC_Node.Host
+	}
+
+	assert.Contains(t, keys, string(b.POH.Wallet.PublicKey))
+	assert.Contains(t, keys, string(c.POH.Wallet.PublicKey))
+	assert.Equal(t, "127.0.0.1", keys[string(c.POH.Wallet.PublicKey)])
+
+	// A node does not add itself
+	assert.Equal(t, 0, c.Discover(addrB))
+	assert.Equal(t, 1, len(c.KnownPeers()))
+
+	// Unreachable peers are not added
+	assert.Equal(t, 0, a.Discover("127.0.0.1:1"))
+	assert.Equal(t, 2, len(a.KnownPeers()))
+
+}
+
+// The P2P host a peer reports is replaced with the host it was dialed on, only the port is taken
+func TestPeerHostBound(t *testing.T) {
+
+	a, _ := newNode(t, nodeOptions{})
+	b, addrB := newNode(t, nodeOptions{})
+
+	b.P2P_Node = p2pnet.Node{Host: "10.0.0.9", Port: 16842}
+
+	a.Discover(addrB)
+
+	peers := a.KnownPeers()
+	assert.Equal(t, 1, len(peers))
+	assert.Equal(t, "127.0.0.1", peers[0].P2P_Node.Host)
+	assert.Equal(t, uint16(16842), peers[0].P2P_Node.Port)
+
+}
+
+func TestPeerTableEviction(t *testing.T) {
+
+	a, _ := newNode(t, nodeOptions{config: p2pnet.P2P{MaxPeers: 1}})
+	b, addrB := newNode(t, nodeOptions{})
+	c, addrC := newNode(t, nodeOptions{})
+
+	a.Discover(addrB)
+	a.Discover(addrC)
+
+	// The least recently seen peer is evicted
+	peers := a.KnownPeers()
+	assert.Equal(t, 1, len(peers))
+	assert.Equal(t, []byte(c.POH.Wallet.PublicKey), peers[0].PublicKey)
+	assert.NotEqual(t, []byte(b.POH.Wallet.PublicKey), peers[0].PublicKey)
+
+}
+
+// Callers of the status endpoint are not added to the peers by the address they claim
+func TestStatusClaimIgnored(t *testing.T) {
+
+	_, addr := newNode(t, nodeOptions{})
+
+	status := func(query string) (status p2pnet.Status) {
+
+		resp, err := http.Get("http://" + addr + "/p2p/status" + query)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+
+		return
+
+	}
+
+	status("?rpc_host=10.0.0.9&rpc_port=24816")
+
+	assert.Empty(t, status("").RPC_Peers)
+
+}
@@ -0,0 +1,434 @@
+package p2pnet
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/wallet"
+	log "github.com/sirupsen/logrus"
+)
+
+// Message type of receipts pushed back to the sender, not queued to the PoH
+const MsgTypeReceipt uint8 = 0xff
+
+// Receipt status, a message is acknowledged on receipt and sequenced once written to a block
+const (
+	ReceiptReceived  = "received"
+	ReceiptSequenced = "sequenced"
+)
+
+// Default number of receipts held, the oldest are dropped first
+const DefaultMaxReceipts = 100_000
+
+var (
+	ErrReceiptSignature  = errors.New("receipt signature is invalid")
+	ErrReceiptUnexpected = errors.New("receipt is not for a message sent to the node")
+)
+
+// Signed by the node that received the message. Sequenced receipts include the PoH seq and the block
+type Receipt struct {
+	MsgID     MsgID     `json:"msg_id"`
+	Status    string    `json:"status"`
+	Sender    []byte    `json:"sender"`
+	Node      []byte    `json:"node"`
+	Received  time.Time `json:"received"`
+	Seq       uint64    `json:"seq,omitempty"`
+	BlockHash []byte    `json:"block_hash,omitempty"`
+	SeqID     uint64    `json:"seqid,omitempty"`
+	Signature []byte    `json:"signature"`
+}
+
+// Receipts by message ID, for messages received by this node and receipts pushed to it as a sender.
+// Receipts are only accepted for messages this node sent
+type receiptStore struct {
+	mu        sync.Mutex
+	receipts  map[MsgID]*receiptEntry
+	pending   map[string]MsgID // TX signature to message ID, until sequenced
+	order     []MsgID
+	sent      map[MsgID]sentMessage
+	sentOrder []MsgID
+	max       int
+}
+
+// A message this node sent, receipts must be for the sender and signed by the node it was sent to
+type sentMessage struct {
+	sender []byte
+	node   []byte
+}
+
+type receiptEntry struct {
+	receipt   Receipt
+	src       *net.UDPAddr
+	signature string // of the TX, while pending
+}
+
+func newReceiptStore(max int) *receiptStore {
+
+	return &receiptStore{receipts: make(map[MsgID]*receiptEntry), pending: make(map[string]MsgID), sent: make(map[MsgID]sentMessage), max: max}
+
+}
+
+// Record a message sent to `node`, dropping the oldest if full
+func (store *receiptStore) addSent(id MsgID, sender, node []byte) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.sent[id]; !ok {
+
+		for len(store.sentOrder) >= store.max {
+			delete(store.sent, store.sentOrder[0])
+			store.sentOrder = store.sentOrder[1:]
+		}
+
+		store.sentOrder = append(store.sentOrder, id)
+
+	}
+
+	store.sent[id] = sentMessage{sender: sender, node: node}
+
+}
+
+// Add a receipt, dropping the oldest if full. Lock must be held
+func (store *receiptStore) add(entry *receiptEntry) {
+
+	id := entry.receipt.MsgID
+
+	if _, ok := store.receipts[id]; !ok {
+
+		for len(store.order) >= store.max {
+			oldest := store.order[0]
+			store.order = store.order[1:]
+
+			if entry, ok := store.receipts[oldest]; ok && entry.signature != "" {
+				delete(store.pending, entry.signature)
+			}
+
+			delete(store.receipts, oldest)
+		}
+
+		store.order = append(store.order, id)
+
+	}
+
+	store.receipts[id] = entry
+
+}
+
+func (store *receiptStore) get(id MsgID) (receipt Receipt, ok bool) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, ok := store.receipts[id]
+
+	if ok {
+		receipt = entry.receipt
+	}
+
+	return
+
+}
+
+// The ID of a queued TX, the packet ID for single packets or the hash of the whole fragmented message
+func txMsgID(packet Packet, tx blockdb.TxPayload) MsgID {
+
+	if packet.Flags[0]&PacketFlagFragment != 0 {
+		return sha256.Sum256(append(append([]byte{}, tx.Data...), tx.Signature...))
+	}
+
+	return packet.ID()
+
+}
+
+// Acknowledge a message queued to the PoH, the receipt is pushed to `src` if it is a verified peer. The
+// source of a datagram can be spoofed to reflect receipts at another host, other senders fetch receipts
+// with FetchReceipt
+func (p2p *P2P) acknowledge(id MsgID, tx blockdb.TxPayload, src *net.UDPAddr) (receipt Receipt, ok bool) {
+
+	if src != nil && p2p.verifiedKey(src.String()) == nil {
+		src = nil
+	}
+
+	receipt = Receipt{MsgID: id, Status: ReceiptReceived, Sender: tx.Sender, Node: p2p.POH.Wallet.PublicKey, Received: time.Now()}
+
+	if err := receipt.sign(&p2p.POH.Wallet); err != nil {
+		log.Warn("Receipt => ", err)
+		return
+	}
+
+	p2p.receipts.mu.Lock()
+	p2p.receipts.add(&receiptEntry{receipt: receipt, src: src, signature: string(tx.Signature)})
+	p2p.receipts.pending[string(tx.Signature)] = id
+	p2p.receipts.mu.Unlock()
+
+	p2p.pushReceipt(receipt, src)
+
+	return receipt, true
+
+}
+
+// Issue sequencing receipts for the messages in a block written by the PoH, `seqs` is the PoH seq of each TX
+func (p2p *P2P) BlockReceipts(block *blockdb.BlockKV, seqs []uint64) {
+
+	type push struct {
+		receipt Receipt
+		src     *net.UDPAddr
+	}
+
+	var pushes []push
+
+	p2p.receipts.mu.Lock()
+
+	for i, tx := range block.Value.Payload {
+
+		id, ok := p2p.receipts.pending[string(tx.Signature)]
+
+		if !ok {
+			continue
+		}
+
+		delete(p2p.receipts.pending, string(tx.Signature))
+
+		entry, ok := p2p.receipts.receipts[id]
+
+		if !ok {
+			continue
+		}
+
+		receipt := entry.receipt
+		receipt.Status = ReceiptSequenced
+		receipt.BlockHash = block.Key[:]
+		receipt.SeqID = block.Value.Header.SeqID
+
+		if i < len(seqs) {
+			receipt.Seq = seqs[i]
+		}
+
+		if err := receipt.sign(&p2p.POH.Wallet); err != nil {
+			log.Warn("Receipt => ", err)
+			continue
+		}
+
+		entry.receipt = receipt
+		entry.signature = ""
+		pushes = append(pushes, push{receipt: receipt, src: entry.src})
+
+	}
+
+	p2p.receipts.mu.Unlock()
+
+	for _, p := range pushes {
+		p2p.pushReceipt(p.receipt, p.src)
+	}
+
+}
+
+// Send the receipt to the address the message came from, over the P2P channel
+func (p2p *P2P) pushReceipt(receipt Receipt, src *net.UDPAddr) {
+
+	if src == nil {
+		return
+	}
+
+	data, err := json.Marshal(receipt)
+
+	if err != nil {
+		log.Warn("Receipt => ", err)
+		return
+	}
+
+	packets, _, err := NewPackets(&p2p.POH.Wallet, receipt.Sender, data, MsgTypeReceipt, true)
+
+	if err == nil {
+		err = p2p.reply(src, packets)
+	}
+
+	if err != nil {
+		log.Debug("Receipt => ", err)
+	}
+
+}
+
+// Record a receipt pushed to this node as the sender, it must be signed by the node that sent it
+func (p2p *P2P) receiveReceipt(tx blockdb.TxPayload) {
+
+	data, err := PlainPayload(tx)
+
+	if err != nil {
+		log.Warn("Ignoring receipt, ", err)
+		return
+	}
+
+	var receipt Receipt
+
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		log.Warn("Ignoring receipt, ", err)
+		return
+	}
+
+	if string(receipt.Node) != string(tx.Sender) {
+		log.Warn("Ignoring receipt, ", ErrReceiptSignature)
+		return
+	}
+
+	if err := p2p.recordReceipt(receipt); err != nil {
+		log.Warn("Ignoring receipt, ", err)
+	}
+
+}
+
+// Record a receipt for a message this node sent, it must be for the sender of the message and signed by
+// the node the message was sent to
+func (p2p *P2P) recordReceipt(receipt Receipt) (err error) {
+
+	if err = receipt.Verify(); err != nil {
+		return
+	}
+
+	p2p.receipts.mu.Lock()
+	defer p2p.receipts.mu.Unlock()
+
+	sent, ok := p2p.receipts.sent[receipt.MsgID]
+
+	if !ok || len(sent.node) == 0 || !bytes.Equal(sent.node, receipt.Node) || !bytes.Equal(sent.sender, receipt.Sender) {
+		return ErrReceiptUnexpected
+	}
+
+	// A sequenced receipt is not replaced by a late acknowledgement
+	if existing, ok := p2p.receipts.receipts[receipt.MsgID]; ok && existing.receipt.Status == ReceiptSequenced && receipt.Status != ReceiptSequenced {
+		return
+	}
+
+	p2p.receipts.add(&receiptEntry{receipt: receipt})
+
+	return
+
+}
+
+// Fetch the receipt for a message this node sent from the RPC host of the node it was sent to, receipts
+// are only pushed to verified peers. The receipt is checked and recorded as a pushed receipt would be
+func (p2p *P2P) FetchReceipt(hostname string, id MsgID) (receipt Receipt, err error) {
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/p2p/receipt?id=%s", hostname, url.QueryEscape(id.String())))
+
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return receipt, fmt.Errorf("receipt request failed, %s", resp.Status)
+	}
+
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxSyncRequest)).Decode(&receipt); err != nil {
+		return
+	}
+
+	err = p2p.recordReceipt(receipt)
+
+	return
+
+}
+
+// Return the receipt for a message, sent or received by this node
+func (p2p *P2P) Receipt(id MsgID) (Receipt, bool) {
+
+	return p2p.receipts.get(id)
+
+}
+
+// JSON RPC method, return the receipt for the message ID
+func (p2p *P2P) ReceiptStatus(c *gin.Context) {
+
+	var id MsgID
+
+	if err := id.UnmarshalText([]byte(c.Query("id"))); err != nil {
+		c.JSON(400, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
+
+	receipt, ok := p2p.Receipt(id)
+
+	if !ok {
+		c.JSON(404, gin.H{"status": "fail", "error": "no receipt for message"})
+		return
+	}
+
+	c.JSON(200, receipt)
+
+}
+
+func (receipt *Receipt) sign(signer *wallet.Wallet) (err error) {
+
+	receipt.Signature = nil
+
+	data, err := json.Marshal(receipt)
+
+	if err != nil {
+		return
+	}
+
+	receipt.Signature, err = signer.Sign(data)
+
+	return
+
+}
+
+// Verify the receipt is signed by the node
+func (receipt Receipt) Verify() (err error) {
+
+	if len(receipt.Node) != ed25519.PublicKeySize {
+		return ErrReceiptSignature
+	}
+
+	unsigned := receipt
+	unsigned.Signature = nil
+
+	data, err := json.Marshal(unsigned)
+
+	if err != nil {
+		return
+	}
+
+	if !ed25519.Verify(receipt.Node, data, receipt.Signature) {
+		return ErrReceiptSignature
+	}
+
+	return
+
+}
+
+func (id MsgID) MarshalText() ([]byte, error) {
+
+	return []byte(id.String()), nil
+
+}
+
+func (id *MsgID) UnmarshalText(text []byte) error {
+
+	b, err := base64.StdEncoding.DecodeString(string(text))
+
+	if err != nil || len(b) != len(id) {
+		return fmt.Errorf("message ID must be %d bytes, base64 encoded", len(id))
+	}
+
+	copy(id[:], b)
+
+	return nil
+
+}
@@ -0,0 +1,129 @@
+package p2pnet_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceipts(t *testing.T) {
+
+	// Receiving node and a sending node, verified peers of each other
+	node, nodeAddr := newNode(t, nodeOptions{udp: true})
+	client, clientAddr := newNode(t, nodeOptions{udp: true})
+
+	client.Discover(nodeAddr)
+	node.Discover(clientAddr)
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	// Receipts are pushed back to the verified peer
+	opts := p2pnet.SendOptions{Peer: fmt.Sprintf("%s:%d", node.P2P_Node.Host, node.P2P_Node.Port)}
+
+	single, err := client.Send(&sender, node.POH.Wallet.PublicKey, []byte("Hello world"), 1, opts)
+	assert.Nil(t, err)
+
+	fragmented, err := client.Send(&sender, node.POH.Wallet.PublicKey, make([]byte, 5000), 1, opts)
+	assert.Nil(t, err)
+
+	status := func(p2p *p2pnet.P2P, id p2pnet.MsgID) string {
+		receipt, _ := p2p.Receipt(id)
+		return receipt.Status
+	}
+
+	for _, id := range []p2pnet.MsgID{single, fragmented} {
+
+		assert.Eventually(t, func() bool { return status(client, id) == p2pnet.ReceiptReceived }, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, p2pnet.ReceiptReceived, status(node, id))
+
+		receipt, _ := client.Receipt(id)
+		assert.Nil(t, receipt.Verify())
+		assert.Equal(t, []byte(node.POH.Wallet.PublicKey), receipt.Node)
+
+	}
+
+	// Sequencing receipts once the block is written
+	node.POH.Mu.Lock()
+	block := blockdb.BlockKV{Key: blockdb.Hash{1, 2, 3}}
+	block.Value.Header.SeqID = 7
+	block.Value.Payload = append(block.Value.Payload, node.POH.QueueSync.State...)
+	node.POH.Mu.Unlock()
+
+	assert.Len(t, block.Value.Payload, 2)
+
+	node.BlockReceipts(&block, []uint64{42, 43})
+
+	for i, id := range []p2pnet.MsgID{single, fragmented} {
+
+		assert.Eventually(t, func() bool { return status(client, id) == p2pnet.ReceiptSequenced }, 2*time.Second, 10*time.Millisecond)
+
+		receipt, _ := client.Receipt(id)
+		assert.Nil(t, receipt.Verify())
+		assert.Equal(t, uint64(42+i), receipt.Seq)
+		assert.Equal(t, uint64(7), receipt.SeqID)
+		assert.Equal(t, block.Key[:], receipt.BlockHash)
+
+	}
+
+	// Tampered receipts fail verification
+	receipt, _ := client.Receipt(single)
+	receipt.Seq++
+	assert.Equal(t, p2pnet.ErrReceiptSignature, receipt.Verify())
+
+}
+
+func TestReceiptsUnverified(t *testing.T) {
+
+	node, nodeAddr := newNode(t, nodeOptions{udp: true})
+	other, _ := newNode(t, nodeOptions{udp: true})
+
+	// The client is not a peer of the node, receipts are not pushed to the source of its datagrams
+	client, _ := newNode(t, nodeOptions{udp: true})
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	peer := fmt.Sprintf("%s:%d", node.P2P_Node.Host, node.P2P_Node.Port)
+
+	id, err := client.Send(&sender, node.POH.Wallet.PublicKey, []byte("Hello world"), 1, p2pnet.SendOptions{Peer: peer, Node: node.POH.Wallet.PublicKey})
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool { return queued(node) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, ok := client.Receipt(id)
+	assert.False(t, ok)
+
+	// Fetched from the node it was sent to
+	receipt, err := client.FetchReceipt(nodeAddr, id)
+	assert.Nil(t, err)
+	assert.Equal(t, p2pnet.ReceiptReceived, receipt.Status)
+
+	receipt, ok = client.Receipt(id)
+	assert.True(t, ok)
+	assert.Equal(t, []byte(node.POH.Wallet.PublicKey), receipt.Node)
+
+	// Receipts from another node, or for messages not sent, are not accepted
+	misdirected, err := other.Send(&sender, node.POH.Wallet.PublicKey, []byte("Hello world"), 1, p2pnet.SendOptions{Peer: peer, Node: other.POH.Wallet.PublicKey})
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool { return queued(node) == 2 }, 2*time.Second, 10*time.Millisecond)
+
+	_, err = other.FetchReceipt(nodeAddr, misdirected)
+	assert.True(t, errors.Is(err, p2pnet.ErrReceiptUnexpected))
+
+	_, err = other.FetchReceipt(nodeAddr, id)
+	assert.True(t, errors.Is(err, p2pnet.ErrReceiptUnexpected))
+
+	_, ok = other.Receipt(id)
+	assert.False(t, ok)
+
+}
@@ -0,0 +1,57 @@
+package p2pnet_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/poh_hash"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayedPacketsDropped(t *testing.T) {
+
+	p2p := p2pnet.New(p2pnet.P2P{ReplayWindow: time.Minute})
+	p2p.POH = &poh_hash.POH{}
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	packets, _, err := p2pnet.NewPackets(&sender, sender.PublicKey, []byte("Hello world"), 0, true)
+	assert.Nil(t, err)
+
+	// A captured packet sent again is only queued once
+	datagram := encodePackets(t, packets)[0]
+
+	for i := 0; i < 3; i++ {
+		p2p.MsgHandler(src, len(datagram), datagram)
+	}
+
+	assert.Len(t, p2p.POH.QueueSync.State, 1)
+
+	tx := p2p.POH.QueueSync.State[0]
+	assert.NotZero(t, tx.Reserved&blockdb.TxFlagReplay)
+
+	header, err := blockdb.ParseReplayHeader(tx.Data)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), header.Time(), time.Second)
+
+	// Validly signed packets outside the window are stale
+	stale := packets[0]
+	copy(stale.Payload[:], blockdb.ReplayHeader{Timestamp: time.Now().Add(-2 * time.Minute).UnixNano()}.Bytes())
+
+	signature, err := sender.Sign(stale.SignedData())
+	assert.Nil(t, err)
+	copy(stale.SenderSignature[:], signature)
+
+	datagram = encodePackets(t, []p2pnet.Packet{stale})[0]
+	p2p.MsgHandler(src, len(datagram), datagram)
+
+	assert.Len(t, p2p.POH.QueueSync.State, 1)
+
+}
@@ -0,0 +1,537 @@
+package p2pnet
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default rate limits, packets or requests per second and burst, for each source IP and each sender key
+const (
+	DefaultPeerRate    = 500
+	DefaultPeerBurst   = 1000
+	DefaultSenderRate  = 100
+	DefaultSenderBurst = 200
+)
+
+// Penalties deducted from the score of a source, which is banned once the score reaches BanScore
+const (
+	PenaltyRateLimit = 1
+	PenaltyMalformed = 10
+	PenaltySignature = 25
+	PenaltySyncData  = 50
+)
+
+const BanScore = -100
+
+// Sources are banned for DefaultBanDuration, and permanently once banned maxTempBans times
+const DefaultBanDuration = time.Hour
+const maxTempBans = 3
+
+// A score recovers one point each interval without penalties
+const scoreRecovery = 10 * time.Second
+
+// Idle rate limit and score entries are dropped once the tables grow past this size
+const maxSources = 65536
+
+var ErrInvalidSource = errors.New("source must be ip:<address> or key:<base64 public key>")
+
+// A banned source, either an IP address or a sender public key. Permanent bans have no expiry
+type Ban struct {
+	Source    string    `json:"source"`
+	Reason    string    `json:"reason"`
+	Created   time.Time `json:"created"`
+	Until     time.Time `json:"until"`
+	Permanent bool      `json:"permanent"`
+}
+
+// Rate limits for each source, see the Default values
+type RateLimits struct {
+	PeerRate    float64
+	PeerBurst   float64
+	SenderRate  float64
+	SenderBurst float64
+}
+
+// Token buckets, scores and bans for each source. Bans are saved to disk as they change
+type Reputation struct {
+	mu      sync.Mutex
+	limits  RateLimits
+	buckets map[string]*tokenBucket
+	scores  map[string]*score
+	bans    map[string]Ban
+	file    string
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type score struct {
+	value float64
+	bans  int
+	last  time.Time
+}
+
+// The source name of an IP address
+func SourceIP(ip string) string {
+
+	return "ip:" + ip
+
+}
+
+// The source name of a sender public key
+func SourceKey(publicKey []byte) string {
+
+	return "key:" + base64.StdEncoding.EncodeToString(publicKey)
+
+}
+
+// Create the reputation table, with bans saved to `file`. Zero limits use the defaults
+func NewReputation(file string, limits RateLimits) *Reputation {
+
+	if limits.PeerRate == 0 {
+		limits.PeerRate = DefaultPeerRate
+	}
+
+	if limits.PeerBurst == 0 {
+		limits.PeerBurst = DefaultPeerBurst
+	}
+
+	if limits.SenderRate == 0 {
+		limits.SenderRate = DefaultSenderRate
+	}
+
+	if limits.SenderBurst == 0 {
+		limits.SenderBurst = DefaultSenderBurst
+	}
+
+	return &Reputation{limits: limits, buckets: make(map[string]*tokenBucket), scores: make(map[string]*score), bans: make(map[string]Ban), file: file}
+
+}
+
+// Load the bans saved from a previous run, a missing file is not an error
+func (r *Reputation) Load() (err error) {
+
+	if r.file == "" {
+		return
+	}
+
+	data, err := os.ReadFile(r.file)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	var bans []Ban
+
+	if err = json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("Bans file %s is invalid (%s)", r.file, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, ban := range bans {
+		r.bans[ban.Source] = ban
+	}
+
+	log.Info(fmt.Sprintf("Loaded (%d) bans from %s", len(r.bans), r.file))
+
+	return
+
+}
+
+// Save the bans that have not expired, lock must be held
+func (r *Reputation) save() {
+
+	if r.file == "" {
+		return
+	}
+
+	bans := r.list()
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(r.file), 0700)
+	}
+
+	tmpFile := fmt.Sprintf("%s.tmp", r.file)
+
+	if err == nil {
+		err = os.WriteFile(tmpFile, data, 0600)
+	}
+
+	if err == nil {
+		err = os.Rename(tmpFile, r.file)
+	}
+
+	if err != nil {
+		log.Warn("Bans => ", err)
+	}
+
+}
+
+// Check if the source is banned, cheap enough to call before verifying signatures
+func (r *Reputation) Banned(source string) bool {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.banned(source, time.Now())
+
+}
+
+func (r *Reputation) banned(source string, now time.Time) bool {
+
+	ban, ok := r.bans[source]
+
+	if !ok {
+		return false
+	}
+
+	if !ban.Permanent && now.After(ban.Until) {
+		delete(r.bans, source)
+		return false
+	}
+
+	return true
+
+}
+
+// Take a token from the bucket of the source IP
+func (r *Reputation) AllowIP(ip string) bool {
+
+	return r.allow(SourceIP(ip), r.limits.PeerRate, r.limits.PeerBurst, true)
+
+}
+
+// Take a token from the UDP bucket of the source IP. Datagram sources can be spoofed, so UDP traffic
+// has its own buckets and is not penalised over the limit, a forged source can't get an IP banned
+func (r *Reputation) AllowUDP(ip string) bool {
+
+	return r.allow("udp:"+ip, r.limits.PeerRate, r.limits.PeerBurst, false)
+
+}
+
+// Take a token from the bucket of the sender key
+func (r *Reputation) AllowSender(publicKey []byte) bool {
+
+	return r.allow(SourceKey(publicKey), r.limits.SenderRate, r.limits.SenderBurst, true)
+
+}
+
+// Take a token from the bucket of the source, sources over the limit are penalised if `penalise`
+func (r *Reputation) allow(source string, rate, burst float64, penalise bool) bool {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	bucket, ok := r.buckets[source]
+
+	if !ok {
+
+		if len(r.buckets) >= maxSources {
+			r.sweep(now)
+		}
+
+		bucket = &tokenBucket{tokens: burst, last: now}
+		r.buckets[source] = bucket
+
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rate
+	bucket.last = now
+
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+
+	if bucket.tokens < 1 {
+
+		if penalise {
+			r.penalize(source, PenaltyRateLimit, "rate limit exceeded", now)
+		}
+
+		return false
+
+	}
+
+	bucket.tokens--
+
+	return true
+
+}
+
+// Deduct the penalty from the score of the source, banning it once the score reaches BanScore
+func (r *Reputation) Penalize(source string, penalty int, reason string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.penalize(source, penalty, reason, time.Now())
+
+}
+
+func (r *Reputation) penalize(source string, penalty int, reason string, now time.Time) {
+
+	if r.banned(source, now) {
+		return
+	}
+
+	s, ok := r.scores[source]
+
+	if !ok {
+
+		if len(r.scores) >= maxSources {
+			r.sweep(now)
+		}
+
+		s = &score{last: now}
+		r.scores[source] = s
+
+	}
+
+	s.recover(now)
+	s.value -= float64(penalty)
+
+	log.Debug(fmt.Sprintf("Reputation => %s score (%.0f), %s", source, s.value, reason))
+
+	if s.value > BanScore {
+		return
+	}
+
+	s.value = 0
+	s.bans++
+
+	ban := Ban{Source: source, Reason: reason, Created: now}
+
+	if s.bans >= maxTempBans {
+		ban.Permanent = true
+	} else {
+		ban.Until = now.Add(DefaultBanDuration)
+	}
+
+	log.Warn(fmt.Sprintf("Reputation => Banning %s (%s), permanent %t", source, reason, ban.Permanent))
+
+	r.bans[source] = ban
+	r.save()
+
+}
+
+// Ban the source for the duration, or permanently if zero
+func (r *Reputation) Ban(source string, duration time.Duration, reason string) (ban Ban, err error) {
+
+	if err = checkSource(source); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ban = Ban{Source: source, Reason: reason, Created: time.Now(), Permanent: duration == 0}
+
+	if duration > 0 {
+		ban.Until = ban.Created.Add(duration)
+	}
+
+	r.bans[source] = ban
+	r.save()
+
+	return
+
+}
+
+// Lift the ban on the source and reset its score, returns false if it was not banned
+func (r *Reputation) Unban(source string) bool {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.bans[source]
+
+	delete(r.bans, source)
+	delete(r.scores, source)
+
+	if ok {
+		r.save()
+	}
+
+	return ok
+
+}
+
+// Return the bans in effect, by source
+func (r *Reputation) Bans() []Ban {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.list()
+
+}
+
+// Lock must be held
+func (r *Reputation) list() (bans []Ban) {
+
+	now := time.Now()
+
+	for source, ban := range r.bans {
+		if r.banned(source, now) {
+			bans = append(bans, ban)
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Source < bans[j].Source })
+
+	return
+
+}
+
+// Drop full buckets and recovered scores, lock must be held
+func (r *Reputation) sweep(now time.Time) {
+
+	for source, bucket := range r.buckets {
+		if now.Sub(bucket.last) > time.Minute {
+			delete(r.buckets, source)
+		}
+	}
+
+	for source, s := range r.scores {
+		if s.recover(now); s.value == 0 && s.bans == 0 {
+			delete(r.scores, source)
+		}
+	}
+
+}
+
+func (s *score) recover(now time.Time) {
+
+	s.value += float64(now.Sub(s.last) / scoreRecovery)
+
+	if s.value > 0 {
+		s.value = 0
+	}
+
+	s.last = now
+
+}
+
+func checkSource(source string) error {
+
+	switch {
+	case strings.HasPrefix(source, "ip:") && net.ParseIP(strings.TrimPrefix(source, "ip:")) != nil:
+		return nil
+	case strings.HasPrefix(source, "key:"):
+		if _, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(source, "key:")); err == nil {
+			return nil
+		}
+	}
+
+	return ErrInvalidSource
+
+}
+
+// Host part of an RPC peer address, used as the source of sync data
+func sourceHost(hostname string) string {
+
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		return SourceIP(host)
+	}
+
+	return SourceIP(hostname)
+
+}
+
+// Gin middleware to drop requests from banned sources and apply the rate limits. The sender
+// query parameter of /push is limited by sender key
+func (p2p *P2P) RateLimit() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		// The remote address is used, not headers set by clients
+		ip, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+
+		if err != nil {
+			ip = c.Request.RemoteAddr
+		}
+
+		sender, hasSender := c.GetQuery("sender")
+
+		if p2p.reputation.Banned(SourceIP(ip)) || (hasSender && p2p.reputation.Banned(SourceKey([]byte(sender)))) {
+			c.AbortWithStatusJSON(403, gin.H{"status": "fail", "error": "banned"})
+			return
+		}
+
+		if !p2p.reputation.AllowIP(ip) || (hasSender && !p2p.reputation.AllowSender([]byte(sender))) {
+			c.AbortWithStatusJSON(429, gin.H{"status": "fail", "error": "rate limit exceeded"})
+			return
+		}
+
+		c.Next()
+
+	}
+
+}
+
+// Admin RPC methods
+
+// Return the bans in effect
+func (p2p *P2P) Bans(c *gin.Context) {
+
+	c.JSON(200, gin.H{"status": "ok", "bans": p2p.reputation.Bans()})
+
+}
+
+// Ban a source, ip:<address> or key:<base64 public key>, for the duration or permanently if not set
+func (p2p *P2P) AddBan(c *gin.Context) {
+
+	var duration time.Duration
+	var err error
+
+	if value, ok := c.GetQuery("duration"); ok {
+		if duration, err = time.ParseDuration(value); err != nil || duration < 0 {
+			c.JSON(400, gin.H{"status": "fail", "error": "duration must be a positive duration, such as 1h"})
+			return
+		}
+	}
+
+	ban, err := p2p.reputation.Ban(c.Query("source"), duration, c.DefaultQuery("reason", "admin"))
+
+	if err != nil {
+		c.JSON(400, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "ok", "ban": ban})
+
+}
+
+// Lift the ban on a source
+func (p2p *P2P) RemoveBan(c *gin.Context) {
+
+	if !p2p.reputation.Unban(c.Query("source")) {
+		c.JSON(404, gin.H{"status": "fail", "error": "source is not banned"})
+		return
+	}
+
+	c.JSON(200, gin.H{"status": "ok"})
+
+}
@@ -0,0 +1,225 @@
+package p2pnet_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/poh_hash"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+
+	r := p2pnet.NewReputation("", p2pnet.RateLimits{PeerRate: 1, PeerBurst: 5, SenderRate: 1, SenderBurst: 2})
+
+	allowed := 0
+
+	for i := 0; i < 10; i++ {
+		if r.AllowIP("10.0.0.1") {
+			allowed++
+		}
+	}
+
+	assert.Equal(t, 5, allowed)
+
+	// Other sources have their own buckets
+	assert.True(t, r.AllowIP("10.0.0.2"))
+	assert.True(t, r.AllowSender([]byte("sender")))
+	assert.True(t, r.AllowSender([]byte("sender")))
+	assert.False(t, r.AllowSender([]byte("sender")))
+
+	// UDP traffic has its own buckets and is not penalised, the source can be spoofed
+	for i := 0; i < 1000; i++ {
+		r.AllowUDP("10.0.0.3")
+	}
+
+	assert.False(t, r.AllowUDP("10.0.0.3"))
+	assert.False(t, r.Banned(p2pnet.SourceIP("10.0.0.3")))
+	assert.True(t, r.AllowIP("10.0.0.3"))
+
+}
+
+func TestBans(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "bans.json")
+	r := p2pnet.NewReputation(file, p2pnet.RateLimits{})
+	source := p2pnet.SourceIP("10.0.0.1")
+
+	// Penalties accumulate to a temporary ban, repeat offenders are banned permanently
+	for ban := 1; ban <= 3; ban++ {
+
+		for i := 0; i < -p2pnet.BanScore/p2pnet.PenaltySignature; i++ {
+			assert.False(t, r.Banned(source))
+			r.Penalize(source, p2pnet.PenaltySignature, "signature failure")
+		}
+
+		assert.True(t, r.Banned(source))
+
+		bans := r.Bans()
+		assert.Equal(t, 1, len(bans))
+		assert.Equal(t, ban == 3, bans[0].Permanent)
+
+		if ban < 3 {
+			// Expire the ban, the offence count is kept
+			_, err := r.Ban(source, -1, "expired")
+			assert.Nil(t, err)
+			assert.False(t, r.Banned(source))
+		}
+
+	}
+
+	// Bans are loaded on restart
+	loaded := p2pnet.NewReputation(file, p2pnet.RateLimits{})
+	assert.Nil(t, loaded.Load())
+	assert.True(t, loaded.Banned(source))
+
+	assert.True(t, loaded.Unban(source))
+	assert.False(t, loaded.Banned(source))
+	assert.False(t, loaded.Unban(source))
+
+	_, err := loaded.Ban("10.0.0.1", 0, "admin")
+	assert.NotNil(t, err)
+
+}
+
+func TestBannedPacketsDropped(t *testing.T) {
+
+	p2p := p2pnet.New(p2pnet.P2P{})
+	p2p.POH = &poh_hash.POH{}
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	packets, _, err := p2pnet.NewPackets(&sender, sender.PublicKey, []byte("Hello world"), 0, true)
+	assert.Nil(t, err)
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, binary.Write(buf, binary.BigEndian, packets[0]))
+
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 16842}
+
+	p2p.MsgHandler(src, buf.Len(), buf.Bytes())
+	assert.Equal(t, 1, len(p2p.POH.QueueSync.State))
+
+	// Forged packets are dropped without a penalty, the source IP of a datagram can be spoofed
+	forged := packets[0]
+	forged.SenderSignature[0] ^= 0xff
+
+	forgedBuf := new(bytes.Buffer)
+	assert.Nil(t, binary.Write(forgedBuf, binary.BigEndian, forged))
+
+	for i := 0; i < 2*-p2pnet.BanScore/p2pnet.PenaltySignature; i++ {
+		p2p.MsgHandler(src, forgedBuf.Len(), forgedBuf.Bytes())
+	}
+
+	packets, _, err = p2pnet.NewPackets(&sender, sender.PublicKey, []byte("Hello world"), 0, true)
+	assert.Nil(t, err)
+
+	buf.Reset()
+	assert.Nil(t, binary.Write(buf, binary.BigEndian, packets[0]))
+
+	p2p.MsgHandler(src, buf.Len(), buf.Bytes())
+	assert.Equal(t, 2, len(p2p.POH.QueueSync.State))
+
+	// Invalid fragments under a valid signature count against the sender key until it is banned
+	for i := 0; i < -p2pnet.BanScore/p2pnet.PenaltyMalformed; i++ {
+
+		replay, err := blockdb.NewReplayHeader()
+		assert.Nil(t, err)
+
+		fragment := p2pnet.Packet{Version: [1]byte{p2pnet.PacketVersion}, Flags: [1]byte{p2pnet.PacketFlagFragment | blockdb.TxFlagReplay}}
+		copy(fragment.SenderPublicKey[:], sender.PublicKey)
+		copy(fragment.RecipientPublicKey[:], sender.PublicKey)
+		copy(fragment.Payload[:], replay.Bytes())
+
+		signature, err := sender.Sign(fragment.SignedData())
+		assert.Nil(t, err)
+		copy(fragment.SenderSignature[:], signature)
+
+		datagram := encodePackets(t, []p2pnet.Packet{fragment})[0]
+		p2p.MsgHandler(src, len(datagram), datagram)
+
+	}
+
+	packets, _, err = p2pnet.NewPackets(&sender, sender.PublicKey, []byte("Hello world"), 0, true)
+	assert.Nil(t, err)
+
+	buf.Reset()
+	assert.Nil(t, binary.Write(buf, binary.BigEndian, packets[0]))
+
+	p2p.MsgHandler(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 16842}, buf.Len(), buf.Bytes())
+	assert.Equal(t, 2, len(p2p.POH.QueueSync.State))
+
+	// Other senders from the same source are unaffected
+	other := wallet.New()
+	assert.Nil(t, other.GenerateWallet())
+
+	packets, _, err = p2pnet.NewPackets(&other, other.PublicKey, []byte("Hello world"), 0, true)
+	assert.Nil(t, err)
+
+	buf.Reset()
+	assert.Nil(t, binary.Write(buf, binary.BigEndian, packets[0]))
+
+	p2p.MsgHandler(src, buf.Len(), buf.Bytes())
+	assert.Equal(t, 3, len(p2p.POH.QueueSync.State))
+
+}
+
+func TestBanAdmin(t *testing.T) {
+
+	p2p := p2pnet.New(p2pnet.P2P{})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/push", p2p.RateLimit(), func(c *gin.Context) { c.JSON(200, gin.H{"status": "ok"}) })
+	router.GET("/admin/bans", p2p.Bans)
+	router.POST("/admin/bans", p2p.AddBan)
+	router.DELETE("/admin/bans", p2p.RemoveBan)
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.0.2.1:5000"
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, request("GET", "/push?sender=alice").Code)
+
+	// Ban the sender key, then the source IP
+	key := url.QueryEscape(p2pnet.SourceKey([]byte("alice")))
+
+	assert.Equal(t, http.StatusOK, request("POST", "/admin/bans?source="+key+"&duration=1h").Code)
+	assert.Equal(t, http.StatusForbidden, request("GET", "/push?sender=alice").Code)
+	assert.Equal(t, http.StatusOK, request("GET", "/push?sender=bob").Code)
+
+	assert.Equal(t, http.StatusOK, request("POST", "/admin/bans?source=ip:192.0.2.1").Code)
+	assert.Equal(t, http.StatusForbidden, request("GET", "/push?sender=bob").Code)
+
+	w := request("GET", "/admin/bans")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Bans []p2pnet.Ban `json:"bans"`
+	}
+
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 2, len(resp.Bans))
+
+	assert.Equal(t, http.StatusBadRequest, request("POST", "/admin/bans?source=nobody").Code)
+	assert.Equal(t, http.StatusOK, request("DELETE", "/admin/bans?source=ip:192.0.2.1").Code)
+	assert.Equal(t, http.StatusNotFound, request("DELETE", "/admin/bans?source=ip:192.0.2.1").Code)
+	assert.Equal(t, http.StatusOK, request("GET", "/push?sender=bob").Code)
+
+}
@@ -0,0 +1,121 @@
+package p2pnet
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/wallet"
+)
+
+// Largest message that can be sealed in a single packet, after the replay header the box is prefixed with its length
+const MaxSealedMessage = len(Packet{}.Payload) - blockdb.ReplayHeaderSize - 2 - wallet.BoxOverhead
+
+var (
+	ErrNotSealed      = errors.New("TX data is not sealed")
+	ErrSealed         = errors.New("TX data is sealed")
+	ErrMalformedFrame = errors.New("TX data length does not match the frame")
+)
+
+// Seal `data` for the recipient into a single packet payload with a new replay header, zero padded
+func SealPayload(recipient ed25519.PublicKey, data []byte) (payload [376]byte, err error) {
+
+	if len(data) > MaxSealedMessage {
+		return payload, fmt.Errorf("%w (%d > %d bytes)", ErrMessageTooLarge, len(data), MaxSealedMessage)
+	}
+
+	message, err := sealMessage(recipient, data)
+
+	if err != nil {
+		return
+	}
+
+	replay, err := blockdb.NewReplayHeader()
+
+	if err != nil {
+		return
+	}
+
+	copy(payload[:], replay.Bytes())
+	copy(payload[blockdb.ReplayHeaderSize:], message)
+
+	return
+
+}
+
+// Seal `data` for the recipient, prefixed with the length of the box
+func sealMessage(recipient ed25519.PublicKey, data []byte) (message []byte, err error) {
+
+	box, err := wallet.Seal(recipient, data)
+
+	if err != nil {
+		return
+	}
+
+	return framed(box), nil
+
+}
+
+// Prefix `data` with its length
+func framed(data []byte) []byte {
+
+	message := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(message[:2], uint16(len(data)))
+	copy(message[2:], data)
+
+	return message
+
+}
+
+// The length prefixed bytes of a TX after the replay header, without the zero padding of a single packet
+func frame(tx blockdb.TxPayload) ([]byte, error) {
+
+	message := tx.Data
+
+	if tx.Reserved&blockdb.TxFlagReplay != 0 && len(message) >= blockdb.ReplayHeaderSize {
+		message = message[blockdb.ReplayHeaderSize:]
+	}
+
+	if len(message) < 2 {
+		return nil, ErrMalformedFrame
+	}
+
+	length := int(binary.BigEndian.Uint16(message[:2]))
+
+	if length > len(message)-2 {
+		return nil, ErrMalformedFrame
+	}
+
+	return message[2 : 2+length], nil
+
+}
+
+// Open the sealed data of a TX stored in the BlockDB with the recipient wallet
+func OpenPayload(recipient *wallet.Wallet, tx blockdb.TxPayload) (data []byte, err error) {
+
+	if tx.Reserved&blockdb.TxFlagSealed == 0 {
+		return nil, ErrNotSealed
+	}
+
+	box, err := frame(tx)
+
+	if err != nil {
+		return nil, wallet.ErrBoxOpen
+	}
+
+	return recipient.Open(box)
+
+}
+
+// The data of a plaintext TX stored in the BlockDB
+func PlainPayload(tx blockdb.TxPayload) (data []byte, err error) {
+
+	if tx.Reserved&blockdb.TxFlagSealed != 0 {
+		return nil, ErrSealed
+	}
+
+	return frame(tx)
+
+}
@@ -0,0 +1,36 @@
+package p2pnet_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealPayload(t *testing.T) {
+
+	recipient := wallet.New()
+	assert.Nil(t, recipient.GenerateWallet())
+
+	payload, err := p2pnet.SealPayload(recipient.PublicKey, []byte("Hello world"))
+	assert.Nil(t, err)
+
+	// Stored in the BlockDB as received, including the padding
+	tx := blockdb.TxPayload{Data: payload[:], Recipient: recipient.PublicKey, Reserved: blockdb.TxFlagSealed | blockdb.TxFlagReplay}
+
+	data, err := p2pnet.OpenPayload(&recipient, tx)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello world", string(data))
+
+	tx.Reserved = 0
+
+	_, err = p2pnet.OpenPayload(&recipient, tx)
+	assert.Equal(t, p2pnet.ErrNotSealed, err)
+
+	_, err = p2pnet.SealPayload(recipient.PublicKey, []byte(strings.Repeat("x", p2pnet.MaxSealedMessage+1)))
+	assert.NotNil(t, err)
+
+}
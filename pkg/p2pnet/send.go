@@ -0,0 +1,164 @@
+package p2pnet
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/perrychain/perry/pkg/wallet"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default time to wait writing a packet to the socket
+const DefaultSendTimeout = 5 * time.Second
+
+var (
+	ErrInvalidRecipient = errors.New("recipient must be an ed25519 public key")
+	ErrMessageTooLarge  = errors.New("message exceeds the packet payload")
+)
+
+// Identifies a message, the hash of the signed packet
+type MsgID [32]byte
+
+func (id MsgID) String() string {
+
+	return base64.StdEncoding.EncodeToString(id[:])
+
+}
+
+type SendOptions struct {
+	Peer      string            // host:port of the node to send to, defaults to the P2P node
+	Node      ed25519.PublicKey // key of the node, receipts are only accepted from it. Defaults to the verified peer key
+	Plaintext bool              // send the data unsealed, readable by any node
+	Timeout   time.Duration     // write deadline, defaults to DefaultSendTimeout
+}
+
+// Send `data` to the recipient, sealed for the recipient unless `opts.Plaintext` is set. Messages larger
+// than a packet are sent over a stream, or as fragments if the node does not accept streams. Safe for
+// concurrent use, sent over the transport of the node
+func (p2p *P2P) Send(senderwallet *wallet.Wallet, recipient ed25519.PublicKey, data []byte, msgType uint8, opts SendOptions) (id MsgID, err error) {
+
+	packets, id, err := NewPackets(senderwallet, recipient, data, msgType, opts.Plaintext)
+
+	if err != nil {
+		return
+	}
+
+	peer := opts.Peer
+
+	if peer == "" {
+		peer = fmt.Sprintf("%s:%d", p2p.P2P_Node.Host, p2p.P2P_Node.Port)
+	}
+
+	timeout := opts.Timeout
+
+	if timeout <= 0 {
+		timeout = DefaultSendTimeout
+	}
+
+	node := p2p.receiptNode(peer, opts)
+
+	// Messages larger than a packet go whole over a stream when the node accepts them
+	if len(packets) > 1 && p2p.streams.enabled {
+
+		streamID, streamErr := p2p.sendStream(senderwallet, recipient, data, msgType, opts, peer, node)
+
+		if streamErr == nil {
+			return streamID, nil
+		}
+
+		log.Debug("Send => ", streamErr, ", sending fragments")
+
+	}
+
+	p2p.receipts.addSent(id, senderwallet.PublicKey, node)
+
+	for _, packet := range packets {
+
+		buf := new(bytes.Buffer)
+
+		if err = binary.Write(buf, binary.BigEndian, packet); err != nil {
+			return
+		}
+
+		if err = p2p.Transport.Send(peer, buf.Bytes(), timeout); err != nil {
+			return
+		}
+
+	}
+
+	return
+
+}
+
+// Key of the node at the P2P address receipts must be signed by, nil if it is not known
+func (p2p *P2P) receiptNode(peer string, opts SendOptions) []byte {
+
+	if opts.Node != nil {
+		return opts.Node
+	}
+
+	if p2p.POH != nil && opts.Peer == "" {
+		return p2p.POH.Wallet.PublicKey
+	}
+
+	return p2p.verifiedKey(peer)
+
+}
+
+// Close the transport and stream sessions, and save the peers
+func (p2p *P2P) Close() (err error) {
+
+	err = p2p.peers.Save()
+
+	if closeErr := p2p.streams.close(); closeErr != nil {
+		err = closeErr
+	}
+
+	if closeErr := p2p.Transport.Close(); closeErr != nil {
+		err = closeErr
+	}
+
+	return
+
+}
+
+// Message ID of a single packet message, computed the same way by the sender and receiving nodes.
+// Fragmented messages are identified by the hash of the whole message. Gossip hops are not part of the ID
+func (packet Packet) ID() (id MsgID) {
+
+	packet.Hops[0] = 0
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, packet)
+
+	return sha256.Sum256(buf.Bytes())
+
+}
+
+// Write packets to `addr`, the source of a received datagram
+func (p2p *P2P) reply(addr *net.UDPAddr, packets []Packet) (err error) {
+
+	for _, packet := range packets {
+
+		buf := new(bytes.Buffer)
+
+		if err = binary.Write(buf, binary.BigEndian, packet); err != nil {
+			return
+		}
+
+		if err = p2p.Transport.Send(addr.String(), buf.Bytes(), DefaultSendTimeout); err != nil {
+			return
+		}
+
+	}
+
+	return
+
+}
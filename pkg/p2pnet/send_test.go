@@ -0,0 +1,112 @@
+package p2pnet_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/poh_hash"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSend(t *testing.T) {
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer l.Close()
+
+	p2p := p2pnet.New(p2pnet.P2P{})
+	p2p.POH = &poh_hash.POH{}
+	defer p2p.Close()
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	recipient := wallet.New()
+	assert.Nil(t, recipient.GenerateWallet())
+
+	opts := p2pnet.SendOptions{Peer: l.LocalAddr().String()}
+
+	for i := 0; i < 3; i++ {
+
+		id, err := p2p.Send(&sender, recipient.PublicKey, []byte("Hello world"), 7, opts)
+		assert.Nil(t, err)
+
+		b := make([]byte, 8192)
+		assert.Nil(t, l.SetReadDeadline(time.Now().Add(time.Second)))
+
+		n, src, err := l.ReadFromUDP(b)
+		assert.Nil(t, err)
+
+		var packet p2pnet.Packet
+		assert.Nil(t, binary.Read(bytes.NewReader(b[:n]), binary.BigEndian, &packet))
+		assert.Equal(t, id, packet.ID())
+
+		// The receiving node queues the sealed TX with the message type
+		p2p.MsgHandler(src, n, b)
+
+		tx := p2p.POH.QueueSync.State[i]
+		assert.Equal(t, uint8(7), tx.Type)
+
+		data, err := p2pnet.OpenPayload(&recipient, tx)
+		assert.Nil(t, err)
+		assert.Equal(t, "Hello world", string(data))
+
+	}
+
+	_, err = p2p.Send(&sender, []byte("short"), []byte("Hello world"), 0, opts)
+	assert.Equal(t, p2pnet.ErrInvalidRecipient, err)
+
+	_, err = p2p.Send(&sender, recipient.PublicKey, make([]byte, p2pnet.MaxMessageSize+1), 0, opts)
+	assert.True(t, errors.Is(err, p2pnet.ErrMessageTooLarge))
+
+}
+
+// Plaintext messages are read back exactly, the zero padding of a single packet is not part of the data
+func TestSendPlaintext(t *testing.T) {
+
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Nil(t, err)
+	defer l.Close()
+
+	p2p := p2pnet.New(p2pnet.P2P{})
+	p2p.POH = &poh_hash.POH{}
+	defer p2p.Close()
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	opts := p2pnet.SendOptions{Peer: l.LocalAddr().String(), Plaintext: true}
+
+	messages := [][]byte{[]byte("Hello world"), append([]byte("Hello world"), 0, 0, 0)}
+
+	for i, message := range messages {
+
+		_, err := p2p.Send(&sender, sender.PublicKey, message, 7, opts)
+		assert.Nil(t, err)
+
+		b := make([]byte, 8192)
+		assert.Nil(t, l.SetReadDeadline(time.Now().Add(time.Second)))
+
+		n, src, err := l.ReadFromUDP(b)
+		assert.Nil(t, err)
+
+		p2p.MsgHandler(src, n, b)
+
+		tx := p2p.POH.QueueSync.State[i]
+
+		data, err := p2pnet.PlainPayload(tx)
+		assert.Nil(t, err)
+		assert.Equal(t, message, data)
+
+		_, err = p2pnet.OpenPayload(&sender, tx)
+		assert.Equal(t, p2pnet.ErrNotSealed, err)
+
+	}
+
+}
@@ -0,0 +1,536 @@
+package p2pnet
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/perrychain/perry/pkg/wallet"
+)
+
+// Stream frame types
+const (
+	frameOpen   uint8 = iota + 1 // opens a stream, the payload names the method
+	frameData                    // stream data
+	frameWindow                  // lets the sender write more bytes, a big endian uint32
+	frameClose                   // no more data from the sender
+	frameReset                   // aborts the stream, the payload is the reason
+)
+
+// Each frame starts with the stream ID, frame type and payload length
+const streamFrameHeader = 4 + 1 + 4
+
+// Largest frame payload, writes are split across frames
+const maxStreamFrame = 32 * 1024
+
+// Bytes a stream may send before the reader grants more, so a slow stream does not hold up the others
+const streamWindow = 256 * 1024
+
+// Default most streams a peer may have open in a session
+const DefaultMaxStreams = 64
+
+const streamHandshakeTimeout = 10 * time.Second
+
+var (
+	ErrStreamAuth   = errors.New("stream peer failed node key authentication")
+	ErrStreamClosed = errors.New("stream session closed")
+	ErrStreamReset  = errors.New("stream reset")
+	ErrStreamFrame  = errors.New("invalid stream frame")
+)
+
+// Streams multiplexed over one encrypted connection, with the node key of the peer proven by the handshake
+type StreamSession struct {
+	PublicKey ed25519.PublicKey
+
+	conn       net.Conn
+	send       *noiseCipher // guarded by wmu
+	recv       *noiseCipher // used by the read loop only
+	wmu        sync.Mutex
+	mu         sync.Mutex
+	streams    map[uint32]*Stream
+	nextID     uint32
+	maxStreams int
+	accept     chan *Stream
+	done       chan struct{}
+	err        error
+}
+
+// A reliable, ordered byte stream within a session. Close ends the writes, the peer reads io.EOF
+type Stream struct {
+	ID     uint32
+	Method string
+
+	session  *StreamSession
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	credit   int // bytes this side may write
+	window   int // bytes the peer may write
+	consumed int // bytes read, not yet granted back to the peer
+	rclosed  bool
+	wclosed  bool
+	err      error
+}
+
+// Run the handshake, authenticating both ends by their node keys and deriving the session keys, then
+// start reading frames. If `expected` is set the peer must hold that key. The dialing side initiates the
+// handshake, and opens streams with odd IDs, the other side even
+func NewStreamSession(conn net.Conn, signer *wallet.Wallet, expected []byte, dialer bool, maxStreams int) (session *StreamSession, err error) {
+
+	conn.SetDeadline(time.Now().Add(streamHandshakeTimeout))
+
+	peer, send, recv, err := noiseHandshake(conn, signer, dialer)
+
+	if err == nil && expected != nil && !bytes.Equal(expected, peer) {
+		err = fmt.Errorf("%w, expected another key", ErrStreamAuth)
+	}
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	session = &StreamSession{
+		PublicKey:  peer,
+		conn:       conn,
+		send:       send,
+		recv:       recv,
+		streams:    make(map[uint32]*Stream),
+		nextID:     2,
+		maxStreams: maxStreams,
+		accept:     make(chan *Stream, maxStreams),
+		done:       make(chan struct{}),
+	}
+
+	if dialer {
+		session.nextID = 1
+	}
+
+	go session.read()
+
+	return
+
+}
+
+// Open a stream to the peer for the method
+func (session *StreamSession) Open(method string) (stream *Stream, err error) {
+
+	if len(method) > maxStreamFrame {
+		return nil, fmt.Errorf("%w, method name too long", ErrStreamFrame)
+	}
+
+	session.mu.Lock()
+
+	if session.err != nil {
+		session.mu.Unlock()
+		return nil, session.err
+	}
+
+	stream = session.newStream(session.nextID, method)
+	session.nextID += 2
+
+	session.mu.Unlock()
+
+	if err = session.writeFrame(stream.ID, frameOpen, []byte(method)); err != nil {
+		session.remove(stream.ID)
+		return nil, err
+	}
+
+	return
+
+}
+
+// Wait for the peer to open a stream
+func (session *StreamSession) Accept() (*Stream, error) {
+
+	select {
+	case stream := <-session.accept:
+		return stream, nil
+	case <-session.done:
+		return nil, session.Err()
+	}
+
+}
+
+// Closed once the session has ended
+func (session *StreamSession) Done() <-chan struct{} {
+
+	return session.done
+
+}
+
+// Why the session ended, nil while open
+func (session *StreamSession) Err() error {
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return session.err
+
+}
+
+func (session *StreamSession) RemoteAddr() net.Addr {
+
+	return session.conn.RemoteAddr()
+
+}
+
+// Close the connection, streams still open fail with ErrStreamClosed
+func (session *StreamSession) Close() error {
+
+	session.fail(ErrStreamClosed)
+
+	return nil
+
+}
+
+// End the session with the error, waking the streams. The first error is kept
+func (session *StreamSession) fail(err error) {
+
+	session.mu.Lock()
+
+	if session.err != nil {
+		session.mu.Unlock()
+		return
+	}
+
+	session.err = err
+	close(session.done)
+	session.conn.Close()
+
+	streams := make([]*Stream, 0, len(session.streams))
+
+	for _, stream := range session.streams {
+		streams = append(streams, stream)
+	}
+
+	session.mu.Unlock()
+
+	for _, stream := range streams {
+		stream.mu.Lock()
+		if stream.err == nil {
+			stream.err = err
+		}
+		stream.cond.Broadcast()
+		stream.mu.Unlock()
+	}
+
+}
+
+// Register a stream, lock must be held
+func (session *StreamSession) newStream(id uint32, method string) *Stream {
+
+	stream := &Stream{ID: id, Method: method, session: session, credit: streamWindow, window: streamWindow}
+	stream.cond = sync.NewCond(&stream.mu)
+	session.streams[id] = stream
+
+	return stream
+
+}
+
+func (session *StreamSession) remove(id uint32) {
+
+	session.mu.Lock()
+	delete(session.streams, id)
+	session.mu.Unlock()
+
+}
+
+func (session *StreamSession) writeFrame(id uint32, frameType uint8, payload []byte) (err error) {
+
+	frame := make([]byte, streamFrameHeader, streamFrameHeader+len(payload))
+	binary.BigEndian.PutUint32(frame, id)
+	frame[4] = frameType
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(payload)))
+	frame = append(frame, payload...)
+
+	session.wmu.Lock()
+	defer session.wmu.Unlock()
+
+	// Each frame is sent as one encrypted record
+	record, err := session.send.seal(frame, nil)
+
+	if err == nil {
+		_, err = session.conn.Write(append([]byte{byte(len(record) >> 8), byte(len(record))}, record...))
+	}
+
+	if err != nil {
+		session.fail(err)
+	}
+
+	return
+
+}
+
+// Read frames until the connection fails, any record that fails to decrypt or invalid frame ends the session
+func (session *StreamSession) read() {
+
+	length := make([]byte, 2)
+	record := make([]byte, maxNoiseRecord)
+
+	for {
+
+		if _, err := io.ReadFull(session.conn, length); err != nil {
+			session.fail(err)
+			return
+		}
+
+		n := int(binary.BigEndian.Uint16(length))
+
+		if _, err := io.ReadFull(session.conn, record[:n]); err != nil {
+			session.fail(err)
+			return
+		}
+
+		frame, err := session.recv.open(record[:n], nil)
+
+		if err != nil {
+			session.fail(fmt.Errorf("%w, record failed to decrypt", ErrStreamFrame))
+			return
+		}
+
+		if len(frame) < streamFrameHeader || int(binary.BigEndian.Uint32(frame[5:])) != len(frame)-streamFrameHeader {
+			session.fail(fmt.Errorf("%w, length mismatch", ErrStreamFrame))
+			return
+		}
+
+		if len(frame)-streamFrameHeader > maxStreamFrame {
+			session.fail(fmt.Errorf("%w, (%d) bytes", ErrStreamFrame, len(frame)-streamFrameHeader))
+			return
+		}
+
+		if err := session.handle(binary.BigEndian.Uint32(frame), frame[4], frame[streamFrameHeader:]); err != nil {
+			session.fail(err)
+			return
+		}
+
+	}
+
+}
+
+func (session *StreamSession) handle(id uint32, frameType uint8, payload []byte) error {
+
+	session.mu.Lock()
+	stream, ok := session.streams[id]
+
+	if frameType == frameOpen {
+
+		// Peers open streams with the other parity
+		if ok || id%2 == session.nextID%2 {
+			session.mu.Unlock()
+			return fmt.Errorf("%w, stream %d opened twice", ErrStreamFrame, id)
+		}
+
+		if len(session.accept) >= cap(session.accept) || len(session.streams) >= 2*session.maxStreams {
+			session.mu.Unlock()
+			return session.writeFrame(id, frameReset, []byte("too many streams"))
+		}
+
+		session.accept <- session.newStream(id, string(payload))
+		session.mu.Unlock()
+
+		return nil
+
+	}
+
+	session.mu.Unlock()
+
+	// Frames for streams reset or done locally are dropped
+	if !ok {
+		return nil
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	switch frameType {
+
+	case frameData:
+
+		if len(payload) > stream.window {
+			return fmt.Errorf("%w, stream %d exceeded its window", ErrStreamFrame, id)
+		}
+
+		stream.window -= len(payload)
+		stream.buf.Write(payload)
+
+	case frameWindow:
+
+		if len(payload) != 4 {
+			return fmt.Errorf("%w, window update", ErrStreamFrame)
+		}
+
+		stream.credit += int(binary.BigEndian.Uint32(payload))
+
+	case frameClose:
+
+		stream.rclosed = true
+
+		if stream.wclosed {
+			session.remove(id)
+		}
+
+	case frameReset:
+		stream.err = fmt.Errorf("%w: %s", ErrStreamReset, payload)
+		session.remove(id)
+
+	default:
+		return fmt.Errorf("%w, type %d", ErrStreamFrame, frameType)
+
+	}
+
+	stream.cond.Broadcast()
+
+	return nil
+
+}
+
+func (stream *Stream) Read(p []byte) (n int, err error) {
+
+	stream.mu.Lock()
+
+	for stream.buf.Len() == 0 && !stream.rclosed && stream.err == nil {
+		stream.cond.Wait()
+	}
+
+	if stream.buf.Len() == 0 {
+
+		// Data the peer finished sending is read to the end, even if the session ends after
+		err = stream.err
+
+		if err == nil || stream.rclosed {
+			err = io.EOF
+		}
+
+		stream.mu.Unlock()
+
+		return
+
+	}
+
+	n, _ = stream.buf.Read(p)
+	stream.consumed += n
+
+	// Grant the bytes read back to the peer, in batches
+	var grant int
+
+	if stream.consumed >= streamWindow/2 {
+		grant = stream.consumed
+		stream.consumed = 0
+		stream.window += grant
+	}
+
+	stream.mu.Unlock()
+
+	if grant > 0 {
+		update := make([]byte, 4)
+		binary.BigEndian.PutUint32(update, uint32(grant))
+		stream.session.writeFrame(stream.ID, frameWindow, update)
+	}
+
+	return
+
+}
+
+func (stream *Stream) Write(p []byte) (n int, err error) {
+
+	for n < len(p) {
+
+		stream.mu.Lock()
+
+		for stream.credit == 0 && stream.err == nil && !stream.wclosed {
+			stream.cond.Wait()
+		}
+
+		if stream.err != nil || stream.wclosed {
+
+			err = stream.err
+
+			if err == nil {
+				err = io.ErrClosedPipe
+			}
+
+			stream.mu.Unlock()
+
+			return
+
+		}
+
+		size := len(p) - n
+
+		if size > stream.credit {
+			size = stream.credit
+		}
+
+		if size > maxStreamFrame {
+			size = maxStreamFrame
+		}
+
+		stream.credit -= size
+		stream.mu.Unlock()
+
+		if err = stream.session.writeFrame(stream.ID, frameData, p[n:n+size]); err != nil {
+			return
+		}
+
+		n += size
+
+	}
+
+	return
+
+}
+
+// End the writes, the peer reads io.EOF once it has read the data sent
+func (stream *Stream) Close() error {
+
+	stream.mu.Lock()
+
+	if stream.wclosed {
+		stream.mu.Unlock()
+		return nil
+	}
+
+	stream.wclosed = true
+	done := stream.rclosed || stream.err != nil
+
+	stream.cond.Broadcast()
+	stream.mu.Unlock()
+
+	if done {
+		stream.session.remove(stream.ID)
+	}
+
+	return stream.session.writeFrame(stream.ID, frameClose, nil)
+
+}
+
+// Abort the stream in both directions, the peer fails with ErrStreamReset and the reason
+func (stream *Stream) Reset(reason string) error {
+
+	stream.mu.Lock()
+
+	if stream.err == nil {
+		stream.err = fmt.Errorf("%w: %s", ErrStreamReset, reason)
+	}
+
+	stream.cond.Broadcast()
+	stream.mu.Unlock()
+
+	stream.session.remove(stream.ID)
+
+	if len(reason) > maxStreamFrame {
+		reason = reason[:maxStreamFrame]
+	}
+
+	return stream.session.writeFrame(stream.ID, frameReset, []byte(reason))
+
+}
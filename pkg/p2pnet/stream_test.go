@@ -0,0 +1,262 @@
+package p2pnet_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func newWallet(t *testing.T) *wallet.Wallet {
+
+	w := wallet.New()
+	assert.Nil(t, w.GenerateWallet())
+
+	return &w
+
+}
+
+// A session over a loopback connection, dialed by `dialer` expecting `expected`. The accepted session
+// is nil if the handshake failed on that side
+func streamPair(t *testing.T, dialer, listener *wallet.Wallet, expected []byte) (client, server *p2pnet.StreamSession, err error) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	accepted := make(chan *p2pnet.StreamSession, 1)
+
+	go func() {
+
+		conn, err := l.Accept()
+
+		if err != nil {
+			accepted <- nil
+			return
+		}
+
+		session, _ := p2pnet.NewStreamSession(conn, listener, nil, false, p2pnet.DefaultMaxStreams)
+		accepted <- session
+
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+
+	client, err = p2pnet.NewStreamSession(conn, dialer, expected, true, p2pnet.DefaultMaxStreams)
+	server = <-accepted
+
+	t.Cleanup(func() {
+		if client != nil {
+			client.Close()
+		}
+		if server != nil {
+			server.Close()
+		}
+	})
+
+	return
+
+}
+
+func TestStreamAuth(t *testing.T) {
+
+	a, b := newWallet(t), newWallet(t)
+
+	client, server, err := streamPair(t, a, b, b.PublicKey)
+	assert.Nil(t, err)
+
+	// Each side holds the key the other proved
+	assert.Equal(t, b.PublicKey, client.PublicKey)
+	assert.Equal(t, a.PublicKey, server.PublicKey)
+
+	// A node holding another key is rejected
+	_, _, err = streamPair(t, a, b, newWallet(t).PublicKey)
+	assert.True(t, errors.Is(err, p2pnet.ErrStreamAuth))
+
+}
+
+func TestStreamMultiplex(t *testing.T) {
+
+	client, server, err := streamPair(t, newWallet(t), newWallet(t), nil)
+	assert.Nil(t, err)
+
+	// The server echoes the streams back
+	go func() {
+		for i := 0; i < 8; i++ {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.Close()
+			}()
+		}
+	}()
+
+	// Streams larger than the window run at once, each flow controlled on its own
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+
+		data := make([]byte, 1024*1024+i)
+		rand.Read(data)
+
+		stream, err := client.Open("echo")
+		assert.Nil(t, err)
+		assert.Equal(t, "echo", stream.Method)
+
+		wg.Add(1)
+
+		go func() {
+
+			defer wg.Done()
+
+			go func() {
+				stream.Write(data)
+				stream.Close()
+			}()
+
+			echoed, err := io.ReadAll(stream)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(data, echoed))
+
+		}()
+
+	}
+
+	wg.Wait()
+
+	// A reset stream fails on the other side with the reason
+	stream, err := client.Open("reset")
+	assert.Nil(t, err)
+
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+	assert.Nil(t, accepted.Reset("not served"))
+
+	_, err = stream.Read(make([]byte, 1))
+	assert.True(t, errors.Is(err, p2pnet.ErrStreamReset))
+
+	// Closing the session ends the streams still open
+	stream, err = client.Open("echo")
+	assert.Nil(t, err)
+
+	server.Close()
+
+	<-client.Done()
+	_, err = stream.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	_, err = client.Open("echo")
+	assert.NotNil(t, err)
+
+}
+
+// Records the bytes written to the connection
+type recordConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+
+	return c.Conn.Write(b)
+
+}
+
+func TestStreamEncrypted(t *testing.T) {
+
+	a, b := newWallet(t), newWallet(t)
+
+	c1, c2 := net.Pipe()
+	recorded := &recordConn{Conn: c1}
+
+	accepted := make(chan *p2pnet.StreamSession, 1)
+
+	go func() {
+		session, _ := p2pnet.NewStreamSession(c2, b, nil, false, p2pnet.DefaultMaxStreams)
+		accepted <- session
+	}()
+
+	client, err := p2pnet.NewStreamSession(recorded, a, b.PublicKey, true, p2pnet.DefaultMaxStreams)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	server := <-accepted
+	assert.NotNil(t, server)
+	defer server.Close()
+
+	data := bytes.Repeat([]byte("plaintext marker "), 100)
+
+	stream, err := client.Open("secret-method")
+	assert.Nil(t, err)
+
+	go func() {
+		stream.Write(data)
+		stream.Close()
+	}()
+
+	received, err := server.Accept()
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-method", received.Method)
+
+	read, err := io.ReadAll(received)
+	assert.Nil(t, err)
+	assert.Equal(t, data, read)
+
+	// Neither the data, the method nor the node key of the dialer is sent in the clear
+	recorded.mu.Lock()
+	written := recorded.written.Bytes()
+	recorded.mu.Unlock()
+
+	assert.False(t, bytes.Contains(written, []byte("plaintext marker")))
+	assert.False(t, bytes.Contains(written, []byte("secret-method")))
+	assert.False(t, bytes.Contains(written, a.PublicKey))
+
+}
+
+func TestStreamHandshakeRejected(t *testing.T) {
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	result := make(chan error, 1)
+
+	go func() {
+		_, err := p2pnet.NewStreamSession(c2, newWallet(t), nil, false, p2pnet.DefaultMaxStreams)
+		result <- err
+	}()
+
+	// A peer without the keys it claims can't complete the handshake
+	ephemeral := make([]byte, 32)
+	rand.Read(ephemeral)
+
+	_, err := c1.Write(ephemeral)
+	assert.Nil(t, err)
+
+	_, err = io.ReadFull(c1, make([]byte, 160))
+	assert.Nil(t, err)
+
+	forged := make([]byte, 128)
+	rand.Read(forged)
+
+	_, err = c1.Write(forged)
+	assert.Nil(t, err)
+
+	assert.True(t, errors.Is(<-result, p2pnet.ErrStreamAuth))
+
+}
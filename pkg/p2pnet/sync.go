@@ -0,0 +1,485 @@
+package p2pnet
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/perrychain/perry/pkg/blockdb"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default size of the pages requested from peers, and the most served in one page
+const (
+	DefaultSyncPageBlocks = 500
+	MaxSyncPageBlocks     = 5000
+	DefaultSyncPageBytes  = 4 * 1024 * 1024
+	MaxSyncPageBytes      = 16 * 1024 * 1024
+)
+
+// Default most peers fetched from at once when far behind
+const DefaultSyncPeers = 4
+
+// Pages behind the peer before fetching from several peers at once
+const parallelSyncPages = 2
+
+// Attempts to fetch a page before waiting for the next sync, the delay doubles after each
+const syncRetries = 3
+const syncRetryDelay = 200 * time.Millisecond
+
+var ErrSyncNotFound = errors.New("block not in the chain, find the common ancestor")
+
+// Sync the blocks following the local head from the peer up to its `height`, page by page. When far
+// behind, pages are fetched from several peers at once first
+func (p2p *P2P) stateSync(hostname string, height uint64) {
+
+	start := time.Now()
+	head := p2p.POH.BlockDB.GetLatestIndex()
+
+	var appended int
+
+	// Blocks the peer has pruned are synced from an archive node first, so their TX data is kept
+	if archive, ok := p2p.archivePeer(hostname, head.Header.SeqID); ok {
+		appended += p2p.pagedSync(archive)
+		head = p2p.POH.BlockDB.GetLatestIndex()
+	}
+
+	if height > head.Header.SeqID+uint64(parallelSyncPages*p2p.SyncPageBlocks) {
+		appended += p2p.parallelSync(p2p.syncPeers(hostname, height), height)
+	}
+
+	appended += p2p.pagedSync(hostname)
+
+	elapsed := time.Since(start)
+
+	log.Info(fmt.Sprintf("Sync Blocks done in %s, (%d) appended, %.0f per sec\n", elapsed, appended, float64(appended)/elapsed.Seconds()))
+
+}
+
+// Fetch pages following the local head from the peer until its latest block, or the first invalid block.
+// Failed requests are retried from the local head, so the sync resumes where it stopped
+func (p2p *P2P) pagedSync(hostname string) (appended int) {
+
+	for attempt := 0; ; {
+
+		head := p2p.POH.BlockDB.GetLatestIndex()
+
+		page, err := p2p.fetchPage(hostname, SyncRequest{From: head.Key[:]})
+
+		if err != nil {
+
+			attempt++
+
+			if errors.Is(err, ErrSyncData) || attempt >= syncRetries {
+				log.Warn(fmt.Sprintf("Sync from %s => %s", hostname, err))
+				return
+			}
+
+			log.Debug(fmt.Sprintf("Sync from %s => %s, retrying", hostname, err))
+			time.Sleep(syncRetryDelay << (attempt - 1))
+
+			continue
+
+		}
+
+		attempt = 0
+
+		n := p2p.appendSynced(hostname, page.Blocks)
+		appended += n
+
+		if n == 0 || n < len(page.Blocks) || len(page.Next) == 0 {
+			return
+		}
+
+	}
+
+}
+
+// Fetch consecutive pages by height from several peers at once, a page from each peer per round, and
+// append them in order. Stops at the first page that fails, the rest is synced from the local head
+func (p2p *P2P) parallelSync(hostnames []string, height uint64) (appended int) {
+
+	limit := uint64(p2p.SyncPageBlocks)
+
+	for {
+
+		from := p2p.POH.BlockDB.GetLatestIndex().Header.SeqID + 1
+
+		// The last partial page is left to the paged sync
+		pages := int((height - from + 1) / limit)
+
+		if height < from || pages == 0 {
+			return
+		}
+
+		if pages > len(hostnames) {
+			pages = len(hostnames)
+		}
+
+		results := make([]blockdb.SyncBlocks, pages)
+		errs := make([]error, pages)
+
+		var wg sync.WaitGroup
+
+		for i := 0; i < pages; i++ {
+
+			wg.Add(1)
+
+			go func(i int) {
+
+				defer wg.Done()
+
+				height := from + uint64(i)*limit
+				results[i], errs[i] = p2p.fetchPage(hostnames[i], SyncRequest{Height: &height})
+
+			}(i)
+
+		}
+
+		wg.Wait()
+
+		for i := 0; i < pages; i++ {
+
+			if errs[i] != nil {
+				log.Warn(fmt.Sprintf("Sync from %s => %s", hostnames[i], errs[i]))
+				return
+			}
+
+			n := p2p.appendSynced(hostnames[i], results[i].Blocks)
+			appended += n
+
+			if n == 0 {
+				return
+			}
+
+			// Pages cut short by the byte limit leave a gap, the next round starts from the local head
+			if uint64(n) < limit {
+				break
+			}
+
+		}
+
+	}
+
+}
+
+// The peer followed by up to SyncPeers-1 other peers at the same height or higher, to sync from at once
+func (p2p *P2P) syncPeers(hostname string, height uint64) (hostnames []string) {
+
+	hostnames = append(hostnames, hostname)
+
+	myNode := fmt.Sprintf("%s:%d", p2p.RPC_Node.Host, p2p.RPC_Node.Port)
+
+	var others []string
+
+	for host, node := range p2p.peers.RPCPeers() {
+
+		if host == hostname || host == myNode || node.SyncHeight < height || p2p.reputation.Banned(sourceHost(host)) {
+			continue
+		}
+
+		others = append(others, host)
+
+	}
+
+	sort.Strings(others)
+
+	for _, host := range others {
+
+		if len(hostnames) >= p2p.SyncPeers {
+			break
+		}
+
+		hostnames = append(hostnames, host)
+
+	}
+
+	return
+
+}
+
+// An archive peer to sync from if the peer has pruned blocks above the local head `seqID`
+func (p2p *P2P) archivePeer(hostname string, seqID uint64) (string, bool) {
+
+	if p2p.peers.RPCPeers()[hostname].PrunedHeight <= seqID {
+		return "", false
+	}
+
+	myNode := fmt.Sprintf("%s:%d", p2p.RPC_Node.Host, p2p.RPC_Node.Port)
+
+	archives := p2p.ArchivePeers()
+	sort.Strings(archives)
+
+	for _, host := range archives {
+		if host != hostname && host != myNode && !p2p.reputation.Banned(sourceHost(host)) {
+			return host, true
+		}
+	}
+
+	return "", false
+
+}
+
+// Fetch a page of blocks from the RPC peer, over a stream if it is a verified peer and over HTTP otherwise.
+// Invalid sync data is penalised
+func (p2p *P2P) fetchPage(hostname string, req SyncRequest) (page blockdb.SyncBlocks, err error) {
+
+	req.Limit, req.MaxBytes = p2p.SyncPageBlocks, p2p.SyncPageBytes
+
+	session, err := p2p.rpcSession(hostname)
+
+	if err != nil {
+		return
+	} else if session != nil {
+		return p2p.fetchStreamPage(hostname, session, req)
+	}
+
+	params := url.Values{"limit": {strconv.Itoa(req.Limit)}, "max_bytes": {strconv.Itoa(req.MaxBytes)}}
+
+	if req.Height != nil {
+		params.Set("height", strconv.FormatUint(*req.Height, 10))
+	} else {
+		params.Set("from", base64.StdEncoding.EncodeToString(req.From))
+	}
+
+	// TODO: Pass correct JSON RPC, not GET
+	resp, err := http.Get(fmt.Sprintf("http://%s/p2p/sync?%s", hostname, params.Encode()))
+
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	log.Debug("Response status:", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
+		return page, fmt.Errorf("sync request failed, %s", resp.Status)
+	}
+
+	return p2p.decodePage(hostname, resp.Body)
+
+}
+
+// Decode a page of blocks from the peer, invalid pages are penalised
+func (p2p *P2P) decodePage(hostname string, r io.Reader) (page blockdb.SyncBlocks, err error) {
+
+	// Pages are bounded by the limits requested, allowing for one oversized block and the encoding
+	body := io.LimitReader(r, int64(2*p2p.SyncPageBytes+blockdb.DefaultMaxBlockSize))
+
+	if err = json.NewDecoder(body).Decode(&page); err == nil && len(page.Blocks) > p2p.SyncPageBlocks {
+		err = fmt.Errorf("page of (%d) blocks, more than the limit", len(page.Blocks))
+	}
+
+	if err != nil {
+		p2p.reputation.Penalize(sourceHost(hostname), PenaltySyncData, "invalid sync data")
+		return page, fmt.Errorf("%w: %s", ErrSyncData, err)
+	}
+
+	return
+
+}
+
+// Append the blocks synced from the peer to the local chain, up to the first invalid block. Blocks
+// must be valid on their own and follow the local head, invalid blocks are penalised against the peer
+func (p2p *P2P) appendSynced(hostname string, blocks []blockdb.BlockKV) (appended int) {
+
+	valid := p2p.verifySynced(hostname, blocks)
+
+	for ; appended < valid; appended++ {
+
+		block := &blocks[appended]
+
+		if err := p2p.POH.BlockDB.AppendBlock(block); err != nil {
+
+			switch {
+
+			// The peer is on another chain, or a block was appended locally meanwhile
+			case errors.Is(err, blockdb.ErrParentMismatch), errors.Is(err, blockdb.ErrSeqIDMismatch):
+				log.Info(fmt.Sprintf("Block SeqID %d from %s does not follow the local head, stopping sync", block.Value.Header.SeqID, hostname))
+
+			// Reject oversized blocks, stop syncing from this peer
+			case errors.Is(err, blockdb.ErrBlockTooLarge), errors.Is(err, blockdb.ErrBlockTooManyTx):
+				log.Warn(fmt.Sprintf("Rejecting block SeqID %d from %s => %s", block.Value.Header.SeqID, hostname, err))
+				p2p.reputation.Penalize(sourceHost(hostname), PenaltySyncData, "invalid sync block")
+
+			default:
+				log.Warn(fmt.Sprintf("Error appending block SeqID %d => %s", block.Value.Header.SeqID, err))
+
+			}
+
+			break
+
+		}
+
+		// TX's in synced blocks can't be included again by this node
+		p2p.POH.RecordReplays(block.Value.Payload)
+
+	}
+
+	return
+
+}
+
+// Number of leading blocks synced from the peer that are valid. Hashes, links and TX signatures are
+// checked in parallel before any block is applied, the first invalid block is penalised
+func (p2p *P2P) verifySynced(hostname string, blocks []blockdb.BlockKV) (valid int) {
+
+	err := blockdb.VerifyBlocks(blocks, runtime.NumCPU())
+
+	if err == nil {
+		return len(blocks)
+	}
+
+	var verr *blockdb.VerifyError
+
+	if errors.As(err, &verr) {
+		valid = verr.Index
+	}
+
+	log.Warn(fmt.Sprintf("Invalid sync block from %s => %s", hostname, err))
+	p2p.reputation.Penalize(sourceHost(hostname), PenaltySyncData, "invalid sync block")
+
+	return
+
+}
+
+// A request for a page of blocks following the `From` hash, or from the SeqID `Height`. Zero limits use the defaults
+type SyncRequest struct {
+	From     []byte  `json:"from,omitempty"`
+	Height   *uint64 `json:"height,omitempty"`
+	Limit    int     `json:"limit,omitempty"`
+	MaxBytes int     `json:"max_bytes,omitempty"`
+}
+
+// JSON RPC method, return a page of blocks following the `from` hash, or from the SeqID `height`.
+// Pages hold up to `limit` blocks and `max_bytes`, pass `next` as `from` for the following page
+func (p2p *P2P) Sync(c *gin.Context) {
+
+	var req SyncRequest
+
+	if height, ok := c.GetQuery("height"); ok {
+
+		seqID, err := strconv.ParseUint(height, 10, 64)
+
+		if err != nil {
+			c.JSON(400, gin.H{"status": "fail", "error": "height must be a SeqID"})
+			return
+		}
+
+		req.Height = &seqID
+
+	} else {
+		req.From, _ = base64.StdEncoding.DecodeString(c.Query("from"))
+
+	}
+
+	var err error
+
+	if req.Limit, err = pageLimit(c, "limit"); err == nil {
+		req.MaxBytes, err = pageLimit(c, "max_bytes")
+	}
+
+	if err != nil {
+		c.JSON(400, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
+
+	page, err := p2p.SyncPage(req)
+
+	switch {
+
+	case errors.Is(err, ErrSyncNotFound):
+		c.JSON(404, gin.H{"status": "fail", "error": err.Error()})
+
+	case err != nil:
+		c.JSON(400, gin.H{"status": "fail", "error": err.Error()})
+
+	default:
+		c.JSON(200, page)
+
+	}
+
+}
+
+// The page of blocks for the request, served over HTTP and streams
+func (p2p *P2P) SyncPage(req SyncRequest) (page blockdb.SyncBlocks, err error) {
+
+	if req.Limit < 0 || req.MaxBytes < 0 {
+		return page, errors.New("limits must be positive")
+	}
+
+	limit, maxBytes := req.Limit, req.MaxBytes
+
+	if limit == 0 {
+		limit = DefaultSyncPageBlocks
+	} else if limit > MaxSyncPageBlocks {
+		limit = MaxSyncPageBlocks
+	}
+
+	if maxBytes == 0 {
+		maxBytes = DefaultSyncPageBytes
+	} else if maxBytes > MaxSyncPageBytes {
+		maxBytes = MaxSyncPageBytes
+	}
+
+	var id int
+
+	if req.Height != nil {
+		id = p2p.POH.BlockDB.SyncHeight(*req.Height)
+
+	} else {
+
+		var ok bool
+
+		if id, ok = p2p.POH.BlockDB.Sync(req.From); !ok {
+			return page, ErrSyncNotFound
+		}
+
+	}
+
+	head := p2p.POH.BlockDB.GetLatestIndex()
+
+	blocks, err := p2p.POH.BlockDB.SyncPage(id, limit, maxBytes)
+
+	if err != nil {
+		log.Warn("Sync => ", err)
+		return
+	}
+
+	page = blockdb.SyncBlocks{PublicKey: p2p.POH.Wallet.PublicKey, Blocks: blocks, Height: head.Header.SeqID}
+
+	if n := len(blocks); n > 0 && blocks[n-1].Key != head.Key {
+		page.Next = append([]byte{}, blocks[n-1].Key[:]...)
+	}
+
+	return
+
+}
+
+// Positive integer query parameter, zero if missing
+func pageLimit(c *gin.Context, key string) (n int, err error) {
+
+	value, ok := c.GetQuery(key)
+
+	if !ok {
+		return 0, nil
+	}
+
+	if n, err = strconv.Atoi(value); err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer", key)
+	}
+
+	return
+
+}
@@ -0,0 +1,292 @@
+package p2pnet_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/perrychain/perry/pkg/blockdb"
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// Count the sync requests, failing those for which `fail` returns true
+func syncRequests(count *int32, fail func(n int32) bool) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		if c.Request.URL.Path != "/p2p/sync" {
+			return
+		}
+
+		if n := atomic.AddInt32(count, 1); fail(n) {
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+		}
+
+	}
+
+}
+
+// Query for the page following the hash
+func fromQuery(hash []byte) string {
+
+	return url.Values{"from": {base64.StdEncoding.EncodeToString(hash)}}.Encode()
+
+}
+
+// Request a sync page from the node
+func syncPage(t *testing.T, node *p2pnet.P2P, query string) (page blockdb.SyncBlocks, code int) {
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/p2p/sync", node.Sync)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/p2p/sync?"+query, nil))
+
+	if w.Code == http.StatusOK {
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &page))
+	}
+
+	return page, w.Code
+
+}
+
+func TestSyncPage(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	node, _ := newNode(t, nodeOptions{})
+	blocks := appendSigned(t, &node.POH.BlockDB, &signer, 10)
+
+	// Pages carry the cursor of the next page
+	page, code := syncPage(t, node, fromQuery(make([]byte, 32))+"&limit=4")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, page.Blocks, 4)
+	assert.Equal(t, blocks[3].Key[:], page.Next)
+	assert.Equal(t, uint64(10), page.Height)
+
+	page, _ = syncPage(t, node, fromQuery(page.Next)+"&limit=4")
+	assert.Equal(t, blocks[4].Key, page.Blocks[0].Key)
+
+	// The last page has no cursor
+	page, _ = syncPage(t, node, "height=9&limit=4")
+	assert.Len(t, page.Blocks, 2)
+	assert.Equal(t, blocks[8].Key, page.Blocks[0].Key)
+	assert.Empty(t, page.Next)
+
+	// Byte limits end the page early, after at least one block
+	page, _ = syncPage(t, node, "height=1&max_bytes=1")
+	assert.Len(t, page.Blocks, 1)
+	assert.Equal(t, blocks[0].Key[:], page.Next)
+
+	// Unknown hashes need the common ancestor first
+	_, code = syncPage(t, node, fromQuery(make([]byte, 31)))
+	assert.Equal(t, http.StatusNotFound, code)
+
+	_, code = syncPage(t, node, "height=1&limit=0")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+}
+
+func TestSyncPagedResume(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	// Every third sync request fails
+	var requests int32
+	b, addrB := newNode(t, nodeOptions{middleware: []gin.HandlerFunc{syncRequests(&requests, func(n int32) bool { return n%3 == 0 })}})
+	a, _ := newNode(t, nodeOptions{config: p2pnet.P2P{SyncPageBlocks: 4}})
+
+	appendSigned(t, &b.POH.BlockDB, &signer, 25)
+
+	a.SyncPeer(addrB)
+
+	assert.Equal(t, 25, a.POH.BlockDB.Len())
+	assert.Equal(t, b.POH.BlockDB.GetLatestIndex().Key, a.POH.BlockDB.GetLatestIndex().Key)
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&requests), int32(10))
+	assert.Nil(t, a.POH.BlockDB.Verify())
+
+}
+
+func TestSyncParallel(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	var requestsB, requestsC int32
+	var down int32 = 1
+
+	b, addrB := newNode(t, nodeOptions{middleware: []gin.HandlerFunc{syncRequests(&requestsB, func(int32) bool { return false })}})
+	c, addrC := newNode(t, nodeOptions{middleware: []gin.HandlerFunc{syncRequests(&requestsC, func(int32) bool { return atomic.LoadInt32(&down) == 1 })}})
+
+	for _, block := range appendSigned(t, &b.POH.BlockDB, &signer, 40) {
+		assert.Nil(t, c.POH.BlockDB.AppendBlock(&block))
+	}
+
+	a, _ := newNode(t, nodeOptions{config: p2pnet.P2P{SyncPageBlocks: 4, BootstrapPeers: []string{addrC}}})
+
+	// The height of C is known, syncing from it fails
+	a.SyncPeer(addrC)
+	assert.Equal(t, 0, a.POH.BlockDB.Len())
+
+	atomic.StoreInt32(&down, 0)
+	atomic.StoreInt32(&requestsC, 0)
+
+	// Far behind B, pages are fetched from B and C at once
+	a.SyncPeer(addrB)
+
+	assert.Equal(t, 40, a.POH.BlockDB.Len())
+	assert.Equal(t, b.POH.BlockDB.GetLatestIndex().Key, a.POH.BlockDB.GetLatestIndex().Key)
+	assert.Greater(t, atomic.LoadInt32(&requestsB), int32(0))
+	assert.Greater(t, atomic.LoadInt32(&requestsC), int32(0))
+	assert.Nil(t, a.POH.BlockDB.Verify())
+
+}
+
+// Blocks a peer has pruned are synced from an archive peer, with their TX data
+func TestSyncArchive(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	b, addrB := newNode(t, nodeOptions{})
+	c, addrC := newNode(t, nodeOptions{})
+	a, _ := newNode(t, nodeOptions{config: p2pnet.P2P{BootstrapPeers: []string{addrB, addrC}}})
+
+	c.POH.BlockDB.Retention.Archive = true
+
+	appendBoth := func(n int) {
+		for _, block := range appendSigned(t, &b.POH.BlockDB, &signer, n) {
+			assert.Nil(t, c.POH.BlockDB.AppendBlock(&block))
+		}
+	}
+
+	// C is known as an archive node
+	appendBoth(3)
+	a.SyncPeer(addrC)
+	assert.Equal(t, 3, a.POH.BlockDB.Len())
+
+	appendBoth(10)
+
+	_, err := b.POH.BlockDB.Prune(blockdb.RetentionPolicy{KeepBlocks: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(11), b.POH.BlockDB.PrunedHeight())
+
+	a.SyncPeer(addrB)
+
+	assert.Equal(t, 13, a.POH.BlockDB.Len())
+	assert.Equal(t, b.POH.BlockDB.GetLatestIndex().Key, a.POH.BlockDB.GetLatestIndex().Key)
+	assert.Nil(t, a.POH.BlockDB.Verify())
+
+	for i := 0; i < a.POH.BlockDB.Len(); i++ {
+		block, err := a.POH.BlockDB.Get(i)
+		assert.Nil(t, err)
+		assert.False(t, block.Value.Payload[0].Pruned)
+	}
+
+}
+
+// A block of unsigned TX's as chains wrote them before TX's were signed, committing to the encoded
+// payload without a TX root
+func legacyBlock(t *testing.T, head blockdb.BlockIndex, sender []byte) blockdb.BlockKV {
+
+	payload := []blockdb.TxPayload{{Sender: sender, Data: []byte(fmt.Sprintf("pushed %d", time.Now().UnixNano()))}}
+
+	data, err := json.Marshal(payload)
+	assert.Nil(t, err)
+
+	return blockdb.BlockKV{
+		Key: sha256.Sum256(append(head.Key[:], data...)),
+		Value: blockdb.Block{
+			Header:  blockdb.BlockHeader{Parent: head.Key, SeqID: head.Header.SeqID + 1, SeqTime: time.Now()},
+			Payload: payload,
+		},
+	}
+
+}
+
+func TestSyncLegacy(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	b, addrB := newNode(t, nodeOptions{})
+	a, _ := newNode(t, nodeOptions{})
+
+	// Unsigned TX's of a chain from before TX's were signed, followed by signed TX's
+	for _, sender := range [][]byte{[]byte("alice"), nil} {
+		block := legacyBlock(t, b.POH.BlockDB.GetLatestIndex(), sender)
+		assert.Nil(t, b.POH.BlockDB.AppendBlock(&block))
+	}
+
+	appendSigned(t, &b.POH.BlockDB, &signer, 2)
+
+	a.SyncPeer(addrB)
+
+	assert.Equal(t, 4, a.POH.BlockDB.Len())
+	assert.Equal(t, b.POH.BlockDB.GetLatestIndex().Key, a.POH.BlockDB.GetLatestIndex().Key)
+	assert.Nil(t, a.POH.BlockDB.Verify())
+
+	// Blocks without a TX root can't follow a block with one
+	legacy := legacyBlock(t, b.POH.BlockDB.GetLatestIndex(), []byte("alice"))
+	assert.ErrorIs(t, b.POH.BlockDB.AppendBlock(&legacy), blockdb.ErrLegacyBlock)
+
+	// Signed TX's must still match the signature
+	block := signedBlock(t, &signer, b.POH.BlockDB.GetLatestIndex())
+	block.Value.Payload[0].Signature[0] ^= 0xff
+
+	root, err := blockdb.TxRoot(block.Value.Payload)
+	assert.Nil(t, err)
+
+	block.Value.Header.TxRoot = &root
+	block.Key = blockdb.BlockHash(block.Value.Header)
+
+	assert.NotNil(t, blockdb.VerifyBlocks([]blockdb.BlockKV{block}, 1))
+
+}
+
+// TX's in new blocks must be signed, a peer can't strip the signature or forge a TX under any sender
+func TestSyncUnsignedForged(t *testing.T) {
+
+	signer := wallet.New()
+	assert.Nil(t, signer.GenerateWallet())
+
+	b, addrB := newNode(t, nodeOptions{})
+	a, _ := newNode(t, nodeOptions{})
+
+	appendSigned(t, &b.POH.BlockDB, &signer, 2)
+
+	forged := signedBlock(t, &signer, b.POH.BlockDB.GetLatestIndex())
+	forged.Value.Payload[0].Signature = nil
+	forged.Value.Payload[0].Data = []byte("forged")
+
+	root, err := blockdb.TxRoot(forged.Value.Payload)
+	assert.Nil(t, err)
+
+	forged.Value.Header.TxRoot = &root
+	forged.Key = blockdb.BlockHash(forged.Value.Header)
+
+	assert.ErrorIs(t, blockdb.VerifyBlocks([]blockdb.BlockKV{forged}, 1), blockdb.ErrTxSignature)
+
+	// The synced page stops before the forged block
+	assert.Nil(t, b.POH.BlockDB.AppendBlock(&forged))
+	appendSigned(t, &b.POH.BlockDB, &signer, 1)
+
+	a.SyncPeer(addrB)
+
+	assert.Equal(t, 2, a.POH.BlockDB.Len())
+	assert.Nil(t, a.POH.BlockDB.Verify())
+
+}
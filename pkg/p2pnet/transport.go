@@ -0,0 +1,230 @@
+package p2pnet
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Largest datagram read from the socket
+const maxDatagramSize = 8192
+
+var (
+	ErrNotListening = errors.New("not listening for P2P traffic")
+	ErrNotUDP       = errors.New("the transport is not UDP")
+)
+
+// Sends and receives the datagrams of a node. UDP is the default, MemNetwork connects nodes within one process
+type Transport interface {
+	// Send a datagram to the node at host:port, within the timeout
+	Send(addr string, b []byte, timeout time.Duration) error
+
+	// Pass each datagram received to the handler, with the address to reply to, until closed
+	Receive(h func(*net.UDPAddr, int, []byte)) error
+
+	// The address datagrams are received on, nil if not listening
+	LocalAddr() net.Addr
+
+	Close() error
+}
+
+// The default transport. Once bound, datagrams are sent from the listening socket so replies reach it.
+// Otherwise each peer has its own socket, reused across sends, with replies passed to the handler
+type UDPTransport struct {
+	mu       sync.Mutex
+	conns    map[string]*net.UDPConn
+	listener *net.UDPConn
+	replies  func(*net.UDPAddr, int, []byte)
+}
+
+// A UDP transport passing replies to datagrams sent before it is bound to `replies`, if set
+func NewUDPTransport(replies func(*net.UDPAddr, int, []byte)) *UDPTransport {
+
+	return &UDPTransport{conns: make(map[string]*net.UDPConn), replies: replies}
+
+}
+
+// Receive datagrams on the socket, and send from it
+func (t *UDPTransport) Bind(l *net.UDPConn) {
+
+	// Queue bursts of fragments, the OS may cap the size
+	l.SetReadBuffer(socketReadBuffer)
+
+	t.mu.Lock()
+	t.listener = l
+	t.mu.Unlock()
+
+}
+
+func (t *UDPTransport) Send(addr string, b []byte, timeout time.Duration) (err error) {
+
+	t.mu.Lock()
+	listener := t.listener
+	t.mu.Unlock()
+
+	if listener != nil {
+
+		var dst *net.UDPAddr
+
+		if dst, err = net.ResolveUDPAddr("udp", addr); err != nil {
+			return
+		}
+
+		if err = listener.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return
+		}
+
+		_, err = listener.WriteToUDP(b, dst)
+
+		return
+
+	}
+
+	conn, err := t.conn(addr)
+
+	if err != nil {
+		return
+	}
+
+	if err = conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+
+	if _, err = conn.Write(b); err != nil {
+		// Redial on the next send
+		t.drop(addr, conn)
+	}
+
+	return
+
+}
+
+func (t *UDPTransport) Receive(h func(*net.UDPAddr, int, []byte)) error {
+
+	t.mu.Lock()
+	l := t.listener
+	t.mu.Unlock()
+
+	if l == nil {
+		return ErrNotListening
+	}
+
+	for {
+		b := make([]byte, maxDatagramSize)
+		n, src, err := l.ReadFromUDP(b)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			log.Warn("ReadFromUDP failed:", err)
+			continue
+		}
+		h(src, n, b)
+	}
+
+}
+
+func (t *UDPTransport) LocalAddr() net.Addr {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.listener == nil {
+		return nil
+	}
+
+	return t.listener.LocalAddr()
+
+}
+
+// Close the listening socket and the socket to each peer
+func (t *UDPTransport) Close() (err error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for peer, conn := range t.conns {
+		if closeErr := conn.Close(); closeErr != nil {
+			err = closeErr
+		}
+		delete(t.conns, peer)
+	}
+
+	if t.listener != nil {
+		if closeErr := t.listener.Close(); closeErr != nil && !errors.Is(closeErr, net.ErrClosed) {
+			err = closeErr
+		}
+		t.listener = nil
+	}
+
+	return
+
+}
+
+func (t *UDPTransport) conn(peer string) (conn *net.UDPConn, err error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if conn, ok := t.conns[peer]; ok {
+		return conn, nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", peer)
+
+	if err != nil {
+		return
+	}
+
+	if conn, err = net.DialUDP("udp", nil, addr); err != nil {
+		return
+	}
+
+	t.conns[peer] = conn
+
+	if t.replies != nil {
+		conn.SetReadBuffer(socketReadBuffer)
+		go t.receive(conn)
+	}
+
+	return
+
+}
+
+// Read replies from the peer until the socket is closed
+func (t *UDPTransport) receive(conn *net.UDPConn) {
+
+	addr, _ := conn.RemoteAddr().(*net.UDPAddr)
+
+	for {
+
+		b := make([]byte, maxDatagramSize)
+		n, err := conn.Read(b)
+
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			// Unreachable peers are reported on the next read, the socket is still usable
+			log.Debug("Sender => ", err)
+			continue
+		}
+
+		t.replies(addr, n, b)
+
+	}
+
+}
+
+func (t *UDPTransport) drop(peer string, conn *net.UDPConn) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns[peer] == conn {
+		conn.Close()
+		delete(t.conns, peer)
+	}
+
+}
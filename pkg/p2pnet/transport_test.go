@@ -0,0 +1,155 @@
+package p2pnet_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/perrychain/perry/pkg/p2pnet"
+	"github.com/perrychain/perry/pkg/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// Datagrams received by a node on the network, in order of delivery
+func memReceive(t *testing.T, network *p2pnet.MemNetwork, addr string) (*p2pnet.MemTransport, *[]byte) {
+
+	transport, err := network.Transport(addr)
+	assert.Nil(t, err)
+	t.Cleanup(func() { transport.Close() })
+
+	var received []byte
+
+	go transport.Receive(func(src *net.UDPAddr, n int, b []byte) { received = append(received, b[0]) })
+	<-transport.Listening()
+
+	return transport, &received
+
+}
+
+func TestMemNetwork(t *testing.T) {
+
+	conditions := p2pnet.MemConditions{Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.1, Duplicate: 0.1, Reorder: 0.1}
+
+	run := func(seed int64) []byte {
+
+		network := p2pnet.NewMemNetwork(seed, conditions)
+
+		a, err := network.Transport("10.0.0.1:24816")
+		assert.Nil(t, err)
+
+		_, received := memReceive(t, network, "10.0.0.2:24816")
+
+		for i := 0; i < 200; i++ {
+			assert.Nil(t, a.Send("10.0.0.2:24816", []byte{byte(i)}, time.Second))
+		}
+
+		// Datagrams to unknown nodes are lost
+		assert.Nil(t, a.Send("10.0.0.3:24816", []byte{1}, time.Second))
+
+		network.Flush()
+
+		assert.GreaterOrEqual(t, network.Elapsed(), conditions.Latency)
+
+		return *received
+
+	}
+
+	received := run(1)
+
+	var lost, duplicated, reordered int
+	seen := map[byte]int{}
+
+	for i, b := range received {
+		seen[b]++
+		if i > 0 && b < received[i-1] {
+			reordered++
+		}
+	}
+
+	for i := 0; i < 200; i++ {
+		switch seen[byte(i)] {
+		case 0:
+			lost++
+		case 2:
+			duplicated++
+		}
+	}
+
+	assert.Greater(t, lost, 0)
+	assert.Greater(t, duplicated, 0)
+	assert.Greater(t, reordered, 0)
+
+	// The same seed delivers the same way
+	assert.Equal(t, received, run(1))
+	assert.NotEqual(t, received, run(2))
+
+	// Addresses are held by one node, closed nodes no longer send
+	network := p2pnet.NewMemNetwork(1, p2pnet.MemConditions{})
+
+	a, err := network.Transport("10.0.0.1:24816")
+	assert.Nil(t, err)
+
+	_, err = network.Transport("10.0.0.1:24816")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, a.Close())
+	assert.Equal(t, net.ErrClosed, a.Send("10.0.0.2:24816", []byte{1}, time.Second))
+
+}
+
+func TestMemNetworkGossip(t *testing.T) {
+
+	network := p2pnet.NewMemNetwork(1, p2pnet.MemConditions{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond, Duplicate: 0.05, Reorder: 0.05})
+
+	// Nodes on the network are told apart by their P2P port. Messages are forwarded to every peer, so each
+	// node receives them however few peers know it
+	memNode := func(port uint16) (*p2pnet.P2P, string) {
+		return newNode(t, nodeOptions{config: p2pnet.P2P{P2P_Node: p2pnet.Node{Port: port}, GossipFanout: 32, GossipMaxHops: 32}, network: network})
+	}
+
+	var nodes []*p2pnet.P2P
+	var addrs []string
+
+	for i := 0; i < 24; i++ {
+		node, addr := memNode(uint16(24001 + i))
+		nodes = append(nodes, node)
+		addrs = append(addrs, addr)
+	}
+
+	// A ring, each node knows the next and the peers the next knows
+	for i := len(nodes) - 1; i >= 0; i-- {
+		nodes[i].Discover(addrs[(i+1)%len(nodes)])
+	}
+
+	// Receipts are pushed to the client as a verified peer of the node it sends to
+	client, clientAddr := memNode(24100)
+	nodes[0].Discover(clientAddr)
+
+	sender := wallet.New()
+	assert.Nil(t, sender.GenerateWallet())
+
+	opts := p2pnet.SendOptions{Peer: "127.0.0.1:24001", Node: nodes[0].POH.Wallet.PublicKey}
+
+	single, err := client.Send(&sender, sender.PublicKey, []byte("Hello world"), 1, opts)
+	assert.Nil(t, err)
+
+	fragmented, err := client.Send(&sender, sender.PublicKey, make([]byte, 2000), 1, opts)
+	assert.Nil(t, err)
+
+	assert.Greater(t, network.Flush(), 0)
+
+	// Every node queues each message once
+	for _, node := range nodes {
+		assert.Equal(t, 2, queued(node))
+
+		for _, id := range []p2pnet.MsgID{single, fragmented} {
+			_, ok := node.Gossip(id)
+			assert.True(t, ok)
+		}
+	}
+
+	receipt, ok := client.Receipt(single)
+	assert.True(t, ok)
+	assert.Equal(t, []byte(nodes[0].POH.Wallet.PublicKey), receipt.Node)
+
+}
@@ -50,6 +50,11 @@ type POH struct {
 	Wallet                wallet.Wallet
 	BlockDB               blockdb.BlockDB
 	currentBlock          blockdb.Block
+	currentSeqs           []uint64 // PoH seq of each TX in currentBlock
+	replay                *blockdb.ReplayGuard
+
+	// Called once a block is written, with the PoH seq of each TX, to issue receipts
+	OnBlock func(block *blockdb.BlockKV, seqs []uint64)
 }
 
 type QueueSync struct {
@@ -100,24 +105,82 @@ func New(wallet_path, db_path string) (this POH) {
 	// Specify the blockchain database
 	this.BlockDB = blockdb.New(db_path)
 
+	// TX's seen in recent blocks, loaded when the PoH is generated
+	this.replay = blockdb.NewReplayGuard(blockdb.DefaultReplayWindow, blockdb.DefaultMaxReplays)
+
 	return
 
 }
 
-// Push data waiting in the queue to the current PoH block calculation
+// Queue a TX for the next block. TX's too large for a block, already queued or included in a recent block
+// are rejected here, so queued TX's are never dropped
+func (poh *POH) QueueTx(tx blockdb.TxPayload) (err error) {
+
+	if err = poh.BlockDB.CheckTxSize(tx); err != nil {
+		return
+	}
+
+	poh.Mu.Lock()
+	defer poh.Mu.Unlock()
+
+	if poh.queued(tx) || poh.replay.Seen(tx, time.Now()) {
+		return blockdb.ErrReplay
+	}
+
+	poh.QueueSync.State = append(poh.QueueSync.State, tx)
+
+	return
+
+}
+
+// Confirm the TX is waiting in the queue, lock must be held
+func (poh *POH) queued(tx blockdb.TxPayload) bool {
+
+	key, ok := blockdb.ReplayKey(tx)
+
+	if !ok {
+		return false
+	}
+
+	for i := range poh.QueueSync.State {
+
+		if poh.QueueSync.State[i].Block > 0 {
+			continue
+		}
+
+		if queued, _ := blockdb.ReplayKey(poh.QueueSync.State[i]); queued == key {
+			return true
+		}
+
+	}
+
+	return false
+
+}
+
+// Push data waiting in the queue to the current PoH block calculation. Replayed TX's are dropped as they
+// are taken, under the lock TX's are queued with
 func (poh *POH) FetchDataState(block uint64) (payload blockdb.TxPayload, chk bool) {
 
+	poh.Mu.Lock()
+	defer poh.Mu.Unlock()
+
 	for i := 0; i < len(poh.QueueSync.State); i++ {
 
 		if poh.QueueSync.State[i].Block > 0 {
 			continue
-		} else {
-			poh.Mu.Lock()
-			poh.QueueSync.State[i].Block = block
-			poh.Mu.Unlock()
-			return poh.QueueSync.State[i], true
 		}
 
+		poh.QueueSync.State[i].Block = block
+
+		// Drop replayed TX's, so the same message can't land in a later block
+		if err := poh.replay.CheckTx(poh.QueueSync.State[i], time.Now()); err != nil {
+			log.Warn("Dropping TX, ", err)
+			continue
+		}
+
+		return poh.QueueSync.State[i], true
+
 	}
 
 	return
@@ -143,14 +206,17 @@ func (poh *POH) GeneratePOH(count uint64) {
 	err = poh.BlockDB.Verify()
 
 	if err != nil {
-		log.Fatal(fmt.Sprintf("Could not verify BlockDB: %s", err))
+		log.Fatal(fmt.Sprintf("Could not verify BlockDB: %s (run `perryctl -cmd repair` to truncate to the last valid block)", err))
 	}
 
 	poh.currentBlock.Payload = make([]blockdb.TxPayload, 0)
 
-	if len(poh.BlockDB.Blocks) > 0 {
+	// TX's in recent blocks can't be included again
+	poh.loadReplays()
+
+	if poh.BlockDB.Len() > 0 {
 		// Get the last hash from the previous block
-		key := poh.BlockDB.Blocks[len(poh.BlockDB.Blocks)-1].Key
+		key := poh.BlockDB.GetLatestIndex().Key
 		h.Write(key[:])
 
 		log.Debug("Using last block hash => ", key)
@@ -219,8 +285,13 @@ func (poh *POH) GeneratePOH(count uint64) {
 			payload.Signature = block.Signature
 			payload.Recipient = block.Recipient
 			payload.Sender = block.Sender
+			payload.Type = block.Type
+			payload.Reserved = block.Reserved
 
+			poh.Mu.Lock()
 			poh.currentBlock.Payload = append(poh.currentBlock.Payload, payload)
+			poh.currentSeqs = append(poh.currentSeqs, i)
+			poh.Mu.Unlock()
 
 		} else {
 			// Hash the latest output, hash of a hash for POH
@@ -366,24 +437,43 @@ func (poh *POH) BlockConfirmation(block chan POH_Block) {
 		// Wait for a job to be pushed to the stack to create a new block
 		current_block := <-block
 
+		poh.Mu.Lock()
+
 		if len(poh.currentBlock.Payload) == 0 {
+			poh.Mu.Unlock()
 			log.Debug("No blocks to write to disk ...")
 			continue
 		}
 
 		start := time.Now()
-		blockLen := len(poh.currentBlock.Payload)
 
-		log.Info(fmt.Sprintf("Writing block (%d) to disk for (%d) TX's ... ", current_block, blockLen))
+		// Limit the block to the max size, the remaining TX's are carried into the next block
+		blockLen := poh.BlockDB.BlockFits(poh.currentBlock.Payload)
 
-		poh.Mu.Lock()
-		payload, err := json.Marshal(poh.currentBlock.Payload)
+		// TX's are checked by QueueTx, only those queued directly can be too large
+		if blockLen == 0 {
+			log.Warn(fmt.Sprintf("Dropping TX larger than the max block size (%d bytes)", poh.BlockDB.MaxBlockSize))
+			poh.currentBlock.Payload = poh.currentBlock.Payload[1:]
+			poh.currentSeqs = poh.currentSeqs[1:]
+			poh.Mu.Unlock()
+			continue
+		}
+
+		carry := len(poh.currentBlock.Payload) - blockLen
+
+		log.Info(fmt.Sprintf("Writing block (%d) to disk for (%d) TX's, (%d) carried to next block ... ", current_block, blockLen, carry))
+
+		payload, err := json.Marshal(poh.currentBlock.Payload[:blockLen])
 
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		payload = poh.CreateBlock(payload, false)
+		payload, err = poh.CreateBlock(payload, false)
+
+		if err != nil {
+			log.Fatal(err)
+		}
 
 		// Append the new block to disk
 		err = poh.BlockDB.Append(payload)
@@ -392,10 +482,23 @@ func (poh *POH) BlockConfirmation(block chan POH_Block) {
 			log.Fatal(err)
 		}
 
-		// Reset the state and unlock the mutex
-		poh.currentBlock = blockdb.Block{}
+		// Reset the state with any carried TX's and unlock the mutex
+		seqs := poh.currentSeqs[:blockLen]
+		remaining := append([]blockdb.TxPayload{}, poh.currentBlock.Payload[blockLen:]...)
+		poh.currentBlock = blockdb.Block{Payload: remaining}
+		poh.currentSeqs = append([]uint64{}, poh.currentSeqs[blockLen:]...)
 		poh.Mu.Unlock()
 
+		if poh.OnBlock != nil {
+
+			var written blockdb.BlockKV
+
+			if err = json.Unmarshal(payload, &written); err == nil {
+				poh.OnBlock(&written, seqs)
+			}
+
+		}
+
 		timer := time.Now()
 		elapsed := timer.Sub(start)
 
@@ -407,31 +510,41 @@ func (poh *POH) BlockConfirmation(block chan POH_Block) {
 
 }
 
-func (poh *POH) CreateBlock(payload []byte, direct bool) (newpayload []byte) {
+// Create a new block from a JSON encoded TX payload, or a JSON encoded block when `direct` (sync).
+// Blocks over the BlockDB size limits are rejected, the block is added to the chain by BlockDB.Append
+func (poh *POH) CreateBlock(payload []byte, direct bool) (newpayload []byte, err error) {
 
 	blockJson := blockdb.BlockKV{}
 
 	if !direct {
 
-		hash := sha256.New()
 		var previousHash blockdb.Hash
 		var currentSeqID uint64
 
-		if len(poh.BlockDB.Blocks) > 0 {
+		if latest := poh.BlockDB.GetLatestIndex(); poh.BlockDB.Len() > 0 {
 			// Find the previous block hash
-			previousHash = poh.BlockDB.Blocks[len(poh.BlockDB.Blocks)-1].Key
+			previousHash = latest.Key
 			// Increment the block sequenceID
-			currentSeqID = poh.BlockDB.Blocks[len(poh.BlockDB.Blocks)-1].Value.Header.SeqID
+			currentSeqID = latest.Header.SeqID
 
 		} else {
 			currentSeqID = 0
 
 		}
 
-		// Append the new hash based on the previous hash + new payload
-		hash.Write(append(previousHash[:], payload...))
-		currentHash := hash.Sum(nil)
-		copy(blockJson.Key[:], currentHash)
+		// Append the new TX records
+		if err = json.Unmarshal(payload, &blockJson.Value.Payload); err != nil {
+			return
+		}
+
+		// Commit to the Merkle root of the TX's, so payloads can be pruned later
+		root, err := blockdb.TxRoot(blockJson.Value.Payload)
+
+		if err != nil {
+			return nil, err
+		}
+
+		blockJson.Value.Header.TxRoot = &root
 
 		// Append the Sequence time
 		blockJson.Value.Header.SeqTime = time.Now()
@@ -442,27 +555,26 @@ func (poh *POH) CreateBlock(payload []byte, direct bool) (newpayload []byte) {
 		// Increment the block sequenceID
 		blockJson.Value.Header.SeqID = currentSeqID + 1
 
-		// Append the new TX records
-		blockJson.Value.Payload = append(blockJson.Value.Payload, poh.currentBlock.Payload...)
+		// Append the new hash based on the full header
+		blockJson.Key = blockdb.BlockHash(blockJson.Value.Header)
 
 	} else {
 
-		if err := json.Unmarshal(payload, &blockJson); err != nil {
-			panic(err)
+		if err = json.Unmarshal(payload, &blockJson); err != nil {
+			return
 		}
 
 	}
 
-	// Append to our local state
-	poh.BlockDB.Mu.Lock()
-	poh.BlockDB.Blocks = append(poh.BlockDB.Blocks, blockJson)
-	poh.BlockDB.Mu.Unlock()
-
 	// Prepare the JSON to write to disk
-	newpayload, err := json.Marshal(blockJson)
+	newpayload, err = json.Marshal(blockJson)
 
 	if err != nil {
-		log.Fatal(err)
+		return
+	}
+
+	if err = poh.BlockDB.CheckBlockSize(newpayload, len(blockJson.Value.Payload)); err != nil {
+		return nil, err
 	}
 
 	return
@@ -593,15 +705,36 @@ func (poh *POH) Verify(c *gin.Context) {
 
 }
 
+// Queue a TX pushed over RPC. The sender public key and the signature of the data are base64 encoded,
+// unsigned TX's can't be included in a block. A TX already queued or in a recent block is a conflict
 func (poh *POH) Pushstate(c *gin.Context) {
 
 	data, _ := c.GetQuery("data")
-	sender, _ := c.GetQuery("sender")
+	sender, _ := base64.StdEncoding.DecodeString(c.Query("sender"))
+	signature, _ := base64.StdEncoding.DecodeString(c.Query("signature"))
 
-	poh.Mu.Lock()
-	queuedata := blockdb.TxPayload{Data: []byte(data), Sender: []byte(sender)}
-	poh.QueueSync.State = append(poh.QueueSync.State, queuedata)
-	poh.Mu.Unlock()
+	queuedata := blockdb.TxPayload{Data: []byte(data), Sender: sender, Signature: signature}
+
+	err := poh.BlockDB.CheckTxSize(queuedata)
+
+	if err == nil {
+		err = blockdb.VerifyTx(queuedata)
+	}
+
+	if err == nil {
+		err = poh.QueueTx(queuedata)
+	}
+
+	// The same TX is accepted once, a duplicate would never be included
+	if errors.Is(err, blockdb.ErrReplay) {
+		c.JSON(409, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(400, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
 
 	c.JSON(200, queuedata)
 
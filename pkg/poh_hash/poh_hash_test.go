@@ -1,13 +1,19 @@
 package poh_hash_test
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/perrychain/perry/pkg/blockdb"
 	"github.com/perrychain/perry/pkg/poh_hash"
 	"github.com/stretchr/testify/assert"
@@ -18,7 +24,7 @@ var count = 10_000_000
 var tick_size = 1_000_000
 
 var wallet_path = "../../config/tests/test-wallet.json"
-var db_path = "../../config/tests/blockchain-db.json"
+var db_path = "../../config/tests/blockchain-db-valid.json"
 
 func TestDataVerification(t *testing.T) {
 
@@ -79,9 +85,23 @@ func TestVerification(t *testing.T) {
 
 }
 
+// Copy the test blockchain DB to a temporary file, new blocks are appended during tests
+func tempDB(t *testing.T) string {
+
+	data, err := os.ReadFile(db_path)
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "blockchain-db.json")
+	err = os.WriteFile(path, data, 0644)
+	assert.Nil(t, err)
+
+	return path
+
+}
+
 func TestGenerationVerify(t *testing.T) {
 
-	poh := poh_hash.New(wallet_path, db_path)
+	poh := poh_hash.New(wallet_path, tempDB(t))
 	poh.QueueSync.State = make([]blockdb.TxPayload, 0)
 	go func() {
 
@@ -254,3 +274,99 @@ func BenchmarkVerifyPOH_OctCore(b *testing.B) {
 	}
 
 }
+
+func TestCreateBlockLimits(t *testing.T) {
+
+	poh := poh_hash.New(wallet_path, tempDB(t))
+	poh.BlockDB.MaxBlockTx = 2
+
+	err := poh.BlockDB.Open()
+	assert.Nil(t, err)
+
+	total := poh.BlockDB.Len()
+
+	payload, err := json.Marshal([]blockdb.TxPayload{{Data: []byte("one")}, {Data: []byte("two")}})
+	assert.Nil(t, err)
+
+	block, err := poh.CreateBlock(payload, false)
+	assert.Nil(t, err)
+
+	err = poh.BlockDB.Append(block)
+	assert.Nil(t, err)
+	assert.Equal(t, total+1, poh.BlockDB.Len())
+	assert.Nil(t, poh.BlockDB.Verify())
+
+	// Synced blocks over the limit are rejected
+	oversized := *poh.BlockDB.GetLatestBlock()
+	oversized.Value.Payload = append(append([]blockdb.TxPayload{}, oversized.Value.Payload...), blockdb.TxPayload{Data: []byte("three")})
+
+	payload, err = json.Marshal(oversized)
+	assert.Nil(t, err)
+
+	_, err = poh.CreateBlock(payload, true)
+	assert.ErrorIs(t, err, blockdb.ErrBlockTooManyTx)
+
+}
+
+func TestQueueTxLimits(t *testing.T) {
+
+	poh := poh_hash.New(wallet_path, tempDB(t))
+	poh.BlockDB.MaxBlockSize = 1024
+
+	assert.Nil(t, poh.QueueTx(blockdb.TxPayload{Data: []byte("fits")}))
+
+	// TX's that could never be written are rejected when queued, not dropped later
+	err := poh.QueueTx(blockdb.TxPayload{Data: make([]byte, 2048)})
+	assert.ErrorIs(t, err, blockdb.ErrTxTooLarge)
+	assert.Len(t, poh.QueueSync.State, 1)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/push", poh.Pushstate)
+
+	push := func(data string, sign bool) int {
+
+		params := url.Values{"data": {data}, "sender": {base64.StdEncoding.EncodeToString(poh.Wallet.PublicKey)}}
+
+		if sign {
+			signature, err := poh.Wallet.Sign([]byte(data))
+			assert.Nil(t, err)
+			params.Set("signature", base64.StdEncoding.EncodeToString(signature))
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/push?"+params.Encode(), nil))
+
+		return w.Code
+
+	}
+
+	assert.Equal(t, 400, push(strings.Repeat("x", 2048), true))
+	assert.Len(t, poh.QueueSync.State, 1)
+
+	// Pushed TX's must be signed by the sender
+	assert.Equal(t, 400, push("unsigned", false))
+	assert.Len(t, poh.QueueSync.State, 1)
+
+	assert.Equal(t, 200, push("signed", true))
+	assert.Len(t, poh.QueueSync.State, 2)
+
+	// A duplicate would be dropped as the block is generated, so it is refused while queued
+	assert.Equal(t, 409, push("signed", true))
+	assert.Len(t, poh.QueueSync.State, 2)
+
+	// And once it is taken for a block
+	for _, chk := poh.FetchDataState(1); chk; _, chk = poh.FetchDataState(1) {
+	}
+
+	assert.Equal(t, 409, push("signed", true))
+
+	// Or included in a block synced from a peer
+	signature, err := poh.Wallet.Sign([]byte("synced"))
+	assert.Nil(t, err)
+
+	poh.RecordReplays([]blockdb.TxPayload{{Data: []byte("synced"), Sender: poh.Wallet.PublicKey, Signature: signature}})
+	assert.Equal(t, 409, push("synced", true))
+	assert.Len(t, poh.QueueSync.State, 2)
+
+}
@@ -0,0 +1,192 @@
+package poh_hash
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/perrychain/perry/pkg/blockdb"
+)
+
+// Return blocks by SeqID range, `from` and `to` are inclusive
+func (poh *POH) Blocks(c *gin.Context) {
+
+	query, err := blockQuery(c)
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	from, err := queryUint(c, "from", 0)
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	to, err := queryUint(c, "to", math.MaxUint64)
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	result, err := poh.BlockDB.BlocksBySeqID(from, to, query)
+
+	if err != nil {
+		c.JSON(500, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, result)
+
+}
+
+// Return blocks by SeqTime window, `start` is inclusive and `end` exclusive. Times are RFC3339 or unix seconds
+func (poh *POH) BlocksByTime(c *gin.Context) {
+
+	query, err := blockQuery(c)
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	start, err := queryTime(c, "start", time.Unix(0, 0))
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	end, err := queryTime(c, "end", time.Now())
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	result, err := poh.BlockDB.BlocksByTime(start, end, query)
+
+	if err != nil {
+		c.JSON(500, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, result)
+
+}
+
+// Return a block by hash, base64 encoded
+func (poh *POH) BlockByHash(c *gin.Context) {
+
+	query, err := blockQuery(c)
+
+	if err != nil {
+		queryError(c, err)
+		return
+	}
+
+	hashParam, _ := c.GetQuery("hash")
+	hashBytes, err := base64.StdEncoding.DecodeString(hashParam)
+
+	if err != nil || len(hashBytes) != len(blockdb.Hash{}) {
+		queryError(c, errors.New("hash must be a base64 encoded block hash"))
+		return
+	}
+
+	var key blockdb.Hash
+	copy(key[:], hashBytes)
+
+	block, err := poh.BlockDB.BlockByHash(key, query.Payload)
+
+	if errors.Is(err, blockdb.ErrBlockNotFound) {
+		c.JSON(404, gin.H{"status": "fail", "error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"status": "fail", "error": err.Error()})
+		return
+	}
+
+	c.JSON(200, block)
+
+}
+
+// Parse the common paging options, `payload`, `limit` and `cursor`
+func blockQuery(c *gin.Context) (query blockdb.Query, err error) {
+
+	if payload, ok := c.GetQuery("payload"); ok {
+		if query.Payload, err = strconv.ParseBool(payload); err != nil {
+			return query, fmt.Errorf("Invalid payload: %s", payload)
+		}
+	}
+
+	limit, err := queryUint(c, "limit", blockdb.DefaultQueryLimit)
+
+	if err != nil {
+		return
+	}
+
+	cursor, err := queryUint(c, "cursor", 0)
+
+	if err != nil {
+		return
+	}
+
+	query.Limit = int(limit)
+	query.Cursor = cursor
+
+	return
+
+}
+
+func queryUint(c *gin.Context, name string, fallback uint64) (uint64, error) {
+
+	value, ok := c.GetQuery(name)
+
+	if !ok || value == "" {
+		return fallback, nil
+	}
+
+	n, err := strconv.ParseUint(value, 10, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %s", name, value)
+	}
+
+	return n, nil
+
+}
+
+func queryTime(c *gin.Context, name string, fallback time.Time) (time.Time, error) {
+
+	value, ok := c.GetQuery(name)
+
+	if !ok || value == "" {
+		return fallback, nil
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+
+	if err != nil {
+		return t, fmt.Errorf("Invalid %s: %s", name, value)
+	}
+
+	return t, nil
+
+}
+
+func queryError(c *gin.Context, err error) {
+
+	c.JSON(400, gin.H{"status": "fail", "error": err.Error()})
+
+}
@@ -0,0 +1,110 @@
+package poh_hash
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/perrychain/perry/pkg/blockdb"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rebuild the replay guard from the TX's of blocks within the replay window
+func (poh *POH) loadReplays() {
+
+	if poh.replay == nil {
+		poh.replay = blockdb.NewReplayGuard(blockdb.DefaultReplayWindow, blockdb.DefaultMaxReplays)
+	}
+
+	now := time.Now()
+	query := blockdb.Query{Payload: true, Limit: blockdb.MaxQueryLimit}
+
+	for {
+
+		result, err := poh.BlockDB.BlocksByTime(now.Add(-blockdb.DefaultReplayWindow), now.Add(blockdb.DefaultReplayWindow), query)
+
+		if err != nil {
+			log.Warn("Replays => ", err)
+			return
+		}
+
+		for _, block := range result.Blocks {
+			poh.RecordReplays(block.Payload)
+		}
+
+		if result.Next == 0 {
+			break
+		}
+
+		query.Cursor = result.Next
+
+	}
+
+	log.Info(fmt.Sprintf("Replays => (%d) recent TX's", poh.replay.Len()))
+
+}
+
+// Record the TX's of a block added to the chain, such as a block synced from a peer
+func (poh *POH) RecordReplays(txs []blockdb.TxPayload) {
+
+	now := time.Now()
+
+	for _, tx := range txs {
+		// Stale TX's are not recorded, they are rejected anyway
+		poh.replay.CheckTx(tx, now)
+	}
+
+}
+
+// Queue the TX's of blocks rolled back by a reorg again, except those in the branch that replaced them,
+// and record the TX's of the branch. Returns the number of TX's queued
+func (poh *POH) RequeueOrphaned(orphaned, branch []blockdb.BlockKV) (queued int) {
+
+	if poh.replay == nil {
+		poh.replay = blockdb.NewReplayGuard(blockdb.DefaultReplayWindow, blockdb.DefaultMaxReplays)
+	}
+
+	for i := range orphaned {
+		for _, tx := range orphaned[i].Value.Payload {
+			poh.replay.ForgetTx(tx)
+		}
+	}
+
+	// TX's in the branch can't be included again by this node
+	for i := range branch {
+		poh.RecordReplays(branch[i].Value.Payload)
+	}
+
+	now := time.Now()
+
+	for i := range orphaned {
+		for _, tx := range orphaned[i].Value.Payload {
+
+			// Pruned TX's have no data left to include, and unsigned TX's of older chains can't be included
+			// in a new block
+			if tx.Pruned || blockdb.VerifyTx(tx) != nil {
+				continue
+			}
+
+			// Checked again as the PoH includes it, so it is only forgotten here
+			if err := poh.replay.CheckTx(tx, now); err != nil {
+				log.Debug("Requeue => Skipping orphaned TX, ", err)
+				continue
+			}
+
+			poh.replay.ForgetTx(tx)
+
+			tx.Block = 0
+
+			if err := poh.QueueTx(tx); err != nil {
+				log.Warn("Requeue => ", err)
+				continue
+			}
+
+			queued++
+
+		}
+	}
+
+	return
+
+}
@@ -0,0 +1,183 @@
+package wallet
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Sealed box overhead, the ephemeral public key and the AEAD tag
+const BoxOverhead = curve25519.PointSize + chacha20poly1305.Overhead
+
+var boxInfo = []byte("perry-sealed-box")
+
+var ErrBoxOpen = errors.New("sealed box could not be opened")
+
+// Field prime of curve25519, 2^255 - 19
+var curveP, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+
+// Convert an ed25519 public key to the X25519 public key of the same wallet, u = (1 + y) / (1 - y)
+func X25519PublicKey(publicKey ed25519.PublicKey) (key []byte, err error) {
+
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("Invalid ed25519 public key size")
+	}
+
+	// The y coordinate is little endian, with the sign of x in the top bit
+	le := make([]byte, 32)
+	copy(le, publicKey)
+	le[31] &= 0x7f
+
+	y := new(big.Int).SetBytes(reverse(le))
+
+	if y.Cmp(curveP) >= 0 {
+		return nil, errors.New("Invalid ed25519 public key")
+	}
+
+	one := big.NewInt(1)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, curveP)
+
+	if denominator.Sign() == 0 {
+		return nil, errors.New("Invalid ed25519 public key")
+	}
+
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, new(big.Int).ModInverse(denominator, curveP))
+	u.Mod(u, curveP)
+
+	key = make([]byte, 32)
+	u.FillBytes(key)
+
+	return reverse(key), nil
+
+}
+
+// Return the X25519 private key for the wallet, derived from the ed25519 seed as for signing
+func (wallet *Wallet) X25519PrivateKey() (key []byte, err error) {
+
+	if len(wallet.PrivateKey) != ed25519.PrivateKeySize {
+		return nil, errors.New("Private key not specified to decrypt")
+	}
+
+	h := sha512.Sum512(wallet.PrivateKey.Seed())
+
+	key = h[:32]
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+
+	return
+
+}
+
+// Encrypt `data` for the holder of the `recipient` wallet with an ephemeral key, only the recipient can open it.
+// The box is the ephemeral public key followed by the ciphertext
+func Seal(recipient ed25519.PublicKey, data []byte) (box []byte, err error) {
+
+	recipientKey, err := X25519PublicKey(recipient)
+
+	if err != nil {
+		return
+	}
+
+	ephemeral := make([]byte, curve25519.ScalarSize)
+
+	if _, err = rand.Read(ephemeral); err != nil {
+		return
+	}
+
+	ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+
+	if err != nil {
+		return
+	}
+
+	aead, err := boxCipher(ephemeral, recipientKey, ephemeralPublic, recipientKey)
+
+	if err != nil {
+		return
+	}
+
+	// Each key is used once, so a zero nonce is safe
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+
+	return aead.Seal(ephemeralPublic, nonce, data, nil), nil
+
+}
+
+// Decrypt a box sealed for the wallet
+func (wallet *Wallet) Open(box []byte) (data []byte, err error) {
+
+	if len(box) < BoxOverhead {
+		return nil, ErrBoxOpen
+	}
+
+	private, err := wallet.X25519PrivateKey()
+
+	if err != nil {
+		return
+	}
+
+	recipientKey, err := X25519PublicKey(wallet.PublicKey)
+
+	if err != nil {
+		return
+	}
+
+	ephemeralPublic := box[:curve25519.PointSize]
+
+	aead, err := boxCipher(private, ephemeralPublic, ephemeralPublic, recipientKey)
+
+	if err != nil {
+		return nil, ErrBoxOpen
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+
+	if data, err = aead.Open(nil, nonce, box[curve25519.PointSize:], nil); err != nil {
+		return nil, ErrBoxOpen
+	}
+
+	return
+
+}
+
+// Derive the box key from the shared secret, bound to both public keys
+func boxCipher(private, public, ephemeralPublic, recipientPublic []byte) (aead cipher.AEAD, err error) {
+
+	shared, err := curve25519.X25519(private, public)
+
+	if err != nil {
+		return
+	}
+
+	salt := append(append([]byte{}, ephemeralPublic...), recipientPublic...)
+	key := make([]byte, chacha20poly1305.KeySize)
+
+	if _, err = io.ReadFull(hkdf.New(sha256.New, shared, salt, boxInfo), key); err != nil {
+		return
+	}
+
+	return chacha20poly1305.New(key)
+
+}
+
+func reverse(b []byte) []byte {
+
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+
+	return b
+
+}
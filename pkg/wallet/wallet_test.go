@@ -7,6 +7,7 @@ import (
 
 	"github.com/perrychain/perry/pkg/wallet"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
 )
 
 func TestGenerateWalletSaveAndLoad(t *testing.T) {
@@ -103,3 +104,43 @@ func Benchmark_Verify(b *testing.B) {
 		mywallet.Verify([]byte("Hello, world!"), sig)
 	}
 }
+
+func TestSealOpen(t *testing.T) {
+
+	recipient := wallet.New()
+	assert.Nil(t, recipient.GenerateWallet())
+
+	// The converted public key matches the converted private key
+	private, err := recipient.X25519PrivateKey()
+	assert.Nil(t, err)
+
+	expected, err := curve25519.X25519(private, curve25519.Basepoint)
+	assert.Nil(t, err)
+
+	public, err := wallet.X25519PublicKey(recipient.PublicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, public)
+
+	data := []byte("Only the recipient can read this")
+
+	box, err := wallet.Seal(recipient.PublicKey, data)
+	assert.Nil(t, err)
+	assert.Len(t, box, len(data)+wallet.BoxOverhead)
+
+	opened, err := recipient.Open(box)
+	assert.Nil(t, err)
+	assert.Equal(t, data, opened)
+
+	// Other wallets can't open the box, and tampering is detected
+	other := wallet.New()
+	assert.Nil(t, other.GenerateWallet())
+
+	_, err = other.Open(box)
+	assert.Equal(t, wallet.ErrBoxOpen, err)
+
+	box[len(box)-1] ^= 0xff
+
+	_, err = recipient.Open(box)
+	assert.Equal(t, wallet.ErrBoxOpen, err)
+
+}